@@ -165,6 +165,41 @@ type debugCreateNodeInput struct {
 	Body DebugCreateNodeRequestBody
 }
 
+// RouteSummary is how one advertised prefix is served. Exit routes have no
+// primary, as every enabled exit node serves them.
+type RouteSummary struct {
+	Prefix        string  `json:"prefix"`
+	Exit          bool    `json:"exit"`
+	Advertising   int     `json:"advertising"`
+	Enabled       int     `json:"enabled"`
+	PrimaryNodeID *string `format:"uint64" json:"primaryNodeId" nullable:"true"`
+}
+
+type routeSummaryOutput struct {
+	Body struct {
+		Routes []RouteSummary `json:"routes" nullable:"false"`
+	}
+}
+
+// NodeDescription is the operator note on a node. It is served on its own
+// rather than as a field of [Node], which mirrors the frozen v1 message.
+type NodeDescription struct {
+	Description string `json:"description" maxLength:"2048"`
+}
+
+type (
+	getNodeDescriptionInput struct {
+		NodeID string `format:"uint64" path:"nodeId"`
+	}
+	setNodeDescriptionInput struct {
+		NodeID string `format:"uint64" path:"nodeId"`
+		Body   NodeDescription
+	}
+	nodeDescriptionOutput struct {
+		Body NodeDescription
+	}
+)
+
 func registerNodes(api huma.API, b Backend) {
 	registerNodeReadOps(api, b)
 	registerNodeWriteOps(api, b)
@@ -172,6 +207,38 @@ func registerNodes(api huma.API, b Backend) {
 }
 
 func registerNodeReadOps(api huma.API, b Backend) {
+	huma.Register(api, huma.Operation{
+		OperationID: "getRouteSummary",
+		Method:      http.MethodGet,
+		Path:        "/api/v1/routes/summary",
+		Summary:     "Summarise routes",
+		Description: "Lists every advertised prefix with its advertising, enabled and primary nodes.",
+		Tags:        []string{"Nodes"},
+		Security:    bearerAuth,
+	}, func(ctx context.Context, _ *struct{}) (*routeSummaryOutput, error) {
+		summaries := b.State.RouteSummary()
+
+		out := &routeSummaryOutput{}
+		out.Body.Routes = make([]RouteSummary, 0, len(summaries))
+
+		for _, sum := range summaries {
+			route := RouteSummary{
+				Prefix:      sum.Prefix.String(),
+				Exit:        sum.Exit,
+				Advertising: sum.Advertising,
+				Enabled:     sum.Enabled,
+			}
+
+			if sum.Primary != 0 {
+				route.PrimaryNodeID = new(formatID(sum.Primary))
+			}
+
+			out.Body.Routes = append(out.Body.Routes, route)
+		}
+
+		return out, nil
+	})
+
 	huma.Register(api, huma.Operation{
 		OperationID: "getNode",
 		Method:      http.MethodGet,
@@ -196,6 +263,30 @@ func registerNodeReadOps(api huma.API, b Backend) {
 		return out, nil
 	})
 
+	huma.Register(api, huma.Operation{
+		OperationID: "getNodeDescription",
+		Method:      http.MethodGet,
+		Path:        "/api/v1/node/{nodeId}/description",
+		Summary:     "Get node description",
+		Tags:        []string{"Nodes"},
+		Security:    bearerAuth,
+	}, func(ctx context.Context, in *getNodeDescriptionInput) (*nodeDescriptionOutput, error) {
+		nodeID, err := parseNodeID(in.NodeID)
+		if err != nil {
+			return nil, err
+		}
+
+		node, ok := b.State.GetNodeByID(nodeID)
+		if !ok {
+			return nil, huma.Error404NotFound("node not found")
+		}
+
+		out := &nodeDescriptionOutput{}
+		out.Body.Description = node.Description()
+
+		return out, nil
+	})
+
 	huma.Register(api, huma.Operation{
 		OperationID: "listNodes",
 		Method:      http.MethodGet,
@@ -263,7 +354,7 @@ func registerNodeWriteOps(api huma.API, b Backend) {
 			return nil, huma.Error404NotFound("node not found")
 		}
 
-		nodeChange, err := b.State.DeleteNode(node)
+		nodeChange, err := b.State.SoftDeleteNode(node)
 		if err != nil {
 			return nil, huma.Error500InternalServerError("deleting node", err)
 		}
@@ -405,6 +496,32 @@ func registerNodeWriteOps(api huma.API, b Backend) {
 
 		return out, nil
 	})
+
+	huma.Register(api, huma.Operation{
+		OperationID: "setNodeDescription",
+		Method:      http.MethodPost,
+		Path:        "/api/v1/node/{nodeId}/description",
+		Summary:     "Set node description",
+		Description: "Sets the operator description of a node. An empty description clears it.",
+		Tags:        []string{"Nodes"},
+		Security:    bearerAuth,
+	}, func(ctx context.Context, in *setNodeDescriptionInput) (*nodeDescriptionOutput, error) {
+		nodeID, err := parseNodeID(in.NodeID)
+		if err != nil {
+			return nil, err
+		}
+
+		// Metadata only: nothing to tell the nodes.
+		node, err := b.State.SetNodeDescription(nodeID, in.Body.Description)
+		if err != nil {
+			return nil, mapError("setting node description", err)
+		}
+
+		out := &nodeDescriptionOutput{}
+		out.Body.Description = node.Description()
+
+		return out, nil
+	})
 }
 
 func registerNodeAdminOps(api huma.API, b Backend) {
@@ -177,7 +177,7 @@ func registerDevices(api huma.API, b Backend) {
 			return nil, err
 		}
 
-		nodeChange, err := b.State.DeleteNode(node)
+		nodeChange, err := b.State.SoftDeleteNode(node)
 		if err != nil {
 			return nil, mapError("deleting device", err)
 		}
@@ -149,13 +149,13 @@ func NewHeadscale(cfg *types.Config) (*Headscale, error) {
 			return
 		}
 
-		policyChanged, err := app.state.DeleteNode(node)
+		nodeChange, err := app.state.PurgeNode(node)
 		if err != nil {
 			log.Error().Err(err).EmbedObject(node).Msg("ephemeral node deletion failed")
 			return
 		}
 
-		app.Change(policyChanged)
+		app.Change(nodeChange)
 		log.Debug().Caller().EmbedObject(node).Msg("ephemeral node deleted because garbage collection timeout reached")
 	})
 	app.ephemeralGC = ephemeralGC
@@ -319,6 +319,15 @@ func (h *Headscale) scheduledTasks(ctx context.Context) {
 		revokedKeyGCChan = revokedKeyTicker.C
 	}
 
+	var expiredNodeGCChan <-chan time.Time
+
+	if h.cfg.Node.ExpiredRetention > 0 {
+		expiredNodeTicker := time.NewTicker(time.Hour)
+		defer expiredNodeTicker.Stop()
+
+		expiredNodeGCChan = expiredNodeTicker.C
+	}
+
 	// OAuth access tokens are short-lived (1h) and re-minted on demand; reap
 	// expired rows hourly so the table stays bounded.
 	accessTokenTicker := time.NewTicker(time.Hour)
@@ -340,6 +349,14 @@ func (h *Headscale) scheduledTasks(ctx context.Context) {
 				log.Info().Int("count", reaped).Msg("reaped revoked pre-auth keys")
 			}
 
+		case <-expiredNodeGCChan:
+			c, err := h.state.PurgeLongExpiredNodes(h.cfg.Node.ExpiredRetention)
+			if err != nil {
+				log.Error().Err(err).Msg("purging long expired nodes")
+			} else if !c.IsEmpty() {
+				h.Change(c)
+			}
+
 		case <-accessTokenTicker.C:
 			reaped, err := h.state.DeleteExpiredAccessTokens(time.Now())
 			if err != nil {
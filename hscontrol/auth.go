@@ -215,7 +215,7 @@ func (h *Headscale) handleLogout(
 				EmbedObject(node).
 				Msg("Deleting ephemeral node during logout")
 
-			c, err := h.state.DeleteNode(node)
+			c, err := h.state.PurgeNode(node)
 			if err != nil {
 				return nil, fmt.Errorf("deleting ephemeral node: %w", err)
 			}
@@ -18,6 +18,7 @@ import (
 	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/util/zlog/zf"
 	"github.com/rs/zerolog/log"
 	"github.com/tailscale/squibble"
 	"gorm.io/driver/postgres"
@@ -228,7 +229,10 @@ AND auth_key_id NOT IN (
 					for _, user := range users {
 						user.ProviderIdentifier.String = types.CleanIdentifier(user.ProviderIdentifier.String)
 
-						err := tx.Save(user).Error
+						// Only write the column this migration fixes; columns
+						// added by later migrations do not exist yet.
+						err := tx.Model(&types.User{}).Where("id = ?", user.ID).
+							Update("provider_identifier", user.ProviderIdentifier).Error
 						if err != nil {
 							return fmt.Errorf("saving user: %w", err)
 						}
@@ -900,6 +904,346 @@ WHERE user_id IS NULL
 				},
 				Rollback: func(db *gorm.DB) error { return nil },
 			},
+			{
+				// Record which external system (e.g. an IaC tool) manages a
+				// node so manual operations on it can warn.
+				ID: "202606251200-node-managed-by",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "managed_by") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "managed_by")
+						if err != nil {
+							return fmt.Errorf("adding managed_by to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Store the label a node's given name was derived from, before
+				// any "-N" collision suffix, so siblings can be counted on a
+				// column instead of matching name patterns. Existing nodes are
+				// backfilled from their given name and hostname.
+				ID: "202606261200-node-given-name-base",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "given_name_base") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "given_name_base")
+						if err != nil {
+							return fmt.Errorf("adding given_name_base to nodes: %w", err)
+						}
+					}
+
+					var rows []struct {
+						ID        types.NodeID
+						Hostname  string
+						GivenName string
+					}
+
+					err := tx.Model(&types.Node{}).
+						Select("id, hostname, given_name").
+						Where("given_name_base IS NULL OR given_name_base = ''").
+						Scan(&rows).Error
+					if err != nil {
+						return fmt.Errorf("listing nodes without given_name_base: %w", err)
+					}
+
+					for _, row := range rows {
+						err := tx.Model(&types.Node{}).
+							Where("id = ?", row.ID).
+							UpdateColumn("given_name_base", givenNameBase(row.GivenName, row.Hostname)).Error
+						if err != nil {
+							return fmt.Errorf("backfilling given_name_base for node %d: %w", row.ID, err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Let operators stop a node from acting as an exit node
+				// regardless of the routes it advertises.
+				ID: "202606271200-node-exit-node-disabled",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "exit_node_disabled") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "exit_node_disabled")
+						if err != nil {
+							return fmt.Errorf("adding exit_node_disabled to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Per-user override of node.expiry for the key lifetime of
+				// the user's nodes. NULL keeps the global default.
+				ID: "202606281200-user-max-key-lifetime",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "max_key_lifetime") {
+						err := tx.Migrator().AddColumn(&types.User{}, "max_key_lifetime")
+						if err != nil {
+							return fmt.Errorf("adding max_key_lifetime to users: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Record the capability version each client reports so
+				// operators can find nodes too old for a feature.
+				ID: "202606291200-node-cap-ver",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "cap_ver") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "cap_ver")
+						if err != nil {
+							return fmt.Errorf("adding cap_ver to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Record when each node first connected to measure how long
+				// onboarding takes. Existing nodes are left unset, as their
+				// first connection is unknown.
+				ID: "202606301200-node-first-seen",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "first_seen") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "first_seen")
+						if err != nil {
+							return fmt.Errorf("adding first_seen to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Copy the client OS and version out of Hostinfo into their
+				// own columns so nodes on outdated clients can be queried.
+				// Existing rows are left NULL until the node next reports
+				// its Hostinfo.
+				ID: "202607011200-node-client-info",
+				Migrate: func(tx *gorm.DB) error {
+					for _, column := range []string{"os", "client_version"} {
+						if !tx.Migrator().HasColumn(&types.Node{}, column) {
+							err := tx.Migrator().AddColumn(&types.Node{}, column)
+							if err != nil {
+								return fmt.Errorf("adding %s to nodes: %w", column, err)
+							}
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Tags applied to every node a user registers. NULL means
+				// the user's nodes stay user-owned.
+				ID: "202607021200-user-default-tags",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "default_tags") {
+						err := tx.Migrator().AddColumn(&types.User{}, "default_tags")
+						if err != nil {
+							return fmt.Errorf("adding default_tags to users: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Index node_key so GetNodeByNodeKey is a direct lookup
+				// rather than a scan of the nodes table.
+				ID: "202607031200-node-node-key-index",
+				Migrate: func(tx *gorm.DB) error {
+					err := tx.Exec("CREATE INDEX IF NOT EXISTS idx_nodes_node_key ON nodes(node_key)").Error
+					if err != nil {
+						return fmt.Errorf("creating node_key index: %w", err)
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Let operators trust a node as an exit node so its
+				// advertised exit routes are approved automatically.
+				ID: "202607041200-node-auto-approve-exit",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "auto_approve_exit") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "auto_approve_exit")
+						if err != nil {
+							return fmt.Errorf("adding auto_approve_exit to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Free-form operator notes on a node.
+				ID: "202607051200-node-description",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "description") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "description")
+						if err != nil {
+							return fmt.Errorf("adding description to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Append-only audit trail of replaced machine and node keys.
+				// As for the OAuth tables, SQLite gets DDL matching
+				// schema.sql and Postgres gets AutoMigrate.
+				ID: "202607061200-node-key-history",
+				Migrate: func(tx *gorm.DB) error {
+					if tx.Migrator().HasTable(&types.NodeKeyHistory{}) {
+						return nil
+					}
+
+					if tx.Name() != "sqlite" {
+						err := tx.AutoMigrate(&types.NodeKeyHistory{})
+						if err != nil {
+							return err
+						}
+					} else {
+						err := tx.Exec(`CREATE TABLE node_key_history(
+  id integer PRIMARY KEY AUTOINCREMENT,
+  node_id integer,
+  machine_key text,
+  node_key text,
+  reason text,
+  changed_at datetime
+)`).Error
+						if err != nil {
+							return fmt.Errorf("creating node_key_history table: %w", err)
+						}
+					}
+
+					err := tx.Exec(`CREATE INDEX idx_node_key_history_node_id ON node_key_history(node_id)`).Error
+					if err != nil {
+						return fmt.Errorf("creating node_key_history index: %w", err)
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// When a node last completed the Noise handshake, kept
+				// apart from last_seen for connectivity debugging.
+				ID: "202607071200-node-last-handshake",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "last_handshake") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "last_handshake")
+						if err != nil {
+							return fmt.Errorf("adding last_handshake to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Cap how many nodes a user may own.
+				ID: "202607081200-user-max-nodes",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.User{}, "max_nodes") {
+						err := tx.Migrator().AddColumn(&types.User{}, "max_nodes")
+						if err != nil {
+							return fmt.Errorf("adding max_nodes to users: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Let reusable pre auth keys register a limited number
+				// of nodes.
+				ID: "202607091200-pre-auth-key-usage-limit",
+				Migrate: func(tx *gorm.DB) error {
+					for _, column := range []string{"usage_limit", "usage_count"} {
+						if !tx.Migrator().HasColumn(&types.PreAuthKey{}, column) {
+							err := tx.Migrator().AddColumn(&types.PreAuthKey{}, column)
+							if err != nil {
+								return fmt.Errorf("adding %s to pre_auth_keys: %w", column, err)
+							}
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Hold nodes registered while node.require_approval is
+				// set until an admin approves them. Existing nodes are
+				// left approved.
+				ID: "202607101200-node-pending-approval",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "pending_approval") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "pending_approval")
+						if err != nil {
+							return fmt.Errorf("adding pending_approval to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Let operators rank subnet routers for primary route
+				// election. Existing nodes get priority 0, which keeps
+				// the node ID order.
+				ID: "202607111200-node-route-priority",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "route_priority") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "route_priority")
+						if err != nil {
+							return fmt.Errorf("adding route_priority to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
+			{
+				// Remember which user's default tags tagged a node, so
+				// re-applying changed defaults still reaches it.
+				ID: "202607121200-node-tagged-by-user",
+				Migrate: func(tx *gorm.DB) error {
+					if !tx.Migrator().HasColumn(&types.Node{}, "tagged_by_user_id") {
+						err := tx.Migrator().AddColumn(&types.Node{}, "tagged_by_user_id")
+						if err != nil {
+							return fmt.Errorf("adding tagged_by_user_id to nodes: %w", err)
+						}
+					}
+
+					return nil
+				},
+				Rollback: func(db *gorm.DB) error { return nil },
+			},
 		},
 	)
 
@@ -913,6 +1257,7 @@ WHERE user_id IS NULL
 			&types.Policy{},
 			&types.OAuthClient{},
 			&types.OAuthAccessToken{},
+			&types.NodeKeyHistory{},
 		)
 		if err != nil {
 			return err
@@ -950,6 +1295,8 @@ WHERE user_id IS NULL
 			`CREATE UNIQUE INDEX idx_pre_auth_keys_prefix ON pre_auth_keys(prefix) WHERE prefix IS NOT NULL AND prefix != ''`,
 			`CREATE UNIQUE INDEX idx_oauth_clients_client_id ON oauth_clients(client_id)`,
 			`CREATE UNIQUE INDEX idx_oauth_access_tokens_prefix ON oauth_access_tokens(prefix)`,
+			`CREATE INDEX idx_nodes_node_key ON nodes(node_key)`,
+			`CREATE INDEX idx_node_key_history_node_id ON node_key_history(node_id)`,
 		}
 
 		for _, indexSQL := range indexes {
@@ -1066,6 +1413,9 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 				Logger:      dbLogger,
 			},
 		)
+		if err != nil {
+			return nil, err
+		}
 
 		// The pure Go SQLite library does not handle locking in
 		// the same way as the C based one and we can't use the gorm
@@ -1075,7 +1425,15 @@ func openDB(cfg types.DatabaseConfig) (*gorm.DB, error) {
 		sqlDB.SetMaxOpenConns(1)
 		sqlDB.SetConnMaxIdleTime(time.Hour)
 
-		return db, err
+		// Concurrent writers can find the database busy or locked; retry
+		// those writes instead of failing them outright. Postgres handles
+		// write concurrency itself and never registers the plugin.
+		err = db.Use(&writeRetry{attempts: cfg.Sqlite.WriteRetryAttempts})
+		if err != nil {
+			return nil, fmt.Errorf("registering sqlite write retry: %w", err)
+		}
+
+		return db, nil
 
 	case types.DatabasePostgres:
 		dbString := fmt.Sprintf(
@@ -1255,11 +1613,17 @@ func Read[T any](db *gorm.DB, fn func(rx *gorm.DB) (T, error)) (T, error) {
 	return ret, nil
 }
 
+// Write runs fn in a transaction and commits it. On sqlite, starting the
+// transaction is retried while the database is busy or locked; fn itself
+// runs at most once.
 func (hsdb *HSDatabase) Write(fn func(tx *gorm.DB) error) error {
-	tx := hsdb.DB.Begin()
+	tx, err := beginWrite(hsdb.DB)
+	if err != nil {
+		return err
+	}
 	defer tx.Rollback()
 
-	err := fn(tx)
+	err = fn(tx)
 	if err != nil {
 		return err
 	}
@@ -1267,8 +1631,13 @@ func (hsdb *HSDatabase) Write(fn func(tx *gorm.DB) error) error {
 	return tx.Commit().Error
 }
 
+// Write is the generic form of [HSDatabase.Write] and retries the same way.
 func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
-	tx := db.Begin()
+	tx, err := beginWrite(db)
+	if err != nil {
+		var no T
+		return no, err
+	}
 	defer tx.Rollback()
 
 	ret, err := fn(tx)
@@ -1277,5 +1646,101 @@ func Write[T any](db *gorm.DB, fn func(tx *gorm.DB) (T, error)) (T, error) {
 		return no, err
 	}
 
-	return ret, tx.Commit().Error
+	err = tx.Commit().Error
+	if err != nil {
+		var no T
+		return no, err
+	}
+
+	return ret, nil
+}
+
+// beginWrite starts a write transaction on db, retrying while sqlite reports
+// the database busy or locked. Only BEGIN is retried: with the IMMEDIATE
+// transaction lock headscale configures, that is where the write lock is
+// taken, and nothing has run in the transaction yet, so callers never see
+// their closure run twice or have to undo state it set outside of tx.
+func beginWrite(db *gorm.DB) (*gorm.DB, error) {
+	var tx *gorm.DB
+
+	err := retryBusy(db, func() error {
+		tx = db.Begin()
+
+		return tx.Error
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return tx, nil
+}
+
+const (
+	writeRetryName         = "headscale:write-retry"
+	writeRetryInitialDelay = 10 * time.Millisecond
+	writeRetryMaxDelay     = 500 * time.Millisecond
+
+	sqliteBusy   = 5
+	sqliteLocked = 6
+)
+
+// writeRetry is a GORM plugin carrying the number of attempts a write
+// transaction gets while sqlite reports the database busy or locked.
+type writeRetry struct {
+	attempts int
+}
+
+func (*writeRetry) Name() string { return writeRetryName }
+
+func (*writeRetry) Initialize(*gorm.DB) error { return nil }
+
+// writeAttempts returns how many times a write on db is tried, 1 when no
+// retry plugin is registered.
+func writeAttempts(db *gorm.DB) int {
+	if p, ok := db.Config.Plugins[writeRetryName].(*writeRetry); ok && p.attempts > 1 {
+		return p.attempts
+	}
+
+	return 1
+}
+
+// isSQLiteBusy reports whether err is SQLITE_BUSY or SQLITE_LOCKED,
+// including their extended result codes.
+func isSQLiteBusy(err error) bool {
+	var coded interface{ Code() int }
+	if !errors.As(err, &coded) {
+		return false
+	}
+
+	switch coded.Code() & 0xff {
+	case sqliteBusy, sqliteLocked:
+		return true
+	default:
+		return false
+	}
+}
+
+// retryBusy calls fn until it succeeds, fails with an error other than
+// busy or locked, or runs out of attempts, backing off exponentially in
+// between. The last error is returned unchanged.
+func retryBusy(db *gorm.DB, fn func() error) error {
+	attempts := writeAttempts(db)
+	delay := writeRetryInitialDelay
+
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !isSQLiteBusy(err) {
+			return err
+		}
+
+		log.Debug().
+			Err(err).
+			Int(zf.Attempt, attempt).
+			Int(zf.Attempts, attempts).
+			Dur(zf.Backoff, delay).
+			Msg("database busy, retrying write")
+
+		time.Sleep(delay)
+		delay = min(delay*2, writeRetryMaxDelay)
+	}
 }
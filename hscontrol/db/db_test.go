@@ -3,16 +3,23 @@ package db
 import (
 	"context"
 	"database/sql"
+	"errors"
+	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 
+	"github.com/glebarez/sqlite"
+	"github.com/juanfont/headscale/hscontrol/db/sqliteconfig"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"gorm.io/gorm"
+	"gorm.io/gorm/logger"
 )
 
 // TestSQLiteMigrationAndDataValidation tests specific SQLite migration scenarios
@@ -588,3 +595,190 @@ func TestSQLiteAllTestdataMigrations(t *testing.T) {
 		})
 	}
 }
+
+// codedError mimics the sqlite driver's error, which exposes the result
+// code through Code().
+type codedError int
+
+func (e codedError) Error() string { return "sqlite error " + strconv.Itoa(int(e)) }
+
+func (e codedError) Code() int { return int(e) }
+
+var errNotRetriable = errors.New("UNIQUE constraint failed")
+
+func TestRetryBusy(t *testing.T) {
+	const busySnapshot = 5 | 2<<8 // SQLITE_BUSY_SNAPSHOT
+
+	db := &gorm.DB{Config: &gorm.Config{Plugins: map[string]gorm.Plugin{}}}
+	require.NoError(t, db.Use(&writeRetry{attempts: 3}))
+
+	tests := []struct {
+		name      string
+		errs      []error
+		wantErr   error
+		wantCalls int
+	}{
+		{
+			name:      "succeeds-first-try",
+			errs:      []error{nil},
+			wantCalls: 1,
+		},
+		{
+			name:      "busy-then-succeeds",
+			errs:      []error{codedError(sqliteBusy), codedError(busySnapshot), nil},
+			wantCalls: 3,
+		},
+		{
+			name:      "locked-until-out-of-attempts",
+			errs:      []error{codedError(sqliteLocked), codedError(sqliteLocked), codedError(sqliteLocked), nil},
+			wantErr:   codedError(sqliteLocked),
+			wantCalls: 3,
+		},
+		{
+			name:      "wrapped-busy-is-retried",
+			errs:      []error{fmt.Errorf("committing: %w", codedError(sqliteBusy)), nil},
+			wantCalls: 2,
+		},
+		{
+			name:      "constraint-violation-not-retried",
+			errs:      []error{errNotRetriable, nil},
+			wantErr:   errNotRetriable,
+			wantCalls: 1,
+		},
+		{
+			name:      "other-sqlite-code-not-retried",
+			errs:      []error{codedError(19), nil}, // SQLITE_CONSTRAINT
+			wantErr:   codedError(19),
+			wantCalls: 1,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			calls := 0
+			err := retryBusy(db, func() error {
+				err := tt.errs[calls]
+				calls++
+
+				return err
+			})
+
+			assert.Equal(t, tt.wantErr, err)
+			assert.Equal(t, tt.wantCalls, calls)
+		})
+	}
+}
+
+func TestRetryBusyWithoutPlugin(t *testing.T) {
+	db := &gorm.DB{Config: &gorm.Config{}}
+
+	calls := 0
+	err := retryBusy(db, func() error {
+		calls++
+
+		return codedError(sqliteBusy)
+	})
+
+	require.Error(t, err)
+	assert.Equal(t, 1, calls, "writes are not retried unless the plugin is registered")
+}
+
+// TestWriteRetriesWhileLocked holds the write lock of an sqlite database on
+// a second connection and checks that Write waits it out when retries are
+// enabled, and fails with a busy error when they are not.
+func TestWriteRetriesWhileLocked(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "headscale_test.db")
+
+	// No busy_timeout, so a held lock fails BEGIN IMMEDIATE right away and
+	// only the retry can wait it out.
+	cfg := sqliteconfig.Default(path)
+	cfg.BusyTimeout = 0
+
+	connectionURL, err := cfg.ToURL()
+	require.NoError(t, err)
+
+	open := func(attempts int) *gorm.DB {
+		t.Helper()
+
+		db, err := gorm.Open(sqlite.Open(connectionURL), &gorm.Config{
+			Logger: logger.Default.LogMode(logger.Silent),
+		})
+		require.NoError(t, err)
+		require.NoError(t, db.Use(&writeRetry{attempts: attempts}))
+
+		sqlDB, err := db.DB()
+		require.NoError(t, err)
+		sqlDB.SetMaxOpenConns(1)
+		t.Cleanup(func() { sqlDB.Close() })
+
+		return db
+	}
+
+	holder := open(1)
+	require.NoError(t, holder.Exec("CREATE TABLE things (id INTEGER PRIMARY KEY)").Error)
+
+	holderDB, err := holder.DB()
+	require.NoError(t, err)
+
+	lock := func(t *testing.T) *sql.Conn {
+		t.Helper()
+
+		conn, err := holderDB.Conn(context.Background())
+		require.NoError(t, err)
+
+		_, err = conn.ExecContext(context.Background(), "BEGIN IMMEDIATE")
+		require.NoError(t, err)
+
+		return conn
+	}
+
+	unlock := func(conn *sql.Conn) {
+		conn.ExecContext(context.Background(), "ROLLBACK") //nolint:errcheck
+		conn.Close()
+	}
+
+	// calls counts how often the write closure ran: only BEGIN is retried,
+	// so it must run once however long the lock is held.
+	var calls int
+
+	insert := func(db *gorm.DB) error {
+		_, err := Write(db, func(tx *gorm.DB) (struct{}, error) {
+			calls++
+
+			return struct{}{}, tx.Exec("INSERT INTO things DEFAULT VALUES").Error
+		})
+
+		return err
+	}
+
+	t.Run("without-retry-fails-busy", func(t *testing.T) {
+		conn := lock(t)
+		defer unlock(conn)
+
+		calls = 0
+		err := insert(open(1))
+		require.Error(t, err)
+		assert.True(t, isSQLiteBusy(err), "want busy error, got %v", err)
+		assert.Zero(t, calls, "the closure must not run when BEGIN fails")
+	})
+
+	t.Run("with-retry-succeeds-once-released", func(t *testing.T) {
+		conn := lock(t)
+
+		released := make(chan struct{})
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			unlock(conn)
+			close(released)
+		}()
+
+		calls = 0
+		require.NoError(t, insert(open(10)))
+		<-released
+		assert.Equal(t, 1, calls, "the closure must run exactly once")
+
+		var count int64
+		require.NoError(t, holder.Table("things").Count(&count).Error)
+		assert.Equal(t, int64(1), count)
+	})
+}
@@ -0,0 +1,211 @@
+package db
+
+import (
+	"fmt"
+	"maps"
+	"net/netip"
+	"slices"
+	"strings"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"gorm.io/gorm"
+)
+
+// InvariantViolationType identifies which invariant a stored node breaks.
+type InvariantViolationType string
+
+const (
+	// InvariantNodeWithoutIP is a node with neither an IPv4 nor an IPv6
+	// address, which no peer can reach.
+	InvariantNodeWithoutIP InvariantViolationType = "node-without-ip"
+	// InvariantDuplicateIP is an address assigned to more than one node.
+	InvariantDuplicateIP InvariantViolationType = "duplicate-ip"
+	// InvariantUnannouncedRoute is an approved route its node does not
+	// announce, so the node does not serve it. A route approved ahead of
+	// the node announcing it shows up here until the node does.
+	InvariantUnannouncedRoute InvariantViolationType = "unannounced-route"
+	// InvariantRouteWithoutAdvertiser is an approved route that no node
+	// announces at all, so nothing in the tailnet serves it.
+	InvariantRouteWithoutAdvertiser InvariantViolationType = "route-without-advertiser"
+	// InvariantGivenNameCollision is a given name shared by more than one
+	// node, ignoring case, which makes its MagicDNS name ambiguous.
+	InvariantGivenNameCollision InvariantViolationType = "given-name-collision"
+)
+
+// InvariantViolation is one problem found by [CheckDatabaseInvariants].
+type InvariantViolation struct {
+	Type    InvariantViolationType
+	Message string
+
+	// NodeIDs are the nodes involved, ordered by ID. Prefixes are the
+	// routes involved, if any.
+	NodeIDs  []types.NodeID
+	Prefixes []netip.Prefix
+}
+
+func (hsdb *HSDatabase) CheckDatabaseInvariants() ([]InvariantViolation, error) {
+	return Read(hsdb.DB, CheckDatabaseInvariants)
+}
+
+// CheckDatabaseInvariants scans the stored nodes for inconsistent state, as
+// a single entry point for diagnosing a database. It only reads, skips
+// soft-deleted nodes, and returns the violations grouped by type, then
+// ordered by node ID.
+//
+// There is no check for more than one primary per non-exit prefix: primary
+// routes are elected at runtime by the NodeStore and never stored, so the
+// database holds nothing to check.
+func CheckDatabaseInvariants(tx *gorm.DB) ([]InvariantViolation, error) {
+	var nodes types.Nodes
+
+	err := tx.Scopes(notDeleted).Order("id").Find(&nodes).Error
+	if err != nil {
+		return nil, fmt.Errorf("loading nodes: %w", err)
+	}
+
+	var violations []InvariantViolation
+
+	violations = append(violations, nodesWithoutIP(nodes)...)
+	violations = append(violations, duplicateIPs(nodes)...)
+	violations = append(violations, unannouncedRoutes(nodes)...)
+	violations = append(violations, routesWithoutAdvertiser(nodes)...)
+	violations = append(violations, givenNameCollisions(nodes)...)
+
+	return violations, nil
+}
+
+func nodesWithoutIP(nodes types.Nodes) []InvariantViolation {
+	var violations []InvariantViolation
+
+	for _, node := range nodes {
+		if node.IPv4 != nil || node.IPv6 != nil {
+			continue
+		}
+
+		violations = append(violations, InvariantViolation{
+			Type:    InvariantNodeWithoutIP,
+			Message: fmt.Sprintf("node %d (%s) has no IP address", node.ID, node.Hostname),
+			NodeIDs: []types.NodeID{node.ID},
+		})
+	}
+
+	return violations
+}
+
+func duplicateIPs(nodes types.Nodes) []InvariantViolation {
+	holders := make(map[netip.Addr][]types.NodeID)
+
+	for _, node := range nodes {
+		for _, ip := range node.IPs() {
+			holders[ip] = append(holders[ip], node.ID)
+		}
+	}
+
+	var violations []InvariantViolation
+
+	for _, ip := range slices.SortedFunc(maps.Keys(holders), netip.Addr.Compare) {
+		ids := holders[ip]
+		if len(ids) < 2 {
+			continue
+		}
+
+		violations = append(violations, InvariantViolation{
+			Type:    InvariantDuplicateIP,
+			Message: fmt.Sprintf("%s is assigned to %d nodes", ip, len(ids)),
+			NodeIDs: ids,
+		})
+	}
+
+	return violations
+}
+
+func unannouncedRoutes(nodes types.Nodes) []InvariantViolation {
+	var violations []InvariantViolation
+
+	for _, node := range nodes {
+		announced := node.AnnouncedRoutes()
+
+		var missing []netip.Prefix
+
+		for _, route := range node.ApprovedRoutes {
+			if !slices.Contains(announced, route) {
+				missing = append(missing, route)
+			}
+		}
+
+		if len(missing) == 0 {
+			continue
+		}
+
+		violations = append(violations, InvariantViolation{
+			Type: InvariantUnannouncedRoute,
+			Message: fmt.Sprintf(
+				"node %d (%s) has approved routes it does not announce: %s",
+				node.ID, node.Hostname, strings.Join(util.PrefixesToString(missing), ", "),
+			),
+			NodeIDs:  []types.NodeID{node.ID},
+			Prefixes: missing,
+		})
+	}
+
+	return violations
+}
+
+func routesWithoutAdvertiser(nodes types.Nodes) []InvariantViolation {
+	announced := make(map[netip.Prefix]bool)
+	approvers := make(map[netip.Prefix][]types.NodeID)
+
+	for _, node := range nodes {
+		for _, route := range node.AnnouncedRoutes() {
+			announced[route] = true
+		}
+
+		for _, route := range node.ApprovedRoutes {
+			approvers[route] = append(approvers[route], node.ID)
+		}
+	}
+
+	var violations []InvariantViolation
+
+	for _, route := range slices.SortedFunc(maps.Keys(approvers), netip.Prefix.Compare) {
+		if announced[route] {
+			continue
+		}
+
+		violations = append(violations, InvariantViolation{
+			Type:     InvariantRouteWithoutAdvertiser,
+			Message:  fmt.Sprintf("%s is approved but no node announces it", route),
+			NodeIDs:  approvers[route],
+			Prefixes: []netip.Prefix{route},
+		})
+	}
+
+	return violations
+}
+
+func givenNameCollisions(nodes types.Nodes) []InvariantViolation {
+	holders := make(map[string][]types.NodeID)
+
+	for _, node := range nodes {
+		name := strings.ToLower(node.GivenName)
+		holders[name] = append(holders[name], node.ID)
+	}
+
+	var violations []InvariantViolation
+
+	for _, name := range slices.Sorted(maps.Keys(holders)) {
+		ids := holders[name]
+		if len(ids) < 2 {
+			continue
+		}
+
+		violations = append(violations, InvariantViolation{
+			Type:    InvariantGivenNameCollision,
+			Message: fmt.Sprintf("given name %q is used by %d nodes", name, len(ids)),
+			NodeIDs: ids,
+		})
+	}
+
+	return violations
+}
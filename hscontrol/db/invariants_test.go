@@ -0,0 +1,183 @@
+package db
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+func TestCheckDatabaseInvariants(t *testing.T) {
+	route := netip.MustParsePrefix("10.0.0.0/24")
+
+	tests := []struct {
+		name string
+		// seed breaks an invariant on two healthy nodes and returns the
+		// violation it expects.
+		seed func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation
+	}{
+		{
+			name: "healthy",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				return nil
+			},
+		},
+		{
+			name: "node-without-ip",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				err := db.DB.Model(&types.Node{}).Where("id = ?", a.ID).
+					Updates(map[string]any{"ipv4": nil, "ipv6": nil}).Error
+				require.NoError(t, err)
+
+				return []InvariantViolation{{
+					Type:    InvariantNodeWithoutIP,
+					Message: "node 1 (a) has no IP address",
+					NodeIDs: []types.NodeID{a.ID},
+				}}
+			},
+		},
+		{
+			name: "duplicate-ip",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				err := db.DB.Model(&types.Node{}).Where("id = ?", b.ID).
+					Update("ipv4", a.IPv4.String()).Error
+				require.NoError(t, err)
+
+				return []InvariantViolation{{
+					Type:    InvariantDuplicateIP,
+					Message: a.IPv4.String() + " is assigned to 2 nodes",
+					NodeIDs: []types.NodeID{a.ID, b.ID},
+				}}
+			},
+		},
+		{
+			name: "unannounced-route",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				// b announces and has the route, a only has it approved.
+				b.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+				b.ApprovedRoutes = []netip.Prefix{route}
+				require.NoError(t, db.DB.Save(b).Error)
+
+				a.ApprovedRoutes = []netip.Prefix{route}
+				require.NoError(t, db.DB.Save(a).Error)
+
+				return []InvariantViolation{{
+					Type:     InvariantUnannouncedRoute,
+					Message:  "node 1 (a) has approved routes it does not announce: 10.0.0.0/24",
+					NodeIDs:  []types.NodeID{a.ID},
+					Prefixes: []netip.Prefix{route},
+				}}
+			},
+		},
+		{
+			name: "route-without-advertiser",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				// Nobody announces the route, so both approvals are dead.
+				a.ApprovedRoutes = []netip.Prefix{route}
+				require.NoError(t, db.DB.Save(a).Error)
+
+				b.ApprovedRoutes = []netip.Prefix{route}
+				require.NoError(t, db.DB.Save(b).Error)
+
+				return []InvariantViolation{
+					{
+						Type:     InvariantUnannouncedRoute,
+						Message:  "node 1 (a) has approved routes it does not announce: 10.0.0.0/24",
+						NodeIDs:  []types.NodeID{a.ID},
+						Prefixes: []netip.Prefix{route},
+					},
+					{
+						Type:     InvariantUnannouncedRoute,
+						Message:  "node 2 (b) has approved routes it does not announce: 10.0.0.0/24",
+						NodeIDs:  []types.NodeID{b.ID},
+						Prefixes: []netip.Prefix{route},
+					},
+					{
+						Type:     InvariantRouteWithoutAdvertiser,
+						Message:  "10.0.0.0/24 is approved but no node announces it",
+						NodeIDs:  []types.NodeID{a.ID, b.ID},
+						Prefixes: []netip.Prefix{route},
+					},
+				}
+			},
+		},
+		{
+			name: "soft-deleted-node-ignored",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				// A deleted node's given name and addresses may be taken
+				// by a live node; that is not a collision.
+				err := db.DB.Model(&types.Node{}).Where("id = ?", b.ID).
+					Updates(map[string]any{"given_name": a.GivenName, "ipv4": a.IPv4.String()}).Error
+				require.NoError(t, err)
+				require.NoError(t, db.SoftDeleteNode(b.ID))
+
+				return nil
+			},
+		},
+		{
+			name: "given-name-collision",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				err := db.DB.Model(&types.Node{}).Where("id = ?", b.ID).
+					Update("given_name", a.GivenName).Error
+				require.NoError(t, err)
+
+				return []InvariantViolation{{
+					Type:    InvariantGivenNameCollision,
+					Message: `given name "a" is used by 2 nodes`,
+					NodeIDs: []types.NodeID{a.ID, b.ID},
+				}}
+			},
+		},
+		{
+			name: "given-name-collision-ignoring-case",
+			seed: func(t *testing.T, db *HSDatabase, a, b *types.Node) []InvariantViolation {
+				t.Helper()
+
+				err := db.DB.Model(&types.Node{}).Where("id = ?", b.ID).
+					Update("given_name", strings.ToUpper(a.GivenName)).Error
+				require.NoError(t, err)
+
+				return []InvariantViolation{{
+					Type:    InvariantGivenNameCollision,
+					Message: `given name "a" is used by 2 nodes`,
+					NodeIDs: []types.NodeID{a.ID, b.ID},
+				}}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := newSQLiteTestDB()
+			require.NoError(t, err)
+
+			user := db.CreateUserForTest("user")
+			a := db.CreateRegisteredNodeForTest(user, "a")
+			b := db.CreateRegisteredNodeForTest(user, "b")
+
+			want := tt.seed(t, db, a, b)
+
+			got, err := db.CheckDatabaseInvariants()
+			require.NoError(t, err)
+			assert.Equal(t, want, got)
+		})
+	}
+}
@@ -58,6 +58,22 @@ func NewIPAllocator(
 	db *HSDatabase,
 	prefix4, prefix6 *netip.Prefix,
 	strategy types.IPAllocationStrategy,
+) (*IPAllocator, error) {
+	if db == nil {
+		return newIPAllocator(nil, prefix4, prefix6, strategy)
+	}
+
+	return Read(db.DB, func(rx *gorm.DB) (*IPAllocator, error) {
+		return newIPAllocator(rx, prefix4, prefix6, strategy)
+	})
+}
+
+// newIPAllocator builds an [IPAllocator] that considers every address
+// stored in rx as handed out. A nil rx starts with no address in use.
+func newIPAllocator(
+	rx *gorm.DB,
+	prefix4, prefix6 *netip.Prefix,
+	strategy types.IPAllocationStrategy,
 ) (*IPAllocator, error) {
 	ret := IPAllocator{
 		prefix4: prefix4,
@@ -71,17 +87,13 @@ func NewIPAllocator(
 		v6s []sql.NullString
 	)
 
-	if db != nil {
-		err := db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv4", &v4s).Error
-		})
+	if rx != nil {
+		err := rx.Model(&types.Node{}).Pluck("ipv4", &v4s).Error
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv4 addresses from database: %w", err)
 		}
 
-		err = db.Read(func(rx *gorm.DB) error {
-			return rx.Model(&types.Node{}).Pluck("ipv6", &v6s).Error
-		})
+		err = rx.Model(&types.Node{}).Pluck("ipv6", &v6s).Error
 		if err != nil {
 			return nil, fmt.Errorf("reading IPv6 addresses from database: %w", err)
 		}
@@ -161,7 +173,93 @@ func (i *IPAllocator) Next() (*netip.Addr, *netip.Addr, error) {
 	return ret4, ret6, nil
 }
 
-var ErrCouldNotAllocateIP = errors.New("failed to allocate IP")
+// NextWithRequested is [IPAllocator.Next] for a caller asking for a specific
+// address. requested is handed out in its family when it lies inside the
+// configured prefix and is free; otherwise that address is allocated as
+// usual or, with strict, [ErrIPNotAvailable] is returned. The other family
+// is always allocated as usual. An invalid requested address is the same as
+// calling [IPAllocator.Next].
+func (i *IPAllocator) NextWithRequested(
+	requested netip.Addr,
+	strict bool,
+) (*netip.Addr, *netip.Addr, error) {
+	if !requested.IsValid() {
+		return i.Next()
+	}
+
+	requested = requested.Unmap()
+
+	err := i.reserve(requested)
+	if err != nil {
+		if strict {
+			return nil, nil, fmt.Errorf("requested IP: %w", err)
+		}
+
+		log.Debug().Err(err).Msg("requested IP not available, allocating one")
+
+		return i.Next()
+	}
+
+	ret4, ret6 := &requested, (*netip.Addr)(nil)
+	other, prev := i.prefix6, &i.prev6
+
+	if requested.Is6() {
+		ret4, ret6 = nil, &requested
+		other, prev = i.prefix4, &i.prev4
+	}
+
+	if other != nil {
+		ip, err := i.allocateNext(prev, other)
+		if err != nil {
+			i.FreeIPs([]netip.Addr{requested})
+
+			return nil, nil, fmt.Errorf("allocating IP: %w", err)
+		}
+
+		if requested.Is4() {
+			ret6 = ip
+		} else {
+			ret4 = ip
+		}
+	}
+
+	return ret4, ret6, nil
+}
+
+var (
+	ErrCouldNotAllocateIP = errors.New("failed to allocate IP")
+	ErrIPNotAvailable     = errors.New("IP address not available")
+)
+
+// reserve marks ip as handed out, as if [IPAllocator.Next] had returned it.
+// It fails when ip lies outside the allocator's prefixes, is already in use,
+// or is reserved by Tailscale.
+func (i *IPAllocator) reserve(ip netip.Addr) error {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+
+	prefix := i.prefix6
+	if ip.Is4() {
+		prefix = i.prefix4
+	}
+
+	if prefix == nil || !prefix.Contains(ip) {
+		return fmt.Errorf("%w: %s is outside the configured prefixes", ErrIPNotAvailable, ip)
+	}
+
+	set, err := i.usedIPs.IPSet()
+	if err != nil {
+		return err
+	}
+
+	if set.Contains(ip) || isTailscaleReservedIP(ip) {
+		return fmt.Errorf("%w: %s is already in use", ErrIPNotAvailable, ip)
+	}
+
+	i.usedIPs.Add(ip)
+
+	return nil
+}
 
 // allocateNext allocates the next address from prefix under i.mu, advancing
 // prev so a run of allocations (e.g. BackfillNodeIPs) does not rescan
@@ -382,6 +480,139 @@ func (db *HSDatabase) BackfillNodeIPs(i *IPAllocator) ([]string, error) {
 	return ret, err
 }
 
+// ReallocateOutOfRangeIPs gives every node holding an address outside the
+// configured prefixes, as left behind when the prefixes are changed, a new
+// address from the [IPAllocator]. Nodes whose addresses are in range are left
+// alone, and so are addresses in a family that is no longer configured, which
+// [HSDatabase.BackfillNodeIPs] removes. The allocator never hands out an
+// address in use, so no two nodes end up sharing one, and the addresses it
+// handed out go back to the pool if nothing is written. It returns the nodes
+// that were changed, with their new addresses.
+func (db *HSDatabase) ReallocateOutOfRangeIPs(i *IPAllocator) (types.Nodes, error) {
+	if i == nil {
+		return nil, fmt.Errorf("reallocating IPs: %w", errIPAllocatorNil)
+	}
+
+	var allocated []netip.Addr
+
+	changed, err := Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		nodes, err := ListNodes(tx)
+		if err != nil {
+			return nil, fmt.Errorf("listing nodes to reallocate IPs: %w", err)
+		}
+
+		changed := types.Nodes{}
+
+		for _, node := range nodes {
+			var ips []string
+
+			if i.prefix4 != nil && node.IPv4 != nil && !i.prefix4.Contains(*node.IPv4) {
+				ret4, err := i.allocateNext(&i.prev4, i.prefix4)
+				if err != nil {
+					return nil, fmt.Errorf("allocating IPv4 for node(%d): %w", node.ID, err)
+				}
+
+				allocated = append(allocated, *ret4)
+				ips = append(ips, node.IPv4.String()+" -> "+ret4.String())
+				node.IPv4 = ret4
+			}
+
+			if i.prefix6 != nil && node.IPv6 != nil && !i.prefix6.Contains(*node.IPv6) {
+				ret6, err := i.allocateNext(&i.prev6, i.prefix6)
+				if err != nil {
+					return nil, fmt.Errorf("allocating IPv6 for node(%d): %w", node.ID, err)
+				}
+
+				allocated = append(allocated, *ret6)
+				ips = append(ips, node.IPv6.String()+" -> "+ret6.String())
+				node.IPv6 = ret6
+			}
+
+			if len(ips) == 0 {
+				continue
+			}
+
+			err := tx.Model(node).Select("ipv4", "ipv6").Updates(node).Error
+			if err != nil {
+				return nil, fmt.Errorf("saving node(%d) after reallocating IPs: %w", node.ID, err)
+			}
+
+			log.Info().EmbedObject(node).Strs("ips", ips).Msg("Reallocated out of range IP addresses")
+
+			changed = append(changed, node)
+		}
+
+		return changed, nil
+	})
+	if err != nil {
+		// Nothing was written, so the addresses go back to the pool.
+		i.FreeIPs(allocated)
+
+		return nil, err
+	}
+
+	return changed, nil
+}
+
+// IPFamilies says which address families nodes are expected to have an
+// address in.
+type IPFamilies struct {
+	IPv4 bool
+	IPv6 bool
+}
+
+// Families returns the address families the allocator hands out addresses
+// in, as configured by its prefixes.
+func (i *IPAllocator) Families() IPFamilies {
+	return IPFamilies{
+		IPv4: i.prefix4 != nil,
+		IPv6: i.prefix6 != nil,
+	}
+}
+
+func (db *HSDatabase) FindNodesWithMismatchedFamilies(expected IPFamilies) (types.Nodes, error) {
+	return Read(db.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return FindNodesWithMismatchedFamilies(rx, expected)
+	})
+}
+
+// FindNodesWithMismatchedFamilies returns the nodes that lack an address in
+// an expected family or hold one in a family that is no longer configured,
+// as left behind when the prefixes switch between dual-stack and a single
+// family. [HSDatabase.BackfillNodeIPs] brings them in line.
+func FindNodesWithMismatchedFamilies(tx *gorm.DB, expected IPFamilies) (types.Nodes, error) {
+	nodes, err := ListNodes(tx)
+	if err != nil {
+		return nil, err
+	}
+
+	mismatched := types.Nodes{}
+
+	for _, node := range nodes {
+		if (node.IPv4 != nil) != expected.IPv4 || (node.IPv6 != nil) != expected.IPv6 {
+			mismatched = append(mismatched, node)
+		}
+	}
+
+	return mismatched, nil
+}
+
+// ReserveIPs marks ips as handed out, for addresses another allocator
+// assigned. It reserves all of them or, when one is outside the prefixes or
+// already in use, none.
+func (i *IPAllocator) ReserveIPs(ips []netip.Addr) error {
+	for idx, ip := range ips {
+		err := i.reserve(ip)
+		if err != nil {
+			i.FreeIPs(ips[:idx])
+
+			return err
+		}
+	}
+
+	return nil
+}
+
 func (i *IPAllocator) FreeIPs(ips []netip.Addr) {
 	i.mu.Lock()
 	defer i.mu.Unlock()
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/netip"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/google/go-cmp/cmp"
@@ -514,3 +515,289 @@ func TestIPAllocatorNextNoReservedIPs(t *testing.T) {
 	require.NoError(t, err)
 	assert.Equal(t, na("100.115.94.0"), *nextChrome)
 }
+
+func TestFindNodesWithMismatchedFamilies(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("families")
+	nodes := db.CreateNodesForTest(user, 2, "families")
+
+	nodes[0].IPv4 = nap("100.64.0.1")
+	nodes[0].IPv6 = nap("fd7a:115c:a1e0::1")
+	nodes[1].IPv4 = nap("100.64.0.2")
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	// The config dropped the IPv6 prefix: only the dual-stack node is stale.
+	alloc, err := NewIPAllocator(db, mpp("100.64.0.0/10"), nil, types.IPAllocationStrategySequential)
+	require.NoError(t, err)
+	assert.Equal(t, IPFamilies{IPv4: true}, alloc.Families())
+
+	mismatched, err := db.FindNodesWithMismatchedFamilies(alloc.Families())
+	require.NoError(t, err)
+	require.Len(t, mismatched, 1)
+	assert.Equal(t, nodes[0].ID, mismatched[0].ID)
+
+	// Under a dual-stack config the v4-only node is the stale one.
+	mismatched, err = db.FindNodesWithMismatchedFamilies(IPFamilies{IPv4: true, IPv6: true})
+	require.NoError(t, err)
+	require.Len(t, mismatched, 1)
+	assert.Equal(t, nodes[1].ID, mismatched[0].ID)
+
+	_, err = db.BackfillNodeIPs(alloc)
+	require.NoError(t, err)
+
+	mismatched, err = db.FindNodesWithMismatchedFamilies(alloc.Families())
+	require.NoError(t, err)
+	assert.Empty(t, mismatched, "backfilling must reconcile every node")
+}
+
+func TestReallocateOutOfRangeIPs(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("realloc")
+	nodes := db.CreateNodesForTest(user, 4, "realloc")
+
+	// The IPv4 prefix moved from 100.64.0.0/10 to 100.100.0.0/16.
+	nodes[0].IPv4 = nap("100.100.0.1") // in range
+	nodes[0].IPv6 = nap("fd7a:115c:a1e0::1")
+	nodes[1].IPv4 = nap("100.64.0.2") // out of range
+	nodes[1].IPv6 = nap("fd7a:115c:a1e0::2")
+	nodes[2].IPv4 = nap("100.64.0.3")  // out of range
+	nodes[3].IPv4 = nap("100.100.0.2") // in range, no IPv6 yet
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	alloc, err := NewIPAllocator(
+		db,
+		mpp("100.100.0.0/16"),
+		mpp("fd7a:115c:a1e0::/48"),
+		types.IPAllocationStrategySequential,
+	)
+	require.NoError(t, err)
+
+	changed, err := db.ReallocateOutOfRangeIPs(alloc)
+	require.NoError(t, err)
+
+	changedIDs := make([]types.NodeID, 0, len(changed))
+	for _, node := range changed {
+		changedIDs = append(changedIDs, node.ID)
+	}
+
+	assert.ElementsMatch(t, []types.NodeID{nodes[1].ID, nodes[2].ID}, changedIDs)
+
+	stored, err := db.ListNodes()
+	require.NoError(t, err)
+
+	seen := make(map[netip.Addr]types.NodeID)
+
+	for _, node := range stored {
+		require.NotNil(t, node.IPv4)
+		assert.True(t, mpp("100.100.0.0/16").Contains(*node.IPv4), "node %d has %s", node.ID, node.IPv4)
+
+		for _, ip := range node.IPs() {
+			other, dup := seen[ip]
+			assert.False(t, dup, "%s is held by nodes %d and %d", ip, other, node.ID)
+			seen[ip] = node.ID
+		}
+	}
+
+	byID := make(map[types.NodeID]*types.Node)
+	for _, node := range stored {
+		byID[node.ID] = node
+	}
+
+	assert.Equal(t, nap("100.100.0.1"), byID[nodes[0].ID].IPv4, "in range addresses are kept")
+	assert.Equal(t, nap("100.100.0.2"), byID[nodes[3].ID].IPv4)
+	assert.Equal(t, nap("fd7a:115c:a1e0::2"), byID[nodes[1].ID].IPv6, "only the out of range family moves")
+	assert.Nil(t, byID[nodes[3].ID].IPv6, "missing families are left to BackfillNodeIPs")
+
+	changed, err = db.ReallocateOutOfRangeIPs(alloc)
+	require.NoError(t, err)
+	assert.Empty(t, changed, "a second run has nothing to do")
+}
+
+// TestReallocateOutOfRangeIPsFreesOnRollback checks that addresses handed
+// out before the reallocation fails go back to the allocator.
+func TestReallocateOutOfRangeIPsFreesOnRollback(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	// 100.100.0.0/29 has six usable addresses for seven nodes to move.
+	user := db.CreateUserForTest("realloc")
+	nodes := db.CreateNodesForTest(user, 7, "realloc")
+
+	for idx, node := range nodes {
+		node.IPv4 = nap(fmt.Sprintf("100.64.0.%d", idx+1))
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	alloc, err := NewIPAllocator(db, mpp("100.100.0.0/29"), nil, types.IPAllocationStrategySequential)
+	require.NoError(t, err)
+
+	_, err = db.ReallocateOutOfRangeIPs(alloc)
+	require.ErrorIs(t, err, ErrCouldNotAllocateIP)
+
+	stored, err := db.ListNodes()
+	require.NoError(t, err)
+
+	for _, node := range stored {
+		assert.True(t, mpp("100.64.0.0/24").Contains(*node.IPv4), "node %d must keep its address", node.ID)
+	}
+
+	var pool []netip.Addr
+	for ip := netip.MustParseAddr("100.100.0.1"); ip != netip.MustParseAddr("100.100.0.7"); ip = ip.Next() {
+		pool = append(pool, ip)
+	}
+
+	require.NoError(t, alloc.ReserveIPs(pool), "the addresses of the rolled back run must be free")
+}
+
+// TestIPAllocatorConcurrentNextDistinct verifies that concurrent
+// registrations never share an address: the scan for a free address and
+// marking it used happen under the same lock.
+func TestIPAllocatorConcurrentNextDistinct(t *testing.T) {
+	const workers = 64
+
+	for _, strategy := range []types.IPAllocationStrategy{
+		types.IPAllocationStrategySequential,
+		types.IPAllocationStrategyRandom,
+	} {
+		t.Run(string(strategy), func(t *testing.T) {
+			db, err := newSQLiteTestDB()
+			require.NoError(t, err)
+
+			defer db.Close()
+
+			alloc, err := NewIPAllocator(
+				db,
+				new(tsaddr.CGNATRange()),
+				new(tsaddr.TailscaleULARange()),
+				strategy,
+			)
+			require.NoError(t, err)
+
+			var (
+				wg   sync.WaitGroup
+				mu   sync.Mutex
+				errs []error
+				v4s  = make(map[netip.Addr]int)
+				v6s  = make(map[netip.Addr]int)
+			)
+
+			for range workers {
+				wg.Go(func() {
+					v4, v6, err := alloc.Next()
+
+					mu.Lock()
+					defer mu.Unlock()
+
+					if err != nil {
+						errs = append(errs, err)
+
+						return
+					}
+
+					v4s[*v4]++
+					v6s[*v6]++
+				})
+			}
+
+			wg.Wait()
+
+			require.Empty(t, errs)
+			assert.Len(t, v4s, workers, "every IPv4 must be handed out once")
+			assert.Len(t, v6s, workers, "every IPv6 must be handed out once")
+		})
+	}
+}
+
+func TestNextWithRequested(t *testing.T) {
+	tests := []struct {
+		name      string
+		requested string
+		strict    bool
+		want4     string
+		want6     string
+		wantErr   error
+	}{
+		{
+			name:      "free-ipv4",
+			requested: "100.64.0.50",
+			want4:     "100.64.0.50",
+			want6:     "fd7a:115c:a1e0::1",
+		},
+		{
+			name:      "free-ipv6",
+			requested: "fd7a:115c:a1e0::50",
+			want4:     "100.64.0.1",
+			want6:     "fd7a:115c:a1e0::50",
+		},
+		{
+			name:      "taken-falls-back",
+			requested: "100.64.0.10",
+			want4:     "100.64.0.1",
+			want6:     "fd7a:115c:a1e0::1",
+		},
+		{
+			name:      "taken-strict",
+			requested: "100.64.0.10",
+			strict:    true,
+			wantErr:   ErrIPNotAvailable,
+		},
+		{
+			name:      "out-of-range-falls-back",
+			requested: "10.0.0.1",
+			want4:     "100.64.0.1",
+			want6:     "fd7a:115c:a1e0::1",
+		},
+		{
+			name:      "out-of-range-strict",
+			requested: "10.0.0.1",
+			strict:    true,
+			wantErr:   ErrIPNotAvailable,
+		},
+		{
+			name:      "tailscale-reserved-strict",
+			requested: "100.100.100.100",
+			strict:    true,
+			wantErr:   ErrIPNotAvailable,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			alloc, err := NewIPAllocator(
+				nil,
+				mpp("100.64.0.0/10"),
+				mpp("fd7a:115c:a1e0::/48"),
+				types.IPAllocationStrategySequential,
+			)
+			require.NoError(t, err)
+
+			// 100.64.0.10 is held by another node.
+			require.NoError(t, alloc.reserve(netip.MustParseAddr("100.64.0.10")))
+
+			got4, got6, err := alloc.NextWithRequested(netip.MustParseAddr(tt.requested), tt.strict)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want4, got4.String())
+			assert.Equal(t, tt.want6, got6.String())
+
+			// The requested address is now in use.
+			_, _, err = alloc.NextWithRequested(netip.MustParseAddr(tt.requested), true)
+			require.ErrorIs(t, err, ErrIPNotAvailable)
+		})
+	}
+}
@@ -4,18 +4,24 @@ import (
 	"cmp"
 	"errors"
 	"fmt"
+	"maps"
 	"net/netip"
 	"slices"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
+	"unicode/utf8"
 
+	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/juanfont/headscale/hscontrol/util/zlog/zf"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/util/dnsname"
 )
@@ -32,8 +38,21 @@ const (
 var ErrNodeNameNotUnique = errors.New("node name is not unique")
 
 // preloadNode returns a session that eager-loads a node's AuthKey, the
-// AuthKey's User, and the node's User.
+// AuthKey's User, and the node's User. It leaves out soft-deleted nodes
+// (see [SoftDeleteNode]), so every query built on it only sees live nodes.
 func preloadNode(tx *gorm.DB) *gorm.DB {
+	return preloadNodeWithDeleted(tx).Scopes(notDeleted)
+}
+
+// notDeleted leaves out soft-deleted nodes. [types.Node.DeletedAt] is a plain
+// *time.Time rather than a gorm.DeletedAt, so GORM never adds this filter on
+// its own: every query on nodes not built on [preloadNode] needs it.
+func notDeleted(tx *gorm.DB) *gorm.DB {
+	return tx.Where("nodes.deleted_at IS NULL")
+}
+
+// preloadNodeWithDeleted is [preloadNode] without the soft-delete filter.
+func preloadNodeWithDeleted(tx *gorm.DB) *gorm.DB {
 	return tx.
 		Preload("AuthKey").
 		Preload("AuthKey.User").
@@ -43,12 +62,21 @@ func preloadNode(tx *gorm.DB) *gorm.DB {
 var (
 	ErrNodeNotFound                  = errors.New("node not found")
 	ErrNodeRouteIsNotAvailable       = errors.New("route is not available on node")
+	ErrNodeNeverConnected            = errors.New("node has never connected")
+	ErrInvalidRegisterMethod         = errors.New("invalid register method")
 	ErrNodeNotFoundRegistrationCache = errors.New(
 		"node not found in registration cache",
 	)
 	ErrCouldNotConvertNodeInterface = errors.New("failed to convert node interface")
+	ErrInvalidNodeOrder             = errors.New("invalid node ordering")
+	ErrInvalidVersionConstraint     = errors.New("invalid version constraint")
+	ErrNodeDescriptionTooLong       = errors.New("node description too long")
 )
 
+// MaxNodeDescriptionLength is the maximum length of a node description, in
+// characters.
+const MaxNodeDescriptionLength = 2048
+
 // ListPeers returns peers of node, regardless of any Policy or if the node is expired.
 // If no peer IDs are given, all peers are returned.
 // If at least one peer ID is given, only these peer nodes will be returned.
@@ -74,6 +102,41 @@ func ListPeers(tx *gorm.DB, nodeID types.NodeID, peerIDs ...types.NodeID) (types
 	return nodes, nil
 }
 
+func (hsdb *HSDatabase) ListPeersFiltered(node *types.Node, polMan policy.PolicyManager) (types.Nodes, error) {
+	return ListPeersFiltered(hsdb.DB, node, polMan)
+}
+
+// ListPeersFiltered returns the peers of node that it may see under the
+// policy of polMan, ordered by ID. It is [ListPeers] filtered with
+// [policy.ReduceNodes], the same decision the map responses take through
+// [state.FilterVisiblePeers]. Without any matchers there are no restrictions
+// and every peer is returned.
+func ListPeersFiltered(tx *gorm.DB, node *types.Node, polMan policy.PolicyManager) (types.Nodes, error) {
+	peers, err := ListPeers(tx, node.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	matchers, err := polMan.MatchersForNode(node.View())
+	if err != nil {
+		return nil, fmt.Errorf("resolving matchers for node %d: %w", node.ID, err)
+	}
+
+	if len(matchers) == 0 {
+		return peers, nil
+	}
+
+	byID := peers.IDMap()
+	visible := policy.ReduceNodes(node.View(), peers.ViewSlice(), matchers)
+
+	filtered := make(types.Nodes, 0, visible.Len())
+	for _, peer := range visible.All() {
+		filtered = append(filtered, byID[peer.ID()])
+	}
+
+	return filtered, nil
+}
+
 // ListNodes queries the database for either all nodes if no parameters are given
 // or for the given nodes if at least one node ID is given as parameter.
 func (hsdb *HSDatabase) ListNodes(nodeIDs ...types.NodeID) (types.Nodes, error) {
@@ -91,153 +154,1309 @@ func ListNodes(tx *gorm.DB, nodeIDs ...types.NodeID) (types.Nodes, error) {
 		return nil, err
 	}
 
-	return nodes, nil
+	return nodes, nil
+}
+
+// filterNodes returns the nodes for which keep reports true, ordered by ID.
+// It serves conditions SQL cannot evaluate: tags and Hostinfo are stored as
+// serialised JSON and addresses as text, so every node is loaded and matched
+// in Go.
+func filterNodes(tx *gorm.DB, keep func(*types.Node) bool) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).Order("nodes.id").Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return slices.DeleteFunc(nodes, func(node *types.Node) bool { return !keep(node) }), nil
+}
+
+func (hsdb *HSDatabase) ListNodesLight() (types.Nodes, error) {
+	return Read(hsdb.DB, ListNodesLight)
+}
+
+// ListNodesLight returns every node like [ListNodes] but without loading the
+// node's User, AuthKey and the AuthKey's User, so bookkeeping that only needs
+// node columns avoids the extra queries and allocations. The associations
+// are left nil; use [ListNodes] when they are needed.
+func ListNodesLight(tx *gorm.DB) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := tx.Scopes(notDeleted).Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// nodeListOrder describes how one ordering accepted by [ListNodesOrdered] is
+// sorted in SQL.
+type nodeListOrder struct {
+	// expr is the column or expression sorted on.
+	expr string
+	// nullable puts rows where expr is NULL last, in either direction.
+	nullable bool
+}
+
+// nodeListOrders maps the orderings accepted by [ListNodesOrdered] to the
+// expression they sort on. Only these are ever interpolated into SQL.
+var nodeListOrders = map[string]nodeListOrder{
+	"id":         {expr: "id"},
+	"given_name": {expr: "LOWER(given_name)"},
+	"hostname":   {expr: "LOWER(hostname)"},
+	"created_at": {expr: "created_at"},
+	"last_seen":  {expr: "last_seen", nullable: true},
+	"expiry":     {expr: "expiry", nullable: true},
+}
+
+// clause builds the ORDER BY clause for o. NULLs are pushed last with an
+// explicit IS NULL key, which SQLite and Postgres both sort false first,
+// and every clause ends on the primary key so ties are stable.
+func (o nodeListOrder) clause(desc bool) string {
+	dir := "ASC"
+	if desc {
+		dir = "DESC"
+	}
+
+	var b strings.Builder
+	if o.nullable {
+		b.WriteString(o.expr + " IS NULL, ")
+	}
+
+	b.WriteString(o.expr + " " + dir)
+
+	if o.expr != "id" {
+		b.WriteString(", id " + dir)
+	}
+
+	return b.String()
+}
+
+func (hsdb *HSDatabase) ListNodesOrdered(orderBy string, desc bool) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesOrdered(rx, orderBy, desc)
+	})
+}
+
+// ListNodesOrdered returns all nodes sorted in the database by orderBy, which
+// must be one of "id", "given_name", "hostname", "created_at", "last_seen" or
+// "expiry", descending if desc is set. Names are compared case-insensitively
+// and nodes that were never seen or never expire always sort last.
+func ListNodesOrdered(tx *gorm.DB, orderBy string, desc bool) (types.Nodes, error) {
+	order, ok := nodeListOrders[orderBy]
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrInvalidNodeOrder, orderBy)
+	}
+
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).Order(order.clause(desc)).Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+// ListNodesOptions filters and pages the result of [ListNodesPaged].
+type ListNodesOptions struct {
+	// UserName limits the result to nodes owned by the user with this name.
+	UserName string
+
+	// Limit is the maximum number of nodes returned; 0 means no limit.
+	Limit int
+	// Offset is the number of nodes skipped before the page starts.
+	Offset int
+
+	// OnlineOnly limits the result to the nodes in OnlineNodeIDs. Whether a
+	// node is connected is only known at runtime, so the caller supplies it.
+	OnlineOnly    bool
+	OnlineNodeIDs []types.NodeID
+}
+
+func (hsdb *HSDatabase) ListNodesPaged(opts ListNodesOptions) (types.Nodes, int64, error) {
+	var (
+		nodes types.Nodes
+		total int64
+	)
+
+	err := hsdb.Read(func(rx *gorm.DB) error {
+		var err error
+
+		nodes, total, err = ListNodesPaged(rx, opts)
+
+		return err
+	})
+
+	return nodes, total, err
+}
+
+// ListNodesPaged returns one page of the nodes matching opts, ordered by ID,
+// along with the total number of matching nodes. Filtering, LIMIT and OFFSET
+// are applied by the database, so only the page is loaded.
+func ListNodesPaged(tx *gorm.DB, opts ListNodesOptions) (types.Nodes, int64, error) {
+	if opts.OnlineOnly && len(opts.OnlineNodeIDs) == 0 {
+		return types.Nodes{}, 0, nil
+	}
+
+	filter := func(db *gorm.DB) *gorm.DB {
+		if opts.UserName != "" {
+			db = db.Where(
+				"user_id IN (?)",
+				tx.Model(&types.User{}).Select("id").Where("name = ?", opts.UserName),
+			)
+		}
+
+		if opts.OnlineOnly {
+			db = db.Where("id IN ?", opts.OnlineNodeIDs)
+		}
+
+		return db
+	}
+
+	var total int64
+
+	err := tx.Model(&types.Node{}).Scopes(notDeleted, filter).Count(&total).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("counting nodes: %w", err)
+	}
+
+	page := preloadNode(tx).Scopes(filter).Order("id").Offset(opts.Offset)
+	if opts.Limit > 0 {
+		page = page.Limit(opts.Limit)
+	}
+
+	nodes := types.Nodes{}
+
+	err = page.Find(&nodes).Error
+	if err != nil {
+		return nil, 0, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	return nodes, total, nil
+}
+
+func (hsdb *HSDatabase) ListEphemeralNodes() (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		nodes := types.Nodes{}
+
+		err := rx.Joins("AuthKey").Scopes(notDeleted).
+			Where(`"AuthKey"."ephemeral" = true`).Find(&nodes).Error
+		if err != nil {
+			return nil, err
+		}
+
+		return nodes, nil
+	})
+}
+
+func (hsdb *HSDatabase) ListNodesByUserID(uid types.UserID) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesByUserID(rx, uid)
+	})
+}
+
+// ListNodesByUserID returns the nodes owned by the user with the given ID.
+// It filters on the user_id foreign key, so renaming the user does not
+// affect it. Tagged nodes have no owner and are never returned.
+func ListNodesByUserID(tx *gorm.DB, uid types.UserID) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("user_id = ?", uint(uid)).
+		Order("id").
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesManagedBy(system string) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesManagedBy(rx, system)
+	})
+}
+
+// ListNodesManagedBy returns the nodes managed by the given external system.
+// An empty system returns the nodes not managed by any system.
+func ListNodesManagedBy(tx *gorm.DB, system string) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("COALESCE(managed_by, '') = ?", system).Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesByTag(tag string) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesByTag(rx, tag)
+	})
+}
+
+// ListNodesByTag returns the nodes carrying tag, ordered by ID.
+//
+// The tags of a pre auth key are copied to the node when it registers and
+// may be changed afterwards, so the node's own tags are its effective tags
+// and the key's tags are not consulted.
+func ListNodesByTag(tx *gorm.DB, tag string) (types.Nodes, error) {
+	return filterNodes(tx, func(node *types.Node) bool {
+		return node.HasTag(tag)
+	})
+}
+
+func (hsdb *HSDatabase) ListExpiredNodes() (types.Nodes, error) {
+	return Read(hsdb.DB, ListExpiredNodes)
+}
+
+// ListExpiredNodes returns the nodes whose expiry has passed, ordered by ID.
+// It is the read-only counterpart of the expiry sweep: it uses the same
+// [types.Node.IsExpired] predicate and writes nothing.
+func ListExpiredNodes(tx *gorm.DB) (types.Nodes, error) {
+	return filterNodes(tx, (*types.Node).IsExpired)
+}
+
+func (hsdb *HSDatabase) ListStaleNodes(threshold time.Duration) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListStaleNodes(rx, threshold)
+	})
+}
+
+// ListStaleNodes returns the nodes last seen more than threshold ago,
+// including nodes that have never connected (no last_seen), ordered by ID.
+// It only reads. last_seen is written when a node disconnects, so a node
+// that has stayed connected for longer than threshold is listed as well;
+// [state.State.ListStaleNodes] leaves out connected nodes.
+func ListStaleNodes(tx *gorm.DB, threshold time.Duration) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("last_seen IS NULL OR last_seen < ?", time.Now().Add(-threshold)).
+		Order("id").Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesBelowCapVer(
+	minCapVer tailcfg.CapabilityVersion,
+) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesBelowCapVer(rx, minCapVer)
+	})
+}
+
+// ListNodesBelowCapVer returns the nodes whose client reported a capability
+// version lower than minCapVer. Nodes that have not reported one yet are
+// left out, as nothing is known about their client.
+func ListNodesBelowCapVer(
+	tx *gorm.DB,
+	minCapVer tailcfg.CapabilityVersion,
+) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("cap_ver > 0 AND cap_ver < ?", minCapVer).
+		Order("id").Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesByClientVersion(constraint string) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesByClientVersion(rx, constraint)
+	})
+}
+
+// ListNodesByClientVersion returns the nodes whose client version satisfies
+// constraint, an operator (<, <=, >, >=, =) followed by a major.minor.patch
+// version such as "<1.80.0"; a bare version means "=". Pre-release and build
+// suffixes are ignored on both sides, as Tailscale appends its commit hashes
+// that way ("1.80.0-t3f2a1b"), so "1.80.0-pre" is treated as 1.80.0. Nodes
+// that have not reported a version, or report one that does not parse, are
+// left out.
+func ListNodesByClientVersion(tx *gorm.DB, constraint string) (types.Nodes, error) {
+	match, err := parseVersionConstraint(constraint)
+	if err != nil {
+		return nil, err
+	}
+
+	var candidates types.Nodes
+
+	err = preloadNode(tx).
+		Where("client_version IS NOT NULL AND client_version != ''").
+		Order("id").Find(&candidates).Error
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := types.Nodes{}
+
+	for _, node := range candidates {
+		version, err := parseVersion(node.ClientVersion)
+		if err != nil {
+			continue
+		}
+
+		if match(version) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes, nil
+}
+
+// parseVersionConstraint turns a constraint accepted by
+// [ListNodesByClientVersion] into a predicate over versions.
+func parseVersionConstraint(constraint string) (func(semver) bool, error) {
+	constraint = strings.TrimSpace(constraint)
+
+	ops := []struct {
+		prefix string
+		ok     func(int) bool
+	}{
+		// Two-character operators first so "<=" is not read as "<".
+		{"<=", func(c int) bool { return c <= 0 }},
+		{">=", func(c int) bool { return c >= 0 }},
+		{"<", func(c int) bool { return c < 0 }},
+		{">", func(c int) bool { return c > 0 }},
+		{"=", func(c int) bool { return c == 0 }},
+	}
+
+	ok := func(c int) bool { return c == 0 }
+
+	for _, op := range ops {
+		if rest, found := strings.CutPrefix(constraint, op.prefix); found {
+			constraint, ok = strings.TrimSpace(rest), op.ok
+
+			break
+		}
+	}
+
+	want, err := parseVersion(constraint)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidVersionConstraint, err)
+	}
+
+	return func(v semver) bool { return ok(v.compare(want)) }, nil
+}
+
+func (hsdb *HSDatabase) UpdateNodeCapVer(
+	nodeID types.NodeID,
+	capVer tailcfg.CapabilityVersion,
+) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return UpdateNodeCapVer(tx, nodeID, capVer)
+	})
+}
+
+// UpdateNodeCapVer records the capability version a node's client reported.
+func UpdateNodeCapVer(
+	tx *gorm.DB,
+	nodeID types.NodeID,
+	capVer tailcfg.CapabilityVersion,
+) error {
+	return tx.Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		Update("cap_ver", capVer).Error
+}
+
+func (hsdb *HSDatabase) ListRecentlyRegisteredNodes(limit int) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListRecentlyRegisteredNodes(rx, limit)
+	})
+}
+
+// ListRecentlyRegisteredNodes returns up to limit nodes, newest registration
+// first. A limit of zero or less returns no nodes.
+func ListRecentlyRegisteredNodes(tx *gorm.DB, limit int) (types.Nodes, error) {
+	nodes := types.Nodes{}
+	if limit <= 0 {
+		return nodes, nil
+	}
+
+	err := preloadNode(tx).
+		Order("created_at DESC").
+		Order("id DESC").
+		Limit(limit).
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesExpiringBetween(from, to time.Time) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesExpiringBetween(rx, from, to)
+	})
+}
+
+// ListNodesExpiringBetween returns the nodes whose key expires in the window
+// [from, to), ordered by expiry. Nodes without an expiry never match. The
+// window may lie anywhere in time, so it also reports nodes that have already
+// expired if from is in the past.
+func ListNodesExpiringBetween(tx *gorm.DB, from, to time.Time) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("expiry IS NOT NULL AND expiry >= ? AND expiry < ?", from, to).
+		Order("expiry").
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListNodesExpiringWithin(window time.Duration) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesExpiringWithin(rx, window)
+	})
+}
+
+// ListNodesExpiringWithin returns the nodes that have not expired yet but
+// will within window, ordered by expiry, so their users can be warned to
+// reauthenticate in time. It is [ListNodesExpiringBetween] from now, so a
+// node expiring exactly at the end of the window is not included.
+func ListNodesExpiringWithin(tx *gorm.DB, window time.Duration) (types.Nodes, error) {
+	now := time.Now()
+
+	return ListNodesExpiringBetween(tx, now, now.Add(window))
+}
+
+func (hsdb *HSDatabase) ListUnexpectedlyOfflineNodes(
+	isConnected func(types.NodeID) bool,
+	recentWindow time.Duration,
+) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListUnexpectedlyOfflineNodes(rx, isConnected, recentWindow)
+	})
+}
+
+// ListUnexpectedlyOfflineNodes returns the nodes that were seen within
+// recentWindow but are not reported as connected by isConnected. A node in
+// this list usually points at a poller or notifier that lost track of a live
+// session rather than at a node that actually went away.
+func ListUnexpectedlyOfflineNodes(
+	tx *gorm.DB,
+	isConnected func(types.NodeID) bool,
+	recentWindow time.Duration,
+) (types.Nodes, error) {
+	recent := types.Nodes{}
+
+	since := time.Now().Add(-recentWindow)
+
+	err := preloadNode(tx).
+		Where("last_seen IS NOT NULL AND last_seen >= ?", since).
+		Order("id").
+		Find(&recent).Error
+	if err != nil {
+		return nil, err
+	}
+
+	nodes := types.Nodes{}
+
+	for _, node := range recent {
+		if !isConnected(node.ID) {
+			nodes = append(nodes, node)
+		}
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) FindNodesWithoutGivenName() (types.Nodes, error) {
+	return Read(hsdb.DB, FindNodesWithoutGivenName)
+}
+
+// FindNodesWithoutGivenName returns the nodes whose given_name is NULL or
+// empty. Such rows come from legacy data or bugs and cannot be given a DNS
+// name until they are repaired.
+func FindNodesWithoutGivenName(tx *gorm.DB) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("COALESCE(given_name, '') = ''").
+		Order("id").
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) ListPartialExitNodes() (types.Nodes, error) {
+	return Read(hsdb.DB, ListPartialExitNodes)
+}
+
+// ListPartialExitNodes returns the nodes that advertise only one of the two
+// default routes (0.0.0.0/0 and ::/0). Clients always advertise both, so
+// such a node is misconfigured and only half works as an exit node.
+// Approval is not considered. The nodes are ordered by ID.
+func ListPartialExitNodes(tx *gorm.DB) (types.Nodes, error) {
+	return filterNodes(tx, func(node *types.Node) bool {
+		announced := node.AnnouncedRoutes()
+
+		return slices.Contains(announced, tsaddr.AllIPv4()) != slices.Contains(announced, tsaddr.AllIPv6())
+	})
+}
+
+func (hsdb *HSDatabase) ListSubnetRouters(excludeExitOnly bool) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListSubnetRouters(rx, excludeExitOnly)
+	})
+}
+
+// ListSubnetRouters returns the nodes that advertise at least one route,
+// approved or not, ordered by ID. With excludeExitOnly, nodes that advertise
+// nothing but the exit routes are left out.
+func ListSubnetRouters(tx *gorm.DB, excludeExitOnly bool) (types.Nodes, error) {
+	return filterNodes(tx, func(node *types.Node) bool {
+		announced := node.AnnouncedRoutes()
+		if excludeExitOnly {
+			return slices.ContainsFunc(announced, func(p netip.Prefix) bool { return !tsaddr.IsExitRoute(p) })
+		}
+
+		return len(announced) > 0
+	})
+}
+
+func (hsdb *HSDatabase) GetAdvertisedRoutesForNodes(
+	nodeIDs []types.NodeID,
+) (map[types.NodeID][]netip.Prefix, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (map[types.NodeID][]netip.Prefix, error) {
+		return GetAdvertisedRoutesForNodes(rx, nodeIDs)
+	})
+}
+
+// GetAdvertisedRoutesForNodes returns the routes each of nodeIDs advertises,
+// loaded in one query instead of one per node. Only the ID and Hostinfo
+// columns are read. Nodes that advertise nothing, or do not exist, are left
+// out of the map; an empty nodeIDs returns an empty map without a query.
+func GetAdvertisedRoutesForNodes(
+	tx *gorm.DB,
+	nodeIDs []types.NodeID,
+) (map[types.NodeID][]netip.Prefix, error) {
+	routes := make(map[types.NodeID][]netip.Prefix, len(nodeIDs))
+	if len(nodeIDs) == 0 {
+		return routes, nil
+	}
+
+	nodes := types.Nodes{}
+
+	err := tx.Select("id", "host_info").
+		Where("id IN ? AND deleted_at IS NULL", nodeIDs).
+		Find(&nodes).Error
+	if err != nil {
+		return nil, fmt.Errorf("loading advertised routes: %w", err)
+	}
+
+	for _, node := range nodes {
+		if announced := node.AnnouncedRoutes(); len(announced) > 0 {
+			routes[node.ID] = announced
+		}
+	}
+
+	return routes, nil
+}
+
+// NodeChurn counts node lifecycle events within a period.
+type NodeChurn struct {
+	Registered int64
+	Deleted    int64
+	Expired    int64
+}
+
+func (hsdb *HSDatabase) NodeChurnRate(from, to time.Time) (NodeChurn, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (NodeChurn, error) {
+		return NodeChurnRate(rx, from, to)
+	})
+}
+
+// NodeChurnRate counts the nodes registered, deleted and expired in the window
+// [from, to). Only expiries that have already passed count as expired.
+//
+// The counts are derived from the node rows themselves as there is no audit
+// log: nodes removed with [PurgeNode] are hard-deleted and leave no trace,
+// so Deleted only covers nodes soft-deleted with [SoftDeleteNode], and a node
+// registered and removed within the window is not counted as registered.
+func NodeChurnRate(tx *gorm.DB, from, to time.Time) (NodeChurn, error) {
+	var churn NodeChurn
+
+	err := tx.Model(&types.Node{}).
+		Where("created_at >= ? AND created_at < ?", from, to).
+		Count(&churn.Registered).Error
+	if err != nil {
+		return NodeChurn{}, fmt.Errorf("counting registered nodes: %w", err)
+	}
+
+	err = tx.Model(&types.Node{}).
+		Where("deleted_at IS NOT NULL AND deleted_at >= ? AND deleted_at < ?", from, to).
+		Count(&churn.Deleted).Error
+	if err != nil {
+		return NodeChurn{}, fmt.Errorf("counting deleted nodes: %w", err)
+	}
+
+	err = tx.Model(&types.Node{}).
+		Where("expiry IS NOT NULL AND expiry >= ? AND expiry < ? AND expiry <= ?",
+			from, to, time.Now()).
+		Count(&churn.Expired).Error
+	if err != nil {
+		return NodeChurn{}, fmt.Errorf("counting expired nodes: %w", err)
+	}
+
+	return churn, nil
+}
+
+func (hsdb *HSDatabase) getNode(uid types.UserID, name string) (*types.Node, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Node, error) {
+		return getNode(rx, uid, name)
+	})
+}
+
+// getNode finds a [types.Node] by name and user and returns the [types.Node] struct.
+func getNode(tx *gorm.DB, uid types.UserID, name string) (*types.Node, error) {
+	uidPtr := uint(uid)
+
+	node := types.Node{}
+
+	err := preloadNode(tx).
+		Where(&types.Node{UserID: &uidPtr, Hostname: name}).
+		First(&node).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+
+		return nil, err
+	}
+
+	return &node, nil
+}
+
+func (hsdb *HSDatabase) GetNodeByID(id types.NodeID) (*types.Node, error) {
+	return GetNodeByID(hsdb.DB, id)
+}
+
+// GetNodeByID finds a [types.Node] by ID and returns the [types.Node] struct.
+func GetNodeByID(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
+	mach := types.Node{}
+	if result := preloadNode(tx).
+		First(&mach, "id = ?", id); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &mach, nil
+}
+
+func (hsdb *HSDatabase) GetNodeWithFQDN(id types.NodeID, baseDomain string) (*types.Node, string, error) {
+	return GetNodeWithFQDN(hsdb.DB, id, baseDomain)
+}
+
+// GetNodeWithFQDN finds a [types.Node] by ID and also returns its MagicDNS
+// name as built by [types.Node.GetFQDN]: the given name under baseDomain, or
+// just the given name if baseDomain is empty.
+func GetNodeWithFQDN(tx *gorm.DB, id types.NodeID, baseDomain string) (*types.Node, string, error) {
+	node, err := GetNodeByID(tx, id)
+	if err != nil {
+		return nil, "", err
+	}
+
+	fqdn, err := node.GetFQDN(baseDomain)
+	if err != nil {
+		return nil, "", fmt.Errorf("node %d: %w", id, err)
+	}
+
+	return node, fqdn, nil
+}
+
+func (hsdb *HSDatabase) GetNodeByIDUnscoped(id types.NodeID) (*types.Node, error) {
+	return GetNodeByIDUnscoped(hsdb.DB, id)
+}
+
+// GetNodeByIDUnscoped is [GetNodeByID] that also finds soft-deleted nodes, so
+// an admin can inspect a deleted node before it is purged. It is meant for
+// diagnostics only; everything else must use [GetNodeByID], which never
+// returns deleted nodes.
+//
+// The associations of a deleted node may be gone as well: a pre-auth key or
+// user removed since then leaves AuthKey or User nil even though AuthKeyID
+// or UserID is set.
+func GetNodeByIDUnscoped(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
+	node := types.Node{}
+	if result := preloadNodeWithDeleted(tx.Unscoped()).
+		First(&node, "id = ?", id); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &node, nil
+}
+
+func (hsdb *HSDatabase) GetNodeByIPAddress(addr netip.Addr) (*types.Node, error) {
+	return GetNodeByIPAddress(hsdb.DB, addr)
+}
+
+// GetNodeByIPAddress finds the [types.Node] holding addr as its IPv4 or IPv6
+// address and returns [ErrNodeNotFound] if no node has it. IPv4-mapped IPv6
+// addresses are looked up as IPv4.
+func GetNodeByIPAddress(tx *gorm.DB, addr netip.Addr) (*types.Node, error) {
+	addr = addr.Unmap()
+
+	column := "ipv6"
+	if addr.Is4() {
+		column = "ipv4"
+	}
+
+	node := types.Node{}
+
+	err := preloadNode(tx).
+		Where(column+" = ?", addr.String()).
+		First(&node).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return nil, ErrNodeNotFound
+		}
+
+		return nil, err
+	}
+
+	return &node, nil
+}
+
+func (hsdb *HSDatabase) GetNodeByGivenName(givenName string) (*types.Node, error) {
+	return GetNodeByGivenName(hsdb.DB, givenName)
+}
+
+// GetNodeByGivenName finds the [types.Node] with the given name, compared
+// case-insensitively as DNS names are, and returns [ErrNodeNotFound] if no
+// node has it. Given names are meant to be unique, but rows written before
+// that was enforced can still share one; [ErrNodeNameNotUnique] is returned
+// rather than picking one of them.
+func GetNodeByGivenName(tx *gorm.DB, givenName string) (*types.Node, error) {
+	var nodes types.Nodes
+
+	err := preloadNode(tx).
+		Where("LOWER(given_name) = ?", strings.ToLower(givenName)).
+		Order("id").Limit(2).Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	switch len(nodes) {
+	case 0:
+		return nil, fmt.Errorf("%w: %q", ErrNodeNotFound, givenName)
+	case 1:
+		return nodes[0], nil
+	default:
+		return nil, fmt.Errorf("%w: %q is used by nodes %d and %d",
+			ErrNodeNameNotUnique, givenName, nodes[0].ID, nodes[1].ID)
+	}
+}
+
+func (hsdb *HSDatabase) GetNodesByPrefix(prefix netip.Prefix) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return GetNodesByPrefix(rx, prefix)
+	})
+}
+
+// GetNodesByPrefix returns the nodes with an IPv4 or IPv6 address inside
+// prefix, ordered by ID.
+func GetNodesByPrefix(tx *gorm.DB, prefix netip.Prefix) (types.Nodes, error) {
+	prefix = prefix.Masked()
+
+	return filterNodes(tx, func(node *types.Node) bool {
+		return slices.ContainsFunc(node.IPs(), prefix.Contains)
+	})
+}
+
+func (hsdb *HSDatabase) CountNodeRoutes(nodeID types.NodeID) (int, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (int, error) {
+		return CountNodeRoutes(rx, nodeID)
+	})
+}
+
+// CountNodeRoutes returns how many routes the node advertises in its stored
+// Hostinfo, approved or not.
+func CountNodeRoutes(tx *gorm.DB, nodeID types.NodeID) (int, error) {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return 0, err
+	}
+
+	return len(node.AnnouncedRoutes()), nil
+}
+
+func (hsdb *HSDatabase) GetNodeByNodeKey(nodeKey key.NodePublic) (*types.Node, error) {
+	return GetNodeByNodeKey(hsdb.DB, nodeKey)
+}
+
+// GetNodeByNodeKey finds a [types.Node] by its [key.NodePublic] and returns the [types.Node] struct.
+func GetNodeByNodeKey(
+	tx *gorm.DB,
+	nodeKey key.NodePublic,
+) (*types.Node, error) {
+	mach := types.Node{}
+	if result := preloadNode(tx).
+		First(&mach, "node_key = ?", nodeKey.String()); result.Error != nil {
+		return nil, result.Error
+	}
+
+	return &mach, nil
+}
+
+// SetLastSeen sets a node's last seen field indicating that we
+// have recently communicating with this node.
+func (hsdb *HSDatabase) SetLastSeen(nodeID types.NodeID, lastSeen time.Time) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetLastSeen(tx, nodeID, lastSeen)
+	})
+}
+
+// SetLastSeen sets a node's last seen field indicating that we
+// have recently communicating with this node.
+func SetLastSeen(tx *gorm.DB, nodeID types.NodeID, lastSeen time.Time) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("last_seen", lastSeen).Error
+}
+
+// setLastSeenBatchSize caps the nodes written per statement in
+// [SetLastSeenBatch]; each takes three bind parameters and SQLite limits
+// how many a statement may have.
+const setLastSeenBatchSize = 1000
+
+func (hsdb *HSDatabase) SetLastSeenBatch(seen map[types.NodeID]time.Time) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetLastSeenBatch(tx, seen)
+	})
+}
+
+// SetLastSeenBatch sets the last seen time of many nodes with one CASE
+// update per [setLastSeenBatchSize] nodes instead of one per node. Only
+// last_seen is written, not even updated_at. An empty map is a no-op.
+func SetLastSeenBatch(tx *gorm.DB, seen map[types.NodeID]time.Time) error {
+	ids := slices.Sorted(maps.Keys(seen))
+
+	for chunk := range slices.Chunk(ids, setLastSeenBatchSize) {
+		var expr strings.Builder
+
+		args := make([]any, 0, 2*len(chunk))
+
+		// The ELSE branch never applies given the WHERE clause, but it gives
+		// the CASE the column's type so PostgreSQL accepts the parameters.
+		expr.WriteString("CASE id")
+
+		for _, id := range chunk {
+			expr.WriteString(" WHEN ? THEN ?")
+
+			args = append(args, id, seen[id])
+		}
+
+		expr.WriteString(" ELSE last_seen END")
+
+		err := tx.Model(&types.Node{}).
+			Where("id IN ?", chunk).
+			UpdateColumn("last_seen", gorm.Expr(expr.String(), args...)).Error
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) RecordConnect(nodeID types.NodeID, handshake time.Time) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return RecordConnect(tx, nodeID, handshake)
+	})
+}
+
+// RecordConnect records when a node last completed the Noise handshake with
+// headscale and, if it has none yet, uses the same time as its first seen
+// time, so the first connection always wins. It is a single UPDATE, as it
+// runs on every poll connect. Only last_handshake and first_seen are
+// written, so last_seen and updated_at are left as they are.
+func RecordConnect(tx *gorm.DB, nodeID types.NodeID, handshake time.Time) error {
+	return tx.Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		UpdateColumns(map[string]any{
+			"last_handshake": handshake,
+			"first_seen":     gorm.Expr("COALESCE(first_seen, ?)", handshake),
+		}).Error
+}
+
+func (hsdb *HSDatabase) ListNodesWithoutRecentHandshake(threshold time.Duration) (types.Nodes, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
+		return ListNodesWithoutRecentHandshake(rx, threshold)
+	})
+}
+
+// ListNodesWithoutRecentHandshake returns the nodes that have not completed
+// a handshake with headscale within threshold, including nodes that never
+// did, ordered by ID. It is meant for troubleshooting connectivity.
+func ListNodesWithoutRecentHandshake(tx *gorm.DB, threshold time.Duration) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).
+		Where("(last_handshake IS NULL OR last_handshake < ?)", time.Now().Add(-threshold)).
+		Order("id").
+		Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
+}
+
+func (hsdb *HSDatabase) NodeOnboardingLatency(nodeID types.NodeID) (time.Duration, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (time.Duration, error) {
+		return NodeOnboardingLatency(rx, nodeID)
+	})
+}
+
+// NodeOnboardingLatency returns how long a node took from registering to
+// its first connection, or [ErrNodeNeverConnected] if it has not connected
+// yet.
+func NodeOnboardingLatency(tx *gorm.DB, nodeID types.NodeID) (time.Duration, error) {
+	var node types.Node
+
+	err := tx.Select("id", "created_at", "first_seen").
+		First(&node, "id = ?", nodeID).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if node.FirstSeen == nil {
+		return 0, fmt.Errorf("%w: %d", ErrNodeNeverConnected, nodeID)
+	}
+
+	return node.FirstSeen.Sub(node.CreatedAt), nil
+}
+
+func (hsdb *HSDatabase) AverageOnboardingLatency(since time.Time) (time.Duration, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (time.Duration, error) {
+		return AverageOnboardingLatency(rx, since)
+	})
+}
+
+// AverageOnboardingLatency returns the mean onboarding latency of the nodes
+// registered at or after since that have connected. It is zero when no such
+// node exists.
+func AverageOnboardingLatency(tx *gorm.DB, since time.Time) (time.Duration, error) {
+	var nodes []types.Node
+
+	err := tx.Select("id", "created_at", "first_seen").Scopes(notDeleted).
+		Where("created_at >= ? AND first_seen IS NOT NULL", since).
+		Find(&nodes).Error
+	if err != nil {
+		return 0, err
+	}
+
+	if len(nodes) == 0 {
+		return 0, nil
+	}
+
+	var total time.Duration
+	for _, node := range nodes {
+		total += node.FirstSeen.Sub(node.CreatedAt)
+	}
+
+	return total / time.Duration(len(nodes)), nil
+}
+
+// RenameNode takes a [types.Node] struct and a new [types.Node.GivenName] for the nodes
+// and renames it, returning the updated node. Given names must be unique across all
+// users, as MagicDNS resolves them without the owner. Validation should be done in
+// the state layer before calling this function.
+func RenameNode(tx *gorm.DB,
+	nodeID types.NodeID, newName string,
+) (*types.Node, error) {
+	err := dnsname.ValidLabel(newName)
+	if err != nil {
+		return nil, fmt.Errorf("renaming node: %w", err)
+	}
+
+	// Check if the new name is unique. DNS names are case-insensitive, so
+	// "Laptop" collides with "laptop".
+	var holder types.Node
+
+	err = tx.Select("id").
+		Where("LOWER(given_name) = LOWER(?) AND id != ?", newName, nodeID).
+		Limit(1).Find(&holder).Error
+	if err != nil {
+		return nil, fmt.Errorf("checking name uniqueness: %w", err)
+	}
+
+	if holder.ID != 0 {
+		return nil, fmt.Errorf("%w: %q is already used by node %d",
+			ErrNodeNameNotUnique, newName, holder.ID)
+	}
+
+	// An admin-chosen name is its own base: it never carries a collision suffix.
+	err = tx.Model(&types.Node{}).Where("id = ?", nodeID).Updates(map[string]any{
+		"given_name":      newName,
+		"given_name_base": newName,
+	}).Error
+	if err != nil {
+		return nil, fmt.Errorf("renaming node in database: %w", err)
+	}
+
+	return GetNodeByID(tx, nodeID)
+}
+
+// ReassignNodes moves every node owned by fromUserID to toUserID with a
+// single UPDATE and returns how many nodes moved. Validation should be done
+// in the state layer before calling this function.
+func ReassignNodes(tx *gorm.DB, fromUserID, toUserID types.UserID) (int64, error) {
+	result := tx.Model(&types.Node{}).
+		Where("user_id = ? AND deleted_at IS NULL", fromUserID).
+		Update("user_id", toUserID)
+	if result.Error != nil {
+		return 0, fmt.Errorf("reassigning nodes in database: %w", result.Error)
+	}
+
+	return result.RowsAffected, nil
+}
+
+// givenNameBase recovers the base a stored given name was derived from. A name
+// that is the sanitised hostname followed by a numeric "-N" collision suffix
+// has the sanitised hostname as its base; any other name is its own base.
+func givenNameBase(givenName, hostname string) string {
+	sanitised := cmp.Or(dnsname.SanitizeHostname(hostname), "node")
+
+	suffix, ok := strings.CutPrefix(givenName, sanitised+"-")
+	if !ok {
+		return givenName
+	}
+
+	_, err := strconv.Atoi(suffix)
+	if err != nil {
+		return givenName
+	}
+
+	return sanitised
+}
+
+func (hsdb *HSDatabase) SetRoutePriority(nodeID types.NodeID, priority int) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetRoutePriority(tx, nodeID, priority)
+	})
 }
 
-func (hsdb *HSDatabase) ListEphemeralNodes() (types.Nodes, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (types.Nodes, error) {
-		nodes := types.Nodes{}
+// SetRoutePriority sets the priority a node has in primary route election
+// for the subnet routes it advertises. Primaries are elected at runtime, so
+// a running server picks it up through [state.State.SetRoutePriority].
+func SetRoutePriority(tx *gorm.DB, nodeID types.NodeID, priority int) error {
+	result := tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("route_priority", priority)
+	if result.Error != nil {
+		return result.Error
+	}
 
-		err := rx.Joins("AuthKey").Where(`"AuthKey"."ephemeral" = true`).Find(&nodes).Error
-		if err != nil {
-			return nil, err
-		}
+	if result.RowsAffected == 0 {
+		return ErrNodeNotFound
+	}
 
-		return nodes, nil
-	})
+	return nil
 }
 
-func (hsdb *HSDatabase) getNode(uid types.UserID, name string) (*types.Node, error) {
-	return Read(hsdb.DB, func(rx *gorm.DB) (*types.Node, error) {
-		return getNode(rx, uid, name)
+func (hsdb *HSDatabase) NodeSetExpiry(nodeID types.NodeID, expiry *time.Time) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return NodeSetExpiry(tx, nodeID, expiry)
 	})
 }
 
-// getNode finds a [types.Node] by name and user and returns the [types.Node] struct.
-func getNode(tx *gorm.DB, uid types.UserID, name string) (*types.Node, error) {
-	uidPtr := uint(uid)
+// NodeSetExpiry sets a new expiry time for a node.
+// If expiry is nil, the node's expiry is disabled (node will never expire).
+func NodeSetExpiry(tx *gorm.DB, nodeID types.NodeID, expiry *time.Time) error {
+	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("expiry", expiry).Error
+}
 
-	node := types.Node{}
+func (hsdb *HSDatabase) CountNodesByRegisterMethod() (map[string]int64, error) {
+	return Read(hsdb.DB, CountNodesByRegisterMethod)
+}
 
-	err := preloadNode(tx).
-		Where(&types.Node{UserID: &uidPtr, Hostname: name}).
-		First(&node).Error
+// CountNodesByRegisterMethod counts nodes per registration method without
+// loading them. Nodes with no recorded method are counted under "", so the
+// counts add up to the number of nodes [ListNodes] returns.
+func CountNodesByRegisterMethod(tx *gorm.DB) (map[string]int64, error) {
+	var rows []struct {
+		Method string
+		Count  int64
+	}
+
+	err := tx.Model(&types.Node{}).Scopes(notDeleted).
+		Select("COALESCE(register_method, '') AS method, COUNT(*) AS count").
+		Group("COALESCE(register_method, '')").
+		Scan(&rows).Error
 	if err != nil {
-		if errors.Is(err, gorm.ErrRecordNotFound) {
-			return nil, ErrNodeNotFound
-		}
+		return nil, fmt.Errorf("counting nodes by register method: %w", err)
+	}
 
-		return nil, err
+	counts := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.Method] = row.Count
 	}
 
-	return &node, nil
+	return counts, nil
 }
 
-func (hsdb *HSDatabase) GetNodeByID(id types.NodeID) (*types.Node, error) {
-	return GetNodeByID(hsdb.DB, id)
+func (hsdb *HSDatabase) ExpireNodesByRegisterMethod(
+	method string,
+	expiry time.Time,
+) ([]types.NodeID, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		return ExpireNodesByRegisterMethod(tx, method, expiry)
+	})
 }
 
-// GetNodeByID finds a [types.Node] by ID and returns the [types.Node] struct.
-func GetNodeByID(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
-	mach := types.Node{}
-	if result := preloadNode(tx).
-		First(&mach, "id = ?", id); result.Error != nil {
-		return nil, result.Error
+// ExpireNodesByRegisterMethod sets expiry on every node registered with
+// method (one of the util.RegisterMethod constants) that is not already
+// expired by then, forcing them to re-authenticate, and returns their IDs.
+func ExpireNodesByRegisterMethod(
+	tx *gorm.DB,
+	method string,
+	expiry time.Time,
+) ([]types.NodeID, error) {
+	switch method {
+	case util.RegisterMethodAuthKey, util.RegisterMethodOIDC, util.RegisterMethodCLI:
+	default:
+		return nil, fmt.Errorf("%w: %q", ErrInvalidRegisterMethod, method)
 	}
 
-	return &mach, nil
-}
+	var nodeIDs []types.NodeID
 
-func (hsdb *HSDatabase) GetNodeByNodeKey(nodeKey key.NodePublic) (*types.Node, error) {
-	return GetNodeByNodeKey(hsdb.DB, nodeKey)
-}
+	err := tx.Model(&types.Node{}).Scopes(notDeleted).
+		Where("register_method = ? AND (expiry IS NULL OR expiry > ?)", method, expiry).
+		Order("id").
+		Pluck("id", &nodeIDs).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes registered via %s: %w", method, err)
+	}
 
-// GetNodeByNodeKey finds a [types.Node] by its [key.NodePublic] and returns the [types.Node] struct.
-func GetNodeByNodeKey(
-	tx *gorm.DB,
-	nodeKey key.NodePublic,
-) (*types.Node, error) {
-	mach := types.Node{}
-	if result := preloadNode(tx).
-		First(&mach, "node_key = ?", nodeKey.String()); result.Error != nil {
-		return nil, result.Error
+	if len(nodeIDs) == 0 {
+		return nil, nil
 	}
 
-	return &mach, nil
+	err = tx.Model(&types.Node{}).
+		Where("id IN ?", nodeIDs).
+		Update("expiry", expiry).Error
+	if err != nil {
+		return nil, fmt.Errorf("expiring nodes registered via %s: %w", method, err)
+	}
+
+	return nodeIDs, nil
 }
 
-// SetLastSeen sets a node's last seen field indicating that we
-// have recently communicating with this node.
-func (hsdb *HSDatabase) SetLastSeen(nodeID types.NodeID, lastSeen time.Time) error {
+func (hsdb *HSDatabase) PurgeNode(node *types.Node) error {
 	return hsdb.Write(func(tx *gorm.DB) error {
-		return SetLastSeen(tx, nodeID, lastSeen)
+		return PurgeNode(tx, node)
 	})
 }
 
-// SetLastSeen sets a node's last seen field indicating that we
-// have recently communicating with this node.
-func SetLastSeen(tx *gorm.DB, nodeID types.NodeID, lastSeen time.Time) error {
-	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("last_seen", lastSeen).Error
-}
-
-// RenameNode takes a [types.Node] struct and a new [types.Node.GivenName] for the nodes
-// and renames it. Validation should be done in the state layer before calling this function.
-func RenameNode(tx *gorm.DB,
-	nodeID types.NodeID, newName string,
+// PurgeNode removes a [types.Node] from the database for good, soft-deleted
+// or not. It does not touch the NodeStore or notify peers; use
+// State.PurgeNode, which does both and returns the change to send.
+func PurgeNode(tx *gorm.DB,
+	node *types.Node,
 ) error {
-	err := dnsname.ValidLabel(newName)
+	// Unscoped causes the node to be fully removed from the database.
+	err := tx.Unscoped().Delete(&types.Node{}, node.ID).Error
 	if err != nil {
-		return fmt.Errorf("renaming node: %w", err)
+		return err
 	}
 
-	// Check if the new name is unique
-	var count int64
+	return nil
+}
 
-	if err := tx.Model(&types.Node{}).Where("given_name = ? AND id != ?", newName, nodeID).Count(&count).Error; err != nil { //nolint:noinlineerr
-		return fmt.Errorf("checking name uniqueness: %w", err)
-	}
+func (hsdb *HSDatabase) SoftDeleteNode(nodeID types.NodeID) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SoftDeleteNode(tx, nodeID)
+	})
+}
 
-	if count > 0 {
-		return ErrNodeNameNotUnique
+// SoftDeleteNode marks a node deleted without removing its row, so it can be
+// brought back with [RestoreNode]. Soft-deleted nodes are left out of all
+// node queries except [ListSoftDeletedNodes], but keep their addresses
+// reserved. [PurgeNode] removes a node for good, soft-deleted or not.
+func SoftDeleteNode(tx *gorm.DB, nodeID types.NodeID) error {
+	res := tx.Model(&types.Node{}).
+		Where("id = ? AND deleted_at IS NULL", nodeID).
+		UpdateColumn("deleted_at", time.Now())
+	if res.Error != nil {
+		return res.Error
 	}
 
-	if err := tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("given_name", newName).Error; err != nil { //nolint:noinlineerr
-		return fmt.Errorf("renaming node in database: %w", err)
+	if res.RowsAffected == 0 {
+		return fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
 	}
 
 	return nil
 }
 
-func (hsdb *HSDatabase) NodeSetExpiry(nodeID types.NodeID, expiry *time.Time) error {
-	return hsdb.Write(func(tx *gorm.DB) error {
-		return NodeSetExpiry(tx, nodeID, expiry)
-	})
+// RestoreNode undoes [SoftDeleteNode] and returns the restored node. A node
+// that is not soft-deleted is reported as [ErrNodeNotFound].
+func RestoreNode(tx *gorm.DB, nodeID types.NodeID) (*types.Node, error) {
+	res := tx.Model(&types.Node{}).
+		Where("id = ? AND deleted_at IS NOT NULL", nodeID).
+		UpdateColumn("deleted_at", nil)
+	if res.Error != nil {
+		return nil, res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return nil, fmt.Errorf("%w: no soft-deleted node %d", ErrNodeNotFound, nodeID)
+	}
+
+	return GetNodeByID(tx, nodeID)
 }
 
-// NodeSetExpiry sets a new expiry time for a node.
-// If expiry is nil, the node's expiry is disabled (node will never expire).
-func NodeSetExpiry(tx *gorm.DB, nodeID types.NodeID, expiry *time.Time) error {
-	return tx.Model(&types.Node{}).Where("id = ?", nodeID).Update("expiry", expiry).Error
+func (hsdb *HSDatabase) ListSoftDeletedNodes() (types.Nodes, error) {
+	return Read(hsdb.DB, ListSoftDeletedNodes)
+}
+
+// ListSoftDeletedNodes returns the soft-deleted nodes, ordered by ID.
+func ListSoftDeletedNodes(tx *gorm.DB) (types.Nodes, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNodeWithDeleted(tx).
+		Where("deleted_at IS NOT NULL").
+		Order("id").Find(&nodes).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return nodes, nil
 }
 
-func (hsdb *HSDatabase) DeleteNode(node *types.Node) error {
+func (hsdb *HSDatabase) DeleteNodes(nodeIDs []types.NodeID) error {
 	return hsdb.Write(func(tx *gorm.DB) error {
-		return DeleteNode(tx, node)
+		return DeleteNodes(tx, nodeIDs)
 	})
 }
 
-// DeleteNode deletes a [types.Node] from the database.
-// Caller is responsible for notifying all of change.
-func DeleteNode(tx *gorm.DB,
-	node *types.Node,
-) error {
-	// Unscoped causes the node to be fully removed from the database.
-	err := tx.Unscoped().Delete(&types.Node{}, node.ID).Error
-	if err != nil {
-		return err
+// DeleteNodes deletes all given nodes from the database in one statement.
+// Routes are stored on the node rows, so they go with them. Like
+// [PurgeNode] it leaves notifying peers to State.DeleteNodes.
+func DeleteNodes(tx *gorm.DB, nodeIDs []types.NodeID) error {
+	if len(nodeIDs) == 0 {
+		return nil
 	}
 
-	return nil
+	return tx.Unscoped().Where("id IN ?", nodeIDs).Delete(&types.Node{}).Error
 }
 
 // DeleteEphemeralNode deletes a [types.Node] from the database, note that this method
@@ -256,6 +1475,27 @@ func (hsdb *HSDatabase) DeleteEphemeralNode(
 	})
 }
 
+// RegisterNode saves a new node within tx. A user-owned node is refused with
+// [ErrUserNodeLimitReached] when its user already owns as many nodes as
+// allowed; see [CheckUserNodeLimit]. The node is saved with the given name it
+// carries: collisions are resolved when it is added to the NodeStore, which
+// the caller writes back.
+func RegisterNode(tx *gorm.DB, node *types.Node) error {
+	if node.UserID != nil {
+		err := CheckUserNodeLimit(tx, types.UserID(*node.UserID))
+		if err != nil {
+			return err
+		}
+	}
+
+	err := tx.Save(node).Error
+	if err != nil {
+		return fmt.Errorf("saving node: %w", err)
+	}
+
+	return nil
+}
+
 // RegisterNodeForTest is used only for testing purposes to register a node directly in the database.
 // Production code should use [state.State.HandleNodeFromAuthPath] or [state.State.HandleNodeFromPreAuthKey].
 func RegisterNodeForTest(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *netip.Addr) (*types.Node, error) {
@@ -301,6 +1541,8 @@ func RegisterNodeForTest(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *n
 		}
 	}
 
+	node.UpdateClientInfo()
+
 	// If the node exists and it already has IP(s), we just save it
 	// so we store the node.Expire and node.Nodekey that has been set when
 	// adding it to the registrationCache
@@ -315,10 +1557,9 @@ func RegisterNodeForTest(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *n
 			Str(zf.NodeHostname, node.Hostname).
 			Str(zf.MachineKey, node.MachineKey.ShortString()).
 			Str(zf.NodeKey, node.NodeKey.ShortString()).
-			Str(zf.UserName, node.User.Username()).
 			Msg("Test node authorized again")
 
-		return &node, nil
+		return readBackRegisteredNode(tx, node.ID)
 	}
 
 	node.IPv4 = ipv4
@@ -331,6 +1572,10 @@ func RegisterNodeForTest(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *n
 		}
 	}
 
+	if node.GivenNameBase == "" {
+		node.GivenNameBase = node.GivenName
+	}
+
 	if err := tx.Save(&node).Error; err != nil { //nolint:noinlineerr
 		return nil, fmt.Errorf("saving node to database: %w", err)
 	}
@@ -340,14 +1585,43 @@ func RegisterNodeForTest(tx *gorm.DB, node types.Node, ipv4 *netip.Addr, ipv6 *n
 		Str(zf.NodeHostname, node.Hostname).
 		Msg("Test node registered with the database")
 
-	return &node, nil
+	return readBackRegisteredNode(tx, node.ID)
+}
+
+// readBackRegisteredNode re-reads a node just saved by [RegisterNodeForTest]
+// so callers get its associations (User, AuthKey) loaded, whatever subset of
+// them the caller filled in.
+func readBackRegisteredNode(tx *gorm.DB, id types.NodeID) (*types.Node, error) {
+	node, err := GetNodeByID(tx, id)
+	if err != nil {
+		return nil, fmt.Errorf("reading back registered node: %w", err)
+	}
+
+	return node, nil
 }
 
 // NodeSetNodeKey sets the node key of a node and saves it to the database.
+// The keys it replaces are appended to the node's key history in the same
+// transaction, so the history cannot drift from the node row. Setting the
+// current key again changes nothing.
 func NodeSetNodeKey(tx *gorm.DB, node *types.Node, nodeKey key.NodePublic) error {
-	return tx.Model(node).Updates(types.Node{
+	prev, err := currentNodeKeys(tx, node.ID)
+	if err != nil {
+		return err
+	}
+
+	if prev.NodeKey == nodeKey {
+		return nil
+	}
+
+	err = tx.Model(node).Updates(types.Node{
 		NodeKey: nodeKey,
 	}).Error
+	if err != nil {
+		return err
+	}
+
+	return appendNodeKeyHistory(tx, prev, types.NodeKeyHistoryNodeKeyChanged)
 }
 
 func (hsdb *HSDatabase) NodeSetMachineKey(
@@ -359,15 +1633,229 @@ func (hsdb *HSDatabase) NodeSetMachineKey(
 	})
 }
 
-// NodeSetMachineKey sets the node key of a node and saves it to the database.
+// NodeSetMachineKey sets the machine key of a node and saves it to the
+// database, recording the keys it replaces in the same transaction like
+// [NodeSetNodeKey]. Setting the current key again changes nothing.
 func NodeSetMachineKey(
 	tx *gorm.DB,
 	node *types.Node,
 	machineKey key.MachinePublic,
 ) error {
-	return tx.Model(node).Updates(types.Node{
+	prev, err := currentNodeKeys(tx, node.ID)
+	if err != nil {
+		return err
+	}
+
+	if prev.MachineKey == machineKey {
+		return nil
+	}
+
+	err = tx.Model(node).Updates(types.Node{
 		MachineKey: machineKey,
 	}).Error
+	if err != nil {
+		return err
+	}
+
+	return appendNodeKeyHistory(tx, prev, types.NodeKeyHistoryMachineKeyChanged)
+}
+
+// RecordNodeKeyChange appends the keys stored for node to its key history if
+// node carries a different machine or node key, recording a machine key
+// change when both differ. Call it in the transaction that writes node,
+// before the write, so every path that replaces a key leaves the same trail.
+// A node that is not stored yet has no history to record.
+func RecordNodeKeyChange(tx *gorm.DB, node *types.Node) error {
+	prev, err := currentNodeKeys(tx, node.ID)
+	if errors.Is(err, ErrNodeNotFound) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case prev.MachineKey != node.MachineKey:
+		return appendNodeKeyHistory(tx, prev, types.NodeKeyHistoryMachineKeyChanged)
+	case prev.NodeKey != node.NodeKey:
+		return appendNodeKeyHistory(tx, prev, types.NodeKeyHistoryNodeKeyChanged)
+	}
+
+	return nil
+}
+
+// currentNodeKeys reads the machine and node key stored for nodeID.
+func currentNodeKeys(tx *gorm.DB, nodeID types.NodeID) (*types.Node, error) {
+	var node types.Node
+
+	err := tx.Select("id", "machine_key", "node_key").
+		Where("id = ?", nodeID).
+		Take(&node).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, ErrNodeNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &node, nil
+}
+
+// appendNodeKeyHistory records the keys prev held before a change.
+func appendNodeKeyHistory(tx *gorm.DB, prev *types.Node, reason string) error {
+	err := tx.Create(&types.NodeKeyHistory{
+		NodeID:     prev.ID,
+		MachineKey: prev.MachineKey,
+		NodeKey:    prev.NodeKey,
+		Reason:     reason,
+		ChangedAt:  time.Now(),
+	}).Error
+	if err != nil {
+		return fmt.Errorf("recording key history of node %d: %w", prev.ID, err)
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) GetNodeKeyHistory(nodeID types.NodeID) ([]types.NodeKeyHistory, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) ([]types.NodeKeyHistory, error) {
+		return GetNodeKeyHistory(rx, nodeID)
+	})
+}
+
+// GetNodeKeyHistory returns the key history of a node, oldest change first.
+// It is empty for a node whose keys never changed.
+func GetNodeKeyHistory(tx *gorm.DB, nodeID types.NodeID) ([]types.NodeKeyHistory, error) {
+	var history []types.NodeKeyHistory
+
+	err := tx.Where("node_id = ?", nodeID).
+		Order("changed_at, id").
+		Find(&history).Error
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// ValidateNodeDescription checks that desc fits in
+// [MaxNodeDescriptionLength] characters.
+func ValidateNodeDescription(desc string) error {
+	if n := utf8.RuneCountInString(desc); n > MaxNodeDescriptionLength {
+		return fmt.Errorf("%w: %d characters, at most %d allowed",
+			ErrNodeDescriptionTooLong, n, MaxNodeDescriptionLength)
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) SetNodeDescription(nodeID types.NodeID, desc string) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetNodeDescription(tx, nodeID, desc)
+	})
+}
+
+// SetNodeDescription stores the operator description of a node. An empty
+// desc clears it.
+func SetNodeDescription(tx *gorm.DB, nodeID types.NodeID, desc string) error {
+	err := ValidateNodeDescription(desc)
+	if err != nil {
+		return err
+	}
+
+	result := tx.Model(&types.Node{}).
+		Where("id = ?", nodeID).
+		Update("description", desc)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrNodeNotFound
+	}
+
+	return nil
+}
+
+func (hsdb *HSDatabase) GetNodeDescription(nodeID types.NodeID) (string, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (string, error) {
+		return GetNodeDescription(rx, nodeID)
+	})
+}
+
+// GetNodeDescription returns the operator description of a node, empty if
+// none is set.
+func GetNodeDescription(tx *gorm.DB, nodeID types.NodeID) (string, error) {
+	var node types.Node
+
+	err := tx.Select("id", "description").
+		Where("id = ?", nodeID).
+		Take(&node).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return "", ErrNodeNotFound
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	return node.Description, nil
+}
+
+func (hsdb *HSDatabase) ReconcileNodeUserAssociations() ([]types.NodeID, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		return ReconcileNodeUserAssociations(tx)
+	})
+}
+
+// ReconcileNodeUserAssociations repairs nodes whose user_id disagrees with
+// their preloaded [types.User] and ownership. Tagged nodes are owned by their
+// tags, so a leftover user_id is cleared. User-owned nodes whose user_id is
+// missing or no longer resolves to a user (e.g. after a manual edit) are
+// re-homed to the owner of their pre-auth key when there is one; nodes
+// without a recoverable owner are logged and left untouched.
+// It returns the IDs of the nodes that were changed.
+func ReconcileNodeUserAssociations(tx *gorm.DB) ([]types.NodeID, error) {
+	nodes, err := ListNodes(tx)
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	var fixed []types.NodeID
+
+	for _, node := range nodes {
+		var userID *uint
+
+		switch {
+		case node.IsTagged():
+			if node.UserID == nil {
+				continue
+			}
+			// Leave userID nil: tagged nodes are owned by their tags.
+		case node.UserID != nil && node.User != nil && node.User.ID == *node.UserID:
+			continue
+		case node.AuthKey != nil && node.AuthKey.User != nil:
+			userID = &node.AuthKey.User.ID
+		default:
+			log.Warn().
+				Uint64(zf.NodeID, node.ID.Uint64()).
+				Str(zf.NodeHostname, node.Hostname).
+				Msg("node has no valid user and no pre-auth key owner to recover from, reassign it manually")
+
+			continue
+		}
+
+		err := tx.Model(&types.Node{}).Where("id = ?", node.ID).Update("user_id", userID).Error
+		if err != nil {
+			return nil, fmt.Errorf("reconciling user of node %d: %w", node.ID, err)
+		}
+
+		fixed = append(fixed, node.ID)
+	}
+
+	return fixed, nil
 }
 
 // EphemeralGarbageCollector is a garbage collector that will delete nodes after
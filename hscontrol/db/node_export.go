@@ -0,0 +1,116 @@
+package db
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/netip"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+// NodeManifestVersion is the version of the [NodeManifest] format written
+// by this release. It is bumped whenever a change to the format would make
+// an older release read a manifest wrongly.
+const NodeManifestVersion = 1
+
+var ErrNodeManifestVersion = errors.New("unsupported node manifest version")
+
+// NodeExport is a node as written by [ExportNodes]. It is the format
+// [ImportNodes] reads, so an export can be imported again as is.
+type NodeExport = NodeImport
+
+// NodeManifest is the versioned document nodes are exported to and
+// imported from.
+type NodeManifest struct {
+	Version int          `json:"version"`
+	Nodes   []NodeExport `json:"nodes"`
+}
+
+func (hsdb *HSDatabase) ExportNodes() (NodeManifest, error) {
+	return Read(hsdb.DB, ExportNodes)
+}
+
+// ExportNodes returns every node, ordered by ID, in a [NodeManifest] of the
+// current [NodeManifestVersion], in the form [ImportNodeManifest] reads: keys
+// and addresses as text, the owner by user name and the routes the node
+// announces and has approved. Runtime state such as endpoints or last seen
+// is left out.
+func ExportNodes(tx *gorm.DB) (NodeManifest, error) {
+	nodes := types.Nodes{}
+
+	err := preloadNode(tx).Order("id").Find(&nodes).Error
+	if err != nil {
+		return NodeManifest{}, err
+	}
+
+	exported := make([]NodeExport, 0, len(nodes))
+
+	for _, node := range nodes {
+		entry := NodeExport{
+			Hostname:        node.Hostname,
+			MachineKey:      node.MachineKey.String(),
+			NodeKey:         node.NodeKey.String(),
+			Tags:            slices.Clone(node.Tags),
+			Expiry:          node.Expiry,
+			AnnouncedRoutes: slices.Clone(node.AnnouncedRoutes()),
+			ApprovedRoutes:  slices.Clone(node.ApprovedRoutes),
+		}
+
+		if node.User != nil {
+			entry.User = node.User.Name
+		}
+
+		if node.IPv4 != nil {
+			entry.IPv4 = node.IPv4.String()
+		}
+
+		if node.IPv6 != nil {
+			entry.IPv6 = node.IPv6.String()
+		}
+
+		exported = append(exported, entry)
+	}
+
+	return NodeManifest{Version: NodeManifestVersion, Nodes: exported}, nil
+}
+
+// ImportNodeManifest is [ImportNodes] for a whole [NodeManifest]. It rejects
+// a manifest written in a version this release does not understand with
+// [ErrNodeManifestVersion] before importing anything.
+func ImportNodeManifest(tx *gorm.DB, manifest NodeManifest, ipPrefixes []netip.Prefix) (types.Nodes, error) {
+	err := checkNodeManifestVersion(manifest.Version)
+	if err != nil {
+		return nil, err
+	}
+
+	return ImportNodes(tx, manifest.Nodes, ipPrefixes)
+}
+
+// ParseNodeManifest decodes a [NodeManifest], rejecting one written in a
+// version this release does not understand.
+func ParseNodeManifest(data []byte) (NodeManifest, error) {
+	var manifest NodeManifest
+
+	err := json.Unmarshal(data, &manifest)
+	if err != nil {
+		return NodeManifest{}, fmt.Errorf("decoding node manifest: %w", err)
+	}
+
+	err = checkNodeManifestVersion(manifest.Version)
+	if err != nil {
+		return NodeManifest{}, err
+	}
+
+	return manifest, nil
+}
+
+func checkNodeManifestVersion(version int) error {
+	if version != NodeManifestVersion {
+		return fmt.Errorf("%w: %d, want %d", ErrNodeManifestVersion, version, NodeManifestVersion)
+	}
+
+	return nil
+}
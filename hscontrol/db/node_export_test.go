@@ -0,0 +1,95 @@
+package db
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestExportImportRoundTrip(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("exporter")
+	nodes := db.CreateRegisteredNodesForTest(user, 3, "export")
+
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+
+	nodes[0].Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{subnet, tsaddr.AllIPv4()}}
+	nodes[0].ApprovedRoutes = []netip.Prefix{subnet}
+	nodes[1].Tags = []string{"tag:server"}
+	nodes[1].UserID = nil
+	nodes[1].User = nil
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	exported, err := db.ExportNodes()
+	require.NoError(t, err)
+	assert.Equal(t, NodeManifestVersion, exported.Version)
+	require.Len(t, exported.Nodes, 3)
+
+	data, err := json.Marshal(exported)
+	require.NoError(t, err)
+	assert.Contains(t, string(data), `"version":1`, "the manifest carries its version")
+
+	// Wipe the nodes, then import the manifest into the now empty server.
+	require.NoError(t, db.DB.Session(&gorm.Session{AllowGlobalUpdate: true}).
+		Unscoped().Delete(&types.Node{}).Error)
+
+	manifest, err := ParseNodeManifest(data)
+	require.NoError(t, err)
+
+	_, err = Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		return ImportNodeManifest(tx, manifest, importTestPrefixes)
+	})
+	require.NoError(t, err)
+
+	restored, err := db.ExportNodes()
+	require.NoError(t, err)
+	assert.Equal(t, exported, restored)
+
+	imported, err := db.ListNodes()
+	require.NoError(t, err)
+	require.Len(t, imported, 3)
+
+	for i, node := range imported {
+		assert.Equal(t, nodes[i].MachineKey, node.MachineKey)
+		assert.Equal(t, nodes[i].NodeKey, node.NodeKey)
+		assert.Equal(t, nodes[i].IPv4, node.IPv4)
+		assert.Equal(t, nodes[i].IPv6, node.IPv6)
+		assert.Equal(t, nodes[i].UserID, node.UserID)
+		assert.Equal(t, nodes[i].Tags, node.Tags)
+		assert.Equal(t, nodes[i].AnnouncedRoutes(), node.AnnouncedRoutes())
+		assert.Equal(t, nodes[i].ApprovedRoutes, node.ApprovedRoutes)
+	}
+}
+
+func TestParseNodeManifestVersion(t *testing.T) {
+	_, err := ParseNodeManifest([]byte(`{"version": 2, "nodes": []}`))
+	require.ErrorIs(t, err, ErrNodeManifestVersion)
+
+	_, err = ParseNodeManifest([]byte(`{"nodes": []}`))
+	require.ErrorIs(t, err, ErrNodeManifestVersion, "a manifest without a version is rejected")
+
+	manifest, err := ParseNodeManifest([]byte(`{"version": 1, "nodes": [{"hostname": "a"}]}`))
+	require.NoError(t, err)
+	require.Len(t, manifest.Nodes, 1)
+	assert.Equal(t, "a", manifest.Nodes[0].Hostname)
+
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	_, err = Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		return ImportNodeManifest(tx, NodeManifest{Version: NodeManifestVersion + 1}, importTestPrefixes)
+	})
+	require.ErrorIs(t, err, ErrNodeManifestVersion, "importing checks the version too")
+}
@@ -0,0 +1,253 @@
+package db
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/juanfont/headscale/hscontrol/util/zlog/zf"
+	"github.com/rs/zerolog/log"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/util/dnsname"
+)
+
+var (
+	ErrNodeImportInvalid       = errors.New("invalid node import")
+	ErrNodeImportAlreadyExists = errors.New("node already exists")
+)
+
+// NodeImport describes one node of an import manifest, as exported from
+// another control server. A node is owned either by its tags or, when it
+// has none, by User.
+type NodeImport struct {
+	Hostname   string `json:"hostname"`
+	MachineKey string `json:"machine_key"`
+	NodeKey    string `json:"node_key"`
+	User       string `json:"user,omitempty"`
+
+	// IPv4 and IPv6 pin the node to the addresses it held on the previous
+	// server. An address left empty is allocated as for a new node.
+	IPv4 string `json:"ipv4,omitempty"`
+	IPv6 string `json:"ipv6,omitempty"`
+
+	Tags []string `json:"tags,omitempty"`
+
+	// Expiry is the node key expiry. Nodes without one do not expire.
+	Expiry *time.Time `json:"expiry,omitempty"`
+
+	// AnnouncedRoutes seeds the routes the node advertises until it
+	// connects and reports its own; ApprovedRoutes are kept as they are.
+	AnnouncedRoutes []netip.Prefix `json:"announced_routes,omitempty"`
+	ApprovedRoutes  []netip.Prefix `json:"approved_routes,omitempty"`
+}
+
+// ImportNodes registers every node of manifest within tx and returns them
+// in manifest order. Keys are parsed, users resolved by name, and addresses
+// allocated sequentially from ipPrefixes (at most one per family), honouring
+// the pinned ones when they are free. Addresses count as free when no node
+// stored in tx holds them. Nodes whose machine or node key is already
+// registered are rejected.
+//
+// Each node is saved through [RegisterNode], so user node limits apply as
+// for a registration. Unlike a registration, an import keeps the expiry of
+// the manifest instead of applying the key lifetime, and only checks that
+// tags are well formed, not that the policy lets anyone own them. Given
+// names are not deduplicated here; the [state.State] does that when it adds
+// the nodes to its NodeStore.
+//
+// The import is all or nothing: callers run it in [Write], so any error
+// rolls back every node written before it.
+func ImportNodes(tx *gorm.DB, manifest []NodeImport, ipPrefixes []netip.Prefix) (types.Nodes, error) {
+	prefix4, prefix6, err := importPrefixes(ipPrefixes)
+	if err != nil {
+		return nil, err
+	}
+
+	alloc, err := newIPAllocator(tx, prefix4, prefix6, types.IPAllocationStrategySequential)
+	if err != nil {
+		return nil, fmt.Errorf("importing nodes: %w", err)
+	}
+
+	imported := make(types.Nodes, 0, len(manifest))
+
+	for idx, entry := range manifest {
+		node, err := importNode(tx, entry, alloc)
+		if err != nil {
+			return nil, fmt.Errorf("importing node %d (%q): %w", idx, entry.Hostname, err)
+		}
+
+		imported = append(imported, node)
+	}
+
+	log.Info().Int(zf.NodeCount, len(imported)).Msg("Imported nodes")
+
+	return imported, nil
+}
+
+// importPrefixes splits the prefixes an import allocates from by family.
+func importPrefixes(ipPrefixes []netip.Prefix) (*netip.Prefix, *netip.Prefix, error) {
+	var prefix4, prefix6 *netip.Prefix
+
+	for _, prefix := range ipPrefixes {
+		family := &prefix6
+		if prefix.Addr().Is4() {
+			family = &prefix4
+		}
+
+		if *family != nil {
+			return nil, nil, fmt.Errorf("%w: more than one prefix for the family of %s", ErrNodeImportInvalid, prefix)
+		}
+
+		*family = &prefix
+	}
+
+	return prefix4, prefix6, nil
+}
+
+// importNode validates and registers a single node of an import.
+func importNode(tx *gorm.DB, entry NodeImport, alloc *IPAllocator) (*types.Node, error) {
+	if entry.Hostname == "" {
+		return nil, fmt.Errorf("%w: hostname is empty", ErrNodeImportInvalid)
+	}
+
+	var (
+		machineKey key.MachinePublic
+		nodeKey    key.NodePublic
+	)
+
+	err := machineKey.UnmarshalText([]byte(entry.MachineKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing machine key: %w", ErrNodeImportInvalid, err)
+	}
+
+	err = nodeKey.UnmarshalText([]byte(entry.NodeKey))
+	if err != nil {
+		return nil, fmt.Errorf("%w: parsing node key: %w", ErrNodeImportInvalid, err)
+	}
+
+	var existing int64
+
+	err = tx.Model(&types.Node{}).
+		Where("machine_key = ? OR node_key = ?", machineKey.String(), nodeKey.String()).
+		Count(&existing).Error
+	if err != nil {
+		return nil, fmt.Errorf("checking for existing node: %w", err)
+	}
+
+	if existing > 0 {
+		return nil, ErrNodeImportAlreadyExists
+	}
+
+	node := &types.Node{
+		Hostname:       entry.Hostname,
+		GivenName:      dnsname.SanitizeHostname(entry.Hostname),
+		MachineKey:     machineKey,
+		NodeKey:        nodeKey,
+		RegisterMethod: util.RegisterMethodCLI,
+		Expiry:         entry.Expiry,
+		LastSeen:       new(time.Now()),
+		ApprovedRoutes: entry.ApprovedRoutes,
+	}
+	node.GivenNameBase = node.GivenName
+
+	if len(entry.AnnouncedRoutes) > 0 {
+		node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: entry.AnnouncedRoutes}
+	}
+
+	// Tagged nodes are owned by their tags and never expire; a user named
+	// alongside tags is ignored, as for tagged pre auth keys.
+	if len(entry.Tags) > 0 {
+		node.Tags, err = validateACLTags(entry.Tags)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNodeImportInvalid, err)
+		}
+
+		node.Expiry = nil
+	} else {
+		if entry.User == "" {
+			return nil, fmt.Errorf("%w: node has neither a user nor tags", ErrNodeImportInvalid)
+		}
+
+		user, err := importUser(tx, entry.User)
+		if err != nil {
+			return nil, err
+		}
+
+		node.UserID = &user.ID
+		node.User = user
+	}
+
+	node.IPv4, err = importIP(alloc, entry.IPv4, true)
+	if err != nil {
+		return nil, fmt.Errorf("assigning IPv4: %w", err)
+	}
+
+	node.IPv6, err = importIP(alloc, entry.IPv6, false)
+	if err != nil {
+		return nil, fmt.Errorf("assigning IPv6: %w", err)
+	}
+
+	err = RegisterNode(tx, node)
+	if err != nil {
+		return nil, err
+	}
+
+	return node, nil
+}
+
+// importUser resolves the user an imported node belongs to by name.
+func importUser(tx *gorm.DB, name string) (*types.User, error) {
+	users, err := ListUsers(tx, &types.User{Name: name})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(users) == 0 {
+		return nil, fmt.Errorf("%w: %q", ErrUserNotFound, name)
+	}
+
+	if len(users) != 1 {
+		return nil, fmt.Errorf("%w: %q, found %d", ErrUserNotUnique, name, len(users))
+	}
+
+	return &users[0], nil
+}
+
+// importIP returns the pinned address when one is given and free, and
+// otherwise the next free one of the family. It returns nil when the family
+// is not configured and nothing is pinned.
+func importIP(alloc *IPAllocator, pinned string, is4 bool) (*netip.Addr, error) {
+	prefix, prev := alloc.prefix6, &alloc.prev6
+	if is4 {
+		prefix, prev = alloc.prefix4, &alloc.prev4
+	}
+
+	if pinned != "" {
+		ip, err := netip.ParseAddr(pinned)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrNodeImportInvalid, err)
+		}
+
+		if ip.Is4() != is4 {
+			return nil, fmt.Errorf("%w: %s is in the wrong address family", ErrNodeImportInvalid, ip)
+		}
+
+		err = alloc.reserve(ip)
+		if err != nil {
+			return nil, err
+		}
+
+		return &ip, nil
+	}
+
+	if prefix == nil {
+		return nil, nil //nolint:nilnil // family not configured
+	}
+
+	return alloc.allocateNext(prev, prefix)
+}
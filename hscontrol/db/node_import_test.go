@@ -0,0 +1,177 @@
+package db
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/types/key"
+)
+
+func importTestEntry(hostname string) NodeImport {
+	return NodeImport{
+		Hostname:   hostname,
+		MachineKey: key.NewMachine().Public().String(),
+		NodeKey:    key.NewNode().Public().String(),
+	}
+}
+
+var importTestPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("fd7a:115c:a1e0::/48"),
+}
+
+func TestImportNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("importer")
+
+	owned := importTestEntry("owned")
+	owned.User = user.Name
+	owned.IPv4 = "100.64.0.10"
+
+	tagged := importTestEntry("tagged")
+	tagged.Tags = []string{"tag:server", "tag:server"}
+
+	imported, err := Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		return ImportNodes(tx, []NodeImport{owned, tagged}, importTestPrefixes)
+	})
+	require.NoError(t, err)
+	require.Len(t, imported, 2)
+
+	stored, err := db.ListNodes()
+	require.NoError(t, err)
+	require.Len(t, stored, 2)
+
+	got := stored[0]
+	assert.Equal(t, "owned", got.Hostname)
+	assert.Equal(t, "owned", got.GivenName)
+	assert.Equal(t, owned.MachineKey, got.MachineKey.String())
+	assert.Equal(t, owned.NodeKey, got.NodeKey.String())
+	require.NotNil(t, got.UserID)
+	assert.Equal(t, user.ID, *got.UserID)
+	assert.Equal(t, "100.64.0.10", got.IPv4.String())
+	assert.NotNil(t, got.IPv6, "an address that is not pinned is allocated")
+
+	got = stored[1]
+	assert.Equal(t, "tagged", got.Hostname)
+	assert.Nil(t, got.UserID, "tagged nodes are owned by their tags")
+	assert.Equal(t, types.Strings{"tag:server"}, got.Tags)
+	assert.NotNil(t, got.IPv4)
+	assert.NotEqual(t, "100.64.0.10", got.IPv4.String())
+
+	// A node that is already registered cannot be imported again.
+	_, err = Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		return ImportNodes(tx, []NodeImport{owned}, importTestPrefixes)
+	})
+	require.ErrorIs(t, err, ErrNodeImportAlreadyExists)
+}
+
+func TestImportNodesRollsBack(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("importer")
+
+	// limited already owns the one node it may have.
+	limited := db.CreateUserForTest("limited")
+	require.NoError(t, db.SetUserMaxNodes(types.UserID(limited.ID), 1))
+	db.CreateRegisteredNodeForTest(limited, "limited-node")
+
+	first := importTestEntry("first")
+	first.User = user.Name
+	first.IPv4 = "100.64.0.10"
+
+	tests := []struct {
+		name    string
+		second  func() NodeImport
+		wantErr error
+	}{
+		{
+			name: "pinned-ip-in-use",
+			second: func() NodeImport {
+				e := importTestEntry("second")
+				e.User = user.Name
+				e.IPv4 = first.IPv4
+
+				return e
+			},
+			wantErr: ErrIPNotAvailable,
+		},
+		{
+			name: "pinned-ip-outside-prefix",
+			second: func() NodeImport {
+				e := importTestEntry("second")
+				e.User = user.Name
+				e.IPv4 = "10.0.0.1"
+
+				return e
+			},
+			wantErr: ErrIPNotAvailable,
+		},
+		{
+			name: "unknown-user",
+			second: func() NodeImport {
+				e := importTestEntry("second")
+				e.User = "nobody"
+
+				return e
+			},
+			wantErr: ErrUserNotFound,
+		},
+		{
+			name: "invalid-node-key",
+			second: func() NodeImport {
+				e := importTestEntry("second")
+				e.User = user.Name
+				e.NodeKey = "nodekey:nothex"
+
+				return e
+			},
+			wantErr: ErrNodeImportInvalid,
+		},
+		{
+			name: "no-owner",
+			second: func() NodeImport {
+				return importTestEntry("second")
+			},
+			wantErr: ErrNodeImportInvalid,
+		},
+		{
+			name: "user-node-limit",
+			second: func() NodeImport {
+				e := importTestEntry("second")
+				e.User = limited.Name
+
+				return e
+			},
+			wantErr: ErrUserNodeLimitReached,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+				return ImportNodes(tx, []NodeImport{first, tt.second()}, importTestPrefixes)
+			})
+			require.ErrorIs(t, err, tt.wantErr)
+
+			nodes, err := db.ListNodes()
+			require.NoError(t, err)
+			assert.Len(t, nodes, 1, "a failed import must not leave any node behind")
+		})
+	}
+
+	// Nothing of the failed imports was stored, so the pinned address is
+	// still free.
+	imported, err := Write(db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		return ImportNodes(tx, []NodeImport{first}, importTestPrefixes)
+	})
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.Equal(t, first.IPv4, imported[0].IPv4.String())
+}
@@ -2,10 +2,12 @@ package db
 
 import (
 	"crypto/rand"
+	"errors"
 	"fmt"
 	"math/big"
 	"net/netip"
 	"runtime"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -62,7 +64,7 @@ func TestHardDeleteNode(t *testing.T) {
 	user := db.CreateUserForTest("test")
 	node := db.CreateNodeForTest(user, "testnode3")
 
-	err = db.DeleteNode(node)
+	err = db.PurgeNode(node)
 	require.NoError(t, err)
 
 	_, err = db.getNode(types.UserID(user.ID), "testnode3")
@@ -90,92 +92,1535 @@ func TestListPeersManyNodes(t *testing.T) {
 	assert.Equal(t, "testnode-10", peersOfFirstNode[9].Hostname)
 }
 
+func TestListPeersFiltered(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	alice := db.CreateUserForTest("alice")
+	bob := db.CreateUserForTest("bob")
+	carol := db.CreateUserForTest("carol")
+
+	aliceNode := db.CreateRegisteredNodeForTest(alice, "alice-laptop")
+	bobNode := db.CreateRegisteredNodeForTest(bob, "bob-laptop")
+	carolNode := db.CreateRegisteredNodeForTest(carol, "carol-laptop")
+
+	users, err := db.ListUsers(nil)
+	require.NoError(t, err)
+
+	nodes, err := db.ListNodes()
+	require.NoError(t, err)
+
+	pm, err := policy.PolicyManagerFuncsForTest([]byte(`{
+	"acls": [
+		{
+			"action": "accept",
+			"src": ["alice@"],
+			"dst": ["bob@:*"]
+		}
+	]
+}`))[0](users, nodes.ViewSlice())
+	require.NoError(t, err)
+
+	peerIDs := func(node *types.Node) []types.NodeID {
+		t.Helper()
+
+		peers, err := db.ListPeersFiltered(node, pm)
+		require.NoError(t, err)
+
+		ids := make([]types.NodeID, 0, len(peers))
+		for _, peer := range peers {
+			ids = append(ids, peer.ID)
+		}
+
+		return ids
+	}
+
+	assert.Equal(t, []types.NodeID{bobNode.ID}, peerIDs(aliceNode))
+	assert.Equal(t, []types.NodeID{aliceNode.ID}, peerIDs(bobNode), "visibility goes both ways")
+	assert.Empty(t, peerIDs(carolNode))
+}
+
 func TestExpireNode(t *testing.T) {
 	db, err := newSQLiteTestDB()
 	require.NoError(t, err)
 
-	user, err := db.CreateUser(types.User{Name: "test"})
+	user, err := db.CreateUser(types.User{Name: "test"})
+	require.NoError(t, err)
+
+	pak, err := db.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+	require.NoError(t, err)
+
+	pakID := pak.ID
+
+	_, err = db.getNode(types.UserID(user.ID), "testnode")
+	require.Error(t, err)
+
+	nodeKey := key.NewNode()
+	machineKey := key.NewMachine()
+
+	node := &types.Node{
+		ID:             0,
+		MachineKey:     machineKey.Public(),
+		NodeKey:        nodeKey.Public(),
+		Hostname:       "testnode",
+		UserID:         &user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		AuthKeyID:      &pakID,
+		Expiry:         &time.Time{},
+	}
+	db.DB.Save(node)
+
+	nodeFromDB, err := db.getNode(types.UserID(user.ID), "testnode")
+	require.NoError(t, err)
+	require.NotNil(t, nodeFromDB)
+
+	assert.False(t, nodeFromDB.IsExpired())
+
+	now := time.Now()
+	err = db.NodeSetExpiry(nodeFromDB.ID, &now)
+	require.NoError(t, err)
+
+	nodeFromDB, err = db.getNode(types.UserID(user.ID), "testnode")
+	require.NoError(t, err)
+
+	assert.True(t, nodeFromDB.IsExpired())
+}
+
+func TestDisableNodeExpiry(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user, err := db.CreateUser(types.User{Name: "test"})
+	require.NoError(t, err)
+
+	pak, err := db.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+	require.NoError(t, err)
+
+	pakID := pak.ID
+	node := &types.Node{
+		ID:             0,
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		Hostname:       "testnode",
+		UserID:         &user.ID,
+		RegisterMethod: util.RegisterMethodAuthKey,
+		AuthKeyID:      &pakID,
+		Expiry:         &time.Time{},
+	}
+	db.DB.Save(node)
+
+	// Set an expiry first.
+	past := time.Now().Add(-time.Hour)
+	err = db.NodeSetExpiry(node.ID, &past)
+	require.NoError(t, err)
+
+	nodeFromDB, err := db.getNode(types.UserID(user.ID), "testnode")
+	require.NoError(t, err)
+	assert.True(t, nodeFromDB.IsExpired(), "node should be expired")
+
+	// Disable expiry by setting nil.
+	err = db.NodeSetExpiry(node.ID, nil)
+	require.NoError(t, err)
+
+	nodeFromDB, err = db.getNode(types.UserID(user.ID), "testnode")
+	require.NoError(t, err)
+	assert.False(t, nodeFromDB.IsExpired(), "node should not be expired after disabling expiry")
+	assert.Nil(t, nodeFromDB.Expiry, "expiry should be nil after disabling")
+}
+
+func TestGetNodeByIPAddress(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 2, "node")
+
+	for i, node := range nodes {
+		node.IPv4 = new(netip.MustParseAddr(fmt.Sprintf("100.64.0.%d", i+1)))
+		node.IPv6 = new(netip.MustParseAddr(fmt.Sprintf("fd7a:115c:a1e0::%d", i+1)))
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	tests := []struct {
+		addr string
+		want types.NodeID
+	}{
+		{addr: "100.64.0.1", want: nodes[0].ID},
+		{addr: "fd7a:115c:a1e0::1", want: nodes[0].ID},
+		{addr: "100.64.0.2", want: nodes[1].ID},
+		{addr: "fd7a:115c:a1e0::2", want: nodes[1].ID},
+		{addr: "::ffff:100.64.0.2", want: nodes[1].ID},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.addr, func(t *testing.T) {
+			got, err := db.GetNodeByIPAddress(netip.MustParseAddr(tt.addr))
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, got.ID)
+		})
+	}
+
+	_, err = db.GetNodeByIPAddress(netip.MustParseAddr("100.64.0.3"))
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestGetNodesByPrefix(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "node")
+
+	for i, node := range nodes {
+		node.IPv4 = new(netip.MustParseAddr(fmt.Sprintf("100.64.%d.1", i)))
+		node.IPv6 = new(netip.MustParseAddr(fmt.Sprintf("fd7a:115c:a1e0::%d:1", i)))
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	tests := []struct {
+		prefix string
+		want   []types.NodeID
+	}{
+		{prefix: "100.64.1.0/24", want: []types.NodeID{nodes[1].ID}},
+		{prefix: "100.64.0.0/16", want: []types.NodeID{nodes[0].ID, nodes[1].ID, nodes[2].ID}},
+		{prefix: "fd7a:115c:a1e0::2:0/112", want: []types.NodeID{nodes[2].ID}},
+		{prefix: "100.64.9.0/24", want: []types.NodeID{}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.prefix, func(t *testing.T) {
+			got, err := db.GetNodesByPrefix(netip.MustParsePrefix(tt.prefix))
+			require.NoError(t, err)
+			require.NotNil(t, got)
+
+			ids := []types.NodeID{}
+			for _, node := range got {
+				ids = append(ids, node.ID)
+			}
+
+			assert.Equal(t, tt.want, ids)
+		})
+	}
+}
+
+func TestListExpiredNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "node")
+
+	past := time.Now().Add(-time.Hour)
+	nodes[0].Expiry = &past
+	nodes[1].Expiry = new(time.Now().Add(time.Hour))
+	nodes[2].Expiry = nil
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	expired, err := db.ListExpiredNodes()
+	require.NoError(t, err)
+	require.Len(t, expired, 1)
+	assert.Equal(t, nodes[0].ID, expired[0].ID)
+	require.NotNil(t, expired[0].User, "the owner is preloaded")
+	assert.Equal(t, user.ID, expired[0].User.ID)
+
+	node, err := db.GetNodeByID(nodes[0].ID)
+	require.NoError(t, err)
+	assert.WithinDuration(t, past, *node.Expiry, time.Second, "listing must not touch the expiry")
+}
+
+func TestListStaleNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "node")
+
+	// nodes[0] was seen just now, nodes[1] two hours ago and nodes[2]
+	// has never connected.
+	nodes[0].LastSeen = new(time.Now())
+	nodes[1].LastSeen = new(time.Now().Add(-2 * time.Hour))
+	nodes[2].LastSeen = nil
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	stale, err := db.ListStaleNodes(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, stale, 2)
+	assert.Equal(t, nodes[1].ID, stale[0].ID)
+	assert.Equal(t, nodes[2].ID, stale[1].ID)
+
+	stale, err = db.ListStaleNodes(3 * time.Hour)
+	require.NoError(t, err)
+	require.Len(t, stale, 1, "only the node that never connected")
+	assert.Equal(t, nodes[2].ID, stale[0].ID)
+}
+
+func TestSetLastSeenBatch(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "node")
+
+	untouched, err := db.GetNodeByID(nodes[2].ID)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SetLastSeenBatch(nil), "an empty batch is a no-op")
+
+	seen := map[types.NodeID]time.Time{
+		nodes[0].ID: time.Now().Add(-time.Hour),
+		nodes[1].ID: time.Now().Add(-2 * time.Hour),
+	}
+	require.NoError(t, db.SetLastSeenBatch(seen))
+
+	for id, want := range seen {
+		node, err := db.GetNodeByID(id)
+		require.NoError(t, err)
+		require.NotNil(t, node.LastSeen)
+		assert.WithinDuration(t, want, *node.LastSeen, time.Second)
+	}
+
+	node, err := db.GetNodeByID(nodes[2].ID)
+	require.NoError(t, err)
+	assert.Equal(t, untouched.LastSeen, node.LastSeen, "nodes outside the batch keep their last seen")
+	assert.Equal(t, untouched.UpdatedAt, node.UpdatedAt)
+}
+
+func BenchmarkSetLastSeen(b *testing.B) {
+	const nodeCount = 500
+
+	db, err := newSQLiteTestDB()
+	require.NoError(b, err)
+
+	user := db.CreateUserForTest("bench")
+	nodes := db.CreateNodesForTest(user, nodeCount, "node")
+
+	seen := make(map[types.NodeID]time.Time, nodeCount)
+	for _, node := range nodes {
+		seen[node.ID] = time.Now()
+	}
+
+	b.Run("per-node", func(b *testing.B) {
+		for b.Loop() {
+			err := db.Write(func(tx *gorm.DB) error {
+				for id, lastSeen := range seen {
+					err := SetLastSeen(tx, id, lastSeen)
+					if err != nil {
+						return err
+					}
+				}
+
+				return nil
+			})
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for b.Loop() {
+			require.NoError(b, db.SetLastSeenBatch(seen))
+		}
+	})
+}
+
+func TestListNodesLight(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("light")
+	nodes := db.CreateNodesForTest(user, 3, "light")
+	require.NoError(t, db.SoftDeleteNode(nodes[2].ID))
+
+	light, err := db.ListNodesLight()
+	require.NoError(t, err)
+	require.Len(t, light, 2, "soft-deleted nodes are left out")
+
+	for _, node := range light {
+		require.NotNil(t, node.UserID)
+		assert.Equal(t, user.ID, *node.UserID)
+		assert.Nil(t, node.User, "associations are not loaded")
+	}
+}
+
+func BenchmarkListNodes(b *testing.B) {
+	const nodeCount = 5000
+
+	db, err := newSQLiteTestDB()
+	require.NoError(b, err)
+
+	user := db.CreateUserForTest("bench")
+	db.CreateNodesForTest(user, nodeCount, "node")
+
+	hostinfo := &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("10.1.0.0/24"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+		netip.MustParsePrefix("0.0.0.0/0"),
+	}}
+	require.NoError(b, db.DB.Model(&types.Node{}).
+		Where("1 = 1").
+		Select("host_info").
+		Updates(&types.Node{Hostinfo: hostinfo}).Error)
+
+	b.Run("full", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for b.Loop() {
+			_, err := db.ListNodes()
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("light", func(b *testing.B) {
+		b.ReportAllocs()
+
+		for b.Loop() {
+			_, err := db.ListNodesLight()
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestCountNodesByRegisterMethod(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	counts, err := db.CountNodesByRegisterMethod()
+	require.NoError(t, err)
+	assert.Empty(t, counts)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 5, "node")
+
+	for i, method := range []string{
+		util.RegisterMethodAuthKey,
+		util.RegisterMethodOIDC,
+		util.RegisterMethodOIDC,
+		util.RegisterMethodCLI,
+		"",
+	} {
+		nodes[i].RegisterMethod = method
+		require.NoError(t, db.DB.Save(nodes[i]).Error)
+	}
+
+	counts, err = db.CountNodesByRegisterMethod()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{
+		util.RegisterMethodAuthKey: 1,
+		util.RegisterMethodOIDC:    2,
+		util.RegisterMethodCLI:     1,
+		"":                         1,
+	}, counts)
+}
+
+func TestExpireNodesByRegisterMethod(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("idp")
+	nodes := db.CreateNodesForTest(user, 4, "idp")
+
+	methods := []string{
+		util.RegisterMethodOIDC,
+		util.RegisterMethodOIDC,
+		util.RegisterMethodAuthKey,
+		util.RegisterMethodOIDC,
+	}
+	for i, node := range nodes {
+		node.RegisterMethod = methods[i]
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	// nodes[3] already expired and must keep its original expiry.
+	expiredAt := time.Now().Add(-time.Hour)
+	require.NoError(t, db.NodeSetExpiry(nodes[3].ID, &expiredAt))
+
+	_, err = db.ExpireNodesByRegisterMethod("saml", time.Now())
+	require.ErrorIs(t, err, ErrInvalidRegisterMethod)
+
+	now := time.Now()
+
+	expired, err := db.ExpireNodesByRegisterMethod(util.RegisterMethodOIDC, now)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodes[0].ID, nodes[1].ID}, expired)
+
+	for _, node := range nodes[:2] {
+		got, err := db.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.NotNil(t, got.Expiry)
+		assert.WithinDuration(t, now, *got.Expiry, time.Second)
+	}
+
+	authKeyNode, err := db.GetNodeByID(nodes[2].ID)
+	require.NoError(t, err)
+	assert.Nil(t, authKeyNode.Expiry, "auth key nodes must be left alone")
+
+	old, err := db.GetNodeByID(nodes[3].ID)
+	require.NoError(t, err)
+	require.NotNil(t, old.Expiry)
+	assert.WithinDuration(t, expiredAt, *old.Expiry, time.Second)
+}
+
+func TestOnboardingLatency(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("onboarding")
+	nodes := db.CreateNodesForTest(user, 4, "onboarding")
+
+	registered := time.Now().Add(-time.Hour)
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Model(node).Update("created_at", registered).Error)
+	}
+
+	// The old node registered before the window and must not count.
+	require.NoError(t, db.DB.Model(nodes[3]).
+		Update("created_at", registered.Add(-24*time.Hour)).Error)
+
+	require.NoError(t, db.RecordConnect(nodes[0].ID, registered.Add(time.Minute)))
+	require.NoError(t, db.RecordConnect(nodes[1].ID, registered.Add(3*time.Minute)))
+	require.NoError(t, db.RecordConnect(nodes[3].ID, registered.Add(time.Minute)))
+
+	// A later connection does not move the first one.
+	require.NoError(t, db.RecordConnect(nodes[0].ID, registered.Add(30*time.Minute)))
+
+	latency, err := db.NodeOnboardingLatency(nodes[0].ID)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, latency.Round(time.Second))
+
+	_, err = db.NodeOnboardingLatency(nodes[2].ID)
+	require.ErrorIs(t, err, ErrNodeNeverConnected)
+
+	_, err = db.NodeOnboardingLatency(9999)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	avg, err := db.AverageOnboardingLatency(registered.Add(-time.Minute))
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Minute, avg.Round(time.Second))
+
+	avg, err = db.AverageOnboardingLatency(time.Now())
+	require.NoError(t, err)
+	assert.Zero(t, avg)
+}
+
+func TestLastHandshake(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("handshake")
+	nodes := db.CreateNodesForTest(user, 3, "handshake")
+
+	lastSeen := time.Now().Add(-time.Minute)
+	require.NoError(t, db.SetLastSeen(nodes[0].ID, lastSeen))
+
+	recent := time.Now().Add(-time.Minute)
+	stale := time.Now().Add(-2 * time.Hour)
+
+	require.NoError(t, db.RecordConnect(nodes[0].ID, recent))
+	require.NoError(t, db.RecordConnect(nodes[1].ID, stale))
+
+	node, err := db.GetNodeByID(nodes[0].ID)
+	require.NoError(t, err)
+	require.NotNil(t, node.LastHandshake)
+	assert.WithinDuration(t, recent, *node.LastHandshake, time.Millisecond)
+	require.NotNil(t, node.LastSeen)
+	assert.WithinDuration(t, lastSeen, *node.LastSeen, time.Millisecond, "last_seen is independent")
+
+	// nodes[2] never completed a handshake and is always listed.
+	without, err := db.ListNodesWithoutRecentHandshake(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, without, 2)
+	assert.Equal(t, nodes[1].ID, without[0].ID)
+	assert.Equal(t, nodes[2].ID, without[1].ID)
+	require.NotNil(t, without[0].User, "the owner is preloaded")
+
+	without, err = db.ListNodesWithoutRecentHandshake(3 * time.Hour)
+	require.NoError(t, err)
+	require.Len(t, without, 1)
+	assert.Equal(t, nodes[2].ID, without[0].ID)
+
+	require.NoError(t, db.RecordConnect(nodes[1].ID, time.Now()))
+
+	node, err = db.GetNodeByID(nodes[1].ID)
+	require.NoError(t, err)
+	require.NotNil(t, node.FirstSeen)
+	assert.WithinDuration(t, stale, *node.FirstSeen, time.Millisecond, "the first connect keeps first_seen")
+
+	without, err = db.ListNodesWithoutRecentHandshake(time.Hour)
+	require.NoError(t, err)
+	require.Len(t, without, 1)
+	assert.Equal(t, nodes[2].ID, without[0].ID)
+}
+
+func TestListPartialExitNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("exit")
+	nodes := db.CreateNodesForTest(user, 4, "exit")
+
+	announced := [][]netip.Prefix{
+		{tsaddr.AllIPv4()},
+		{tsaddr.AllIPv4(), tsaddr.AllIPv6()},
+		{netip.MustParsePrefix("10.0.0.0/24"), tsaddr.AllIPv6()},
+		nil,
+	}
+
+	for i, node := range nodes {
+		node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: announced[i]}
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	partial, err := db.ListPartialExitNodes()
+	require.NoError(t, err)
+
+	got := make([]types.NodeID, 0, len(partial))
+	for _, node := range partial {
+		got = append(got, node.ID)
+	}
+
+	assert.ElementsMatch(t, []types.NodeID{nodes[0].ID, nodes[2].ID}, got)
+}
+
+func TestListSubnetRouters(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("routers")
+	nodes := db.CreateNodesForTest(user, 4, "router")
+
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+	announced := [][]netip.Prefix{
+		{subnet},
+		{tsaddr.AllIPv4(), tsaddr.AllIPv6()},
+		{subnet, tsaddr.AllIPv4(), tsaddr.AllIPv6()},
+		nil,
+	}
+
+	for i, node := range nodes {
+		node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: announced[i]}
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	ids := func(nodes types.Nodes) []types.NodeID {
+		got := make([]types.NodeID, 0, len(nodes))
+		for _, node := range nodes {
+			got = append(got, node.ID)
+		}
+
+		return got
+	}
+
+	routers, err := db.ListSubnetRouters(false)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodes[0].ID, nodes[1].ID, nodes[2].ID}, ids(routers))
+
+	routers, err = db.ListSubnetRouters(true)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodes[0].ID, nodes[2].ID}, ids(routers),
+		"an exit-only advertiser must be excluded")
+
+	for _, router := range routers {
+		assert.NotNil(t, router.User, "routers must be returned with their user")
+	}
+}
+
+func TestGetAdvertisedRoutesForNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("routers")
+	nodes := db.CreateNodesForTest(user, 3, "router")
+
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+	other := netip.MustParsePrefix("192.168.0.0/16")
+	announced := [][]netip.Prefix{
+		{subnet},
+		{other, tsaddr.AllIPv4()},
+		nil,
+	}
+
+	for i, node := range nodes {
+		node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: announced[i]}
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	routes, err := db.GetAdvertisedRoutesForNodes(nil)
+	require.NoError(t, err)
+	assert.NotNil(t, routes)
+	assert.Empty(t, routes)
+
+	routes, err = db.GetAdvertisedRoutesForNodes([]types.NodeID{nodes[0].ID, nodes[1].ID, nodes[2].ID, 9999})
+	require.NoError(t, err)
+	assert.Equal(t, map[types.NodeID][]netip.Prefix{
+		nodes[0].ID: {subnet},
+		nodes[1].ID: {other, tsaddr.AllIPv4()},
+	}, routes, "nodes without routes and unknown nodes are left out")
+
+	routes, err = db.GetAdvertisedRoutesForNodes([]types.NodeID{nodes[1].ID})
+	require.NoError(t, err)
+	assert.Equal(t, map[types.NodeID][]netip.Prefix{nodes[1].ID: {other, tsaddr.AllIPv4()}}, routes)
+}
+
+func BenchmarkGetAdvertisedRoutesForNodes(b *testing.B) {
+	const nodeCount = 500
+
+	db, err := newSQLiteTestDB()
+	require.NoError(b, err)
+
+	user := db.CreateUserForTest("bench")
+	nodes := db.CreateNodesForTest(user, nodeCount, "node")
+
+	hostinfo := &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{
+		netip.MustParsePrefix("10.0.0.0/24"),
+		netip.MustParsePrefix("192.168.0.0/16"),
+	}}
+	require.NoError(b, db.DB.Model(&types.Node{}).
+		Where("1 = 1").
+		Select("host_info").
+		Updates(&types.Node{Hostinfo: hostinfo}).Error)
+
+	ids := make([]types.NodeID, 0, nodeCount)
+	for _, node := range nodes {
+		ids = append(ids, node.ID)
+	}
+
+	b.Run("per-node", func(b *testing.B) {
+		for b.Loop() {
+			err := db.Read(func(rx *gorm.DB) error {
+				routes := make(map[types.NodeID][]netip.Prefix, len(ids))
+
+				for _, id := range ids {
+					node, err := GetNodeByID(rx, id)
+					if err != nil {
+						return err
+					}
+
+					routes[id] = node.AnnouncedRoutes()
+				}
+
+				return nil
+			})
+			require.NoError(b, err)
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		for b.Loop() {
+			_, err := db.GetAdvertisedRoutesForNodes(ids)
+			require.NoError(b, err)
+		}
+	})
+}
+
+func TestListNodesByUserID(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	alice := db.CreateUserForTest("alice")
+	bob := db.CreateUserForTest("bob")
+
+	aliceNodes := db.CreateNodesForTest(alice, 2, "alice")
+	db.CreateNodesForTest(bob, 1, "bob")
+
+	require.NoError(t, db.RenameUser(types.UserID(alice.ID), "alice-renamed"))
+
+	nodes, err := db.ListNodesByUserID(types.UserID(alice.ID))
+	require.NoError(t, err)
+	require.Len(t, nodes, 2, "a rename must not lose the user's nodes")
+
+	for i, node := range nodes {
+		assert.Equal(t, aliceNodes[i].ID, node.ID)
+		require.NotNil(t, node.User)
+		assert.Equal(t, "alice-renamed", node.User.Name)
+	}
+
+	nodes, err = db.ListNodesByUserID(9999)
+	require.NoError(t, err)
+	assert.Empty(t, nodes)
+}
+
+func TestListRecentlyRegisteredNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("recent")
+	nodes := db.CreateNodesForTest(user, 4, "recent")
+
+	// Register the nodes out of ID order: 1, 3, 0, 2 from newest to oldest.
+	now := time.Now()
+	for i, age := range []time.Duration{3, 1, 4, 2} {
+		require.NoError(t, db.DB.Model(nodes[i]).
+			Update("created_at", now.Add(-age*time.Hour)).Error)
+	}
+
+	recent, err := db.ListRecentlyRegisteredNodes(3)
+	require.NoError(t, err)
+	require.Len(t, recent, 3)
+
+	for i, want := range []int{1, 3, 0} {
+		assert.Equal(t, nodes[want].ID, recent[i].ID, "position %d", i)
+		assert.NotNil(t, recent[i].User, "user must be preloaded")
+	}
+
+	all, err := db.ListRecentlyRegisteredNodes(10)
+	require.NoError(t, err)
+	assert.Len(t, all, 4)
+
+	none, err := db.ListRecentlyRegisteredNodes(0)
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+func TestListNodesBelowCapVer(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("capver")
+	nodes := db.CreateNodesForTest(user, 4, "capver")
+
+	// nodes[3] never reports a version and must not be listed.
+	for i, capVer := range []tailcfg.CapabilityVersion{90, 106, 113} {
+		require.NoError(t, db.UpdateNodeCapVer(nodes[i].ID, capVer))
+	}
+
+	below, err := db.ListNodesBelowCapVer(106)
+	require.NoError(t, err)
+	require.Len(t, below, 1)
+	assert.Equal(t, nodes[0].ID, below[0].ID)
+	assert.Equal(t, tailcfg.CapabilityVersion(90), below[0].CapVer)
+
+	below, err = db.ListNodesBelowCapVer(200)
+	require.NoError(t, err)
+	assert.Len(t, below, 3)
+
+	below, err = db.ListNodesBelowCapVer(90)
+	require.NoError(t, err)
+	assert.Empty(t, below)
+}
+
+func TestGetNodeByNodeKeyUsesIndex(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	assert.True(t, db.DB.Migrator().HasIndex(&types.Node{}, "idx_nodes_node_key"))
+
+	user := db.CreateUserForTest("keyed")
+	nodes := db.CreateNodesForTest(user, 2, "keyed")
+
+	node, err := db.GetNodeByNodeKey(nodes[1].NodeKey)
+	require.NoError(t, err)
+	assert.Equal(t, nodes[1].ID, node.ID)
+
+	var plan []struct {
+		Detail string
+	}
+
+	require.NoError(t, db.DB.Raw(
+		"EXPLAIN QUERY PLAN SELECT * FROM nodes WHERE node_key = ?",
+		nodes[1].NodeKey.String(),
+	).Scan(&plan).Error)
+	require.NotEmpty(t, plan)
+	assert.Contains(t, plan[0].Detail, "idx_nodes_node_key")
+
+	_, err = db.GetNodeByNodeKey(key.NewNode().Public())
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+var errAbortKeyRotation = errors.New("aborting key rotation")
+
+func TestNodeKeyHistory(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("rotating")
+	node := db.CreateNodeForTest(user, "rotating")
+	origMachine, origNode := node.MachineKey, node.NodeKey
+
+	history, err := db.GetNodeKeyHistory(node.ID)
+	require.NoError(t, err)
+	assert.Empty(t, history)
+
+	firstNode, secondNode := key.NewNode().Public(), key.NewNode().Public()
+	newMachine := key.NewMachine().Public()
+
+	require.NoError(t, db.Write(func(tx *gorm.DB) error {
+		return NodeSetNodeKey(tx, node, firstNode)
+	}))
+	require.NoError(t, db.Write(func(tx *gorm.DB) error {
+		return NodeSetNodeKey(tx, node, secondNode)
+	}))
+	require.NoError(t, db.Write(func(tx *gorm.DB) error {
+		return NodeSetNodeKey(tx, node, secondNode)
+	}), "setting the current key again is not a change")
+	require.NoError(t, db.NodeSetMachineKey(node, newMachine))
+	require.NoError(t, db.NodeSetMachineKey(node, newMachine),
+		"setting the current machine key again is not a change")
+
+	history, err = db.GetNodeKeyHistory(node.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 3)
+
+	assert.Equal(t, types.NodeKeyHistoryNodeKeyChanged, history[0].Reason)
+	assert.Equal(t, origNode, history[0].NodeKey, "the replaced key is recorded")
+	assert.Equal(t, origMachine, history[0].MachineKey)
+
+	assert.Equal(t, types.NodeKeyHistoryNodeKeyChanged, history[1].Reason)
+	assert.Equal(t, firstNode, history[1].NodeKey)
+
+	assert.Equal(t, types.NodeKeyHistoryMachineKeyChanged, history[2].Reason)
+	assert.Equal(t, origMachine, history[2].MachineKey)
+	assert.Equal(t, secondNode, history[2].NodeKey)
+
+	for _, entry := range history {
+		assert.Equal(t, node.ID, entry.NodeID)
+		assert.False(t, entry.ChangedAt.IsZero())
+	}
+
+	stored, err := db.GetNodeByID(node.ID)
+	require.NoError(t, err)
+	assert.Equal(t, secondNode, stored.NodeKey)
+	assert.Equal(t, newMachine, stored.MachineKey)
+
+	// A failing transaction rolls the history back with the key.
+	require.Error(t, db.Write(func(tx *gorm.DB) error {
+		err := NodeSetNodeKey(tx, node, key.NewNode().Public())
+		if err != nil {
+			return err
+		}
+
+		return errAbortKeyRotation
+	}))
+
+	history, err = db.GetNodeKeyHistory(node.ID)
+	require.NoError(t, err)
+	assert.Len(t, history, 3)
+
+	err = db.Write(func(tx *gorm.DB) error {
+		return NodeSetNodeKey(tx, &types.Node{ID: node.ID + 1000}, firstNode)
+	})
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	err = db.NodeSetMachineKey(&types.Node{ID: node.ID + 1000}, newMachine)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestRecordNodeKeyChange(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("recording")
+	node := db.CreateNodeForTest(user, "recording")
+	origMachine := node.MachineKey
+
+	// Writers that save the whole row record the change before the save.
+	require.NoError(t, db.Write(func(tx *gorm.DB) error {
+		moved := &types.Node{ID: node.ID, MachineKey: key.NewMachine().Public(), NodeKey: node.NodeKey}
+
+		err := RecordNodeKeyChange(tx, moved)
+		if err != nil {
+			return err
+		}
+
+		return tx.Model(moved).Select("machine_key").Updates(moved).Error
+	}))
+
+	history, err := db.GetNodeKeyHistory(node.ID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	assert.Equal(t, types.NodeKeyHistoryMachineKeyChanged, history[0].Reason)
+	assert.Equal(t, origMachine, history[0].MachineKey)
+
+	require.NoError(t, db.Write(func(tx *gorm.DB) error {
+		return RecordNodeKeyChange(tx, &types.Node{ID: node.ID + 1000})
+	}), "a node that is not stored yet has no history")
+}
+
+func TestGetNodeByGivenName(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("named")
+	nodes := db.CreateRegisteredNodesForTest(user, 3, "named")
+
+	node, err := db.GetNodeByGivenName(nodes[1].GivenName)
+	require.NoError(t, err)
+	assert.Equal(t, nodes[1].ID, node.ID)
+	require.NotNil(t, node.User, "the owner is preloaded")
+
+	node, err = db.GetNodeByGivenName(strings.ToUpper(nodes[1].GivenName))
+	require.NoError(t, err)
+	assert.Equal(t, nodes[1].ID, node.ID, "lookup ignores case")
+
+	_, err = db.GetNodeByGivenName("missing")
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	// Bypass RenameNode to recreate a duplicate left by older releases.
+	require.NoError(t, db.DB.Model(&types.Node{}).
+		Where("id = ?", nodes[2].ID).
+		Update("given_name", nodes[1].GivenName).Error)
+
+	_, err = db.GetNodeByGivenName(nodes[1].GivenName)
+	require.ErrorIs(t, err, ErrNodeNameNotUnique)
+}
+
+func TestSetNodeDescription(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("described")
+	node := db.CreateNodeForTest(user, "described")
+
+	desc, err := db.GetNodeDescription(node.ID)
+	require.NoError(t, err)
+	assert.Empty(t, desc)
+
+	require.NoError(t, db.SetNodeDescription(node.ID, "rack 3 jump host"))
+
+	desc, err = db.GetNodeDescription(node.ID)
+	require.NoError(t, err)
+	assert.Equal(t, "rack 3 jump host", desc)
+
+	// The cap counts characters, not bytes.
+	longest := strings.Repeat("ü", MaxNodeDescriptionLength)
+	require.NoError(t, db.SetNodeDescription(node.ID, longest))
+
+	err = db.SetNodeDescription(node.ID, longest+"x")
+	require.ErrorIs(t, err, ErrNodeDescriptionTooLong)
+
+	desc, err = db.GetNodeDescription(node.ID)
+	require.NoError(t, err)
+	assert.Equal(t, longest, desc, "a rejected description leaves the old one")
+
+	require.NoError(t, db.SetNodeDescription(node.ID, ""))
+
+	desc, err = db.GetNodeDescription(node.ID)
+	require.NoError(t, err)
+	assert.Empty(t, desc, "an empty description clears it")
+
+	err = db.SetNodeDescription(node.ID+1000, "nobody")
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	_, err = db.GetNodeDescription(node.ID + 1000)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestListNodesByClientVersion(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("client")
+	nodes := db.CreateNodesForTest(user, 6, "client")
+
+	// nodes[5] never reports a version and must not be listed.
+	for i, version := range []string{
+		"1.78.1-t3f2a1b0c4-g9d8e7f6a5",
+		"1.80.0",
+		"1.80.0-pre",
+		"1.82.3",
+		"unstable",
+	} {
+		require.NoError(t, db.DB.Model(&types.Node{}).
+			Where("id = ?", nodes[i].ID).
+			Update("client_version", version).Error)
+	}
+
+	tests := []struct {
+		constraint string
+		want       []int
+	}{
+		{constraint: "<1.80.0", want: []int{0}},
+		{constraint: "<=1.80.0", want: []int{0, 1, 2}},
+		{constraint: ">1.80.0", want: []int{3}},
+		{constraint: ">= 1.80.0", want: []int{1, 2, 3}},
+		{constraint: "1.80.0", want: []int{1, 2}},
+		{constraint: "=1.80.0-pre", want: []int{1, 2}},
+		{constraint: "<1.78.1", want: []int{}},
+		{constraint: "<v2.0.0", want: []int{0, 1, 2, 3}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.constraint, func(t *testing.T) {
+			got, err := db.ListNodesByClientVersion(tt.constraint)
+			require.NoError(t, err)
+
+			want := make([]types.NodeID, 0, len(tt.want))
+			for _, i := range tt.want {
+				want = append(want, nodes[i].ID)
+			}
+
+			gotIDs := make([]types.NodeID, 0, len(got))
+			for _, node := range got {
+				gotIDs = append(gotIDs, node.ID)
+			}
+
+			assert.Equal(t, want, gotIDs)
+		})
+	}
+
+	for _, constraint := range []string{"", "<", "~1.80.0", "1.80"} {
+		_, err := db.ListNodesByClientVersion(constraint)
+		require.ErrorIs(t, err, ErrInvalidVersionConstraint, "constraint %q", constraint)
+	}
+}
+
+func TestListNodesPaged(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	alice := db.CreateUserForTest("alice")
+	bob := db.CreateUserForTest("bob")
+
+	aliceNodes := db.CreateNodesForTest(alice, 3, "alice")
+	bobNodes := db.CreateNodesForTest(bob, 2, "bob")
+
+	ids := func(nodes ...*types.Node) []types.NodeID {
+		out := make([]types.NodeID, 0, len(nodes))
+		for _, node := range nodes {
+			out = append(out, node.ID)
+		}
+
+		return out
+	}
+
+	tests := []struct {
+		name      string
+		opts      ListNodesOptions
+		want      []types.NodeID
+		wantTotal int64
+	}{
+		{
+			name:      "first-page",
+			opts:      ListNodesOptions{Limit: 2},
+			want:      ids(aliceNodes[0], aliceNodes[1]),
+			wantTotal: 5,
+		},
+		{
+			name:      "last-page-of-user",
+			opts:      ListNodesOptions{UserName: "alice", Limit: 2, Offset: 2},
+			want:      ids(aliceNodes[2]),
+			wantTotal: 3,
+		},
+		{
+			name: "online-only",
+			opts: ListNodesOptions{
+				OnlineOnly:    true,
+				OnlineNodeIDs: ids(aliceNodes[1], bobNodes[0]),
+			},
+			want:      ids(aliceNodes[1], bobNodes[0]),
+			wantTotal: 2,
+		},
+		{
+			name: "online-only-of-user",
+			opts: ListNodesOptions{
+				UserName:      "bob",
+				OnlineOnly:    true,
+				OnlineNodeIDs: ids(aliceNodes[1], bobNodes[0]),
+			},
+			want:      ids(bobNodes[0]),
+			wantTotal: 1,
+		},
+		{
+			name:      "nobody-online",
+			opts:      ListNodesOptions{OnlineOnly: true},
+			want:      []types.NodeID{},
+			wantTotal: 0,
+		},
+		{
+			name:      "unknown-user",
+			opts:      ListNodesOptions{UserName: "mallory"},
+			want:      []types.NodeID{},
+			wantTotal: 0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, total, err := db.ListNodesPaged(tt.opts)
+			require.NoError(t, err)
+			assert.Equal(t, tt.wantTotal, total)
+			assert.Equal(t, tt.want, ids(got...))
+
+			for _, node := range got {
+				assert.NotNil(t, node.User, "preloads must still apply")
+			}
+		})
+	}
+}
+
+func TestListNodesExpiringBetween(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 4, "node")
+
+	now := time.Now()
+	expiries := []*time.Time{
+		new(now.Add(-2 * time.Hour)),
+		new(now.Add(time.Hour)),
+		new(now.Add(48 * time.Hour)),
+		nil,
+	}
+
+	for i, node := range nodes {
+		require.NoError(t, db.NodeSetExpiry(node.ID, expiries[i]))
+	}
+
+	ids := func(nodes types.Nodes) []types.NodeID {
+		out := make([]types.NodeID, 0, len(nodes))
+		for _, node := range nodes {
+			out = append(out, node.ID)
+		}
+
+		return out
+	}
+
+	tests := []struct {
+		name     string
+		from, to time.Time
+		want     []types.NodeID
+	}{
+		{
+			name: "future-window",
+			from: now.Add(24 * time.Hour),
+			to:   now.Add(72 * time.Hour),
+			want: []types.NodeID{nodes[2].ID},
+		},
+		{
+			name: "window-spanning-now",
+			from: now.Add(-3 * time.Hour),
+			to:   now.Add(2 * time.Hour),
+			want: []types.NodeID{nodes[0].ID, nodes[1].ID},
+		},
+		{
+			name: "empty-window",
+			from: now.Add(2 * time.Hour),
+			to:   now.Add(24 * time.Hour),
+			want: []types.NodeID{},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := db.ListNodesExpiringBetween(tt.from, tt.to)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, ids(got))
+		})
+	}
+}
+
+// TestSoftDeletedNodesExcluded covers the node queries not built on
+// preloadNode: a soft-deleted node must not be counted, listed or changed by
+// any of them.
+func TestSoftDeletedNodesExcluded(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateRegisteredNodesForTest(user, 2, "node")
+	live, deleted := nodes[0], nodes[1]
+
+	now := time.Now()
+	require.NoError(t, db.RecordConnect(live.ID, now))
+	require.NoError(t, db.RecordConnect(deleted.ID, now.Add(10*time.Hour)))
+	require.NoError(t, db.DB.Model(&types.PreAuthKey{}).
+		Where("id IN ?", []uint64{*live.AuthKeyID, *deleted.AuthKeyID}).
+		Update("ephemeral", true).Error)
+	require.NoError(t, db.SoftDeleteNode(deleted.ID))
+
+	_, total, err := db.ListNodesPaged(ListNodesOptions{})
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), total)
+
+	ephemeral, err := db.ListEphemeralNodes()
+	require.NoError(t, err)
+	assert.Len(t, ephemeral, 1)
+
+	counts, err := db.CountNodesByRegisterMethod()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]int64{util.RegisterMethodAuthKey: 1}, counts)
+
+	latency, err := db.AverageOnboardingLatency(now.Add(-time.Hour))
+	require.NoError(t, err)
+	assert.Less(t, latency, time.Hour, "the deleted node's late first seen must not count")
+
+	require.NoError(t, db.SetUserMaxNodes(types.UserID(user.ID), 2))
+	require.NoError(t, db.DB.Transaction(func(tx *gorm.DB) error {
+		return CheckUserNodeLimit(tx, types.UserID(user.ID))
+	}), "a soft-deleted node must not count against the limit")
+
+	expired, err := db.ExpireNodesByRegisterMethod(util.RegisterMethodAuthKey, now)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{live.ID}, expired)
+
+	stored, err := db.GetNodeByIDUnscoped(deleted.ID)
+	require.NoError(t, err)
+	assert.Nil(t, stored.Expiry, "a soft-deleted node must not be expired")
+}
+
+func TestGetNodeWithFQDN(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	node := db.CreateRegisteredNodeForTest(user, "laptop")
+
+	tests := []struct {
+		name       string
+		baseDomain string
+		want       string
+	}{
+		{name: "base-domain", baseDomain: "example.com", want: "laptop.example.com."},
+		{name: "empty-base-domain", baseDomain: "", want: "laptop"},
+		{name: "base-domain-with-dots", baseDomain: ".example.com.", want: "laptop.example.com."},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, fqdn, err := db.GetNodeWithFQDN(node.ID, tt.baseDomain)
+			require.NoError(t, err)
+			assert.Equal(t, node.ID, got.ID)
+			assert.Equal(t, tt.want, fqdn)
+		})
+	}
+
+	_, _, err = db.GetNodeWithFQDN(9999, "example.com")
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestSetRoutePriority(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	node := db.CreateRegisteredNodeForTest(user, "router")
+	assert.Zero(t, node.RoutePriority)
+
+	require.NoError(t, db.SetRoutePriority(node.ID, 10))
+
+	stored, err := db.GetNodeByID(node.ID)
 	require.NoError(t, err)
+	assert.Equal(t, 10, stored.RoutePriority)
 
-	pak, err := db.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+	require.NoError(t, db.SetRoutePriority(node.ID, 0))
+
+	stored, err = db.GetNodeByID(node.ID)
 	require.NoError(t, err)
+	assert.Zero(t, stored.RoutePriority)
 
-	pakID := pak.ID
+	err = db.SetRoutePriority(9999, 1)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
 
-	_, err = db.getNode(types.UserID(user.ID), "testnode")
-	require.Error(t, err)
+func TestListNodesExpiringWithin(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
 
-	nodeKey := key.NewNode()
-	machineKey := key.NewMachine()
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 5, "node")
+
+	now := time.Now().UTC().Truncate(time.Second)
+	window := 24 * time.Hour
+	expiries := []*time.Time{
+		new(now.Add(-time.Hour)),
+		new(now.Add(time.Hour)),
+		new(now.Add(window)),
+		new(now.Add(window + time.Second)),
+		nil,
+	}
 
-	node := &types.Node{
-		ID:             0,
-		MachineKey:     machineKey.Public(),
-		NodeKey:        nodeKey.Public(),
-		Hostname:       "testnode",
-		UserID:         &user.ID,
-		RegisterMethod: util.RegisterMethodAuthKey,
-		AuthKeyID:      &pakID,
-		Expiry:         &time.Time{},
+	for i, node := range nodes {
+		require.NoError(t, db.NodeSetExpiry(node.ID, expiries[i]))
 	}
-	db.DB.Save(node)
 
-	nodeFromDB, err := db.getNode(types.UserID(user.ID), "testnode")
+	// Only the node inside the window is listed; the expired node, the one
+	// exactly at its end, the one just outside and the one that never
+	// expires are not.
+	got, err := ListNodesExpiringBetween(db.DB, now, now.Add(window))
 	require.NoError(t, err)
-	require.NotNil(t, nodeFromDB)
 
-	assert.False(t, nodeFromDB.IsExpired())
+	gotIDs := make([]types.NodeID, 0, len(got))
+	for _, node := range got {
+		gotIDs = append(gotIDs, node.ID)
+	}
+
+	assert.Equal(t, []types.NodeID{nodes[1].ID}, gotIDs)
+
+	got, err = db.ListNodesExpiringWithin(time.Minute)
+	require.NoError(t, err)
+	assert.Empty(t, got)
+
+	got, err = db.ListNodesExpiringWithin(2 * time.Hour)
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, nodes[1].ID, got[0].ID)
+}
+
+func TestListUnexpectedlyOfflineNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 4, "node")
 
 	now := time.Now()
-	err = db.NodeSetExpiry(nodeFromDB.ID, &now)
+
+	// nodes[0]: seen 10s ago but missing from the connected map.
+	// nodes[1]: seen 10s ago and connected.
+	// nodes[2]: last seen an hour ago, outside the window.
+	// nodes[3]: never seen.
+	require.NoError(t, db.SetLastSeen(nodes[0].ID, now.Add(-10*time.Second)))
+	require.NoError(t, db.SetLastSeen(nodes[1].ID, now.Add(-10*time.Second)))
+	require.NoError(t, db.SetLastSeen(nodes[2].ID, now.Add(-time.Hour)))
+
+	connected := map[types.NodeID]bool{nodes[1].ID: true}
+	isConnected := func(id types.NodeID) bool { return connected[id] }
+
+	got, err := db.ListUnexpectedlyOfflineNodes(isConnected, time.Minute)
 	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, nodes[0].ID, got[0].ID)
+}
 
-	nodeFromDB, err = db.getNode(types.UserID(user.ID), "testnode")
+func TestFindNodesWithoutGivenName(t *testing.T) {
+	db, err := newSQLiteTestDB()
 	require.NoError(t, err)
 
-	assert.True(t, nodeFromDB.IsExpired())
+	user := db.CreateUserForTest("test")
+	named := db.CreateRegisteredNodeForTest(user, "named")
+	broken := db.CreateRegisteredNodeForTest(user, "broken")
+
+	require.NoError(t, db.DB.Model(&types.Node{}).
+		Where("id = ?", broken.ID).
+		Update("given_name", "").Error)
+
+	got, err := db.FindNodesWithoutGivenName()
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, broken.ID, got[0].ID)
+	assert.NotEqual(t, named.ID, got[0].ID)
 }
 
-func TestDisableNodeExpiry(t *testing.T) {
+func TestSoftDeleteAndRestoreNode(t *testing.T) {
 	db, err := newSQLiteTestDB()
 	require.NoError(t, err)
 
-	user, err := db.CreateUser(types.User{Name: "test"})
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 2, "node")
+	deleted, kept := nodes[0], nodes[1]
+
+	require.NoError(t, db.SoftDeleteNode(deleted.ID))
+	require.ErrorIs(t, db.SoftDeleteNode(deleted.ID), ErrNodeNotFound, "already soft-deleted")
+
+	listed, err := db.ListNodes()
 	require.NoError(t, err)
+	require.Len(t, listed, 1, "ListNodes hides soft-deleted nodes")
+	assert.Equal(t, kept.ID, listed[0].ID)
 
-	pak, err := db.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+	_, err = db.GetNodeByID(deleted.ID)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	softDeleted, err := db.ListSoftDeletedNodes()
 	require.NoError(t, err)
+	require.Len(t, softDeleted, 1)
+	assert.Equal(t, deleted.ID, softDeleted[0].ID)
+	require.NotNil(t, softDeleted[0].User, "the owner is preloaded")
 
-	pakID := pak.ID
-	node := &types.Node{
-		ID:             0,
-		MachineKey:     key.NewMachine().Public(),
-		NodeKey:        key.NewNode().Public(),
-		Hostname:       "testnode",
-		UserID:         &user.ID,
-		RegisterMethod: util.RegisterMethodAuthKey,
-		AuthKeyID:      &pakID,
-		Expiry:         &time.Time{},
-	}
-	db.DB.Save(node)
+	restored, err := Write(db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return RestoreNode(tx, deleted.ID)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, deleted.ID, restored.ID)
+	assert.Nil(t, restored.DeletedAt)
 
-	// Set an expiry first.
-	past := time.Now().Add(-time.Hour)
-	err = db.NodeSetExpiry(node.ID, &past)
+	listed, err = db.ListNodes()
 	require.NoError(t, err)
+	assert.Len(t, listed, 2)
 
-	nodeFromDB, err := db.getNode(types.UserID(user.ID), "testnode")
+	_, err = Write(db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		return RestoreNode(tx, kept.ID)
+	})
+	require.ErrorIs(t, err, ErrNodeNotFound, "only soft-deleted nodes can be restored")
+
+	// Hard deletion still removes a soft-deleted node for good.
+	require.NoError(t, db.SoftDeleteNode(deleted.ID))
+	require.NoError(t, db.PurgeNode(deleted))
+
+	softDeleted, err = db.ListSoftDeletedNodes()
 	require.NoError(t, err)
-	assert.True(t, nodeFromDB.IsExpired(), "node should be expired")
+	assert.Empty(t, softDeleted)
+}
 
-	// Disable expiry by setting nil.
-	err = db.NodeSetExpiry(node.ID, nil)
+func TestGetNodeByIDUnscoped(t *testing.T) {
+	db, err := newSQLiteTestDB()
 	require.NoError(t, err)
 
-	nodeFromDB, err = db.getNode(types.UserID(user.ID), "testnode")
+	user := db.CreateUserForTest("test")
+	node := db.CreateNodeForTest(user, "node")
+
+	found, err := db.GetNodeByIDUnscoped(node.ID)
 	require.NoError(t, err)
-	assert.False(t, nodeFromDB.IsExpired(), "node should not be expired after disabling expiry")
-	assert.Nil(t, nodeFromDB.Expiry, "expiry should be nil after disabling")
+	assert.Equal(t, node.ID, found.ID, "live nodes are found too")
+
+	require.NoError(t, db.SoftDeleteNode(node.ID))
+
+	_, err = db.GetNodeByID(node.ID)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound, "GetNodeByID never returns deleted nodes")
+
+	found, err = db.GetNodeByIDUnscoped(node.ID)
+	require.NoError(t, err)
+	assert.Equal(t, node.ID, found.ID)
+	assert.Equal(t, node.Hostname, found.Hostname)
+	require.NotNil(t, found.DeletedAt)
+	require.NotNil(t, found.User, "the owner is preloaded while it exists")
+	assert.Equal(t, user.ID, found.User.ID)
+
+	require.NoError(t, db.PurgeNode(found))
+
+	_, err = db.GetNodeByIDUnscoped(node.ID)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound, "purged nodes are gone")
+}
+
+func TestNodeChurnRate(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 4, "node")
+
+	now := time.Now()
+	from := now.Add(-24 * time.Hour)
+	to := now.Add(24 * time.Hour)
+
+	seed := []map[string]any{
+		// Registered before the window, expired inside it.
+		{"created_at": now.Add(-48 * time.Hour), "expiry": now.Add(-time.Hour)},
+		// Registered inside the window, later soft-deleted.
+		{"created_at": now.Add(-12 * time.Hour), "deleted_at": now.Add(-time.Hour)},
+		// Registered inside the window, expiring later inside it.
+		{"created_at": now.Add(-6 * time.Hour), "expiry": now.Add(time.Hour)},
+		// Registered inside the window, expiry beyond it.
+		{"created_at": now.Add(-time.Hour), "expiry": now.Add(48 * time.Hour)},
+	}
+
+	for i, columns := range seed {
+		require.NoError(t, db.DB.Model(&types.Node{}).
+			Where("id = ?", nodes[i].ID).UpdateColumns(columns).Error)
+	}
+
+	churn, err := db.NodeChurnRate(from, to)
+	require.NoError(t, err)
+	assert.Equal(t, NodeChurn{Registered: 3, Deleted: 1, Expired: 1}, churn)
+
+	churn, err = db.NodeChurnRate(to, to.Add(time.Hour))
+	require.NoError(t, err)
+	assert.Equal(t, NodeChurn{}, churn, "a future window has no churn yet")
 }
 
 func TestAutoApproveRoutes(t *testing.T) {
@@ -578,6 +2023,95 @@ func TestListEphemeralNodes(t *testing.T) {
 	assert.Equal(t, nodeEph.Hostname, ephemeralNodes[0].Hostname)
 }
 
+func TestListNodesByTag(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("tagger")
+	nodes := db.CreateNodesForTest(user, 4, "tagged")
+
+	pak, err := db.CreatePreAuthKey(user.TypedID(), true, false, nil, []string{"tag:server"})
+	require.NoError(t, err)
+
+	pakID := pak.ID
+
+	// Set directly on the node.
+	nodes[0].Tags = []string{"tag:server", "tag:web"}
+	// Registered with the tagged key, which copies its tags to the node.
+	nodes[1].AuthKeyID = &pakID
+	nodes[1].Tags = []string{"tag:server"}
+	// Registered with the tagged key, then retagged.
+	nodes[2].AuthKeyID = &pakID
+	nodes[2].Tags = []string{"tag:db"}
+
+	for _, node := range nodes {
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	got, err := db.ListNodesByTag("tag:server")
+	require.NoError(t, err)
+	require.Len(t, got, 2)
+	assert.Equal(t, nodes[0].ID, got[0].ID)
+	assert.Equal(t, nodes[1].ID, got[1].ID)
+	require.NotNil(t, got[1].AuthKey, "nodes must be returned with their auth key")
+	assert.Equal(t, []string{"tag:server"}, got[1].AuthKey.Tags)
+
+	got, err = db.ListNodesByTag("tag:db")
+	require.NoError(t, err)
+	require.Len(t, got, 1)
+	assert.Equal(t, nodes[2].ID, got[0].ID)
+
+	got, err = db.ListNodesByTag("tag:unknown")
+	require.NoError(t, err)
+	assert.Empty(t, got)
+}
+
+func TestListNodesManagedBy(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "node")
+
+	for _, node := range nodes[:2] {
+		require.NoError(t, db.DB.Model(&types.Node{}).
+			Where("id = ?", node.ID).Update("managed_by", "terraform").Error)
+	}
+
+	managed, err := db.ListNodesManagedBy("terraform")
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]types.NodeID{nodes[0].ID, nodes[1].ID},
+		[]types.NodeID{managed[0].ID, managed[1].ID},
+	)
+	assert.Equal(t, "terraform", managed[0].ManagedBy)
+
+	manual, err := db.ListNodesManagedBy("")
+	require.NoError(t, err)
+	require.Len(t, manual, 1)
+	assert.Equal(t, nodes[2].ID, manual[0].ID)
+
+	none, err := db.ListNodesManagedBy("pulumi")
+	require.NoError(t, err)
+	assert.Empty(t, none)
+}
+
+// TestNodeManagedByMigration checks that upgraded databases gain the
+// managed_by column and treat every existing node as manually managed.
+func TestNodeManagedByMigration(t *testing.T) {
+	db := dbForTestWithPath(t, "testdata/sqlite/failing-node-preauth-constraint_dump.sql")
+
+	assert.True(t, db.DB.Migrator().HasColumn(&types.Node{}, "managed_by"))
+
+	nodes, err := db.ListNodes()
+	require.NoError(t, err)
+	require.NotEmpty(t, nodes)
+
+	manual, err := db.ListNodesManagedBy("")
+	require.NoError(t, err)
+	assert.Len(t, manual, len(nodes))
+}
+
 func TestListPeers(t *testing.T) {
 	// Setup test database
 	db, err := newSQLiteTestDB()
@@ -752,3 +2286,253 @@ func TestListNodes(t *testing.T) {
 	assert.Equal(t, "test1", nodes[0].Hostname)
 	assert.Equal(t, "test2", nodes[1].Hostname)
 }
+
+func TestListNodesOrdered(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+
+	for _, name := range []string{"bravo", "Alpha", "charlie", "ALPHA-2", "Bravo-2"} {
+		node := db.CreateNodeForTest(user, name)
+		require.NoError(t, db.DB.Model(&types.Node{}).
+			Where("id = ?", node.ID).Update("given_name", name).Error)
+	}
+
+	nodes, err := db.ListNodesOrdered("given_name", false)
+	require.NoError(t, err)
+
+	got := make([]string, 0, len(nodes))
+	for _, node := range nodes {
+		got = append(got, node.GivenName)
+	}
+
+	assert.Equal(t, []string{"Alpha", "ALPHA-2", "bravo", "Bravo-2", "charlie"}, got)
+
+	_, err = db.ListNodesOrdered("given_name; DROP TABLE nodes", false)
+	require.ErrorIs(t, err, ErrInvalidNodeOrder)
+}
+
+func TestListNodesOrderedNullsLast(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	base := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// "never" is left NULL for both columns.
+	times := map[string]*time.Time{
+		"old":   new(base),
+		"never": nil,
+		"new":   new(base.Add(time.Hour)),
+		"mid":   new(base.Add(time.Minute)),
+	}
+
+	for _, name := range []string{"old", "never", "new", "mid"} {
+		node := db.CreateNodeForTest(user, name)
+		require.NoError(t, db.DB.Model(&types.Node{}).
+			Where("id = ?", node.ID).
+			Updates(map[string]any{
+				"given_name": name,
+				"last_seen":  times[name],
+				"expiry":     times[name],
+			}).Error)
+	}
+
+	tests := []struct {
+		orderBy string
+		desc    bool
+		want    []string
+	}{
+		{orderBy: "last_seen", want: []string{"old", "mid", "new", "never"}},
+		{orderBy: "last_seen", desc: true, want: []string{"new", "mid", "old", "never"}},
+		{orderBy: "expiry", want: []string{"old", "mid", "new", "never"}},
+		{orderBy: "expiry", desc: true, want: []string{"new", "mid", "old", "never"}},
+		{orderBy: "given_name", desc: true, want: []string{"old", "new", "never", "mid"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(fmt.Sprintf("%s/desc=%t", tt.orderBy, tt.desc), func(t *testing.T) {
+			nodes, err := db.ListNodesOrdered(tt.orderBy, tt.desc)
+			require.NoError(t, err)
+
+			got := make([]string, 0, len(nodes))
+			for _, node := range nodes {
+				got = append(got, node.Hostname)
+			}
+
+			assert.Equal(t, tt.want, got)
+		})
+	}
+}
+
+func TestReconcileNodeUserAssociations(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("owner")
+	other := db.CreateUserForTest("other")
+
+	healthy := db.CreateNodeForTest(user, "healthy")
+
+	// A tagged node that still carries a user_id.
+	tagged := db.CreateNodeForTest(other, "tagged")
+	tagged.Tags = types.Strings{"tag:server"}
+	require.NoError(t, db.DB.Save(tagged).Error)
+
+	// A user-owned node whose user_id points at a user that does not exist.
+	// Its pre-auth key still records the real owner.
+	dangling := db.CreateNodeForTest(user, "dangling")
+
+	require.NoError(t, db.DB.Exec("PRAGMA foreign_keys = OFF").Error)
+	err = db.DB.Model(&types.Node{}).Where("id = ?", dangling.ID).Update("user_id", 9999).Error
+	require.NoError(t, err)
+	require.NoError(t, db.DB.Exec("PRAGMA foreign_keys = ON").Error)
+
+	fixed, err := db.ReconcileNodeUserAssociations()
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []types.NodeID{tagged.ID, dangling.ID}, fixed)
+
+	got, err := db.GetNodeByID(healthy.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.UserID)
+	assert.Equal(t, user.ID, *got.UserID)
+
+	got, err = db.GetNodeByID(tagged.ID)
+	require.NoError(t, err)
+	assert.Nil(t, got.UserID)
+	assert.Nil(t, got.User)
+
+	got, err = db.GetNodeByID(dangling.ID)
+	require.NoError(t, err)
+	require.NotNil(t, got.UserID)
+	require.NotNil(t, got.User)
+	assert.Equal(t, user.ID, *got.UserID)
+	assert.Equal(t, user.ID, got.User.ID)
+
+	// A second pass finds nothing left to repair.
+	fixed, err = db.ReconcileNodeUserAssociations()
+	require.NoError(t, err)
+	assert.Empty(t, fixed)
+}
+
+func TestGivenNameBase(t *testing.T) {
+	tests := []struct {
+		givenName string
+		hostname  string
+		want      string
+	}{
+		{givenName: "laptop", hostname: "laptop", want: "laptop"},
+		{givenName: "laptop-3", hostname: "laptop", want: "laptop"},
+		{givenName: "laptop-3", hostname: "Laptop", want: "laptop"},
+		{givenName: "node-1", hostname: "", want: "node"},
+		{givenName: "laptop-old", hostname: "laptop", want: "laptop-old"},
+		{givenName: "web-2", hostname: "laptop", want: "web-2"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.givenName+"/"+tt.hostname, func(t *testing.T) {
+			assert.Equal(t, tt.want, givenNameBase(tt.givenName, tt.hostname))
+		})
+	}
+}
+
+func TestRenameNode(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	alice := db.CreateUserForTest("alice")
+	bob := db.CreateUserForTest("bob")
+
+	aliceNode := db.CreateRegisteredNodeForTest(alice, "laptop")
+	bobNode := db.CreateRegisteredNodeForTest(bob, "desktop")
+
+	renamed, err := RenameNode(db.DB, aliceNode.ID, "workstation")
+	require.NoError(t, err)
+	assert.Equal(t, aliceNode.ID, renamed.ID)
+	assert.Equal(t, "workstation", renamed.GivenName)
+	assert.Equal(t, "workstation", renamed.GivenNameBase)
+	require.NotNil(t, renamed.User, "the returned node is fully loaded")
+
+	// Given names are unique across users, as MagicDNS ignores the owner.
+	_, err = RenameNode(db.DB, bobNode.ID, "workstation")
+	require.ErrorIs(t, err, ErrNodeNameNotUnique)
+	assert.ErrorContains(t, err, fmt.Sprintf("node %d", aliceNode.ID))
+
+	// DNS names ignore case, so a name differing only in case collides.
+	_, err = RenameNode(db.DB, bobNode.ID, "WorkStation")
+	require.ErrorIs(t, err, ErrNodeNameNotUnique)
+
+	// Renaming a node to its current name is not a collision.
+	_, err = RenameNode(db.DB, aliceNode.ID, "workstation")
+	require.NoError(t, err)
+
+	_, err = RenameNode(db.DB, 9999, "ghost")
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+// TestGivenNameBaseMigration checks that upgraded databases have the base
+// backfilled for every existing node.
+func TestGivenNameBaseMigration(t *testing.T) {
+	db := dbForTestWithPath(t, "testdata/sqlite/failing-node-preauth-constraint_dump.sql")
+
+	nodes, err := db.ListNodes()
+	require.NoError(t, err)
+	require.NotEmpty(t, nodes)
+
+	for _, node := range nodes {
+		assert.Equal(t, node.GivenName, node.GivenNameBase,
+			"node %d has no collision suffix, so its name is its base", node.ID)
+	}
+}
+
+func TestRegisterNodeForTestReadsBack(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("readback")
+	route := netip.MustParsePrefix("10.0.0.0/24")
+
+	register := func(node types.Node, ipv4 *netip.Addr) *types.Node {
+		t.Helper()
+
+		var registered *types.Node
+
+		err := db.DB.Transaction(func(tx *gorm.DB) error {
+			var err error
+
+			registered, err = RegisterNodeForTest(tx, node, ipv4, nil)
+
+			return err
+		})
+		require.NoError(t, err)
+
+		return registered
+	}
+
+	node := db.CreateNodeForTest(user, "readback")
+	node.ApprovedRoutes = []netip.Prefix{route}
+	require.NoError(t, db.DB.Save(node).Error)
+
+	// Only the foreign keys are set; the associations must be loaded.
+	node.User = nil
+	node.AuthKey = nil
+
+	registered := register(*node, new(netip.MustParseAddr("100.64.0.1")))
+	require.NotNil(t, registered.User)
+	assert.Equal(t, user.ID, registered.User.ID)
+	require.NotNil(t, registered.AuthKey)
+	assert.Equal(t, *node.AuthKeyID, registered.AuthKey.ID)
+	assert.Equal(t, []netip.Prefix{route}, []netip.Prefix(registered.ApprovedRoutes))
+
+	// Re-registering a node that already has addresses takes the early
+	// return, which must read back as well.
+	registered.User = nil
+	registered.AuthKey = nil
+
+	again := register(*registered, nil)
+	assert.Equal(t, registered.ID, again.ID)
+	require.NotNil(t, again.User)
+	require.NotNil(t, again.AuthKey)
+	assert.Equal(t, []netip.Prefix{route}, []netip.Prefix(again.ApprovedRoutes))
+}
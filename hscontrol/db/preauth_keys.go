@@ -22,7 +22,9 @@ var (
 	ErrPreAuthKeyExpired           = errors.New("auth-key expired")
 	ErrSingleUseAuthKeyHasBeenUsed = errors.New("auth-key has already been used")
 	ErrUserMismatch                = errors.New("user mismatch")
+	ErrEphemeralMismatch           = errors.New("ephemeral mismatch")
 	ErrPreAuthKeyACLTagInvalid     = errors.New("auth-key tag is invalid")
+	ErrPreAuthKeyUsageLimitInvalid = errors.New("auth-key usage limit must not be negative")
 )
 
 // validateACLTags deduplicates, sorts, and checks that every tag carries the
@@ -151,6 +153,28 @@ func (hsdb *HSDatabase) SetPreAuthKeyDescription(id uint64, description string)
 		Update("description", description).Error
 }
 
+// SetPreAuthKeyUsageLimit caps how many nodes a reusable pre-auth key may
+// register. Like the description it is set after creation; zero removes
+// the cap.
+func (hsdb *HSDatabase) SetPreAuthKeyUsageLimit(id uint64, limit int) error {
+	if limit < 0 {
+		return fmt.Errorf("%w: %d", ErrPreAuthKeyUsageLimitInvalid, limit)
+	}
+
+	res := hsdb.DB.Model(&types.PreAuthKey{}).
+		Where("id = ?", id).
+		Update("usage_limit", limit)
+	if res.Error != nil {
+		return res.Error
+	}
+
+	if res.RowsAffected == 0 {
+		return ErrPreAuthKeyNotFound
+	}
+
+	return nil
+}
+
 func (hsdb *HSDatabase) ListPreAuthKeys() ([]types.PreAuthKey, error) {
 	return Read(hsdb.DB, ListPreAuthKeys)
 }
@@ -355,6 +379,76 @@ func DestroyPreAuthKey(tx *gorm.DB, id uint64) error {
 	})
 }
 
+func (hsdb *HSDatabase) RotateAuthKeyForNodes(oldKeyID, newKeyID uint64) ([]types.NodeID, error) {
+	return Write(hsdb.DB, func(tx *gorm.DB) ([]types.NodeID, error) {
+		return RotateAuthKeyForNodes(tx, oldKeyID, newKeyID)
+	})
+}
+
+// RotateAuthKeyForNodes moves every node registered with the key oldKeyID
+// over to newKeyID, e.g. after the old key leaked, and returns the moved
+// nodes. Both keys must belong to the same user (for tagged keys, the user
+// that created them) and agree on being ephemeral, as that decides whether
+// the nodes are removed when they disconnect. Node tags are not touched.
+func RotateAuthKeyForNodes(tx *gorm.DB, oldKeyID, newKeyID uint64) ([]types.NodeID, error) {
+	var oldKey, newKey types.PreAuthKey
+
+	err := tx.First(&oldKey, "id = ?", oldKeyID).Error
+	if err != nil {
+		return nil, fmt.Errorf("loading auth key %d: %w", oldKeyID, err)
+	}
+
+	err = tx.First(&newKey, "id = ?", newKeyID).Error
+	if err != nil {
+		return nil, fmt.Errorf("loading auth key %d: %w", newKeyID, err)
+	}
+
+	if !ptrEqual(oldKey.UserID, newKey.UserID) {
+		return nil, fmt.Errorf(
+			"%w: auth keys %d and %d belong to different users",
+			ErrUserMismatch, oldKeyID, newKeyID,
+		)
+	}
+
+	if oldKey.Ephemeral != newKey.Ephemeral {
+		return nil, fmt.Errorf(
+			"%w: auth keys %d and %d",
+			ErrEphemeralMismatch, oldKeyID, newKeyID,
+		)
+	}
+
+	var nodeIDs []types.NodeID
+
+	err = tx.Model(&types.Node{}).
+		Where("auth_key_id = ?", oldKeyID).
+		Order("id").
+		Pluck("id", &nodeIDs).Error
+	if err != nil {
+		return nil, fmt.Errorf("listing nodes of auth key %d: %w", oldKeyID, err)
+	}
+
+	if len(nodeIDs) == 0 {
+		return nil, nil
+	}
+
+	err = tx.Model(&types.Node{}).
+		Where("id IN ?", nodeIDs).
+		Update("auth_key_id", newKeyID).Error
+	if err != nil {
+		return nil, fmt.Errorf("moving nodes to auth key %d: %w", newKeyID, err)
+	}
+
+	return nodeIDs, nil
+}
+
+func ptrEqual[T comparable](a, b *T) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+
+	return *a == *b
+}
+
 func (hsdb *HSDatabase) ExpirePreAuthKey(id uint64) error {
 	return hsdb.Write(func(tx *gorm.DB) error {
 		return ExpirePreAuthKey(tx, id)
@@ -430,7 +524,29 @@ func (hsdb *HSDatabase) DestroyRevokedPreAuthKeysBefore(cutoff time.Time) (int,
 // the second returns [types.PAKError]("authkey already used"). Without the
 // guard the previous code (Update("used", true) with no WHERE) would
 // silently let both transactions claim the key.
+//
+// A reusable key is not marked used; its usage count is incremented
+// instead, guarded by its usage limit in the same way, so concurrent
+// registrations cannot overshoot the limit. Once it is reached,
+// [types.ErrPreAuthKeyUsageLimitReached] is returned.
 func UsePreAuthKey(tx *gorm.DB, k *types.PreAuthKey) error {
+	if k.Reusable {
+		res := tx.Model(&types.PreAuthKey{}).
+			Where("id = ? AND (COALESCE(usage_limit, 0) = 0 OR COALESCE(usage_count, 0) < usage_limit)", k.ID).
+			Update("usage_count", gorm.Expr("COALESCE(usage_count, 0) + 1"))
+		if res.Error != nil {
+			return fmt.Errorf("updating key usage count in database: %w", res.Error)
+		}
+
+		if res.RowsAffected == 0 {
+			return types.ErrPreAuthKeyUsageLimitReached
+		}
+
+		k.UsageCount++
+
+		return nil
+	}
+
 	res := tx.Model(&types.PreAuthKey{}).
 		Where("id = ? AND used = ?", k.ID, false).
 		Update("used", true)
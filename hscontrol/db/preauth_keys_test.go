@@ -488,6 +488,58 @@ func TestUsePreAuthKeyAtomicCAS(t *testing.T) {
 	assert.Equal(t, "authkey already used", pakErr.Error())
 }
 
+// TestUsePreAuthKeyUsageLimit verifies that a reusable key with a usage
+// limit counts every use and refuses the one past the limit, even when the
+// caller holds a stale copy of the key that still looks usable.
+func TestUsePreAuthKeyUsageLimit(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("usage-limit")
+
+	pakNew, err := db.CreatePreAuthKey(user.TypedID(), true /* reusable */, false, nil, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, db.SetPreAuthKeyUsageLimit(pakNew.ID, 2))
+
+	stale, err := db.GetPreAuthKey(pakNew.Key)
+	require.NoError(t, err)
+	require.Equal(t, 2, stale.UsageLimit)
+
+	use := func() error {
+		pak := *stale
+
+		return db.Write(func(tx *gorm.DB) error {
+			return UsePreAuthKey(tx, &pak)
+		})
+	}
+
+	// Below and up to the limit.
+	require.NoError(t, use())
+	require.NoError(t, use())
+
+	// Past the limit.
+	err = use()
+	require.ErrorIs(t, err, types.ErrPreAuthKeyUsageLimitReached)
+
+	pak, err := db.GetPreAuthKey(pakNew.Key)
+	require.NoError(t, err)
+	assert.Equal(t, 2, pak.UsageCount, "a refused use must not be counted")
+	assert.False(t, pak.Used, "reusable keys are never marked used")
+	require.ErrorIs(t, pak.Validate(), types.ErrPreAuthKeyUsageLimitReached)
+
+	// Raising the limit makes the key usable again; zero lifts it.
+	require.NoError(t, db.SetPreAuthKeyUsageLimit(pakNew.ID, 3))
+	require.NoError(t, use())
+	require.ErrorIs(t, use(), types.ErrPreAuthKeyUsageLimitReached)
+
+	require.NoError(t, db.SetPreAuthKeyUsageLimit(pakNew.ID, 0))
+	require.NoError(t, use())
+
+	require.ErrorIs(t, db.SetPreAuthKeyUsageLimit(pakNew.ID, -1), ErrPreAuthKeyUsageLimitInvalid)
+	require.ErrorIs(t, db.SetPreAuthKeyUsageLimit(99999, 1), ErrPreAuthKeyNotFound)
+}
+
 // TestGetPreAuthKeyUnknownMapsToRecordNotFound ensures an unknown (or deleted)
 // pre-auth key resolves to a record-not-found error, which the registration
 // handler maps to a 401 rather than a raw server error.
@@ -500,3 +552,61 @@ func TestGetPreAuthKeyUnknownMapsToRecordNotFound(t *testing.T) {
 	require.ErrorIs(t, err, gorm.ErrRecordNotFound,
 		"unknown pre-auth key must map to record-not-found (handled as 401)")
 }
+
+func TestRotateAuthKeyForNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("rotate")
+	other := db.CreateUserForTest("other")
+
+	oldKey, err := db.CreatePreAuthKey(user.TypedID(), true, false, nil, []string{"tag:server"})
+	require.NoError(t, err)
+
+	newKey, err := db.CreatePreAuthKey(user.TypedID(), true, false, nil, []string{"tag:server"})
+	require.NoError(t, err)
+
+	otherKey, err := db.CreatePreAuthKey(other.TypedID(), true, false, nil, nil)
+	require.NoError(t, err)
+
+	ephemeralKey, err := db.CreatePreAuthKey(user.TypedID(), true, true, nil, nil)
+	require.NoError(t, err)
+
+	nodes := db.CreateNodesForTest(user, 4, "rotate")
+	for _, node := range nodes[:3] {
+		node.AuthKeyID = new(oldKey.ID)
+		node.Tags = []string{"tag:server"}
+		node.UserID = nil
+		require.NoError(t, db.DB.Save(node).Error)
+	}
+
+	_, err = db.RotateAuthKeyForNodes(oldKey.ID, otherKey.ID)
+	require.ErrorIs(t, err, ErrUserMismatch)
+
+	_, err = db.RotateAuthKeyForNodes(oldKey.ID, ephemeralKey.ID)
+	require.ErrorIs(t, err, ErrEphemeralMismatch)
+
+	_, err = db.RotateAuthKeyForNodes(oldKey.ID, 9999)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	moved, err := db.RotateAuthKeyForNodes(oldKey.ID, newKey.ID)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodes[0].ID, nodes[1].ID, nodes[2].ID}, moved)
+
+	for _, node := range nodes[:3] {
+		got, err := db.GetNodeByID(node.ID)
+		require.NoError(t, err)
+		require.NotNil(t, got.AuthKeyID)
+		assert.Equal(t, newKey.ID, *got.AuthKeyID)
+		assert.Equal(t, []string{"tag:server"}, []string(got.Tags))
+	}
+
+	// The fourth node registered with a key of its own and stays on it.
+	untouched, err := db.GetNodeByID(nodes[3].ID)
+	require.NoError(t, err)
+	assert.Equal(t, nodes[3].AuthKeyID, untouched.AuthKeyID)
+
+	moved, err = db.RotateAuthKeyForNodes(oldKey.ID, newKey.ID)
+	require.NoError(t, err)
+	assert.Empty(t, moved, "no nodes are left on the old key")
+}
@@ -0,0 +1,92 @@
+package db
+
+import (
+	"fmt"
+	"math"
+	"net/netip"
+
+	"go4.org/netipx"
+	"gorm.io/gorm"
+)
+
+// ipv6NetworkBits is the prefix length [TotalRoutedAddressSpace] counts IPv6
+// space in, as the number of individual addresses does not fit in a uint64.
+const ipv6NetworkBits = 64
+
+func (hsdb *HSDatabase) TotalRoutedAddressSpace() (uint64, uint64, error) {
+	var v4, v6 uint64
+
+	err := hsdb.Read(func(rx *gorm.DB) error {
+		var err error
+
+		v4, v6, err = TotalRoutedAddressSpace(rx)
+
+		return err
+	})
+
+	return v4, v6, err
+}
+
+// TotalRoutedAddressSpace reports how much address space the tailnet can
+// reach through its subnet routers. Every announced and approved subnet route
+// is merged before counting, so routes overlapping within or across nodes are
+// not counted twice. Exit routes are left out as they cover the whole
+// internet rather than a routed subnet.
+//
+// The first value is the exact number of IPv4 addresses. The second is an
+// approximation of the IPv6 space counted in /64 networks: a prefix longer
+// than /64 counts as one and the total saturates at [math.MaxUint64].
+func TotalRoutedAddressSpace(tx *gorm.DB) (uint64, uint64, error) {
+	nodes, err := ListNodes(tx)
+	if err != nil {
+		return 0, 0, fmt.Errorf("listing nodes: %w", err)
+	}
+
+	var builder netipx.IPSetBuilder
+
+	for _, node := range nodes {
+		for _, route := range node.SubnetRoutes() {
+			builder.AddPrefix(route)
+		}
+	}
+
+	set, err := builder.IPSet()
+	if err != nil {
+		return 0, 0, fmt.Errorf("merging routes: %w", err)
+	}
+
+	var v4, v6 uint64
+
+	for _, prefix := range set.Prefixes() {
+		if prefix.Addr().Is4() {
+			v4 += 1 << (prefix.Addr().BitLen() - prefix.Bits())
+
+			continue
+		}
+
+		v6 = saturatingAdd(v6, ipv6Networks(prefix))
+	}
+
+	return v4, v6, nil
+}
+
+// ipv6Networks returns the number of /64 networks covered by prefix, rounding
+// anything smaller than a /64 up to one.
+func ipv6Networks(prefix netip.Prefix) uint64 {
+	switch {
+	case prefix.Bits() >= ipv6NetworkBits:
+		return 1
+	case prefix.Bits() == 0:
+		return math.MaxUint64
+	default:
+		return 1 << (ipv6NetworkBits - prefix.Bits())
+	}
+}
+
+func saturatingAdd(a, b uint64) uint64 {
+	if a > math.MaxUint64-b {
+		return math.MaxUint64
+	}
+
+	return a + b
+}
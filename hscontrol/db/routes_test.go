@@ -0,0 +1,73 @@
+package db
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+// announceRoutesForTest makes node announce the given routes and approves the
+// subset in approved, persisting both.
+func announceRoutesForTest(t *testing.T, db *HSDatabase, node *types.Node, announced, approved []netip.Prefix) {
+	t.Helper()
+
+	node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: announced}
+	node.ApprovedRoutes = approved
+
+	require.NoError(t, db.DB.Save(node).Error)
+}
+
+func TestTotalRoutedAddressSpace(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("test")
+	nodes := db.CreateNodesForTest(user, 3, "router")
+
+	v4, v6, err := db.TotalRoutedAddressSpace()
+	require.NoError(t, err)
+	assert.Zero(t, v4)
+	assert.Zero(t, v6)
+
+	// 10.0.1.0/24 and fd00::/64 sit inside routes of another node and must
+	// not be counted twice. The unapproved and exit routes do not count.
+	announceRoutesForTest(t, db, nodes[0],
+		[]netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/16"),
+			netip.MustParsePrefix("fd00::/56"),
+			netip.MustParsePrefix("192.168.0.0/24"),
+			tsaddr.AllIPv4(),
+		},
+		[]netip.Prefix{
+			netip.MustParsePrefix("10.0.0.0/16"),
+			netip.MustParsePrefix("fd00::/56"),
+			tsaddr.AllIPv4(),
+		},
+	)
+	announceRoutesForTest(t, db, nodes[1],
+		[]netip.Prefix{
+			netip.MustParsePrefix("10.0.1.0/24"),
+			netip.MustParsePrefix("fd00::/64"),
+			netip.MustParsePrefix("fd01::/120"),
+		},
+		[]netip.Prefix{
+			netip.MustParsePrefix("10.0.1.0/24"),
+			netip.MustParsePrefix("fd00::/64"),
+			netip.MustParsePrefix("fd01::/120"),
+		},
+	)
+	announceRoutesForTest(t, db, nodes[2],
+		[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")},
+		[]netip.Prefix{netip.MustParsePrefix("10.1.0.0/24")},
+	)
+
+	v4, v6, err = db.TotalRoutedAddressSpace()
+	require.NoError(t, err)
+	assert.Equal(t, uint64(65536+256), v4)
+	assert.Equal(t, uint64(256+1), v6)
+}
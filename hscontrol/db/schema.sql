@@ -12,6 +12,9 @@ CREATE TABLE users(
   provider_identifier text,
   provider text,
   profile_pic_url text,
+  max_key_lifetime integer,
+  max_nodes integer,
+  default_tags text,
 
   created_at datetime,
   updated_at datetime,
@@ -48,6 +51,8 @@ CREATE TABLE pre_auth_keys(
   reusable numeric,
   ephemeral numeric DEFAULT false,
   used numeric DEFAULT false,
+  usage_limit integer DEFAULT 0,
+  usage_count integer DEFAULT 0,
   tags text,
   expiration datetime,
   revoked datetime,
@@ -112,15 +117,28 @@ CREATE TABLE nodes(
   ipv6 text,
   hostname text,
   given_name varchar(63),
+  given_name_base varchar(63),
   -- user_id is NULL for tagged nodes (owned by tags, not a user).
   -- Only set for user-owned nodes (no tags).
   user_id integer,
   register_method text,
   tags text,
+  tagged_by_user_id integer,
+  managed_by text,
   auth_key_id integer,
   last_seen datetime,
+  first_seen datetime,
+  last_handshake datetime,
   expiry datetime,
   approved_routes text,
+  exit_node_disabled numeric DEFAULT false,
+  auto_approve_exit numeric DEFAULT false,
+  pending_approval numeric DEFAULT false,
+  route_priority integer DEFAULT 0,
+  cap_ver integer,
+  os text,
+  client_version text,
+  description text,
 
   created_at datetime,
   updated_at datetime,
@@ -129,6 +147,19 @@ CREATE TABLE nodes(
   CONSTRAINT fk_nodes_user FOREIGN KEY(user_id) REFERENCES users(id) ON DELETE CASCADE,
   CONSTRAINT fk_nodes_auth_key FOREIGN KEY(auth_key_id) REFERENCES pre_auth_keys(id)
 );
+CREATE INDEX idx_nodes_node_key ON nodes(node_key);
+
+-- Append-only audit trail of the machine and node keys a node held before
+-- each rotation. node_id has no foreign key so the history outlives the node.
+CREATE TABLE node_key_history(
+  id integer PRIMARY KEY AUTOINCREMENT,
+  node_id integer,
+  machine_key text,
+  node_key text,
+  reason text,
+  changed_at datetime
+);
+CREATE INDEX idx_node_key_history_node_id ON node_key_history(node_id);
 
 CREATE TABLE policies(
   id integer PRIMARY KEY AUTOINCREMENT,
@@ -0,0 +1,108 @@
+package db
+
+import (
+	"fmt"
+	"net/netip"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"gorm.io/gorm"
+)
+
+// SupportBundle collects everything known about a node for a support ticket
+// in one serialisable value. Headscale keeps no connection or audit log, so
+// the bundle reflects the current state only.
+type SupportBundle struct {
+	GeneratedAt time.Time `json:"generated_at"`
+
+	// Node is the node row. Its AuthKey is left out in favour of AuthKey
+	// below so the bundle carries no key material.
+	Node *types.Node `json:"node"`
+
+	// User is the owner of the node, nil for tagged nodes.
+	User *types.User `json:"user,omitempty"`
+
+	// AuthKey describes the pre-auth key the node registered with, if any.
+	AuthKey *SupportBundleAuthKey `json:"auth_key,omitempty"`
+
+	Routes SupportBundleRoutes `json:"routes"`
+
+	Online   bool       `json:"online"`
+	Expired  bool       `json:"expired"`
+	Expiry   *time.Time `json:"expiry,omitempty"`
+	LastSeen *time.Time `json:"last_seen,omitempty"`
+}
+
+// SupportBundleAuthKey is the non-secret part of a [types.PreAuthKey].
+type SupportBundleAuthKey struct {
+	ID         uint64     `json:"id"`
+	Prefix     string     `json:"prefix,omitempty"`
+	Reusable   bool       `json:"reusable"`
+	Ephemeral  bool       `json:"ephemeral"`
+	Used       bool       `json:"used"`
+	Tags       []string   `json:"tags,omitempty"`
+	Expiration *time.Time `json:"expiration,omitempty"`
+}
+
+// SupportBundleRoutes lists the routes of a node by stage.
+type SupportBundleRoutes struct {
+	Announced []netip.Prefix `json:"announced"`
+	Approved  []netip.Prefix `json:"approved"`
+	Subnet    []netip.Prefix `json:"subnet"`
+	Exit      []netip.Prefix `json:"exit"`
+}
+
+func (hsdb *HSDatabase) NodeSupportBundle(
+	nodeID types.NodeID,
+	isConnected func(types.NodeID) bool,
+) (SupportBundle, error) {
+	return Read(hsdb.DB, func(rx *gorm.DB) (SupportBundle, error) {
+		return NodeSupportBundle(rx, nodeID, isConnected)
+	})
+}
+
+// NodeSupportBundle builds the [SupportBundle] of a node. isConnected
+// reports whether the node currently holds a poll session, which the
+// database does not know.
+func NodeSupportBundle(
+	tx *gorm.DB,
+	nodeID types.NodeID,
+	isConnected func(types.NodeID) bool,
+) (SupportBundle, error) {
+	node, err := GetNodeByID(tx, nodeID)
+	if err != nil {
+		return SupportBundle{}, fmt.Errorf("loading node %d: %w", nodeID, err)
+	}
+
+	bundle := SupportBundle{
+		GeneratedAt: time.Now(),
+		User:        node.User,
+		Routes: SupportBundleRoutes{
+			Announced: node.AnnouncedRoutes(),
+			Approved:  node.ApprovedRoutes,
+			Subnet:    node.SubnetRoutes(),
+			Exit:      node.ExitRoutes(),
+		},
+		Online:   isConnected(nodeID),
+		Expired:  node.IsExpired(),
+		Expiry:   node.Expiry,
+		LastSeen: node.LastSeen,
+	}
+
+	if pak := node.AuthKey; pak != nil {
+		bundle.AuthKey = &SupportBundleAuthKey{
+			ID:         pak.ID,
+			Prefix:     pak.Prefix,
+			Reusable:   pak.Reusable,
+			Ephemeral:  pak.Ephemeral,
+			Used:       pak.Used,
+			Tags:       pak.Tags,
+			Expiration: pak.Expiration,
+		}
+	}
+
+	node.AuthKey = nil
+	bundle.Node = node
+
+	return bundle, nil
+}
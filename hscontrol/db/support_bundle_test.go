@@ -0,0 +1,71 @@
+package db
+
+import (
+	"encoding/json"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+)
+
+func TestNodeSupportBundle(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("support")
+	node := db.CreateRegisteredNodeForTest(user, "router")
+
+	subnet := netip.MustParsePrefix("10.0.0.0/24")
+	exit := []netip.Prefix{netip.MustParsePrefix("0.0.0.0/0"), netip.MustParsePrefix("::/0")}
+	lastSeen := time.Now().Add(-time.Minute)
+
+	node.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: append([]netip.Prefix{subnet}, exit...)}
+	node.ApprovedRoutes = []netip.Prefix{subnet}
+	node.Expiry = new(time.Now().Add(time.Hour))
+	node.LastSeen = &lastSeen
+	require.NoError(t, db.DB.Save(node).Error)
+
+	isConnected := func(id types.NodeID) bool { return id == node.ID }
+
+	bundle, err := db.NodeSupportBundle(node.ID, isConnected)
+	require.NoError(t, err)
+
+	require.NotNil(t, bundle.Node)
+	assert.Equal(t, node.ID, bundle.Node.ID)
+	assert.Nil(t, bundle.Node.AuthKey, "the node row must not carry key material")
+
+	require.NotNil(t, bundle.User)
+	assert.Equal(t, user.ID, bundle.User.ID)
+
+	require.NotNil(t, bundle.AuthKey)
+	assert.Equal(t, *node.AuthKeyID, bundle.AuthKey.ID)
+
+	assert.Len(t, bundle.Routes.Announced, 3)
+	assert.Equal(t, []netip.Prefix{subnet}, bundle.Routes.Approved)
+	assert.Equal(t, []netip.Prefix{subnet}, bundle.Routes.Subnet)
+	assert.Empty(t, bundle.Routes.Exit, "exit routes are not approved")
+
+	assert.True(t, bundle.Online)
+	assert.False(t, bundle.Expired)
+	require.NotNil(t, bundle.Expiry)
+	require.NotNil(t, bundle.LastSeen)
+	assert.WithinDuration(t, lastSeen, *bundle.LastSeen, time.Second)
+
+	out, err := json.Marshal(bundle)
+	require.NoError(t, err)
+
+	var sections map[string]json.RawMessage
+	require.NoError(t, json.Unmarshal(out, &sections))
+
+	for _, section := range []string{"node", "user", "auth_key", "routes", "online", "expiry", "last_seen"} {
+		assert.Contains(t, sections, section)
+	}
+
+	_, err = db.NodeSupportBundle(9999, isConnected)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
@@ -5,17 +5,22 @@ import (
 	"fmt"
 	"strconv"
 	"testing"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"gorm.io/gorm"
+	"gorm.io/gorm/clause"
 )
 
 var (
-	ErrUserExists        = errors.New("user already exists")
-	ErrUserNotFound      = errors.New("user not found")
-	ErrUserStillHasNodes = errors.New("user not empty: node(s) found")
-	ErrUserNotUnique     = errors.New("expected exactly one user")
+	ErrUserExists           = errors.New("user already exists")
+	ErrUserNotFound         = errors.New("user not found")
+	ErrInvalidKeyLifetime   = errors.New("key lifetime must be positive")
+	ErrUserStillHasNodes    = errors.New("user not empty: node(s) found")
+	ErrUserNotUnique        = errors.New("expected exactly one user")
+	ErrInvalidNodeLimit     = errors.New("node limit must not be negative")
+	ErrUserNodeLimitReached = errors.New("user has reached its node limit")
 )
 
 func (hsdb *HSDatabase) CreateUser(user types.User) (*types.User, error) {
@@ -117,17 +122,139 @@ func RenameUser(tx *gorm.DB, uid types.UserID, newName string) error {
 	return nil
 }
 
+func (hsdb *HSDatabase) SetUserMaxKeyLifetime(uid types.UserID, lifetime *time.Duration) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetUserMaxKeyLifetime(tx, uid, lifetime)
+	})
+}
+
+func (hsdb *HSDatabase) SetUserMaxNodes(uid types.UserID, maxNodes int) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetUserMaxNodes(tx, uid, maxNodes)
+	})
+}
+
+func (hsdb *HSDatabase) SetUserDefaultTags(uid types.UserID, tags []string) error {
+	return hsdb.Write(func(tx *gorm.DB) error {
+		return SetUserDefaultTags(tx, uid, tags)
+	})
+}
+
+// SetUserDefaultTags stores the tags applied to every node a [types.User]
+// registers. Validation should be done in the state layer before calling
+// this function.
+func SetUserDefaultTags(tx *gorm.DB, uid types.UserID, tags []string) error {
+	result := tx.Model(&types.User{}).
+		Where("id = ?", uid).
+		Select("default_tags").
+		Updates(&types.User{DefaultTags: tags})
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// SetUserMaxNodes stores how many nodes a [types.User] may own. Zero
+// removes the limit.
+func SetUserMaxNodes(tx *gorm.DB, uid types.UserID, maxNodes int) error {
+	if maxNodes < 0 {
+		return fmt.Errorf("%w: %d", ErrInvalidNodeLimit, maxNodes)
+	}
+
+	result := tx.Model(&types.User{}).
+		Where("id = ?", uid).
+		Update("max_nodes", maxNodes)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
+// CheckUserNodeLimit returns [ErrUserNodeLimitReached] when the user already
+// owns as many nodes as its MaxNodes allows. Call it in the transaction that
+// saves the new node so concurrent registrations cannot both slip under the
+// limit: SQLite write transactions already run one at a time, and on other
+// databases the user row is locked until tx ends.
+func CheckUserNodeLimit(tx *gorm.DB, uid types.UserID) error {
+	var user types.User
+
+	query := tx.Select("max_nodes").Where("id = ?", uid)
+	if tx.Name() != "sqlite" {
+		query = query.Clauses(clause.Locking{Strength: "UPDATE"})
+	}
+
+	err := query.Take(&user).Error
+	if err != nil {
+		if errors.Is(err, gorm.ErrRecordNotFound) {
+			return ErrUserNotFound
+		}
+
+		return fmt.Errorf("loading node limit: %w", err)
+	}
+
+	if user.MaxNodes <= 0 {
+		return nil
+	}
+
+	var count int64
+
+	err = tx.Model(&types.Node{}).Scopes(notDeleted).Where("user_id = ?", uid).Count(&count).Error
+	if err != nil {
+		return fmt.Errorf("counting nodes of user %d: %w", uid, err)
+	}
+
+	if count >= int64(user.MaxNodes) {
+		return fmt.Errorf("%w: %d of %d", ErrUserNodeLimitReached, count, user.MaxNodes)
+	}
+
+	return nil
+}
+
+// SetUserMaxKeyLifetime stores the key lifetime override of a [types.User].
+// A nil lifetime clears the override.
+func SetUserMaxKeyLifetime(tx *gorm.DB, uid types.UserID, lifetime *time.Duration) error {
+	if lifetime != nil && *lifetime <= 0 {
+		return fmt.Errorf("%w: %s", ErrInvalidKeyLifetime, *lifetime)
+	}
+
+	result := tx.Model(&types.User{}).
+		Where("id = ?", uid).
+		Update("max_key_lifetime", lifetime)
+	if result.Error != nil {
+		return result.Error
+	}
+
+	if result.RowsAffected == 0 {
+		return ErrUserNotFound
+	}
+
+	return nil
+}
+
 func (hsdb *HSDatabase) GetUserByID(uid types.UserID) (*types.User, error) {
 	return GetUserByID(hsdb.DB, uid)
 }
 
 func GetUserByID(tx *gorm.DB, uid types.UserID) (*types.User, error) {
 	user := types.User{}
-	if result := tx.First(&user, "id = ?", uid); errors.Is(
-		result.Error,
-		gorm.ErrRecordNotFound,
-	) {
-		return nil, ErrUserNotFound
+
+	err := tx.First(&user, "id = ?", uid).Error
+	if errors.Is(err, gorm.ErrRecordNotFound) {
+		return nil, fmt.Errorf("%w: %d", ErrUserNotFound, uid)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("loading user %d: %w", uid, err)
 	}
 
 	return &user, nil
@@ -279,3 +279,63 @@ func TestRenameUser(t *testing.T) {
 		})
 	}
 }
+
+func TestCheckUserNodeLimit(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxNodes int
+		owned    int
+		wantErr  error
+	}{
+		{name: "unlimited", maxNodes: 0, owned: 5},
+		{name: "below-limit", maxNodes: 3, owned: 2},
+		{name: "at-limit", maxNodes: 3, owned: 3, wantErr: ErrUserNodeLimitReached},
+		{name: "above-limit", maxNodes: 2, owned: 3, wantErr: ErrUserNodeLimitReached},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			db, err := newSQLiteTestDB()
+			require.NoError(t, err)
+
+			user := db.CreateUserForTest("limited")
+			uid := types.UserID(user.ID)
+			db.CreateNodesForTest(user, tt.owned, "owned")
+
+			// Nodes of other users do not count against the limit.
+			other := db.CreateUserForTest("other")
+			db.CreateNodesForTest(other, 5, "other")
+
+			require.NoError(t, db.SetUserMaxNodes(uid, tt.maxNodes))
+
+			err = db.Write(func(tx *gorm.DB) error {
+				return CheckUserNodeLimit(tx, uid)
+			})
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+			} else {
+				require.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestSetUserMaxNodes(t *testing.T) {
+	db, err := newSQLiteTestDB()
+	require.NoError(t, err)
+
+	user := db.CreateUserForTest("limited")
+	uid := types.UserID(user.ID)
+
+	require.NoError(t, db.SetUserMaxNodes(uid, 4))
+
+	stored, err := db.GetUserByID(uid)
+	require.NoError(t, err)
+	assert.Equal(t, 4, stored.MaxNodes)
+
+	err = db.SetUserMaxNodes(uid, -1)
+	require.ErrorIs(t, err, ErrInvalidNodeLimit)
+
+	err = db.SetUserMaxNodes(99988, 1)
+	require.ErrorIs(t, err, ErrUserNotFound)
+}
@@ -1,6 +1,7 @@
 package db
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"regexp"
@@ -46,6 +47,16 @@ func (s semver) String() string {
 	return fmt.Sprintf("v%d.%d.%d", s.Major, s.Minor, s.Patch)
 }
 
+// compare returns -1, 0 or +1 depending on whether s is lower than, equal
+// to or higher than o.
+func (s semver) compare(o semver) int {
+	return cmp.Or(
+		cmp.Compare(s.Major, o.Major),
+		cmp.Compare(s.Minor, o.Minor),
+		cmp.Compare(s.Patch, o.Patch),
+	)
+}
+
 // parseVersion parses a version string like "v0.25.0", "0.25.1",
 // "v0.25.0-beta.1", or "v0.25.0-rc1+build123" into its major, minor,
 // patch components. Pre-release and build metadata suffixes are stripped.
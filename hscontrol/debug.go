@@ -4,6 +4,7 @@ import (
 	"cmp"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
@@ -13,6 +14,7 @@ import (
 	"time"
 
 	"github.com/arl/statsviz"
+	"github.com/juanfont/headscale/hscontrol/state"
 	"github.com/juanfont/headscale/hscontrol/templates"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/types/change"
@@ -360,8 +362,15 @@ func (h *Headscale) doPing(ctx context.Context, query string) *templates.PingRes
 		}
 	}
 
-	node, ok := h.state.ResolveNode(query)
-	if !ok {
+	node, err := h.state.ResolveNode(query)
+	if errors.Is(err, state.ErrNodeAmbiguous) {
+		return &templates.PingResult{
+			Status:  "error",
+			Message: fmt.Sprintf("Node %q is ambiguous, use the node ID.", query),
+		}
+	}
+
+	if err != nil {
 		return &templates.PingResult{
 			Status:  "error",
 			Message: fmt.Sprintf("Node %q not found.", query),
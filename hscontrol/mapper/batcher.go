@@ -598,7 +598,8 @@ func (b *Batcher) addToBatch(changes ...change.Change) {
 	// errors when workers try to generate map responses for deleted nodes.
 	//
 	// Safety: [change.Change.PeersRemoved] is ONLY populated when nodes are actually
-	// deleted from the system (via [change.NodeRemoved] in [state.State.DeleteNode]).
+	// deleted from the system (via [change.NodeRemoved] in [state.State.PurgeNode]
+	// or [state.State.SoftDeleteNode]).
 	// Policy changes that affect peer visibility do NOT use this field - they set
 	// RequiresRuntimePeerComputation=true and compute removed peers at runtime,
 	// putting them in [tailcfg.MapResponse.PeersRemoved] (a different struct).
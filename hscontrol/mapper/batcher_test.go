@@ -2159,7 +2159,7 @@ func TestNodeDeletedWhileChangesPending(t *testing.T) {
 
 			// Delete the node from state - this returns a NodeRemoved change
 			// In production, this change is sent to batcher via app.Change()
-			nodeChange, err := st.DeleteNode(nodeToDelete)
+			nodeChange, err := st.PurgeNode(nodeToDelete)
 			require.NoError(t, err, "should be able to delete node from state")
 			t.Logf("Deleted node %d from state, change: %s", node3.n.ID, nodeChange.Reason)
 
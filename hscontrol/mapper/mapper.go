@@ -14,7 +14,6 @@ import (
 	"strings"
 	"time"
 
-	"github.com/juanfont/headscale/hscontrol/policy"
 	"github.com/juanfont/headscale/hscontrol/state"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/types/change"
@@ -434,34 +433,19 @@ func (m *mapper) buildFromChange(
 
 // visiblePeerIDs returns the set of peer node IDs the recipient may see under
 // the current policy. It is the single visibility decision shared by the
-// incremental peer-change and user-profile paths, computed from the same live
-// per-node matchers and [policy.ReduceNodes] filter that
-// [MapResponseBuilder.buildTailPeers] applies to full peer objects, so the
-// paths cannot drift. The snapshot peer map ([NodeStore.ListPeers]) is used
-// only as the candidate set, matching buildTailPeers; the live policy decides
-// visibility because the snapshot is not rebuilt on policy changes.
+// incremental peer-change and user-profile paths, taken from
+// [state.State.ListVisiblePeers]. It filters with [state.FilterVisiblePeers],
+// which [MapResponseBuilder.buildTailPeers] also uses for full peer objects,
+// so the paths cannot drift.
 //
 // ok is false when the node or its matchers cannot be resolved; callers must
 // then fail closed (emit nothing) rather than risk leaking forbidden peers.
 func (m *mapper) visiblePeerIDs(nodeID types.NodeID) (map[tailcfg.NodeID]struct{}, bool) {
-	node, ok := m.state.GetNodeByID(nodeID)
-	if !ok {
-		return nil, false
-	}
-
-	matchers, err := m.state.MatchersForNode(node)
+	peers, err := m.state.ListVisiblePeers(nodeID)
 	if err != nil {
 		return nil, false
 	}
 
-	peers := m.state.ListPeers(nodeID)
-
-	// No matchers means no policy restrictions, so every peer is visible —
-	// the same default buildTailPeers applies.
-	if len(matchers) > 0 {
-		peers = policy.ReduceNodes(node, peers, matchers)
-	}
-
 	// Key by tailcfg.NodeID so the peer-patch path can look up by patch.NodeID
 	// directly, avoiding an unchecked int64->uint64 conversion.
 	visible := make(map[tailcfg.NodeID]struct{}, peers.Len())
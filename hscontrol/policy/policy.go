@@ -8,6 +8,7 @@ import (
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/rs/zerolog/log"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/types/views"
 )
 
@@ -59,6 +60,9 @@ func ReduceRoutes(
 // - Previously approved routes are ALWAYS preserved (auto-approval never removes routes)
 // - New routes can be auto-approved according to policy
 // - Routes can only be removed by explicit admin action (not by auto-approval).
+//
+// Exit routes of a node with [types.Node.AutoApproveExit] set are approved
+// without consulting the policy.
 func ApproveRoutesWithPolicy(pm PolicyManager, nv types.NodeView, currentApproved, announcedRoutes []netip.Prefix) ([]netip.Prefix, bool) {
 	if pm == nil {
 		return currentApproved, false
@@ -75,7 +79,8 @@ func ApproveRoutesWithPolicy(pm PolicyManager, nv types.NodeView, currentApprove
 		}
 
 		// Check if this new route can be auto-approved by policy
-		canApprove := pm.NodeCanApproveRoute(nv, route)
+		canApprove := (nv.AutoApproveExit() && tsaddr.IsExitRoute(route)) ||
+			pm.NodeCanApproveRoute(nv, route)
 		if canApprove {
 			newApproved = append(newApproved, route)
 		}
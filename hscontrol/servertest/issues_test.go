@@ -459,7 +459,7 @@ func TestIssuesServerMutations(t *testing.T) {
 		node2View, ok := srv.State().GetNodeByID(nodeID2)
 		require.True(t, ok)
 
-		deleteChange, err := srv.State().DeleteNode(node2View)
+		deleteChange, err := srv.State().PurgeNode(node2View)
 		require.NoError(t, err)
 		srv.App.Change(deleteChange)
 
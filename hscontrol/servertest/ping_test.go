@@ -148,8 +148,8 @@ func TestPingResolveByHostname(t *testing.T) {
 	st := h.Server.State()
 
 	// Resolve by hostname.
-	node, ok := st.ResolveNode("my-test-host")
-	require.True(t, ok, "should resolve node by hostname")
+	node, err := st.ResolveNode("my-test-host")
+	require.NoError(t, err, "should resolve node by hostname")
 
 	nodeID := node.ID()
 
@@ -195,7 +195,7 @@ func TestRaceConcurrentServerMutations(t *testing.T) {
 		// Delete node2 and change policy simultaneously.
 
 		wg.Go(func() {
-			delChange, err := srv.State().DeleteNode(nv2)
+			delChange, err := srv.State().PurgeNode(nv2)
 			if err == nil {
 				srv.App.Change(delChange)
 			}
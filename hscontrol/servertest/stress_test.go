@@ -119,7 +119,7 @@ func TestStressConnectDisconnect(t *testing.T) {
 		nv, ok := srv.State().GetNodeByID(nodeID)
 		require.True(t, ok)
 
-		deleteChange, err := srv.State().DeleteNode(nv)
+		deleteChange, err := srv.State().PurgeNode(nv)
 		require.NoError(t, err)
 		srv.App.Change(deleteChange)
 
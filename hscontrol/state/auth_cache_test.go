@@ -6,8 +6,10 @@ import (
 
 	"github.com/hashicorp/golang-lru/v2/expirable"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"tailscale.com/types/key"
 )
 
 // TestAuthCacheBoundedLRU verifies that the registration auth cache is
@@ -62,3 +64,70 @@ func TestAuthCacheBoundedLRU(t *testing.T) {
 		assert.True(t, ok, "non-evicted entry %d should still be in the cache", i)
 	}
 }
+
+// TestStaleRegistrations verifies that pending registrations past the
+// threshold are listed, that non-registration requests are ignored, and that
+// evicting them wakes the parked AuthRequest with ErrRegistrationExpired.
+func TestStaleRegistrations(t *testing.T) {
+	s := &State{
+		authCache: expirable.NewLRU[types.AuthID, *types.AuthRequest](
+			defaultRegisterCacheMaxEntries,
+			func(_ types.AuthID, rn *types.AuthRequest) {
+				rn.FinishAuth(types.AuthVerdict{Err: ErrRegistrationExpired})
+			},
+			time.Hour,
+		),
+	}
+
+	regID := types.MustAuthID()
+	reg := types.NewRegisterAuthRequest(&types.RegistrationData{
+		MachineKey: key.NewMachine().Public(),
+		Hostname:   "waiting-laptop",
+	})
+	s.SetAuthCacheEntry(regID, reg)
+	s.SetAuthCacheEntry(types.MustAuthID(), types.NewSSHCheckAuthRequest(1, 2))
+
+	assert.Empty(t, s.ListStaleRegistrations(time.Hour),
+		"a registration younger than the threshold is not stale")
+
+	stale := s.ListStaleRegistrations(0)
+	require.Len(t, stale, 1, "only registration requests are listed")
+	assert.Equal(t, regID, stale[0].AuthID)
+	assert.Equal(t, "waiting-laptop", stale[0].Hostname)
+	assert.Equal(t, reg.CreatedAt(), stale[0].CreatedAt)
+
+	assert.Equal(t, 1, s.EvictStaleRegistrations(0))
+
+	_, ok := s.GetAuthCacheEntry(regID)
+	assert.False(t, ok, "evicted registration must leave the cache")
+	assert.Equal(t, 1, s.authCache.Len(), "the SSH check request must be kept")
+
+	select {
+	case verdict := <-reg.WaitForAuth():
+		require.ErrorIs(t, verdict.Err, ErrRegistrationExpired)
+	case <-time.After(time.Second):
+		t.Fatal("eviction did not wake the parked AuthRequest")
+	}
+}
+
+// TestHandleNodeFromAuthPathRejectsSSHCheckRequest ensures that registering a
+// node with the ID of an SSH check request fails with a typed error instead
+// of panicking on its missing registration data, and leaves the request in
+// place for the SSH check it belongs to.
+func TestHandleNodeFromAuthPathRejectsSSHCheckRequest(t *testing.T) {
+	s := &State{
+		authCache: expirable.NewLRU[types.AuthID, *types.AuthRequest](
+			defaultRegisterCacheMaxEntries, nil, time.Hour,
+		),
+	}
+
+	authID := types.MustAuthID()
+	s.SetAuthCacheEntry(authID, types.NewSSHCheckAuthRequest(1, 2))
+
+	_, _, err := s.HandleNodeFromAuthPath(authID, 1, nil, util.RegisterMethodCLI)
+	require.ErrorIs(t, err, ErrAuthRequestNotRegistration)
+	assert.Contains(t, err.Error(), authID.String())
+
+	_, ok := s.GetAuthCacheEntry(authID)
+	assert.True(t, ok, "the SSH check request must be kept")
+}
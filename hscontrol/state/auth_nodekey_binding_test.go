@@ -6,8 +6,10 @@ import (
 
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
 	"github.com/stretchr/testify/require"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 // TestPreAuthKeyReauthRejectsVictimNodeKey ensures the PAK re-registration
@@ -72,3 +74,57 @@ func TestPreAuthKeyReauthRejectsVictimNodeKey(t *testing.T) {
 	require.Equal(t, victimNode.MachineKey, resolved.MachineKey(),
 		"victim NodeKey must remain bound to the victim's MachineKey")
 }
+
+// TestReauthRecordsNodeKeyHistory ensures a node key rotated by
+// re-authenticating through the auth path lands in the node's key history,
+// the same as an explicit [State.RotateNodeKey].
+func TestReauthRecordsNodeKeyHistory(t *testing.T) {
+	dbPath := t.TempDir() + "/headscale.db"
+	cfg := persistTestConfig(dbPath)
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("rotate-user")
+	node := database.CreateRegisteredNodeForTest(user, "rotate-node")
+	nodeID := node.ID
+	machineKey := node.MachineKey
+	oldNodeKey := node.NodeKey
+	discoKey := node.DiscoKey
+
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	newNodeKey := key.NewNode().Public()
+	expiry := time.Now().Add(24 * time.Hour)
+
+	authID := types.MustAuthID()
+	s.SetAuthCacheEntry(authID, types.NewRegisterAuthRequest(&types.RegistrationData{
+		MachineKey: machineKey,
+		NodeKey:    newNodeKey,
+		DiscoKey:   discoKey,
+		Hostname:   "rotate-node",
+		Hostinfo:   &tailcfg.Hostinfo{Hostname: "rotate-node"},
+		Expiry:     &expiry,
+	}))
+
+	finalNode, _, err := s.HandleNodeFromAuthPath(
+		authID,
+		types.UserID(user.ID),
+		nil,
+		util.RegisterMethodOIDC,
+	)
+	require.NoError(t, err)
+	require.Equal(t, nodeID, finalNode.ID(), "re-auth must update the existing node")
+	require.Equal(t, newNodeKey, finalNode.NodeKey())
+
+	history, err := s.DB().GetNodeKeyHistory(nodeID)
+	require.NoError(t, err)
+	require.Len(t, history, 1)
+	require.Equal(t, oldNodeKey, history[0].NodeKey)
+	require.Equal(t, machineKey, history[0].MachineKey)
+	require.Equal(t, types.NodeKeyHistoryNodeKeyChanged, history[0].Reason)
+}
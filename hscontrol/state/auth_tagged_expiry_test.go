@@ -8,6 +8,7 @@ import (
 	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
@@ -478,3 +479,96 @@ func TestTaggingPreservesNodeExpiry(t *testing.T) {
 	require.NotNil(t, tagged.AsStruct().Expiry, "tag change must not clear expiry")
 	require.Equal(t, expiry.Unix(), tagged.AsStruct().Expiry.Unix())
 }
+
+// TestUserMaxKeyLifetime covers the per-user key lifetime override: it takes
+// precedence over the global node.expiry as the default, caps the expiry a
+// client asks for, and falls back to the global default once cleared.
+func TestUserMaxKeyLifetime(t *testing.T) {
+	const (
+		day      = 24 * time.Hour
+		global   = 30 * day
+		override = 7 * day
+	)
+
+	tests := []struct {
+		name      string
+		lifetime  *time.Duration
+		requested time.Duration
+		want      time.Duration
+	}{
+		{name: "no-override-uses-global", want: global},
+		{name: "override-takes-precedence", lifetime: new(override), want: override},
+		{
+			name:      "override-clamps-requested-expiry",
+			lifetime:  new(override),
+			requested: 180 * day,
+			want:      override,
+		},
+		{
+			name:      "override-keeps-shorter-requested-expiry",
+			lifetime:  new(override),
+			requested: day,
+			want:      day,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+			cfg.Node.Expiry = global
+
+			s, err := NewState(cfg)
+			require.NoError(t, err)
+			t.Cleanup(func() { _ = s.Close() })
+
+			user := s.CreateUserForTest("lifetime-user")
+			require.NoError(t, s.SetUserMaxKeyLifetime(types.UserID(user.ID), tt.lifetime))
+
+			pak, err := s.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+			require.NoError(t, err)
+
+			regReq := tailcfg.RegisterRequest{
+				Auth:     &tailcfg.RegisterResponseAuth{AuthKey: pak.Key},
+				NodeKey:  key.NewNode().Public(),
+				Hostinfo: &tailcfg.Hostinfo{Hostname: "lifetime-node"},
+			}
+			if tt.requested > 0 {
+				regReq.Expiry = time.Now().Add(tt.requested)
+			}
+
+			node, _, err := s.HandleNodeFromPreAuthKey(regReq, key.NewMachine().Public())
+			require.NoError(t, err)
+			require.True(t, node.Expiry().Valid(), "user-owned node must get an expiry")
+			assert.WithinDuration(t, time.Now().Add(tt.want), node.Expiry().Get(), time.Minute)
+		})
+	}
+}
+
+func TestUserMaxKeyLifetimeCleared(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+	cfg.Node.Expiry = 30 * 24 * time.Hour
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	user := s.CreateUserForTest("lifetime-user")
+	uid := types.UserID(user.ID)
+
+	require.NoError(t, s.SetUserMaxKeyLifetime(uid, new(7*24*time.Hour)))
+	require.NoError(t, s.SetUserMaxKeyLifetime(uid, nil))
+
+	stored, err := s.GetUserByID(uid)
+	require.NoError(t, err)
+	assert.Nil(t, stored.MaxKeyLifetime, "clearing must remove the override")
+
+	lifetime, capped := s.keyLifetime(stored)
+	assert.False(t, capped)
+	assert.Equal(t, cfg.Node.Expiry, lifetime, "without an override the global default applies")
+
+	err = s.SetUserMaxKeyLifetime(uid, new(time.Duration(0)))
+	require.ErrorIs(t, err, db.ErrInvalidKeyLifetime)
+
+	err = s.SetUserMaxKeyLifetime(types.UserID(9999), nil)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+}
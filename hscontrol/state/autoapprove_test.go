@@ -2,11 +2,13 @@ package state
 
 import (
 	"net/netip"
+	"slices"
 	"testing"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 )
 
@@ -40,3 +42,111 @@ func TestAutoApproveBatchApprovesRoutes(t *testing.T) {
 	assert.Contains(t, nv.ApprovedRoutes().AsSlice(), route,
 		"auto-approver should have approved the advertised route")
 }
+
+// TestAutoApproveAdvertisedRoutesByContainment verifies that a route a node
+// advertises is approved when it equals or lies within an auto-approver
+// prefix, and left alone otherwise.
+func TestAutoApproveAdvertisedRoutesByContainment(t *testing.T) {
+	pol := `{
+		"autoApprovers": {"routes": {"10.0.0.0/16": ["persist-user@"]}},
+		"acls": [{"action": "accept", "src": ["*"], "dst": ["*:*"]}]
+	}`
+
+	tests := []struct {
+		name  string
+		route netip.Prefix
+		want  bool
+	}{
+		{name: "exact", route: netip.MustParsePrefix("10.0.0.0/16"), want: true},
+		{name: "subset", route: netip.MustParsePrefix("10.0.7.0/24"), want: true},
+		{name: "superset", route: netip.MustParsePrefix("10.0.0.0/8"), want: false},
+		{name: "disjoint", route: netip.MustParsePrefix("192.168.0.0/24"), want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, s, nodeID := persistTestSetup(t)
+			t.Cleanup(func() { _ = s.Close() })
+
+			_, err := s.SetPolicy([]byte(pol))
+			require.NoError(t, err)
+
+			_, err = s.UpdateNodeFromMapRequest(nodeID, tailcfg.MapRequest{
+				Hostinfo: &tailcfg.Hostinfo{
+					Hostname:    "persist-node",
+					RoutableIPs: []netip.Prefix{tt.route},
+				},
+			})
+			require.NoError(t, err)
+
+			nv, ok := s.GetNodeByID(nodeID)
+			require.True(t, ok)
+			assert.Equal(t, tt.want, slices.Contains(nv.ApprovedRoutes().AsSlice(), tt.route))
+		})
+	}
+}
+
+// TestAutoApproveExitFlag verifies that a node flagged with AutoApproveExit
+// gets its advertised exit routes approved without an auto-approver, while an
+// unflagged node advertising the same routes does not.
+func TestAutoApproveExitFlag(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "trusted", "other")
+	trusted, other := nodes["trusted"].ID, nodes["other"].ID
+	exitRoutes := []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()}
+
+	_, _, err := s.SetAutoApproveExit(trusted, true)
+	require.NoError(t, err)
+
+	for hostname, id := range map[string]types.NodeID{"trusted": trusted, "other": other} {
+		_, err := s.UpdateNodeFromMapRequest(id, tailcfg.MapRequest{
+			Hostinfo: &tailcfg.Hostinfo{
+				Hostname:    hostname,
+				RoutableIPs: append([]netip.Prefix{netip.MustParsePrefix("10.0.0.0/24")}, exitRoutes...),
+			},
+		})
+		require.NoError(t, err)
+	}
+
+	nv, ok := s.GetNodeByID(trusted)
+	require.True(t, ok)
+	assert.ElementsMatch(t, exitRoutes, nv.ApprovedRoutes().AsSlice(),
+		"only the exit routes are approved by the flag")
+	assert.True(t, nv.IsExitNode())
+
+	dbNode, err := s.DB().GetNodeByID(trusted)
+	require.NoError(t, err)
+	assert.True(t, dbNode.AutoApproveExit)
+	assert.ElementsMatch(t, exitRoutes, []netip.Prefix(dbNode.ApprovedRoutes))
+
+	nv, ok = s.GetNodeByID(other)
+	require.True(t, ok)
+	assert.Empty(t, nv.ApprovedRoutes().AsSlice(), "an unflagged node needs an approval")
+
+	for _, route := range exitRoutes {
+		_, ok := s.nodeStore.PrimaryRouteFor(route)
+		assert.False(t, ok, "exit routes never have a primary")
+	}
+}
+
+// TestSetAutoApproveExitApprovesAdvertisedRoutes verifies that turning the
+// flag on approves exit routes the node already advertises.
+func TestSetAutoApproveExitApprovesAdvertisedRoutes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router")
+	nodeID := nodes["router"].ID
+
+	_, ok := s.nodeStore.UpdateNode(nodeID, func(n *types.Node) {
+		n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{tsaddr.AllIPv4()}}
+	})
+	require.True(t, ok)
+
+	nv, c, err := s.SetAutoApproveExit(nodeID, true)
+	require.NoError(t, err)
+	assert.False(t, c.IsEmpty())
+	assert.Equal(t, []netip.Prefix{tsaddr.AllIPv4()}, nv.ApprovedRoutes().AsSlice())
+
+	nv, _, err = s.SetAutoApproveExit(nodeID, false)
+	require.NoError(t, err)
+	assert.False(t, nv.AutoApproveExit())
+	assert.Equal(t, []netip.Prefix{tsaddr.AllIPv4()}, nv.ApprovedRoutes().AsSlice(),
+		"clearing the flag keeps routes already approved")
+}
@@ -3,6 +3,7 @@ package state
 import (
 	"net/netip"
 	"testing"
+	"time"
 
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/juanfont/headscale/hscontrol/types/change"
@@ -277,3 +278,51 @@ func TestDisconnectOutOfOrderSessionsCannotStrandNodeOnline(t *testing.T) {
 	require.True(t, known)
 	assert.False(t, online, "node must be offline after its last session is released")
 }
+
+// TestConnectSetsFirstSeenOnce checks that the first connection after
+// registration is recorded and that reconnects, including after a restart,
+// do not move it.
+func TestConnectSetsFirstSeenOnce(t *testing.T) {
+	dbPath, s, nodeID := persistTestSetup(t)
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	require.False(t, nv.FirstSeen().Valid(), "precondition: node has never connected")
+
+	_, epoch := s.Connect(nodeID)
+
+	nv, ok = s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	require.True(t, nv.FirstSeen().Valid())
+	firstSeen := nv.FirstSeen().Get()
+
+	_, err := s.Disconnect(nodeID, epoch)
+	require.NoError(t, err)
+	s.Connect(nodeID)
+
+	nv, ok = s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.Equal(t, firstSeen, nv.FirstSeen().Get(), "a reconnect must not overwrite it")
+	require.True(t, nv.LastHandshake().Valid())
+	assert.False(t, nv.LastHandshake().Get().Before(firstSeen), "every connect records the handshake")
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	require.NotNil(t, dbNode.LastHandshake)
+	assert.WithinDuration(t, nv.LastHandshake().Get(), *dbNode.LastHandshake, time.Millisecond)
+
+	require.NoError(t, s.Close())
+
+	s2 := persistTestReopen(t, dbPath)
+	s2.Connect(nodeID)
+
+	nv, ok = s2.GetNodeByID(nodeID)
+	require.True(t, ok)
+	require.True(t, nv.FirstSeen().Valid())
+	assert.WithinDuration(t, firstSeen, nv.FirstSeen().Get(), time.Millisecond,
+		"the persisted first seen time must survive a restart")
+
+	latency, err := s2.DB().NodeOnboardingLatency(nodeID)
+	require.NoError(t, err)
+	assert.Positive(t, latency)
+}
@@ -0,0 +1,105 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+// TestPurgeNodeReturnsPeersRemoved pins the contract that purging a node
+// yields the change telling peers to drop it, so no caller has to build
+// one itself.
+func TestPurgeNodeReturnsPeersRemoved(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+
+	c, err := s.PurgeNode(nv)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodeID}, c.PeersRemoved)
+
+	_, ok = s.GetNodeByID(nodeID)
+	assert.False(t, ok)
+
+	_, err = s.DB().GetNodeByID(nodeID)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+}
+
+func TestDeleteNodes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "node1", "node2", "node3")
+
+	var views []types.NodeView
+
+	for _, hostname := range []string{"node1", "node2"} {
+		nv, ok := s.GetNodeByID(nodes[hostname].ID)
+		require.True(t, ok)
+
+		views = append(views, nv)
+	}
+
+	c, err := s.DeleteNodes(views)
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]types.NodeID{nodes["node1"].ID, nodes["node2"].ID},
+		c.PeersRemoved,
+	)
+
+	for _, hostname := range []string{"node1", "node2"} {
+		_, ok := s.GetNodeByID(nodes[hostname].ID)
+		assert.False(t, ok, "%s must leave the NodeStore", hostname)
+
+		_, err = s.DB().GetNodeByID(nodes[hostname].ID)
+		require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+	}
+
+	_, ok := s.GetNodeByID(nodes["node3"].ID)
+	assert.True(t, ok)
+
+	_, err = s.DB().GetNodeByID(nodes["node3"].ID)
+	require.NoError(t, err)
+
+	c, err = s.DeleteNodes(nil)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty())
+}
+
+func TestSoftDeleteAndRestoreNode(t *testing.T) {
+	dbPath, s, nodeID := persistTestSetup(t)
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+
+	ips := nv.IPs()
+
+	c, err := s.SoftDeleteNode(nv)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodeID}, c.PeersRemoved)
+
+	_, ok = s.GetNodeByID(nodeID)
+	assert.False(t, ok, "a soft-deleted node leaves the NodeStore")
+
+	// A restart must not bring the node back on its own.
+	require.NoError(t, s.Close())
+	s = persistTestReopen(t, dbPath)
+
+	_, ok = s.GetNodeByID(nodeID)
+	require.False(t, ok, "soft-deleted nodes are not loaded on startup")
+
+	nv, c, err = s.RestoreNode(nodeID)
+	require.NoError(t, err)
+	assert.False(t, c.IsEmpty(), "peers must learn the node is back")
+	assert.Equal(t, ips, nv.IPs(), "the node keeps its addresses")
+	assert.False(t, nv.IsOnline().Get())
+
+	_, ok = s.GetNodeByID(nodeID)
+	assert.True(t, ok)
+
+	_, _, err = s.RestoreNode(nodeID)
+	require.ErrorIs(t, err, db.ErrNodeNotFound)
+}
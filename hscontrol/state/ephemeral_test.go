@@ -8,6 +8,7 @@ import (
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
 )
 
 // TestEphemeralNodeDeleteWithConcurrentUpdate tests the race condition where UpdateNode and DeleteNode
@@ -464,3 +465,76 @@ func TestPersistNodeToDBChecksNodeStoreBeforePersist(t *testing.T) {
 	// _, exists := s.nodeStore.GetNode(node.ID())
 	// if !exists { return error }
 }
+
+func TestExpireEphemeralNodesAcrossUsers(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "eph1", "eph2", "eph-online", "eph-recent", "eph-new", "eph-never", "regular")
+	other := types.UserID(s.CreateUserForTest("other-user").ID)
+
+	_, _, err := s.MoveNodeToUser(nodes["eph2"].ID, other)
+	require.NoError(t, err)
+
+	for hostname, lastSeen := range map[string]time.Duration{
+		"eph1":       time.Hour,
+		"eph2":       time.Hour,
+		"eph-online": time.Hour,
+		"eph-recent": time.Second,
+		"regular":    time.Hour,
+	} {
+		_, ok := s.nodeStore.UpdateNode(nodes[hostname].ID, func(n *types.Node) {
+			n.IsOnline = new(hostname == "eph-online")
+			n.LastSeen = new(time.Now().Add(-lastSeen))
+
+			if hostname != "regular" {
+				n.AuthKey = &types.PreAuthKey{Ephemeral: true}
+			}
+		})
+		require.True(t, ok)
+	}
+
+	// Never seen: one just registered, one registered long enough ago
+	// to have used up its grace period.
+	for hostname, registered := range map[string]time.Duration{
+		"eph-new":   time.Second,
+		"eph-never": time.Hour,
+	} {
+		_, ok := s.nodeStore.UpdateNode(nodes[hostname].ID, func(n *types.Node) {
+			n.IsOnline = new(false)
+			n.LastSeen = nil
+			n.CreatedAt = time.Now().Add(-registered)
+			n.AuthKey = &types.PreAuthKey{Ephemeral: true}
+		})
+		require.True(t, ok)
+	}
+
+	c, err := s.ExpireEphemeralNodes(time.Minute)
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]types.NodeID{nodes["eph1"].ID, nodes["eph2"].ID, nodes["eph-never"].ID},
+		c.PeersRemoved,
+		"one change must cover the expired nodes of both users",
+	)
+
+	for hostname, kept := range map[string]bool{
+		"eph1":       false,
+		"eph2":       false,
+		"eph-online": true,
+		"eph-recent": true,
+		"eph-new":    true,
+		"eph-never":  false,
+		"regular":    true,
+	} {
+		_, ok := s.GetNodeByID(nodes[hostname].ID)
+		assert.Equal(t, kept, ok, "%s in NodeStore", hostname)
+
+		_, err = s.DB().GetNodeByID(nodes[hostname].ID)
+		if kept {
+			require.NoError(t, err, hostname)
+		} else {
+			require.ErrorIs(t, err, gorm.ErrRecordNotFound, hostname)
+		}
+	}
+
+	c, err = s.ExpireEphemeralNodes(time.Minute)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "nothing left to expire")
+}
@@ -0,0 +1,174 @@
+package state
+
+import (
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+)
+
+func TestSetNodeExpiryIn(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	before := time.Now()
+
+	nv, c, err := s.SetNodeExpiryIn(nodeID, 24*time.Hour)
+	require.NoError(t, err)
+	require.True(t, nv.Expiry().Valid())
+	assert.WithinDuration(t, before.Add(24*time.Hour), nv.Expiry().Get(), time.Minute)
+
+	require.Len(t, c.PeerPatches, 1, "peers must be patched with the new expiry")
+	assert.Equal(t, nodeID.NodeID(), c.PeerPatches[0].NodeID)
+	require.NotNil(t, c.PeerPatches[0].KeyExpiry)
+	assert.Equal(t, nv.Expiry().Get(), *c.PeerPatches[0].KeyExpiry)
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	require.NotNil(t, dbNode.Expiry)
+	assert.WithinDuration(t, nv.Expiry().Get(), *dbNode.Expiry, time.Second)
+
+	_, _, err = s.SetNodeExpiryIn(nodeID, -time.Hour)
+	require.ErrorIs(t, err, ErrNegativeExpiryDuration)
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.False(t, nv.IsExpired(), "a rejected call must not touch the expiry")
+}
+
+func TestExpireNodeAndRevokeAuthKey(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	require.True(t, nv.AuthKeyID().Valid(), "precondition: node registered with a key")
+
+	keyID := nv.AuthKeyID().Get()
+
+	nv, c, err := s.ExpireNodeAndRevokeAuthKey(nodeID)
+	require.NoError(t, err)
+	assert.True(t, nv.IsExpired())
+	require.Len(t, c.PeerPatches, 1, "peers must be patched with the new expiry")
+
+	pak, err := s.GetPreAuthKeyByID(keyID)
+	require.NoError(t, err)
+	require.Error(t, pak.Validate(), "the key must no longer authorize nodes")
+
+	// Doing it again finds the key already revoked, which is fine.
+	_, _, err = s.ExpireNodeAndRevokeAuthKey(nodeID)
+	require.NoError(t, err)
+
+	// A node registered another way has no key to revoke.
+	_, ok = s.nodeStore.UpdateNode(nodeID, func(n *types.Node) {
+		n.AuthKeyID = nil
+		n.AuthKey = nil
+	})
+	require.True(t, ok)
+
+	_, _, err = s.ExpireNodeAndRevokeAuthKey(nodeID)
+	require.ErrorIs(t, err, ErrNodeHasNoAuthKey)
+}
+
+// TestExpireExpiredNodesNotifiesOnce checks that consecutive expiry passes
+// report a node once, in the pass whose window its expiry falls in.
+func TestExpireExpiredNodesNotifiesOnce(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	lastCheck := time.Now()
+
+	expiry := lastCheck.Add(time.Millisecond)
+	_, _, err := s.SetNodeExpiry(nodeID, &expiry)
+	require.NoError(t, err)
+
+	// Wait for the expiry to pass before running the first pass.
+	require.Eventually(t, func() bool {
+		return time.Now().After(expiry)
+	}, time.Second, time.Millisecond)
+
+	next, updates, found := s.ExpireExpiredNodes(lastCheck)
+	require.True(t, found)
+	require.Len(t, updates, 1)
+	assert.Equal(t, nodeID, updates[0].OriginNode)
+
+	_, updates, found = s.ExpireExpiredNodes(next)
+	assert.False(t, found, "an already reported node must not be reported again")
+	assert.Empty(t, updates)
+}
+
+func TestPreviewExpiredNodesMatchesSweep(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	lastCheck := time.Now()
+
+	assert.Empty(t, s.PreviewExpiredNodes(lastCheck), "no node has expired yet")
+
+	expiry := lastCheck.Add(time.Millisecond)
+	_, _, err := s.SetNodeExpiry(nodeID, &expiry)
+	require.NoError(t, err)
+
+	require.Eventually(t, func() bool {
+		return time.Now().After(expiry)
+	}, time.Second, time.Millisecond)
+
+	preview := s.PreviewExpiredNodes(lastCheck)
+	require.Len(t, preview, 1)
+	assert.Equal(t, nodeID.NodeID(), preview[0].NodeID)
+	require.NotNil(t, preview[0].KeyExpiry)
+	assert.True(t, expiry.Equal(*preview[0].KeyExpiry))
+
+	assert.Len(t, s.PreviewExpiredNodes(lastCheck), 1, "previewing must not consume the node")
+
+	_, updates, found := s.ExpireExpiredNodes(lastCheck)
+	require.True(t, found)
+	require.Len(t, updates, 1)
+	assert.Equal(t, preview, updates[0].PeerPatches, "the sweep reports what the preview showed")
+}
+
+func TestPurgeLongExpiredNodes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "long-expired", "recently-expired", "online-expired", "valid", "no-expiry")
+
+	for hostname, expiredFor := range map[string]time.Duration{
+		"long-expired":     45 * 24 * time.Hour,
+		"recently-expired": 24 * time.Hour,
+		"online-expired":   45 * 24 * time.Hour,
+		"valid":            -time.Hour,
+	} {
+		_, ok := s.nodeStore.UpdateNode(nodes[hostname].ID, func(n *types.Node) {
+			n.Expiry = new(time.Now().Add(-expiredFor))
+			n.IsOnline = new(hostname == "online-expired")
+		})
+		require.True(t, ok)
+	}
+
+	c, err := s.PurgeLongExpiredNodes(30 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.Equal(t, []types.NodeID{nodes["long-expired"].ID}, c.PeersRemoved)
+
+	for hostname, kept := range map[string]bool{
+		"long-expired":     false,
+		"recently-expired": true,
+		"online-expired":   true,
+		"valid":            true,
+		"no-expiry":        true,
+	} {
+		_, ok := s.GetNodeByID(nodes[hostname].ID)
+		assert.Equal(t, kept, ok, "%s in NodeStore", hostname)
+
+		_, err = s.DB().GetNodeByID(nodes[hostname].ID)
+		if kept {
+			require.NoError(t, err, hostname)
+		} else {
+			require.ErrorIs(t, err, gorm.ErrRecordNotFound, hostname)
+		}
+	}
+
+	c, err = s.PurgeLongExpiredNodes(30 * 24 * time.Hour)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "nothing is left to purge")
+}
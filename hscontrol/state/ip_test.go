@@ -0,0 +1,95 @@
+package state
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/types/key"
+)
+
+func TestReallocateOutOfRangeIPsAfterPrefixChange(t *testing.T) {
+	dbPath, s, nodeID := persistTestSetup(t)
+
+	before, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+
+	cs, err := s.ReallocateOutOfRangeIPs()
+	require.NoError(t, err)
+	assert.Empty(t, cs, "nodes in range are left alone")
+
+	require.NoError(t, s.Close())
+
+	// Restart with the IPv4 prefix moved; IPv6 is unchanged.
+	cfg := persistTestConfig(dbPath)
+	cfg.PrefixV4 = new(netip.MustParsePrefix("100.100.0.0/16"))
+
+	s, err = NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	cs, err = s.ReallocateOutOfRangeIPs()
+	require.NoError(t, err)
+	require.Len(t, cs, 2)
+	assert.True(t, cs[0].IncludePolicy)
+	assert.Equal(t, []types.NodeID{nodeID}, cs[0].PeersChanged)
+	assert.Equal(t, nodeID, cs[1].TargetNode)
+	assert.True(t, cs[1].IncludeSelf, "the node learns its own new address")
+
+	after, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	require.True(t, after.IPv4().Valid())
+	assert.True(t, cfg.PrefixV4.Contains(after.IPv4().Get()))
+	assert.Equal(t, before.IPv6().Get(), after.IPv6().Get(), "the in range family is kept")
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	assert.Equal(t, after.IPv4().Get(), *dbNode.IPv4)
+}
+
+// TestCreateNodeWithRequestedIP covers registration with a requested
+// address: a free one is assigned and persisted, a taken one fails a strict
+// request without leaving a node behind and falls back otherwise.
+func TestCreateNodeWithRequestedIP(t *testing.T) {
+	s, err := NewState(persistTestConfig(t.TempDir() + "/headscale.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	user := s.CreateUserForTest("user")
+
+	requested := netip.MustParseAddr("100.64.0.42")
+
+	params := func(hostname string, strict bool) newNodeParams {
+		return newNodeParams{
+			User:               *user,
+			MachineKey:         key.NewMachine().Public(),
+			NodeKey:            key.NewNode().Public(),
+			DiscoKey:           key.NewDisco().Public(),
+			Hostname:           hostname,
+			RegisterMethod:     util.RegisterMethodCLI,
+			RequestedIP:        requested,
+			RequireRequestedIP: strict,
+		}
+	}
+
+	first, err := s.createAndSaveNewNode(params("first", true))
+	require.NoError(t, err)
+	require.True(t, first.IPv4().Valid())
+	assert.Equal(t, requested, first.IPv4().Get())
+
+	stored, err := s.db.GetNodeByID(first.ID())
+	require.NoError(t, err)
+	assert.Equal(t, requested, *stored.IPv4, "the requested address must be persisted")
+
+	_, err = s.createAndSaveNewNode(params("strict", true))
+	require.ErrorIs(t, err, db.ErrIPNotAvailable)
+	assert.Equal(t, 1, s.ListNodes().Len(), "a failed strict request must not create a node")
+
+	fallback, err := s.createAndSaveNewNode(params("fallback", false))
+	require.NoError(t, err)
+	assert.NotEqual(t, requested, fallback.IPv4().Get())
+}
@@ -1,12 +1,17 @@
 package state
 
 import (
+	"fmt"
+	"net/netip"
 	"testing"
+	"time"
 
+	"github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 func TestNetInfoFromMapRequest(t *testing.T) {
@@ -133,3 +138,127 @@ func TestNetInfoPreservationInRegistrationFlow(t *testing.T) {
 		assert.Equal(t, 7, result.PreferredDERP, "Should preserve DERP region from existing node")
 	})
 }
+
+// routes returns n distinct /24 prefixes.
+func routes(n int) []netip.Prefix {
+	out := make([]netip.Prefix, n)
+	for i := range out {
+		out[i] = netip.MustParsePrefix(fmt.Sprintf("10.%d.%d.0/24", i/256, i%256))
+	}
+
+	return out
+}
+
+func TestUpdateNodeFromMapRequestCapsAdvertisedRoutes(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+	cfg.Tuning.MaxRoutesPerNode = 3
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("routes-user")
+	node := database.CreateRegisteredNodeForTest(user, "router")
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	tests := []struct {
+		name       string
+		advertised int
+		want       int
+	}{
+		{name: "at-cap", advertised: 3, want: 3},
+		{name: "above-cap", advertised: 5, want: 3},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hi := &tailcfg.Hostinfo{
+				Hostname:    "router",
+				RoutableIPs: routes(tt.advertised),
+			}
+			_, err := s.UpdateNodeFromMapRequest(node.ID, tailcfg.MapRequest{Hostinfo: hi})
+			require.NoError(t, err)
+			assert.Len(t, hi.RoutableIPs, tt.advertised, "caller's Hostinfo must not be truncated")
+
+			nv, ok := s.GetNodeByID(node.ID)
+			require.True(t, ok)
+			assert.Equal(t, routes(tt.want), nv.AnnouncedRoutes())
+
+			count, err := s.DB().CountNodeRoutes(node.ID)
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, count)
+		})
+	}
+}
+
+func TestRegistrationCapsAdvertisedRoutes(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+	cfg.Tuning.MaxRoutesPerNode = 3
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	user := s.CreateUserForTest("routes-user")
+
+	pak, err := s.CreatePreAuthKey(user.TypedID(), false, false, nil, nil)
+	require.NoError(t, err)
+
+	hi := &tailcfg.Hostinfo{Hostname: "router", RoutableIPs: routes(5)}
+	node, _, err := s.HandleNodeFromPreAuthKey(tailcfg.RegisterRequest{
+		Auth:     &tailcfg.RegisterResponseAuth{AuthKey: pak.Key},
+		NodeKey:  key.NewNode().Public(),
+		Hostinfo: hi,
+		Expiry:   time.Now().Add(24 * time.Hour),
+	}, key.NewMachine().Public())
+	require.NoError(t, err)
+
+	assert.Equal(t, routes(3), node.AnnouncedRoutes())
+	assert.Len(t, hi.RoutableIPs, 5, "caller's Hostinfo must not be truncated")
+}
+
+func TestCapAdvertisedRoutesNonPositiveMax(t *testing.T) {
+	for _, maxRoutes := range []int{0, -1} {
+		s := &State{cfg: &types.Config{Tuning: types.Tuning{MaxRoutesPerNode: maxRoutes}}}
+
+		hi := &tailcfg.Hostinfo{RoutableIPs: routes(defaultMaxRoutesPerNode + 1)}
+
+		got := s.capAdvertisedRoutes(hi)
+		assert.Len(t, got.RoutableIPs, defaultMaxRoutesPerNode, "max %d", maxRoutes)
+	}
+}
+
+// TestMapRequestPersistsClientInfo checks that the client OS and version a
+// node reports in its Hostinfo reach their own database columns.
+func TestMapRequestPersistsClientInfo(t *testing.T) {
+	_, s, nodeID := persistTestSetup(t)
+	t.Cleanup(func() { _ = s.Close() })
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+
+	_, err := s.UpdateNodeFromMapRequest(nodeID, tailcfg.MapRequest{
+		NodeKey:  nv.NodeKey(),
+		DiscoKey: nv.DiscoKey(),
+		Hostinfo: &tailcfg.Hostinfo{
+			Hostname:   nv.Hostname(),
+			OS:         "linux",
+			IPNVersion: "1.80.0-t3f2a1b0c4",
+		},
+	})
+	require.NoError(t, err)
+
+	nv, ok = s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.Equal(t, "linux", nv.OS())
+	assert.Equal(t, "1.80.0-t3f2a1b0c4", nv.ClientVersion())
+
+	outdated, err := s.DB().ListNodesByClientVersion("<1.82.0")
+	require.NoError(t, err)
+	require.Len(t, outdated, 1)
+	assert.Equal(t, nodeID, outdated[0].ID)
+	assert.Equal(t, "linux", outdated[0].OS)
+}
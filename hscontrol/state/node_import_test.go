@@ -0,0 +1,61 @@
+package state
+
+import (
+	"testing"
+
+	hsdb "github.com/juanfont/headscale/hscontrol/db"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/types/key"
+)
+
+func TestImportNodesState(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "server")
+	existing := nodes["server"]
+
+	imported, c, err := s.ImportNodes(hsdb.NodeManifest{
+		Version: hsdb.NodeManifestVersion,
+		Nodes: []hsdb.NodeImport{{
+			Hostname:   "server",
+			MachineKey: key.NewMachine().Public().String(),
+			NodeKey:    key.NewNode().Public().String(),
+			User:       "tag-user",
+		}},
+	})
+	require.NoError(t, err)
+	require.Len(t, imported, 1)
+	assert.False(t, c.IsEmpty())
+
+	nv := imported[0]
+	assert.NotEqual(t, existing.GivenName, nv.GivenName(),
+		"an imported node taking a used name is renamed as on registration")
+
+	dbNode, err := s.DB().GetNodeByID(nv.ID())
+	require.NoError(t, err)
+	assert.Equal(t, nv.GivenName(), dbNode.GivenName, "the database keeps the renamed node")
+
+	// The imported addresses are claimed in the allocator, so the next
+	// registration gets others.
+	next4, next6, err := s.ipAlloc.Next()
+	require.NoError(t, err)
+	assert.NotEqual(t, nv.IPv4().Get(), *next4)
+	assert.NotEqual(t, nv.IPv6().Get(), *next6)
+}
+
+func TestImportNodesStateRejectsUnknownVersion(t *testing.T) {
+	s, _ := tagsTestSetup(t)
+
+	before := s.ListNodes().Len()
+
+	_, _, err := s.ImportNodes(hsdb.NodeManifest{
+		Version: hsdb.NodeManifestVersion + 1,
+		Nodes: []hsdb.NodeImport{{
+			Hostname:   "server",
+			MachineKey: key.NewMachine().Public().String(),
+			NodeKey:    key.NewNode().Public().String(),
+			User:       "tag-user",
+		}},
+	})
+	require.ErrorIs(t, err, hsdb.ErrNodeManifestVersion)
+	assert.Equal(t, before, s.ListNodes().Len(), "nothing is imported")
+}
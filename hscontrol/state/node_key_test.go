@@ -0,0 +1,99 @@
+package state
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"gorm.io/gorm"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+func TestRotateNodeKey(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "laptop", "desktop")
+	nodeID := nodes["laptop"].ID
+	newKey := key.NewNode().Public()
+
+	nv, c, err := s.RotateNodeKey(nodeID, newKey)
+	require.NoError(t, err)
+	assert.Equal(t, newKey, nv.NodeKey())
+	assert.Equal(t, nodeID, c.OriginNode)
+	require.Len(t, c.PeerPatches, 1, "peers get the new key as a patch")
+	assert.Equal(t, nodeID.NodeID(), c.PeerPatches[0].NodeID)
+	require.NotNil(t, c.PeerPatches[0].Key)
+	assert.Equal(t, newKey, *c.PeerPatches[0].Key)
+
+	byKey, ok := s.GetNodeByNodeKey(newKey)
+	require.True(t, ok)
+	assert.Equal(t, nodeID, byKey.ID())
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	assert.Equal(t, newKey, dbNode.NodeKey)
+	assert.Equal(t, nodes["laptop"].MachineKey, dbNode.MachineKey, "only the node key is written")
+
+	_, c, err = s.RotateNodeKey(nodeID, newKey)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "setting the current key again is a no-op")
+
+	_, _, err = s.RotateNodeKey(nodes["desktop"].ID, newKey)
+	require.ErrorIs(t, err, ErrNodeKeyInUse)
+
+	_, _, err = s.RotateNodeKey(9999, key.NewNode().Public())
+	require.ErrorIs(t, err, ErrNodeNotInNodeStore)
+}
+
+// TestReplaceNodeKeepsIdentity covers a reinstalled device coming back under
+// new keys: the replacement must keep the addresses, routes and name of the
+// node it replaces, and the old record must be gone everywhere.
+func TestReplaceNodeKeepsIdentity(t *testing.T) {
+	dbPath, s, oldID := persistTestSetup(t)
+
+	route := netip.MustParsePrefix("10.0.0.0/24")
+
+	_, ok := s.nodeStore.UpdateNode(oldID, func(n *types.Node) {
+		n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+	})
+	require.True(t, ok)
+
+	_, _, err := s.SetApprovedRoutes(oldID, []netip.Prefix{route})
+	require.NoError(t, err)
+
+	old, ok := s.GetNodeByID(oldID)
+	require.True(t, ok)
+
+	_, _, err = s.ReplaceNode(oldID, key.NewMachine().Public(), old.NodeKey())
+	require.ErrorIs(t, err, ErrNodeKeyInUse)
+
+	machineKey := key.NewMachine().Public()
+	nodeKey := key.NewNode().Public()
+
+	nv, c, err := s.ReplaceNode(oldID, machineKey, nodeKey)
+	require.NoError(t, err)
+	assert.False(t, c.IsEmpty())
+
+	assert.NotEqual(t, oldID, nv.ID())
+	assert.Equal(t, machineKey, nv.MachineKey())
+	assert.Equal(t, nodeKey, nv.NodeKey())
+	assert.Equal(t, old.IPs(), nv.IPs())
+	assert.Equal(t, old.GivenName(), nv.GivenName())
+	assert.Equal(t, []netip.Prefix{route}, nv.SubnetRoutes())
+
+	_, ok = s.GetNodeByID(oldID)
+	assert.False(t, ok, "replaced node must leave the NodeStore")
+
+	_, err = s.DB().GetNodeByID(oldID)
+	require.ErrorIs(t, err, gorm.ErrRecordNotFound)
+
+	require.NoError(t, s.Close())
+
+	s2 := persistTestReopen(t, dbPath)
+
+	reloaded, ok := s2.GetNodeByID(nv.ID())
+	require.True(t, ok)
+	assert.Equal(t, old.IPs(), reloaded.IPs())
+	assert.Equal(t, []netip.Prefix{route}, reloaded.ApprovedRoutes().AsSlice())
+}
@@ -1,6 +1,7 @@
 package state
 
 import (
+	"cmp"
 	"errors"
 	"fmt"
 	"maps"
@@ -450,7 +451,9 @@ func (s *NodeStore) applyBatch(batch []work) {
 		switch w.op {
 		case put:
 			n := w.node
-			n.GivenName = resolveGivenName(nodes, n.ID, n.GivenName)
+			// A stored node already carries its base; its GivenName may be
+			// the suffixed label derived from it and is kept while free.
+			resolveGivenName(nodes, &n, cmp.Or(n.GivenNameBase, n.GivenName))
 
 			nodes[w.nodeID] = n
 			if w.nodeResult != nil {
@@ -463,11 +466,17 @@ func (s *NodeStore) applyBatch(batch []work) {
 					continue
 				}
 
-				oldGivenName := n.GivenName
+				oldGivenName, oldBase := n.GivenName, n.GivenNameBase
 				fn(&n)
 
 				if n.GivenName != oldGivenName {
-					n.GivenName = resolveGivenName(nodes, n.ID, n.GivenName)
+					// A new name is its own base unless fn set one too.
+					base := n.GivenName
+					if n.GivenNameBase != oldBase {
+						base = n.GivenNameBase
+					}
+
+					resolveGivenName(nodes, &n, base)
 				}
 
 				nodes[id] = n
@@ -497,7 +506,7 @@ func (s *NodeStore) applyBatch(batch []work) {
 			taken := false
 
 			for id, other := range nodes {
-				if id != w.nodeID && other.GivenName == w.name {
+				if id != w.nodeID && strings.EqualFold(other.GivenName, w.name) {
 					taken = true
 					break
 				}
@@ -511,6 +520,7 @@ func (s *NodeStore) applyBatch(batch []work) {
 			}
 
 			n.GivenName = w.name
+			n.GivenNameBase = w.name
 			nodes[w.nodeID] = n
 			nodeResultRequests[w.nodeID] = append(nodeResultRequests[w.nodeID], w)
 		case rebuildPeerMaps:
@@ -562,37 +572,64 @@ func (s *NodeStore) applyBatch(batch []work) {
 	}
 }
 
-// resolveGivenName returns a unique DNS label for the node identified
-// by self, based on the caller-supplied base label. If base is empty
-// it falls back to [fallbackGivenName] ("node"). The label's own holder
-// (self) is excluded from the collision scan so an idempotent write
-// keeps the current label.
+// resolveGivenName assigns n a unique DNS label based on the
+// caller-supplied base label and records base in [types.Node.GivenNameBase].
+// If base is empty it falls back to [fallbackGivenName] ("node"). The
+// label's own holder (n) is excluded from the collision scan. Labels are
+// compared ignoring case, as DNS names are, like [NodeStore.SetGivenName]
+// does.
 //
-// On collision the label is bumped as base, base-1, base-2, …, first
-// unused wins. Must be called from the [NodeStore] writer goroutine
-// (inside [NodeStore.applyBatch]) so the nodes map reflects all earlier
-// ops in the batch and no other writer can interleave.
-func resolveGivenName(nodes map[types.NodeID]types.Node, self types.NodeID, base string) string {
+// A label n already carries is kept while no other node holds it, so
+// re-putting a stored node never renames it, even when a gap has opened
+// below its suffix. Only on a real collision is a new label derived from
+// base: base itself while it is free, otherwise a suffix starting at the
+// number of other nodes sharing the base, so numbering continues after
+// the highest sibling rather than probing from -1 on every registration;
+// any label still taken is skipped. Must be called from the [NodeStore]
+// writer goroutine (inside [NodeStore.applyBatch]) so the nodes map
+// reflects all earlier ops in the batch and no other writer can
+// interleave.
+func resolveGivenName(nodes map[types.NodeID]types.Node, n *types.Node, base string) {
 	if base == "" {
 		base = fallbackGivenName
 	}
 
+	n.GivenNameBase = base
+
+	siblings := 0
 	taken := make(map[string]struct{}, len(nodes))
-	for id, n := range nodes {
-		if id == self {
+
+	for id, other := range nodes {
+		if id == n.ID {
 			continue
 		}
 
-		taken[n.GivenName] = struct{}{}
+		if strings.EqualFold(other.GivenNameBase, base) {
+			siblings++
+		}
+
+		taken[strings.ToLower(other.GivenName)] = struct{}{}
 	}
 
-	candidate := base
-	for i := 1; ; i++ {
-		if _, busy := taken[candidate]; !busy {
-			return candidate
+	if n.GivenName != "" {
+		if _, busy := taken[strings.ToLower(n.GivenName)]; !busy {
+			return
 		}
+	}
+
+	if _, busy := taken[strings.ToLower(base)]; !busy {
+		n.GivenName = base
 
-		candidate = base + "-" + strconv.Itoa(i)
+		return
+	}
+
+	for i := max(siblings, 1); ; i++ {
+		candidate := base + "-" + strconv.Itoa(i)
+		if _, busy := taken[strings.ToLower(candidate)]; !busy {
+			n.GivenName = candidate
+
+			return
+		}
 	}
 }
 
@@ -662,7 +699,9 @@ func snapshotFromNodes(
 
 // onlineAdvertisers maps each non-exit prefix to the IDs of online nodes
 // that approve it. Nodes are visited in the order of ids, so the per-prefix
-// slices preserve that order.
+// slices preserve that order. Only connected nodes count as online: a router
+// that just disconnected must lose its primaries right away, not once its
+// last seen time has aged out.
 func onlineAdvertisers(
 	nodes map[types.NodeID]types.Node,
 	ids []types.NodeID,
@@ -671,7 +710,7 @@ func onlineAdvertisers(
 
 	for _, id := range ids {
 		n := nodes[id]
-		if n.IsOnline == nil || !*n.IsOnline {
+		if !n.IsOnlineWithin(0) {
 			continue
 		}
 
@@ -690,8 +729,10 @@ func onlineAdvertisers(
 // electPrimaryRoutes picks the primary advertiser for each non-exit
 // prefix. Inputs are restricted to online nodes that advertise the
 // prefix. The previous primary is preserved when it is still online
-// and healthy (anti-flap); otherwise the lowest-NodeID healthy
-// advertiser wins. When every advertiser is unhealthy the previous
+// and healthy and no healthy advertiser has a higher
+// [types.Node.RoutePriority] (anti-flap); otherwise the healthy
+// advertiser with the highest priority wins, the lowest NodeID
+// breaking ties. When every advertiser is unhealthy the previous
 // primary is preserved only if still a candidate — falling back to
 // any other candidate would point peers at a node the prober has
 // already declared unreachable, so leaving the prefix unmapped is
@@ -704,27 +745,32 @@ func electPrimaryRoutes(
 
 	routes := make(map[netip.Prefix]types.NodeID, len(advertisers))
 	for prefix, candidates := range advertisers {
-		if cur, ok := prev[prefix]; ok &&
-			slices.Contains(candidates, cur) &&
-			!nodes[cur].Unhealthy {
-			routes[prefix] = cur
-			continue
-		}
-
 		var (
 			selected types.NodeID
 			found    bool
 		)
 
+		// Candidates are in NodeID order, so only a strictly higher
+		// priority replaces the first healthy one found.
 		for _, c := range candidates {
-			if !nodes[c].Unhealthy {
+			if nodes[c].Unhealthy {
+				continue
+			}
+
+			if !found || nodes[c].RoutePriority > nodes[selected].RoutePriority {
 				selected = c
 				found = true
-
-				break
 			}
 		}
 
+		if cur, ok := prev[prefix]; ok &&
+			slices.Contains(candidates, cur) &&
+			!nodes[cur].Unhealthy &&
+			nodes[cur].RoutePriority >= nodes[selected].RoutePriority {
+			routes[prefix] = cur
+			continue
+		}
+
 		// All-unhealthy fallback: preserve the previous primary only
 		// when it is still a candidate. Falling back to any candidate
 		// would point peers at a node the prober has already declared
@@ -33,6 +33,29 @@ func TestPutNodeGivenNameCollisionBumps(t *testing.T) {
 	require.Equal(t, "laptop-2", got3.GivenName(), "third registration bumps to -2")
 }
 
+// TestPutNodeGivenNameCollisionIgnoresCase asserts that a label differing
+// from a taken one only in case is bumped, as DNS names ignore case.
+func TestPutNodeGivenNameCollisionIgnoresCase(t *testing.T) {
+	store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+	store.Start()
+	defer store.Stop()
+
+	n1 := createTestNode(1, 1, "alice", "laptop")
+	n2 := createTestNode(2, 1, "alice", "laptop")
+	n2.GivenName = "Laptop"
+	n3 := createTestNode(3, 1, "alice", "laptop")
+	n3.GivenName = "LAPTOP-1"
+
+	got1 := store.PutNode(n1)
+	got2 := store.PutNode(n2)
+	got3 := store.PutNode(n3)
+
+	require.Equal(t, "laptop", got1.GivenName())
+	require.Equal(t, "Laptop-1", got2.GivenName(), "a label differing only in case collides")
+	require.Equal(t, "LAPTOP-1-1", got3.GivenName(), "suffixed labels collide ignoring case too")
+}
+
 // TestPutNodeEmptyGivenNameFallsBackToNode covers the SaaS rule that
 // an empty sanitised label becomes the literal "node". Subsequent
 // empty-label registrations bump as usual.
@@ -70,6 +93,57 @@ func TestPutNodeIdempotentKeepsLabel(t *testing.T) {
 	require.Equal(t, "laptop", second.GivenName(), "re-put of same node must not bump its own label")
 }
 
+// TestPutNodeKeepsGivenNameBase asserts that re-putting a node whose
+// label was bumped keeps the base it was derived from, rather than
+// adopting the suffixed label as a new base.
+func TestPutNodeKeepsGivenNameBase(t *testing.T) {
+	store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+	store.Start()
+	defer store.Stop()
+
+	store.PutNode(createTestNode(1, 1, "alice", "laptop"))
+	bumped := store.PutNode(createTestNode(2, 1, "alice", "laptop"))
+	require.Equal(t, "laptop-1", bumped.GivenName())
+
+	again := store.PutNode(*bumped.AsStruct())
+	require.Equal(t, "laptop-1", again.GivenName(), "re-put must keep the bumped label")
+	require.Equal(t, "laptop", again.GivenNameBase(), "re-put must keep the original base")
+}
+
+// TestPutNodeKeepsGivenNameAfterGap asserts that re-putting a stored
+// node keeps its label when a lower label from the same base has been
+// freed by a delete, instead of re-deriving a name into the gap.
+func TestPutNodeKeepsGivenNameAfterGap(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted types.NodeID
+	}{
+		{name: "suffixed-sibling-deleted", deleted: 2},
+		{name: "base-holder-deleted", deleted: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+			store.Start()
+			defer store.Stop()
+
+			store.PutNode(createTestNode(1, 1, "alice", "laptop"))
+			store.PutNode(createTestNode(2, 1, "alice", "laptop"))
+			third := store.PutNode(createTestNode(3, 1, "alice", "laptop"))
+			require.Equal(t, "laptop-2", third.GivenName())
+
+			store.DeleteNode(tt.deleted)
+
+			again := store.PutNode(*third.AsStruct())
+			require.Equal(t, "laptop-2", again.GivenName(), "re-put must not rename into the gap")
+			require.Equal(t, "laptop", again.GivenNameBase())
+		})
+	}
+}
+
 // TestUpdateNodeBumpsOnCollision asserts that UpdateNode also runs
 // the collision-bump branch when a callback rewrites GivenName to a
 // label held by another node.
@@ -172,6 +246,10 @@ func TestSetGivenNameRejectsTaken(t *testing.T) {
 	_, err := store.SetGivenName(2, "laptop")
 	require.ErrorIs(t, err, ErrGivenNameTaken)
 
+	// DNS names are case-insensitive, so a case variant collides too.
+	_, err = store.SetGivenName(2, "Laptop")
+	require.ErrorIs(t, err, ErrGivenNameTaken)
+
 	view, _ := store.GetNode(2)
 	require.Equal(t, "phone", view.GivenName(), "rejected rename must not mutate state")
 }
@@ -217,3 +295,76 @@ func TestSetGivenNameIdempotent(t *testing.T) {
 	require.NoError(t, err)
 	require.Equal(t, "laptop", view.GivenName())
 }
+
+// TestPutNodeGivenNameContinuesAfterSiblings asserts that once the base
+// label is taken, the suffix continues from the number of nodes sharing
+// the base instead of reusing a gap left by a deleted sibling.
+func TestPutNodeGivenNameContinuesAfterSiblings(t *testing.T) {
+	store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+	store.Start()
+	defer store.Stop()
+
+	store.PutNode(createTestNode(1, 1, "alice", "laptop"))
+	store.PutNode(createTestNode(2, 1, "alice", "laptop"))
+	store.PutNode(createTestNode(3, 1, "alice", "laptop"))
+	store.DeleteNode(2)
+
+	got := store.PutNode(createTestNode(4, 1, "alice", "laptop"))
+	require.Equal(t, "laptop-3", got.GivenName(), "numbering continues after siblings")
+	require.Equal(t, "laptop", got.GivenNameBase())
+
+	for _, id := range []types.NodeID{1, 3} {
+		view, ok := store.GetNode(id)
+		require.True(t, ok)
+		require.Equal(t, "laptop", view.GivenNameBase())
+	}
+
+	// Freeing the base label itself makes it available again.
+	store.DeleteNode(1)
+
+	got = store.PutNode(createTestNode(5, 1, "alice", "laptop"))
+	require.Equal(t, "laptop", got.GivenName())
+}
+
+// TestPutNodeGivenNameSkipsSeededSuffix asserts that a collision bump never
+// lands on a label another node already holds, here one an admin assigned
+// by hand, but moves on to the next free suffix.
+func TestPutNodeGivenNameSkipsSeededSuffix(t *testing.T) {
+	store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+	store.Start()
+	defer store.Stop()
+
+	store.PutNode(createTestNode(1, 1, "alice", "laptop"))
+	store.PutNode(createTestNode(2, 1, "alice", "desktop"))
+
+	_, err := store.SetGivenName(2, "laptop-1")
+	require.NoError(t, err)
+
+	got := store.PutNode(createTestNode(3, 2, "bob", "laptop"))
+	require.Equal(t, "laptop-2", got.GivenName(), "the seeded laptop-1 must be skipped")
+
+	seeded, ok := store.GetNode(2)
+	require.True(t, ok)
+	require.Equal(t, "laptop-1", seeded.GivenName(), "the seeded holder keeps its label")
+}
+
+// TestSetGivenNameResetsBase asserts that an admin rename makes the new
+// label its own base, so it no longer counts as a sibling of the old one.
+func TestSetGivenNameResetsBase(t *testing.T) {
+	store := NewNodeStore(nil, allowAllPeersFunc, TestBatchSize, TestBatchTimeout)
+
+	store.Start()
+	defer store.Stop()
+
+	store.PutNode(createTestNode(1, 1, "alice", "laptop"))
+	store.PutNode(createTestNode(2, 1, "alice", "laptop"))
+
+	view, err := store.SetGivenName(2, "workhorse")
+	require.NoError(t, err)
+	require.Equal(t, "workhorse", view.GivenNameBase())
+
+	got := store.PutNode(createTestNode(3, 1, "alice", "laptop"))
+	require.Equal(t, "laptop-1", got.GivenName())
+}
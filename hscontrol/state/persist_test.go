@@ -3,6 +3,7 @@ package state
 import (
 	"errors"
 	"net/netip"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -169,6 +170,30 @@ func TestPersistEmptyTags(t *testing.T) {
 		"after restart, NodeStore should reflect the cleared tags")
 }
 
+func TestPersistManagedBy(t *testing.T) {
+	dbPath, s, nodeID := persistTestSetup(t)
+
+	nv, err := s.SetNodeManagedBy(nodeID, "terraform")
+	require.NoError(t, err)
+	assert.Equal(t, "terraform", nv.ManagedBy())
+
+	got, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	assert.Equal(t, "terraform", got.ManagedBy)
+
+	_, err = s.SetNodeManagedBy(nodeID, "")
+	require.NoError(t, err)
+
+	require.NoError(t, s.Close())
+
+	s2 := persistTestReopen(t, dbPath)
+
+	nv, ok := s2.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.Empty(t, nv.ManagedBy(),
+		"after restart, NodeStore should reflect the cleared managed_by")
+}
+
 // TestPersistEmptyEndpoints covers the endpoints column. Endpoints
 // arrive via MapRequest in production; the test reaches the persist
 // layer directly because the bug is in serialization, not in
@@ -582,3 +607,34 @@ func TestConcurrentPreAuthKeyRegistrationSameMachineKey(t *testing.T) {
 	require.Equal(t, 1, s.ListNodes().Len(),
 		"concurrent registrations of one machine key must yield a single node")
 }
+
+func TestSetNodeDescriptionPersists(t *testing.T) {
+	dbPath, s, nodeID := persistTestSetup(t)
+
+	nv, err := s.SetNodeDescription(nodeID, "rack 3 jump host")
+	require.NoError(t, err)
+	assert.Equal(t, "rack 3 jump host", nv.Description())
+
+	_, err = s.SetNodeDescription(nodeID, strings.Repeat("x", db.MaxNodeDescriptionLength+1))
+	require.ErrorIs(t, err, db.ErrNodeDescriptionTooLong)
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.Equal(t, "rack 3 jump host", nv.Description(), "a rejected description leaves the old one")
+
+	require.NoError(t, s.Close())
+
+	s = persistTestReopen(t, dbPath)
+
+	nv, ok = s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.Equal(t, "rack 3 jump host", nv.Description())
+
+	nv, err = s.SetNodeDescription(nodeID, "")
+	require.NoError(t, err)
+	assert.Empty(t, nv.Description())
+
+	desc, err := s.DB().GetNodeDescription(nodeID)
+	require.NoError(t, err)
+	assert.Empty(t, desc, "clearing is persisted")
+}
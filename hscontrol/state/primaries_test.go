@@ -5,6 +5,7 @@ import (
 	"slices"
 	"testing"
 
+	hsdb "github.com/juanfont/headscale/hscontrol/db"
 	"github.com/juanfont/headscale/hscontrol/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -88,6 +89,14 @@ func (f *primariesFixture) healthy(id types.NodeID) {
 	})
 }
 
+// priority mirrors State.SetRoutePriority.
+func (f *primariesFixture) priority(id types.NodeID, priority int) {
+	f.t.Helper()
+	f.ns.UpdateNode(id, func(n *types.Node) {
+		n.RoutePriority = priority
+	})
+}
+
 // requirePrimary asserts that prefix has node id as its primary.
 func (f *primariesFixture) requirePrimary(prefix netip.Prefix, id types.NodeID) {
 	f.t.Helper()
@@ -145,6 +154,37 @@ func TestPrimaries_OverlappingRoutesLowerIDWins(t *testing.T) {
 	f.requireNodeRoutes(2)
 }
 
+func TestPrimaries_HigherPriorityBeatsLowerID(t *testing.T) {
+	f := newPrimariesFixture(t, 1, 2, 3)
+	f.priority(2, 10)
+	f.priority(3, 10)
+	f.advertise(1, mp("192.168.1.0/24"))
+	f.advertise(2, mp("192.168.1.0/24"))
+	f.advertise(3, mp("192.168.1.0/24"))
+
+	// Node 2 and 3 tie on priority, so the lower ID breaks the tie.
+	f.requirePrimary(mp("192.168.1.0/24"), 2)
+}
+
+func TestPrimaries_HigherPriorityTakesOverFromPrimary(t *testing.T) {
+	// Unlike a returning node of equal priority (see AntiFlap), a
+	// node given a higher priority pre-empts the current primary,
+	// and failover still falls back to the lower priority.
+	f := newPrimariesFixture(t, 1, 2)
+	f.advertise(1, mp("192.168.1.0/24"))
+	f.advertise(2, mp("192.168.1.0/24"))
+	f.requirePrimary(mp("192.168.1.0/24"), 1)
+
+	f.priority(2, 1)
+	f.requirePrimary(mp("192.168.1.0/24"), 2)
+
+	f.unhealthy(2)
+	f.requirePrimary(mp("192.168.1.0/24"), 1)
+
+	f.healthy(2)
+	f.requirePrimary(mp("192.168.1.0/24"), 2)
+}
+
 func TestPrimaries_AntiFlapPreservesCurrentPrimary(t *testing.T) {
 	// A primary that disappears (advertiser leaves the set) should
 	// trigger failover. When the original primary returns, the new
@@ -339,3 +379,386 @@ func TestPrimaries_HANodes(t *testing.T) {
 		})
 	}
 }
+
+func TestSetApprovedRoutesWithQuorum(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2", "router3")
+
+	route := mp("10.0.0.0/24")
+
+	advertise := func(hostname string) {
+		t.Helper()
+
+		_, ok := s.nodeStore.UpdateNode(nodes[hostname].ID, func(n *types.Node) {
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+		})
+		require.True(t, ok)
+	}
+
+	advertise("router1")
+	advertise("router2")
+
+	_, _, err := s.SetApprovedRoutesWithQuorum(nodes["router1"].ID, []netip.Prefix{route}, 3)
+	require.ErrorIs(t, err, ErrInsufficientRedundancy)
+
+	nv, ok := s.GetNodeByID(nodes["router1"].ID)
+	require.True(t, ok)
+	assert.Empty(t, nv.ApprovedRoutes().AsSlice(), "below quorum nothing is approved")
+
+	advertise("router3")
+
+	nv, _, err = s.SetApprovedRoutesWithQuorum(nodes["router1"].ID, []netip.Prefix{route}, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{route}, nv.ApprovedRoutes().AsSlice())
+
+	// Once approved, a route is kept even when the quorum is lost; only
+	// routes being added are counted.
+	_, ok = s.nodeStore.UpdateNode(nodes["router3"].ID, func(n *types.Node) {
+		n.Hostinfo = &tailcfg.Hostinfo{}
+	})
+	require.True(t, ok)
+
+	nv, _, err = s.SetApprovedRoutesWithQuorum(nodes["router1"].ID, []netip.Prefix{route}, 3)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{route}, nv.ApprovedRoutes().AsSlice())
+
+	other := mp("10.0.1.0/24")
+
+	_, _, err = s.SetApprovedRoutesWithQuorum(nodes["router1"].ID, []netip.Prefix{route, other}, 1)
+	require.ErrorIs(t, err, ErrInsufficientRedundancy)
+
+	nv, ok = s.GetNodeByID(nodes["router1"].ID)
+	require.True(t, ok)
+	assert.Equal(t, []netip.Prefix{route}, nv.ApprovedRoutes().AsSlice(), "a refused approval changes nothing")
+}
+
+func TestExitNodeDisabledExcludedFromExitNodes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "exit", "laptop")
+
+	exitRoutes := []netip.Prefix{mp("0.0.0.0/0"), mp("::/0")}
+
+	for _, node := range nodes {
+		_, ok := s.nodeStore.UpdateNode(node.ID, func(n *types.Node) {
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: exitRoutes}
+			n.ApprovedRoutes = exitRoutes
+		})
+		require.True(t, ok)
+	}
+
+	require.Len(t, s.ListExitNodes(), 2)
+
+	nv, c, err := s.SetExitNodeDisabled(nodes["laptop"].ID, true)
+	require.NoError(t, err)
+	assert.True(t, c.IncludePolicy, "peers must get a fresh netmap without the exit routes")
+	assert.Empty(t, nv.ExitRoutes(), "a disabled node offers no exit routes")
+	assert.Equal(t, exitRoutes, nv.ApprovedRoutes().AsSlice(),
+		"disabling keeps the approval so it can be re-enabled")
+
+	exitNodes := s.ListExitNodes()
+	require.Len(t, exitNodes, 1)
+	assert.Equal(t, nodes["exit"].ID, exitNodes[0].ID())
+
+	dbNode, err := s.DB().GetNodeByID(nodes["laptop"].ID)
+	require.NoError(t, err)
+	assert.True(t, dbNode.ExitNodeDisabled)
+
+	_, _, err = s.SetExitNodeDisabled(nodes["laptop"].ID, false)
+	require.NoError(t, err)
+	assert.Len(t, s.ListExitNodes(), 2)
+}
+
+func TestDisableUserRoutesFailsOver(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "leaver-router")
+
+	other := s.CreateUserForTest("stayer")
+	backup := s.CreateRegisteredNodeForTest(other, "stayer-router")
+	s.PutNodeInStoreForTest(*backup)
+
+	route := mp("10.0.0.0/24")
+	leaver := nodes["leaver-router"]
+
+	// The leaver has the lower ID and is approved first, so it is elected.
+	for _, id := range []types.NodeID{leaver.ID, backup.ID} {
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+		})
+		require.True(t, ok)
+
+		_, _, err := s.SetApprovedRoutes(id, []netip.Prefix{route})
+		require.NoError(t, err)
+	}
+
+	primary, ok := s.nodeStore.PrimaryRouteFor(route)
+	require.True(t, ok)
+	require.Equal(t, leaver.ID, primary, "precondition: the leaving user is primary")
+
+	c, err := s.DisableUserRoutes(types.UserID(*leaver.UserID))
+	require.NoError(t, err)
+	assert.True(t, c.IncludePolicy, "failover must reach every peer")
+
+	nv, ok := s.GetNodeByID(leaver.ID)
+	require.True(t, ok)
+	assert.Empty(t, nv.ApprovedRoutes().AsSlice())
+
+	dbNode, err := s.DB().GetNodeByID(leaver.ID)
+	require.NoError(t, err)
+	assert.Empty(t, dbNode.ApprovedRoutes)
+
+	primary, ok = s.nodeStore.PrimaryRouteFor(route)
+	require.True(t, ok)
+	assert.Equal(t, backup.ID, primary, "the route must fail over to the other user")
+
+	c, err = s.DisableUserRoutes(types.UserID(*leaver.UserID))
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "nothing left to disable")
+}
+
+func TestDisconnectFailsOverAcrossThreeRouters(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2", "router3")
+
+	route := mp("10.0.0.0/24")
+	router1, router2, router3 := nodes["router1"].ID, nodes["router2"].ID, nodes["router3"].ID
+
+	epochs := make(map[types.NodeID]uint64)
+
+	for _, id := range []types.NodeID{router1, router2, router3} {
+		_, epoch := s.Connect(id)
+		epochs[id] = epoch
+
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+		})
+		require.True(t, ok)
+
+		_, _, err := s.SetApprovedRoutes(id, []netip.Prefix{route})
+		require.NoError(t, err)
+	}
+
+	requirePrimary := func(want types.NodeID) {
+		t.Helper()
+
+		got, ok := s.nodeStore.PrimaryRouteFor(route)
+		require.True(t, ok, "expected a primary for %s", route)
+		require.Equal(t, want, got)
+	}
+
+	requirePrimary(router1)
+
+	// The primary dropping elects the next online router and tells every
+	// peer to recompute, so they route through the new primary.
+	cs, err := s.Disconnect(router1, epochs[router1])
+	require.NoError(t, err)
+	assert.NotEmpty(t, runtimePeerComputationReasons(cs))
+	requirePrimary(router2)
+
+	// A standby dropping leaves the primary where it is.
+	_, err = s.Disconnect(router3, epochs[router3])
+	require.NoError(t, err)
+	requirePrimary(router2)
+
+	_, epochs[router3] = s.Connect(router3)
+
+	cs, err = s.Disconnect(router2, epochs[router2])
+	require.NoError(t, err)
+	assert.NotEmpty(t, runtimePeerComputationReasons(cs))
+	requirePrimary(router3)
+
+	// The original primary coming back does not take the prefix over.
+	s.Connect(router1)
+	requirePrimary(router3)
+}
+
+func TestDisableRoutesFailsOver(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2")
+
+	shared, own := mp("10.0.0.0/24"), mp("10.1.0.0/24")
+	router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+	// Approve router1 first so it is elected for the shared prefix.
+	for _, r := range []struct {
+		id     types.NodeID
+		routes []netip.Prefix
+	}{
+		{router1, []netip.Prefix{shared, own}},
+		{router2, []netip.Prefix{shared}},
+	} {
+		id, routes := r.id, r.routes
+
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: routes}
+		})
+		require.True(t, ok)
+
+		_, _, err := s.SetApprovedRoutes(id, routes)
+		require.NoError(t, err)
+	}
+
+	primary, ok := s.nodeStore.PrimaryRouteFor(shared)
+	require.True(t, ok)
+	require.Equal(t, router1, primary, "precondition: router1 is primary")
+
+	_, _, err := s.DisableRoutes(router1, mp("192.168.0.0/24"))
+	require.ErrorIs(t, err, hsdb.ErrNodeRouteIsNotAvailable)
+
+	nv, c, err := s.DisableRoutes(router1, shared)
+	require.NoError(t, err)
+	assert.True(t, c.IncludePolicy, "failover must reach every peer")
+	assert.Equal(t, []netip.Prefix{own}, nv.ApprovedRoutes().AsSlice())
+
+	dbNode, err := s.DB().GetNodeByID(router1)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{own}, []netip.Prefix(dbNode.ApprovedRoutes))
+
+	primary, ok = s.nodeStore.PrimaryRouteFor(shared)
+	require.True(t, ok)
+	assert.Equal(t, router2, primary, "the shared route must fail over")
+
+	primary, ok = s.nodeStore.PrimaryRouteFor(own)
+	require.True(t, ok)
+	assert.Equal(t, router1, primary, "other routes stay enabled")
+}
+
+func TestSetNodeRoutesSwapsEnabledSet(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2")
+
+	a, b, c := mp("10.0.0.0/24"), mp("10.1.0.0/24"), mp("10.2.0.0/24")
+	router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+	for _, id := range []types.NodeID{router1, router2} {
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{a, b, c}}
+		})
+		require.True(t, ok)
+	}
+
+	_, _, err := s.SetNodeRoutes(router1, []netip.Prefix{a, b})
+	require.NoError(t, err)
+
+	_, _, err = s.SetNodeRoutes(router2, []netip.Prefix{a})
+	require.NoError(t, err)
+
+	_, _, err = s.SetNodeRoutes(router1, []netip.Prefix{c, mp("192.168.0.0/24")})
+	require.ErrorIs(t, err, hsdb.ErrNodeRouteIsNotAvailable)
+
+	nv, ok := s.GetNodeByID(router1)
+	require.True(t, ok)
+	assert.Equal(t, []netip.Prefix{a, b}, nv.ApprovedRoutes().AsSlice(), "a rejected call changes nothing")
+
+	// Swap router1 from {a, b} to {c, b}: a is disabled and c enabled at once.
+	nv, ch, err := s.SetNodeRoutes(router1, []netip.Prefix{c, b, c})
+	require.NoError(t, err)
+	assert.True(t, ch.IncludePolicy, "the moved primary must reach every peer")
+	assert.Equal(t, []netip.Prefix{b, c}, nv.ApprovedRoutes().AsSlice())
+
+	dbNode, err := s.DB().GetNodeByID(router1)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{b, c}, []netip.Prefix(dbNode.ApprovedRoutes))
+
+	for prefix, want := range map[netip.Prefix]types.NodeID{a: router2, b: router1, c: router1} {
+		primary, ok := s.nodeStore.PrimaryRouteFor(prefix)
+		require.True(t, ok, "%s must have a primary", prefix)
+		assert.Equal(t, want, primary, "primary of %s", prefix)
+	}
+}
+
+func TestSetApprovedRoutesExclusiveOverlap(t *testing.T) {
+	tests := []struct {
+		name    string
+		served  netip.Prefix
+		enabled netip.Prefix
+		overlap bool
+	}{
+		{name: "exact", served: mp("10.0.0.0/24"), enabled: mp("10.0.0.0/24")},
+		{name: "subset", served: mp("10.0.0.0/16"), enabled: mp("10.0.0.0/24"), overlap: true},
+		{name: "superset", served: mp("10.0.0.0/24"), enabled: mp("10.0.0.0/16"), overlap: true},
+		{name: "disjoint", served: mp("10.0.0.0/24"), enabled: mp("10.1.0.0/24")},
+		{name: "exit", served: mp("10.0.0.0/24"), enabled: mp("0.0.0.0/0")},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, nodes := tagsTestSetup(t, "router1", "router2")
+			router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+			for id, route := range map[types.NodeID]netip.Prefix{router1: tt.served, router2: tt.enabled} {
+				_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+					n.IsOnline = new(true)
+					n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{route}}
+				})
+				require.True(t, ok)
+			}
+
+			_, _, err := s.SetApprovedRoutes(router1, []netip.Prefix{tt.served})
+			require.NoError(t, err)
+
+			_, _, err = s.SetApprovedRoutesExclusive(router2, []netip.Prefix{tt.enabled})
+			if !tt.overlap {
+				require.NoError(t, err)
+
+				return
+			}
+
+			require.ErrorIs(t, err, ErrRouteOverlap)
+			assert.ErrorContains(t, err, tt.served.String())
+
+			nv, ok := s.GetNodeByID(router2)
+			require.True(t, ok)
+			assert.Empty(t, nv.ApprovedRoutes().AsSlice(), "a rejected route is not approved")
+
+			// Without strict mode the overlap is only logged.
+			_, _, err = s.SetApprovedRoutes(router2, []netip.Prefix{tt.enabled})
+			require.NoError(t, err)
+		})
+	}
+}
+
+func TestEnableRouteOnAllAdvertisers(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2", "router3", "laptop")
+
+	pool, other := mp("10.1.0.0/16"), mp("10.2.0.0/24")
+	routers := []types.NodeID{nodes["router1"].ID, nodes["router2"].ID, nodes["router3"].ID}
+
+	for _, id := range routers {
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: []netip.Prefix{pool, other}}
+		})
+		require.True(t, ok)
+	}
+
+	c, err := s.EnableRouteOnAllAdvertisers(mp("192.168.0.0/24"))
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "no advertiser is a no-op")
+
+	c, err = s.EnableRouteOnAllAdvertisers(pool)
+	require.NoError(t, err)
+	assert.True(t, c.IncludePolicy, "the new primary must reach every peer")
+
+	primaries := 0
+
+	for _, id := range routers {
+		nv, ok := s.GetNodeByID(id)
+		require.True(t, ok)
+		assert.Equal(t, []netip.Prefix{pool}, nv.ApprovedRoutes().AsSlice(), "only the prefix is enabled")
+
+		dbNode, err := s.DB().GetNodeByID(id)
+		require.NoError(t, err)
+		assert.Equal(t, []netip.Prefix{pool}, []netip.Prefix(dbNode.ApprovedRoutes))
+
+		if slices.Contains(s.GetNodePrimaryRoutes(id), pool) {
+			primaries++
+		}
+	}
+
+	assert.Equal(t, 1, primaries, "exactly one advertiser is primary")
+
+	laptop, ok := s.GetNodeByID(nodes["laptop"].ID)
+	require.True(t, ok)
+	assert.Empty(t, laptop.ApprovedRoutes().AsSlice(), "nodes not advertising the prefix are untouched")
+
+	c, err = s.EnableRouteOnAllAdvertisers(pool)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "enabling again is a no-op")
+}
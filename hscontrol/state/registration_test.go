@@ -0,0 +1,278 @@
+package state
+
+import (
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/types/change"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+	"tailscale.com/types/views"
+)
+
+// TestConcurrentPreAuthKeyRegistrationUsageLimit ensures concurrent
+// registrations of different machines with one capped reusable key cannot
+// overshoot its usage limit: exactly the limit succeed and the rest are
+// refused with [types.ErrPreAuthKeyUsageLimitReached].
+func TestConcurrentPreAuthKeyRegistrationUsageLimit(t *testing.T) {
+	s, err := NewState(persistTestConfig(t.TempDir() + "/headscale.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	user := s.CreateUserForTest("capped-user")
+
+	pak, err := s.CreatePreAuthKey(user.TypedID(), true, false, nil, nil)
+	require.NoError(t, err)
+
+	const (
+		limit = 3
+		n     = 8
+	)
+
+	require.NoError(t, s.SetPreAuthKeyUsageLimit(pak.ID, limit))
+
+	var wg sync.WaitGroup
+
+	start := make(chan struct{})
+	errs := make(chan error, n)
+
+	for range n {
+		wg.Go(func() {
+			regReq := tailcfg.RegisterRequest{
+				Auth:     &tailcfg.RegisterResponseAuth{AuthKey: pak.Key},
+				NodeKey:  key.NewNode().Public(),
+				Hostinfo: &tailcfg.Hostinfo{Hostname: "capped-node"},
+				Expiry:   time.Now().Add(24 * time.Hour),
+			}
+
+			<-start
+
+			_, _, err := s.HandleNodeFromPreAuthKey(regReq, key.NewMachine().Public())
+			errs <- err
+		})
+	}
+
+	close(start)
+	wg.Wait()
+	close(errs)
+
+	registered := 0
+
+	for err := range errs {
+		if err == nil {
+			registered++
+
+			continue
+		}
+
+		require.ErrorIs(t, err, types.ErrPreAuthKeyUsageLimitReached)
+	}
+
+	assert.Equal(t, limit, registered)
+	assert.Equal(t, limit, s.ListNodes().Len(), "refused registrations must not leave a node behind")
+
+	stored, err := s.DB().GetPreAuthKeyByID(pak.ID)
+	require.NoError(t, err)
+	assert.Equal(t, limit, stored.UsageCount)
+}
+
+func TestCreateNodeRespectsUserNodeLimit(t *testing.T) {
+	s, err := NewState(persistTestConfig(t.TempDir() + "/headscale.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	user := s.CreateUserForTest("user")
+	other := s.CreateUserForTest("other")
+
+	params := func(owner *types.User, hostname string) newNodeParams {
+		return newNodeParams{
+			User:           *owner,
+			MachineKey:     key.NewMachine().Public(),
+			NodeKey:        key.NewNode().Public(),
+			DiscoKey:       key.NewDisco().Public(),
+			Hostname:       hostname,
+			RegisterMethod: util.RegisterMethodCLI,
+		}
+	}
+
+	uid := types.UserID(user.ID)
+	require.NoError(t, s.SetUserMaxNodes(uid, 2))
+
+	// Below the limit.
+	_, err = s.createAndSaveNewNode(params(user, "first"))
+	require.NoError(t, err)
+	_, err = s.createAndSaveNewNode(params(user, "second"))
+	require.NoError(t, err)
+
+	// At the limit.
+	_, err = s.createAndSaveNewNode(params(user, "third"))
+	require.ErrorIs(t, err, db.ErrUserNodeLimitReached)
+	assert.Equal(t, 2, s.ListNodes().Len(), "a refused registration must not create a node")
+
+	// Other users are not affected.
+	_, err = s.createAndSaveNewNode(params(other, "other"))
+	require.NoError(t, err)
+
+	// Above the limit, after it was lowered.
+	require.NoError(t, s.SetUserMaxNodes(uid, 1))
+	_, err = s.createAndSaveNewNode(params(user, "third"))
+	require.ErrorIs(t, err, db.ErrUserNodeLimitReached)
+
+	// Zero lifts the limit.
+	require.NoError(t, s.SetUserMaxNodes(uid, 0))
+	_, err = s.createAndSaveNewNode(params(user, "third"))
+	require.NoError(t, err)
+
+	nodes, err := s.db.ListNodes()
+	require.NoError(t, err)
+	assert.Len(t, nodes, 4)
+}
+
+func TestGetNodeByMachineKeyWithState(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "live", "expired")
+	uid := types.UserID(*nodes["live"].UserID)
+
+	_, ok := s.nodeStore.UpdateNode(nodes["live"].ID, func(n *types.Node) {
+		n.IsOnline = new(true)
+		n.Expiry = new(time.Now().Add(time.Hour))
+	})
+	require.True(t, ok)
+
+	_, ok = s.nodeStore.UpdateNode(nodes["expired"].ID, func(n *types.Node) {
+		n.IsOnline = new(false)
+		n.Expiry = new(time.Now().Add(-time.Hour))
+	})
+	require.True(t, ok)
+
+	live, ok := s.GetNodeByMachineKeyWithState(nodes["live"].MachineKey, uid)
+	require.True(t, ok)
+	assert.Equal(t, nodes["live"].ID, live.Node.ID())
+	assert.False(t, live.Expired)
+	assert.True(t, live.Online)
+
+	expired, ok := s.GetNodeByMachineKeyWithState(nodes["expired"].MachineKey, uid)
+	require.True(t, ok, "expired nodes are returned too")
+	assert.Equal(t, nodes["expired"].ID, expired.Node.ID())
+	assert.True(t, expired.Expired)
+	assert.False(t, expired.Online)
+
+	_, ok = s.GetNodeByMachineKeyWithState(nodes["live"].MachineKey, uid+1)
+	assert.False(t, ok, "the node belongs to another user")
+
+	_, ok = s.GetNodeByMachineKeyWithState(key.NewMachine().Public(), uid)
+	assert.False(t, ok)
+}
+
+func TestNodePendingApproval(t *testing.T) {
+	dbPath, s, existingID := persistTestSetup(t)
+
+	existing, ok := s.GetNodeByID(existingID)
+	require.True(t, ok)
+
+	user := existing.User().AsStruct()
+
+	// Restart with approval required; the existing node predates the flag.
+	require.NoError(t, s.Close())
+
+	cfg := persistTestConfig(dbPath)
+	cfg.Node.RequireApproval = true
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	peerIDs := func(peers views.Slice[types.NodeView]) []types.NodeID {
+		ids := []types.NodeID{}
+		for _, peer := range peers.All() {
+			ids = append(ids, peer.ID())
+		}
+
+		return ids
+	}
+
+	pending, err := s.createAndSaveNewNode(newNodeParams{
+		User:           *user,
+		MachineKey:     key.NewMachine().Public(),
+		NodeKey:        key.NewNode().Public(),
+		DiscoKey:       key.NewDisco().Public(),
+		Hostname:       "pending",
+		RegisterMethod: util.RegisterMethodCLI,
+	})
+	require.NoError(t, err, "registration succeeds while approval is pending")
+	require.True(t, pending.PendingApproval())
+
+	existing, ok = s.GetNodeByID(existingID)
+	require.True(t, ok)
+	assert.False(t, existing.PendingApproval(), "nodes from before the flag stay approved")
+
+	// Invisible in both directions, in full and incremental updates.
+	assert.Empty(t, peerIDs(s.ListPeers(existingID)))
+	assert.Empty(t, peerIDs(s.ListPeers(existingID, pending.ID())))
+	assert.Empty(t, peerIDs(s.ListPeers(pending.ID())))
+	assert.Empty(t, peerIDs(s.ListPeers(pending.ID(), existingID)))
+
+	visible, err := s.ListVisiblePeers(existingID)
+	require.NoError(t, err)
+	assert.Empty(t, peerIDs(visible))
+
+	// Admin lookups still find it, so it can be approved.
+	assert.Equal(t, []types.NodeID{pending.ID()}, peerIDs(s.ListNodes(pending.ID())))
+	assert.Equal(t, 2, s.ListNodes().Len())
+
+	approved, cs, err := s.ApproveNode(pending.ID())
+	require.NoError(t, err)
+	assert.False(t, approved.PendingApproval())
+	require.Len(t, cs, 2)
+	// Either a targeted peer change or, when the policy's node set moved, a
+	// policy change that recomputes every peer list.
+	assert.True(t,
+		slices.Contains(cs[0].PeersChanged, pending.ID()) || cs[0].RequiresRuntimePeerComputation,
+		"peers learn about the approved node")
+	assert.Equal(t, change.FullSelf(pending.ID()), cs[1])
+
+	assert.Equal(t, []types.NodeID{pending.ID()}, peerIDs(s.ListPeers(existingID)))
+	assert.Equal(t, []types.NodeID{existingID}, peerIDs(s.ListPeers(pending.ID())))
+
+	stored, err := s.DB().GetNodeByID(pending.ID())
+	require.NoError(t, err)
+	assert.False(t, stored.PendingApproval, "the approval must be persisted")
+
+	_, cs, err = s.ApproveNode(pending.ID())
+	require.NoError(t, err)
+	assert.Empty(t, cs, "approving an approved node changes nothing")
+
+	_, _, err = s.ApproveNode(9999)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+// TestHandleNodeFromAuthPathUnknownUser ensures that registering a node for a
+// user that does not exist, as the CLI does with a user it has not checked,
+// fails with a typed error before anything is allocated or stored.
+func TestHandleNodeFromAuthPathUnknownUser(t *testing.T) {
+	s, err := NewState(persistTestConfig(t.TempDir() + "/headscale.db"))
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	authID := types.MustAuthID()
+	s.SetAuthCacheEntry(authID, types.NewRegisterAuthRequest(&types.RegistrationData{
+		MachineKey: key.NewMachine().Public(),
+		NodeKey:    key.NewNode().Public(),
+		Hostname:   "orphan",
+	}))
+
+	_, _, err = s.HandleNodeFromAuthPath(authID, 9999, nil, util.RegisterMethodCLI)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+
+	assert.Equal(t, 0, s.ListNodes().Len())
+
+	var count int64
+	require.NoError(t, s.db.DB.Model(&types.Node{}).Count(&count).Error)
+	assert.Zero(t, count)
+}
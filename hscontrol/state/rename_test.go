@@ -2,10 +2,16 @@ package state
 
 import (
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
 )
 
 // TestRenameNodeRejectsNameExceedingFQDNLimit proves RenameNode rejects a name
@@ -38,3 +44,257 @@ func TestRenameNodeRejectsNameExceedingFQDNLimit(t *testing.T) {
 	_, _, err = s.RenameNode(node.ID, "short")
 	require.NoError(t, err)
 }
+
+func TestRepairGivenNames(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("repair-user")
+	broken := database.CreateRegisteredNodeForTest(user, "laptop")
+	healthy := database.CreateRegisteredNodeForTest(user, "desktop")
+
+	require.NoError(t, database.DB.Model(&types.Node{}).
+		Where("id = ?", broken.ID).
+		Update("given_name", "").Error)
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	missing, err := s.DB().FindNodesWithoutGivenName()
+	require.NoError(t, err)
+	require.Len(t, missing, 1)
+
+	c, err := s.RepairGivenNames()
+	require.NoError(t, err)
+	assert.False(t, c.IsEmpty(), "peers must learn the repaired name")
+
+	nv, ok := s.GetNodeByID(broken.ID)
+	require.True(t, ok)
+	assert.Equal(t, "laptop", nv.GivenName())
+
+	other, ok := s.GetNodeByID(healthy.ID)
+	require.True(t, ok)
+	assert.Equal(t, "desktop", other.GivenName(), "named nodes are left alone")
+
+	missing, err = s.DB().FindNodesWithoutGivenName()
+	require.NoError(t, err)
+	assert.Empty(t, missing, "the repaired name must be persisted")
+}
+
+func TestHandleNodeFromAuthPathWithGivenName(t *testing.T) {
+	dbPath := t.TempDir() + "/headscale.db"
+	cfg := persistTestConfig(dbPath)
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("sso-user")
+	database.CreateRegisteredNodeForTest(user, "alice")
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	register := func(givenName string) (types.NodeView, error) {
+		t.Helper()
+
+		authID := types.MustAuthID()
+		s.SetAuthCacheEntry(authID, types.NewRegisterAuthRequest(&types.RegistrationData{
+			MachineKey: key.NewMachine().Public(),
+			NodeKey:    key.NewNode().Public(),
+			DiscoKey:   key.NewDisco().Public(),
+			Hostname:   "laptop",
+			Hostinfo:   &tailcfg.Hostinfo{Hostname: "laptop"},
+		}))
+
+		nv, _, err := s.HandleNodeFromAuthPathWithGivenName(
+			authID, types.UserID(user.ID), nil, util.RegisterMethodOIDC, givenName,
+		)
+
+		return nv, err
+	}
+
+	nv, err := register("bob")
+	require.NoError(t, err)
+	assert.Equal(t, "bob", nv.GivenName())
+	assert.Equal(t, "laptop", nv.Hostname(), "the hostname is left alone")
+
+	nv, err = register("alice")
+	require.NoError(t, err)
+	assert.Equal(t, "alice-1", nv.GivenName(), "a taken name gets a suffix")
+
+	nv, err = register("")
+	require.NoError(t, err)
+	assert.Equal(t, "laptop", nv.GivenName(), "no name derives it from the hostname")
+
+	_, err = register("Not A Label")
+	require.ErrorIs(t, err, ErrGivenNameInvalid)
+}
+
+func TestRenameNodeFoldsCase(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "laptop", "phone")
+	phoneID := nodes["phone"].ID
+
+	nv, _, err := s.RenameNode(phoneID, "Work-Phone")
+	require.NoError(t, err)
+	assert.Equal(t, "work-phone", nv.GivenName(), "the stored name is returned")
+
+	dbNode, err := s.DB().GetNodeByID(phoneID)
+	require.NoError(t, err)
+	assert.Equal(t, "work-phone", dbNode.GivenName)
+
+	_, _, err = s.RenameNode(phoneID, "LAPTOP")
+	require.ErrorIs(t, err, ErrNodeNameNotUnique, "a case variant of a taken name collides")
+
+	_, _, err = s.RenameNode(phoneID, "My Phone")
+	require.ErrorIs(t, err, ErrGivenNameInvalid, "spaces are rejected, not rewritten")
+
+	nv, ok := s.GetNodeByID(phoneID)
+	require.True(t, ok)
+	assert.Equal(t, "work-phone", nv.GivenName(), "rejected renames must not change the name")
+}
+
+// TestConcurrentRegistrationsGetDistinctGivenNames registers nodes asking
+// for the same given name at the same time. The NodeStore hands each a
+// distinct name, and the database must end up with the same names.
+func TestConcurrentRegistrationsGetDistinctGivenNames(t *testing.T) {
+	dbPath := t.TempDir() + "/headscale.db"
+	cfg := persistTestConfig(dbPath)
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("racer")
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	const racers = 4
+
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+		views = make([]types.NodeView, racers)
+		errs  = make([]error, racers)
+	)
+
+	for i := range racers {
+		wg.Go(func() {
+			<-start
+
+			views[i], errs[i] = s.createAndSaveNewNode(newNodeParams{
+				User:           *user,
+				MachineKey:     key.NewMachine().Public(),
+				NodeKey:        key.NewNode().Public(),
+				DiscoKey:       key.NewDisco().Public(),
+				Hostname:       "laptop",
+				GivenName:      "shared",
+				RegisterMethod: util.RegisterMethodCLI,
+			})
+		})
+	}
+
+	close(start)
+	wg.Wait()
+
+	names := make(map[string]types.NodeID, racers)
+
+	for i := range racers {
+		require.NoError(t, errs[i])
+
+		name := views[i].GivenName()
+		require.NotContains(t, names, name, "given name %q handed out twice", name)
+		names[name] = views[i].ID()
+
+		stored, err := s.DB().GetNodeByID(views[i].ID())
+		require.NoError(t, err)
+		assert.Equal(t, name, stored.GivenName, "the database must hold the name the node got")
+		assert.Equal(t, "shared", stored.GivenNameBase)
+	}
+
+	assert.Contains(t, names, "shared", "one racer keeps the requested name")
+}
+
+func TestResolveNode(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	alice := database.CreateUserForTest("alice")
+	bob := database.CreateUserForTest("bob")
+
+	web := database.CreateRegisteredNodeForTest(alice, "web")
+	aliceWeb := database.CreateRegisteredNodeForTest(alice, "web")
+	bobWeb := database.CreateRegisteredNodeForTest(bob, "web")
+	numeric := database.CreateRegisteredNodeForTest(alice, "numeric")
+	scanner := database.CreateRegisteredNodeForTest(alice, "scanner")
+	printerA := database.CreateRegisteredNodeForTest(alice, "printer")
+	printerB := database.CreateRegisteredNodeForTest(bob, "printer")
+
+	// Only the first "web" keeps the hostname as its given name, so the
+	// hostname pass sees the others; numeric shares web's IPv4.
+	for id, givenName := range map[types.NodeID]string{
+		aliceWeb.ID: "web-alt",
+		bobWeb.ID:   "bob-web",
+		numeric.ID:  "4242",
+		scanner.ID:  "office-scanner",
+		printerA.ID: "printer-a",
+		printerB.ID: "printer-b",
+	} {
+		require.NoError(t, database.DB.Model(&types.Node{}).
+			Where("id = ?", id).Update("given_name", givenName).Error)
+	}
+
+	require.NoError(t, database.DB.Model(&types.Node{}).
+		Where("id = ?", numeric.ID).Update("ipv4", web.IPv4.String()).Error)
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	tests := []struct {
+		name    string
+		query   string
+		want    types.NodeID
+		wantErr error
+	}{
+		{name: "id", query: bobWeb.ID.String(), want: bobWeb.ID},
+		{name: "unknown-id", query: "9999", wantErr: ErrNodeNotFound},
+		{name: "ipv6", query: bobWeb.IPv6.String(), want: bobWeb.ID},
+		{name: "shared-ipv4", query: web.IPv4.String(), wantErr: ErrNodeAmbiguous},
+		{name: "unknown-ip", query: "100.64.99.99", wantErr: ErrNodeNotFound},
+		{name: "user-hostname", query: "bob:web", want: bobWeb.ID},
+		{name: "shared-user-hostname", query: "alice:web", wantErr: ErrNodeAmbiguous},
+		{name: "unknown-user", query: "carol:web", wantErr: ErrNodeNotFound},
+		{name: "unknown-hostname", query: "alice:db", wantErr: ErrNodeNotFound},
+		{name: "given-name", query: "web", want: web.ID},
+		{name: "numeric-given-name", query: "4242", want: numeric.ID},
+		{name: "unknown-given-name", query: "db", wantErr: ErrNodeNotFound},
+		{name: "hostname", query: "scanner", want: scanner.ID},
+		{name: "shared-hostname", query: "printer", wantErr: ErrNodeAmbiguous},
+		{name: "empty", query: " ", wantErr: ErrNodeNotFound},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node, err := s.ResolveNode(tt.query)
+			if tt.wantErr != nil {
+				require.ErrorIs(t, err, tt.wantErr)
+
+				return
+			}
+
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, node.ID())
+		})
+	}
+}
@@ -0,0 +1,234 @@
+package state
+
+import (
+	"maps"
+	"net/netip"
+	"slices"
+	"sync"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/util/zlog/zf"
+	"github.com/rs/zerolog/log"
+)
+
+// routeEventBuffer is how many events a subscriber may fall behind before
+// further events for it are dropped.
+const routeEventBuffer = 256
+
+// RouteEventType identifies what happened to a route.
+type RouteEventType int
+
+const (
+	// RouteAdvertised is emitted when a node starts announcing a prefix.
+	RouteAdvertised RouteEventType = iota
+	// RouteEnabled is emitted when a prefix is approved for a node.
+	RouteEnabled
+	// RouteDisabled is emitted when a prefix approval is removed from a node.
+	RouteDisabled
+	// PrimaryChanged is emitted when the primary advertiser of a prefix
+	// changes, including failover and the prefix losing its last primary.
+	PrimaryChanged
+)
+
+func (t RouteEventType) String() string {
+	switch t {
+	case RouteAdvertised:
+		return "RouteAdvertised"
+	case RouteEnabled:
+		return "RouteEnabled"
+	case RouteDisabled:
+		return "RouteDisabled"
+	case PrimaryChanged:
+		return "PrimaryChanged"
+	default:
+		return "Unknown"
+	}
+}
+
+// RouteEvent describes a single routing change for external monitoring.
+type RouteEvent struct {
+	Type   RouteEventType
+	Prefix netip.Prefix
+
+	// NodeID and Hostname identify the node the event is about. For
+	// [PrimaryChanged] this is the new primary, and is zero when the prefix
+	// no longer has one.
+	NodeID   types.NodeID
+	Hostname string
+
+	// PreviousNodeID is the former primary for [PrimaryChanged], zero if the
+	// prefix had none. It is unset for the other event types.
+	PreviousNodeID types.NodeID
+}
+
+// RouteEventSubscriber receives route events. Each subscriber is called
+// from its own goroutine, in the order the events were emitted.
+type RouteEventSubscriber func(RouteEvent)
+
+// routeEventBus fans route events out to subscribers without ever blocking
+// the emitter: a subscriber that cannot keep up loses events rather than
+// stalling route changes.
+type routeEventBus struct {
+	mu     sync.Mutex
+	subs   []chan RouteEvent
+	closed bool
+}
+
+func newRouteEventBus() *routeEventBus {
+	return &routeEventBus{}
+}
+
+func (b *routeEventBus) subscribe(fn RouteEventSubscriber) {
+	ch := make(chan RouteEvent, routeEventBuffer)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		close(ch)
+
+		return
+	}
+
+	b.subs = append(b.subs, ch)
+
+	go func() {
+		for ev := range ch {
+			fn(ev)
+		}
+	}()
+}
+
+func (b *routeEventBus) emit(events ...RouteEvent) {
+	if len(events) == 0 {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	for _, ch := range b.subs {
+		for _, ev := range events {
+			select {
+			case ch <- ev:
+			default:
+				log.Warn().
+					Uint64(zf.NodeID, ev.NodeID.Uint64()).
+					Str(zf.Prefix, ev.Prefix.String()).
+					Stringer(zf.RouteEvent, ev.Type).
+					Msg("route event subscriber is falling behind, dropping event")
+			}
+		}
+	}
+}
+
+func (b *routeEventBus) close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.closed {
+		return
+	}
+
+	b.closed = true
+
+	for _, ch := range b.subs {
+		close(ch)
+	}
+
+	b.subs = nil
+}
+
+// SubscribeRouteEvents registers fn to receive every route event emitted
+// after the call. Events are emitted once the change is committed and are
+// delivered asynchronously; see [RouteEventType] for what is reported.
+func (s *State) SubscribeRouteEvents(fn RouteEventSubscriber) {
+	s.routeEvents.subscribe(fn)
+}
+
+// emitRouteDiff emits one event of typ for every prefix in next that is
+// not in prev.
+func (s *State) emitRouteDiff(
+	typ RouteEventType,
+	node types.NodeView,
+	prev, next []netip.Prefix,
+) {
+	var events []RouteEvent
+
+	for _, prefix := range next {
+		if slices.Contains(prev, prefix) {
+			continue
+		}
+
+		events = append(events, RouteEvent{
+			Type:     typ,
+			Prefix:   prefix,
+			NodeID:   node.ID(),
+			Hostname: node.Hostname(),
+		})
+	}
+
+	s.routeEvents.emit(events...)
+}
+
+// publishPrimaryChanges emits [PrimaryChanged] events for every prefix whose
+// primary moved since the assignment last published. Writers call it once
+// their change is persisted, so subscribers never hear of a primary the
+// database does not back yet; a move no writer published is reported by
+// the next call.
+func (s *State) publishPrimaryChanges() {
+	s.primariesMu.Lock()
+	defer s.primariesMu.Unlock()
+
+	next := s.nodeStore.PrimaryRoutes()
+	if maps.Equal(s.publishedPrimaries, next) {
+		return
+	}
+
+	s.emitPrimaryChanges(s.publishedPrimaries, next)
+	s.publishedPrimaries = next
+}
+
+// emitPrimaryChanges emits a [PrimaryChanged] event for every prefix whose
+// primary differs between prev and next.
+func (s *State) emitPrimaryChanges(prev, next map[netip.Prefix]types.NodeID) {
+	prefixes := make([]netip.Prefix, 0, len(prev)+len(next))
+	for prefix := range prev {
+		prefixes = append(prefixes, prefix)
+	}
+
+	for prefix := range next {
+		if _, ok := prev[prefix]; !ok {
+			prefixes = append(prefixes, prefix)
+		}
+	}
+
+	slices.SortFunc(prefixes, netip.Prefix.Compare)
+
+	var events []RouteEvent
+
+	for _, prefix := range prefixes {
+		if prev[prefix] == next[prefix] {
+			continue
+		}
+
+		ev := RouteEvent{
+			Type:           PrimaryChanged,
+			Prefix:         prefix,
+			NodeID:         next[prefix],
+			PreviousNodeID: prev[prefix],
+		}
+
+		if node, ok := s.nodeStore.GetNode(ev.NodeID); ok {
+			ev.Hostname = node.Hostname()
+		}
+
+		events = append(events, ev)
+	}
+
+	s.routeEvents.emit(events...)
+}
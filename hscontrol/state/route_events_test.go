@@ -0,0 +1,133 @@
+package state
+
+import (
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+)
+
+// routeEventRecorder is a subscriber that keeps every event it receives.
+type routeEventRecorder struct {
+	mu     sync.Mutex
+	events []RouteEvent
+}
+
+func (r *routeEventRecorder) record(ev RouteEvent) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.events = append(r.events, ev)
+}
+
+func (r *routeEventRecorder) snapshot() []RouteEvent {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return append([]RouteEvent(nil), r.events...)
+}
+
+func TestRouteEvents(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2")
+
+	rec := &routeEventRecorder{}
+	s.SubscribeRouteEvents(rec.record)
+
+	route := mp("10.0.0.0/24")
+	router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+	for hostname, node := range nodes {
+		_, err := s.UpdateNodeFromMapRequest(node.ID, tailcfg.MapRequest{
+			Hostinfo: &tailcfg.Hostinfo{
+				Hostname:    hostname,
+				RoutableIPs: []netip.Prefix{route},
+			},
+		})
+		require.NoError(t, err)
+
+		s.Connect(node.ID)
+	}
+
+	_, _, err := s.SetApprovedRoutes(router1, []netip.Prefix{route})
+	require.NoError(t, err)
+
+	_, _, err = s.SetApprovedRoutes(router2, []netip.Prefix{route})
+	require.NoError(t, err)
+
+	// router1 going away fails the prefix over to router2.
+	_, err = s.Disconnect(router1, 0)
+	require.NoError(t, err)
+
+	_, _, err = s.SetApprovedRoutes(router2, nil)
+	require.NoError(t, err)
+
+	want := []RouteEvent{
+		{Type: RouteAdvertised, Prefix: route, NodeID: router1, Hostname: "router1"},
+		{Type: RouteAdvertised, Prefix: route, NodeID: router2, Hostname: "router2"},
+		{Type: RouteEnabled, Prefix: route, NodeID: router1, Hostname: "router1"},
+		{Type: PrimaryChanged, Prefix: route, NodeID: router1, Hostname: "router1"},
+		{Type: RouteEnabled, Prefix: route, NodeID: router2, Hostname: "router2"},
+		{
+			Type: PrimaryChanged, Prefix: route,
+			NodeID: router2, Hostname: "router2", PreviousNodeID: router1,
+		},
+		{Type: RouteDisabled, Prefix: route, NodeID: router2, Hostname: "router2"},
+		{Type: PrimaryChanged, Prefix: route, PreviousNodeID: router2},
+	}
+
+	// Every writer emits after persisting, so the events arrive in the
+	// order the changes were made: an approval before the primary it elects.
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, want, rec.snapshot())
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+// TestRouteEventsAutoApproved checks that a route approved by an
+// autoApprovers entry is reported like a manual approval, both when the
+// node announces it and when a policy change approves it later.
+func TestRouteEventsAutoApproved(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2")
+
+	rec := &routeEventRecorder{}
+	s.SubscribeRouteEvents(rec.record)
+
+	route := mp("10.0.0.0/24")
+	router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+	_, err := s.SetPolicy([]byte(`{"autoApprovers": {"routes": {"10.0.0.0/24": ["tag-user@"]}}}`))
+	require.NoError(t, err)
+
+	_, err = s.UpdateNodeFromMapRequest(router1, tailcfg.MapRequest{
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "router1", RoutableIPs: []netip.Prefix{route}},
+	})
+	require.NoError(t, err)
+
+	_, err = s.SetPolicy([]byte(`{}`))
+	require.NoError(t, err)
+
+	_, err = s.UpdateNodeFromMapRequest(router2, tailcfg.MapRequest{
+		Hostinfo: &tailcfg.Hostinfo{Hostname: "router2", RoutableIPs: []netip.Prefix{route}},
+	})
+	require.NoError(t, err)
+
+	_, err = s.SetPolicyInDB(`{"autoApprovers": {"routes": {"10.0.0.0/24": ["tag-user@"]}}}`)
+	require.NoError(t, err)
+
+	_, err = s.ReloadPolicy()
+	require.NoError(t, err)
+
+	want := []RouteEvent{
+		{Type: RouteAdvertised, Prefix: route, NodeID: router1, Hostname: "router1"},
+		{Type: RouteEnabled, Prefix: route, NodeID: router1, Hostname: "router1"},
+		{Type: RouteAdvertised, Prefix: route, NodeID: router2, Hostname: "router2"},
+		{Type: RouteEnabled, Prefix: route, NodeID: router2, Hostname: "router2"},
+	}
+
+	assert.EventuallyWithT(t, func(c *assert.CollectT) {
+		assert.Equal(c, want, rec.snapshot())
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,106 @@
+package state
+
+import (
+	"net/netip"
+	"slices"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"tailscale.com/net/tsaddr"
+)
+
+// RouteSummary describes how one prefix is served across the tailnet.
+type RouteSummary struct {
+	Prefix netip.Prefix
+
+	// Exit is set for the default routes (0.0.0.0/0 and ::/0). Every
+	// enabled exit node serves them, so they never have a primary.
+	Exit bool
+
+	// Advertising is the number of nodes announcing the prefix, Enabled
+	// the number of those that also have it approved.
+	Advertising int
+	Enabled     int
+
+	// Primary is the node currently elected to serve a subnet prefix, zero
+	// if none is (e.g. every enabled router is offline).
+	Primary types.NodeID
+}
+
+// RouteSummary returns a summary of every advertised prefix, subnet routes
+// first and exit routes last, each group ordered by prefix.
+func (s *State) RouteSummary() []RouteSummary {
+	byPrefix := make(map[netip.Prefix]*RouteSummary)
+
+	summary := func(prefix netip.Prefix) *RouteSummary {
+		sum, ok := byPrefix[prefix]
+		if !ok {
+			sum = &RouteSummary{Prefix: prefix, Exit: tsaddr.IsExitRoute(prefix)}
+			byPrefix[prefix] = sum
+		}
+
+		return sum
+	}
+
+	for _, node := range s.nodeStore.ListNodes().All() {
+		for _, prefix := range node.AnnouncedRoutes() {
+			summary(prefix).Advertising++
+		}
+
+		for _, prefix := range append(node.SubnetRoutes(), node.ExitRoutes()...) {
+			summary(prefix).Enabled++
+		}
+	}
+
+	for prefix, nodeID := range s.nodeStore.PrimaryRoutes() {
+		if sum, ok := byPrefix[prefix]; ok {
+			sum.Primary = nodeID
+		}
+	}
+
+	out := make([]RouteSummary, 0, len(byPrefix))
+	for _, sum := range byPrefix {
+		out = append(out, *sum)
+	}
+
+	slices.SortFunc(out, func(a, b RouteSummary) int {
+		if a.Exit != b.Exit {
+			if a.Exit {
+				return 1
+			}
+
+			return -1
+		}
+
+		return a.Prefix.Compare(b.Prefix)
+	})
+
+	return out
+}
+
+// PrimaryRoutesByNode returns, per node, the subnet prefixes it is the
+// current primary for, each list ordered by prefix. Nodes that are primary
+// for nothing are left out. It is [State.RouteSummary] turned node-first.
+//
+// Exit routes have no primary; with includeExit, every node with its exit
+// routes enabled is listed with them as well.
+func (s *State) PrimaryRoutesByNode(includeExit bool) map[types.NodeID][]netip.Prefix {
+	out := make(map[types.NodeID][]netip.Prefix)
+
+	for prefix, nodeID := range s.nodeStore.PrimaryRoutes() {
+		out[nodeID] = append(out[nodeID], prefix)
+	}
+
+	if includeExit {
+		for _, node := range s.nodeStore.ListNodes().All() {
+			if exits := node.ExitRoutes(); len(exits) > 0 {
+				out[node.ID()] = append(out[node.ID()], exits...)
+			}
+		}
+	}
+
+	for _, prefixes := range out {
+		slices.SortFunc(prefixes, netip.Prefix.Compare)
+	}
+
+	return out
+}
@@ -0,0 +1,152 @@
+package state
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/net/tsaddr"
+	"tailscale.com/tailcfg"
+)
+
+func TestRouteSummary(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2", "router3", "exit")
+
+	subnet := mp("10.0.0.0/24")
+	other := mp("192.168.1.0/24")
+	exits := []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()}
+
+	routes := map[string]struct {
+		announced []netip.Prefix
+		approved  []netip.Prefix
+	}{
+		"router1": {[]netip.Prefix{subnet}, []netip.Prefix{subnet}},
+		"router2": {[]netip.Prefix{subnet, other}, []netip.Prefix{subnet}},
+		"router3": {[]netip.Prefix{subnet}, nil},
+		"exit":    {exits, exits},
+	}
+
+	// Approve in ID order so the lowest ID, router1, is elected primary.
+	for _, hostname := range []string{"router1", "router2", "router3", "exit"} {
+		id := nodes[hostname].ID
+
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: routes[hostname].announced}
+		})
+		require.True(t, ok)
+
+		_, _, err := s.SetApprovedRoutes(id, routes[hostname].approved)
+		require.NoError(t, err)
+	}
+
+	want := []RouteSummary{
+		{Prefix: subnet, Advertising: 3, Enabled: 2, Primary: nodes["router1"].ID},
+		{Prefix: other, Advertising: 1},
+		{Prefix: tsaddr.AllIPv4(), Exit: true, Advertising: 1, Enabled: 1},
+		{Prefix: tsaddr.AllIPv6(), Exit: true, Advertising: 1, Enabled: 1},
+	}
+
+	assert.Equal(t, want, s.RouteSummary())
+}
+
+func TestPrimaryRoutesByNode(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2", "exit")
+
+	subnet := mp("10.0.0.0/24")
+	other := mp("192.168.1.0/24")
+	exits := []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()}
+
+	routes := map[string][]netip.Prefix{
+		"router1": {subnet},
+		"router2": {other},
+		"exit":    exits,
+	}
+
+	for hostname, prefixes := range routes {
+		id := nodes[hostname].ID
+
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+			n.Hostinfo = &tailcfg.Hostinfo{RoutableIPs: prefixes}
+		})
+		require.True(t, ok)
+
+		_, _, err := s.SetApprovedRoutes(id, prefixes)
+		require.NoError(t, err)
+	}
+
+	want := map[types.NodeID][]netip.Prefix{
+		nodes["router1"].ID: {subnet},
+		nodes["router2"].ID: {other},
+	}
+	assert.Equal(t, want, s.PrimaryRoutesByNode(false))
+
+	want[nodes["exit"].ID] = []netip.Prefix{tsaddr.AllIPv4(), tsaddr.AllIPv6()}
+	assert.Equal(t, want, s.PrimaryRoutesByNode(true))
+}
+
+func TestUpdateAdvertisedRoutes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "router1", "router2")
+
+	subnet := mp("10.0.0.0/24")
+	other := mp("192.168.1.0/24")
+
+	for _, hostname := range []string{"router1", "router2"} {
+		id := nodes[hostname].ID
+
+		_, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
+			n.IsOnline = new(true)
+		})
+		require.True(t, ok)
+	}
+
+	router1, router2 := nodes["router1"].ID, nodes["router2"].ID
+
+	// Add: both routers advertise subnet and have it approved, router1,
+	// the lower ID, is elected primary.
+	for _, id := range []types.NodeID{router1, router2} {
+		_, _, err := s.UpdateAdvertisedRoutes(id, []netip.Prefix{subnet})
+		require.NoError(t, err)
+
+		_, _, err = s.SetApprovedRoutes(id, []netip.Prefix{subnet})
+		require.NoError(t, err)
+	}
+
+	primary, ok := s.nodeStore.PrimaryRouteFor(subnet)
+	require.True(t, ok)
+	require.Equal(t, router1, primary)
+
+	// Adding a route that does not move a primary only concerns router1.
+	nv, c, err := s.UpdateAdvertisedRoutes(router1, []netip.Prefix{other, subnet})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{subnet, other}, nv.AnnouncedRoutes())
+	assert.Equal(t, []netip.Prefix{subnet}, nv.ApprovedRoutes().AsSlice(), "approvals of kept routes are preserved")
+	assert.Equal(t, []types.NodeID{router1}, c.PeersChanged)
+
+	// Unchanged: the same set in another order is a no-op.
+	_, c, err = s.UpdateAdvertisedRoutes(router1, []netip.Prefix{subnet, other})
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty())
+
+	// Remove: withdrawing the approved subnet disables it and fails over.
+	nv, c, err = s.UpdateAdvertisedRoutes(router1, []netip.Prefix{other})
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{other}, nv.AnnouncedRoutes())
+	assert.Empty(t, nv.ApprovedRoutes().AsSlice(), "a withdrawn route loses its approval")
+	assert.True(t, c.IncludePolicy, "a failover sends every node a fresh netmap")
+
+	primary, ok = s.nodeStore.PrimaryRouteFor(subnet)
+	require.True(t, ok)
+	assert.Equal(t, router2, primary)
+
+	dbNode, err := s.DB().GetNodeByID(router1)
+	require.NoError(t, err)
+	assert.Equal(t, []netip.Prefix{other}, dbNode.AnnouncedRoutes())
+	assert.Empty(t, dbNode.ApprovedRoutes)
+
+	_, _, err = s.UpdateAdvertisedRoutes(9999, nil)
+	require.ErrorIs(t, err, ErrNodeNotInNodeStore)
+}
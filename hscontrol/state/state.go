@@ -36,6 +36,7 @@ import (
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"gorm.io/gorm"
+	"tailscale.com/net/tsaddr"
 	"tailscale.com/tailcfg"
 	"tailscale.com/types/key"
 	"tailscale.com/types/views"
@@ -60,6 +61,10 @@ const (
 	// defaultNodeStoreBatchTimeout is the default maximum time to wait before
 	// processing a partial batch of node operations.
 	defaultNodeStoreBatchTimeout = 500 * time.Millisecond
+
+	// defaultMaxRoutesPerNode is the default cap on the number of routes a
+	// single node may advertise. Real subnet routers stay far below it.
+	defaultMaxRoutesPerNode = 1024
 )
 
 // ErrUnsupportedPolicyMode is returned for invalid policy modes. Valid modes are "file" and "db".
@@ -77,6 +82,34 @@ var ErrNodeNotInNodeStore = errors.New("node no longer exists in NodeStore")
 // ErrNodeNameNotUnique is returned when a node name is not unique.
 var ErrNodeNameNotUnique = errors.New("node name is not unique")
 
+// ErrNodeAmbiguous is returned by [State.ResolveNode] when an identifier
+// matches more than one node.
+var ErrNodeAmbiguous = errors.New("identifier matches more than one node")
+
+// ErrMachineKeyInUse is returned when a node is moved to a machine key that
+// already belongs to another node.
+var ErrMachineKeyInUse = errors.New("machine key already in use by another node")
+
+// ErrTooManyRoutes is reported when a node advertises more routes than
+// [types.Tuning.MaxRoutesPerNode] allows.
+var ErrTooManyRoutes = errors.New("node advertises too many routes")
+
+// ErrNegativeExpiryDuration is returned when a node is asked to expire a
+// negative duration from now.
+var ErrNegativeExpiryDuration = errors.New("expiry duration must not be negative")
+
+// ErrNodeHasNoAuthKey is returned when an operation needs the pre-auth key a
+// node registered with, but the node registered another way (e.g. OIDC).
+var ErrNodeHasNoAuthKey = errors.New("node was not registered with an auth key")
+
+// ErrInsufficientRedundancy is returned when a route is approved with a quorum
+// that fewer nodes advertise it than required.
+var ErrInsufficientRedundancy = errors.New("not enough nodes advertise route")
+
+// ErrRouteOverlap is returned when a route would be enabled that overlaps,
+// without being equal to, a route another node serves.
+var ErrRouteOverlap = errors.New("route overlaps a route enabled on another node")
+
 // nodeUpdateColumns lists all Node columns that should be written
 // during a struct-based GORM Updates() call.  Listing them explicitly
 // forces GORM to include nil/zero-value fields (e.g. UserID=nil when
@@ -101,12 +134,24 @@ var nodeUpdateColumns = []string{
 	"IPv6",
 	"Hostname",
 	"GivenName",
+	"GivenNameBase",
 	"UserID",
 	"RegisterMethod",
 	"Tags",
+	"ManagedBy",
 	"Expiry",
 	"LastSeen",
+	"FirstSeen",
+	"LastHandshake",
 	"ApprovedRoutes",
+	"ExitNodeDisabled",
+	"AutoApproveExit",
+	"PendingApproval",
+	"RoutePriority",
+	"CapVer",
+	"OS",
+	"ClientVersion",
+	"Description",
 	"UpdatedAt",
 }
 
@@ -125,6 +170,11 @@ var ErrNodeKeyInUse = errors.New("node key already in use by another machine")
 // registration is rejected rather than mutating an arbitrarily-picked node.
 var ErrAmbiguousNodeOwnership = errors.New("machine key maps to ambiguous node ownership")
 
+// ErrAuthRequestNotRegistration is returned when a node is registered with
+// the ID of a pending auth request that is not a registration, e.g. an SSH
+// check.
+var ErrAuthRequestNotRegistration = errors.New("auth request is not a node registration")
+
 // sshCheckPair identifies a (source, destination) node pair for
 // SSH check auth tracking.
 type sshCheckPair struct {
@@ -194,6 +244,15 @@ type State struct {
 	// ponytail: entries are never pruned; bounded by distinct machine keys
 	// seen, add cleanup on node delete only if it ever matters.
 	registerLocks *xsync.Map[key.MachinePublic, *sync.Mutex]
+
+	// routeEvents delivers route changes to external subscribers; see
+	// [State.SubscribeRouteEvents].
+	routeEvents *routeEventBus
+
+	// publishedPrimaries is the primary route assignment last reported as
+	// [PrimaryChanged] events; see [State.publishPrimaryChanges].
+	publishedPrimaries map[netip.Prefix]types.NodeID
+	primariesMu        sync.Mutex
 }
 
 // lockRegistration serialises registration for a single machine key and
@@ -270,12 +329,11 @@ func NewState(cfg *types.Config) (*State, error) {
 	nodeStore := NewNodeStore(
 		nodes,
 		func(nodes []types.NodeView) map[types.NodeID][]types.NodeView {
-			return polMan.BuildPeerMap(views.SliceOf(nodes))
+			return polMan.BuildPeerMap(views.SliceOf(approvedNodes(nodes)))
 		},
 		batchSize,
 		batchTimeout,
 	)
-	nodeStore.Start()
 
 	s := &State{
 		cfg: cfg,
@@ -289,8 +347,14 @@ func NewState(cfg *types.Config) (*State, error) {
 
 		sshCheckAuth:  make(map[sshCheckPair]time.Time),
 		registerLocks: xsync.NewMap[key.MachinePublic, *sync.Mutex](),
+
+		routeEvents: newRouteEventBus(),
 	}
 
+	nodeStore.Start()
+
+	s.publishedPrimaries = nodeStore.PrimaryRoutes()
+
 	// Surface nodes whose stored data would break map generation (e.g. an
 	// invalid given name from a legacy row) so an operator can fix them. This
 	// only logs; it never mutates a node's stored name at boot.
@@ -303,6 +367,7 @@ func NewState(cfg *types.Config) (*State, error) {
 func (s *State) Close() error {
 	s.pings.drain()
 	s.nodeStore.Stop()
+	s.routeEvents.close()
 
 	err := s.db.Close()
 	if err != nil {
@@ -513,7 +578,22 @@ func (s *State) ListAllUsers() ([]types.User, error) {
 // authoritative copy from [NodeStore], without touching the policy manager.
 // Batch callers (e.g. autoApproveNodes) use it to write many rows and then
 // trigger a single policy rebuild instead of one per node.
+//
+// Expiry is left alone: it is only updated through explicit SetNodeExpiry
+// calls or re-registration, not during MapRequest updates. Callers that
+// change it in [NodeStore] use [State.persistNodeRowWithExpiryToDB].
 func (s *State) persistNodeRowToDB(node types.NodeView) (types.NodeView, error) {
+	return s.persistNodeRow(node, "Expiry")
+}
+
+// persistNodeRowWithExpiryToDB is [State.persistNodeRowToDB] for callers
+// that set the node's expiry in the same [NodeStore] update, so the row and
+// its expiry are written together.
+func (s *State) persistNodeRowWithExpiryToDB(node types.NodeView) (types.NodeView, error) {
+	return s.persistNodeRow(node)
+}
+
+func (s *State) persistNodeRow(node types.NodeView, omit ...string) (types.NodeView, error) {
 	if !node.Valid() {
 		return types.NodeView{}, ErrInvalidNodeView
 	}
@@ -545,11 +625,9 @@ func (s *State) persistNodeRowToDB(node types.NodeView) (types.NodeView, error)
 
 	nodePtr := fresh.AsStruct()
 
-	// Explicitly select all node columns so GORM includes nil/zero-value
-	// fields (e.g. UserID=nil when converting a user-owned node to tagged).
-	// Omit "Expiry" here: expiry is only updated through explicit
-	// SetNodeExpiry calls or re-registration, not during MapRequest updates.
-	err := s.db.DB.Select(nodeUpdateColumns).Omit("Expiry").Updates(nodePtr).Error
+	err := s.db.Write(func(tx *gorm.DB) error {
+		return updateNodeRow(tx, nodePtr, omit...)
+	})
 	s.persistMu.Unlock()
 
 	if err != nil {
@@ -559,6 +637,25 @@ func (s *State) persistNodeRowToDB(node types.NodeView) (types.NodeView, error)
 	return fresh, nil
 }
 
+// updateNodeRow writes node's row in tx. It explicitly selects all node
+// columns so GORM includes nil/zero-value fields (e.g. UserID=nil when
+// converting a user-owned node to tagged), leaving out omit. A replaced
+// machine or node key is recorded in the node's key history first, so key
+// rotations through re-authentication are tracked like explicit ones.
+func updateNodeRow(tx *gorm.DB, node *types.Node, omit ...string) error {
+	err := hsdb.RecordNodeKeyChange(tx, node)
+	if err != nil {
+		return err
+	}
+
+	query := tx.Select(nodeUpdateColumns)
+	if len(omit) > 0 {
+		query = query.Omit(omit...)
+	}
+
+	return query.Updates(node).Error
+}
+
 // persistNodeToDB saves the given node state to the database and refreshes the
 // policy manager. The exact row written comes from [NodeStore]; see
 // [State.persistNodeRowToDB].
@@ -588,20 +685,32 @@ func (s *State) SaveNode(node types.NodeView) (types.NodeView, change.Change, er
 	resultNode := s.nodeStore.PutNode(*nodePtr)
 
 	// Then save to database using the result from [NodeStore.PutNode]
-	return s.persistNodeToDB(resultNode)
+	nv, c, err := s.persistNodeToDB(resultNode)
+	if err != nil {
+		return nv, c, err
+	}
+
+	s.publishPrimaryChanges()
+
+	return nv, c, nil
 }
 
-// DeleteNode permanently removes a node and cleans up associated resources.
-// Returns whether policies changed and any error. This operation is irreversible.
-func (s *State) DeleteNode(node types.NodeView) (change.Change, error) {
+// PurgeNode permanently removes a node and cleans up associated resources.
+// The returned change removes the node from every peer's netmap and must be
+// sent by the caller. This operation is irreversible; operator deletes go
+// through [State.SoftDeleteNode] instead.
+func (s *State) PurgeNode(node types.NodeView) (change.Change, error) {
+	warnIfExternallyManaged(node, "purge")
+
 	s.nodeStore.DeleteNode(node.ID())
 
-	err := s.db.DeleteNode(node.AsStruct())
+	err := s.db.PurgeNode(node.AsStruct())
 	if err != nil {
 		return change.Change{}, err
 	}
 
 	s.ipAlloc.FreeIPs(node.IPs())
+	s.publishPrimaryChanges()
 
 	c := change.NodeRemoved(node.ID())
 
@@ -620,6 +729,232 @@ func (s *State) DeleteNode(node types.NodeView) (change.Change, error) {
 	return c, nil
 }
 
+// DeleteNodes permanently removes several nodes at once. The database rows
+// go in a single statement and the policy manager is refreshed once, so a
+// large cleanup such as removing a user's fleet yields one change listing
+// every removed node instead of one change per node.
+func (s *State) DeleteNodes(nodes []types.NodeView) (change.Change, error) {
+	if len(nodes) == 0 {
+		return change.Change{}, nil
+	}
+
+	ids := make([]types.NodeID, 0, len(nodes))
+
+	for _, node := range nodes {
+		warnIfExternallyManaged(node, "delete")
+
+		s.nodeStore.DeleteNode(node.ID())
+		ids = append(ids, node.ID())
+	}
+
+	err := s.db.DeleteNodes(ids)
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	for _, node := range nodes {
+		s.ipAlloc.FreeIPs(node.IPs())
+	}
+
+	s.publishPrimaryChanges()
+
+	c := change.PeersRemoved(ids...)
+
+	policyChange, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return change.Change{}, fmt.Errorf("updating policy manager after node deletion: %w", err)
+	}
+
+	if !policyChange.IsEmpty() {
+		c = c.Merge(policyChange)
+	}
+
+	return c, nil
+}
+
+// SoftDeleteNode removes a node from the tailnet like [State.PurgeNode], but
+// keeps its database row so [State.RestoreNode] can undo an accidental
+// delete. The node keeps its addresses while soft-deleted. The returned change
+// removes the node from every peer's netmap and must be sent by the caller.
+func (s *State) SoftDeleteNode(node types.NodeView) (change.Change, error) {
+	warnIfExternallyManaged(node, "soft_delete")
+
+	err := s.db.SoftDeleteNode(node.ID())
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	s.nodeStore.DeleteNode(node.ID())
+	s.publishPrimaryChanges()
+
+	c := change.NodeRemoved(node.ID())
+
+	policyChange, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return change.Change{}, fmt.Errorf("updating policy manager after node soft deletion: %w", err)
+	}
+
+	return c.Merge(policyChange), nil
+}
+
+// RestoreNode brings back a node removed with [State.SoftDeleteNode]. It is
+// refused with [ErrMachineKeyInUse] or [ErrNodeKeyInUse] if the device has
+// registered again as a new node in the meantime. The node comes back
+// offline; if its given name was taken meanwhile it gets a numeric suffix.
+func (s *State) RestoreNode(nodeID types.NodeID) (types.NodeView, change.Change, error) {
+	restored, err := hsdb.Write(s.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		node, err := hsdb.RestoreNode(tx, nodeID)
+		if err != nil {
+			return nil, err
+		}
+
+		owner := types.UserID(0)
+		if node.UserID != nil {
+			owner = types.UserID(*node.UserID)
+		}
+
+		if _, taken := s.nodeStore.GetNodesByMachineKeyAllUsers(node.MachineKey)[owner]; taken {
+			return nil, ErrMachineKeyInUse
+		}
+
+		if _, taken := s.nodeStore.GetNodeByNodeKey(node.NodeKey); taken {
+			return nil, ErrNodeKeyInUse
+		}
+
+		return node, nil
+	})
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	restored.IsOnline = new(false)
+
+	log.Info().EmbedObject(restored.View()).Msg("node restored")
+
+	return s.SaveNode(restored.View())
+}
+
+// RotateNodeKey replaces the node key of a node, as when a client rotates its
+// key on the same machine. Only the node_key column is written. The returned
+// change patches the new key into every peer's netmap right away, so peers do
+// not keep the stale key until their next full update.
+func (s *State) RotateNodeKey(nodeID types.NodeID, nodeKey key.NodePublic) (types.NodeView, change.Change, error) {
+	if holder, taken := s.nodeStore.GetNodeByNodeKey(nodeKey); taken {
+		if holder.ID() == nodeID {
+			return holder, change.Change{}, nil
+		}
+
+		return types.NodeView{}, change.Change{}, ErrNodeKeyInUse
+	}
+
+	nv, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.NodeKey = nodeKey
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	err := s.db.Write(func(tx *gorm.DB) error {
+		return hsdb.NodeSetNodeKey(tx, &types.Node{ID: nodeID}, nodeKey)
+	})
+	if err != nil {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("saving rotated node key: %w", err)
+	}
+
+	return nv, change.NodeKeyRotated(nv), nil
+}
+
+// ReplaceNode moves a node to a new machine and node key, as when a device is
+// reinstalled and operators want it back with the same identity. The old
+// record is deleted and a new one created in a single transaction; the new
+// record keeps the IPs, approved routes, tags or owner, given name, expiry
+// and last known Hostinfo. Connection state (disco key, endpoints, online
+// status) is left for the new device to report.
+func (s *State) ReplaceNode(
+	oldID types.NodeID,
+	machineKey key.MachinePublic,
+	nodeKey key.NodePublic,
+) (types.NodeView, change.Change, error) {
+	old, ok := s.nodeStore.GetNode(oldID)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotFound, oldID)
+	}
+
+	if _, taken := s.nodeStore.GetNodeByNodeKey(nodeKey); taken {
+		return types.NodeView{}, change.Change{}, ErrNodeKeyInUse
+	}
+
+	if len(s.nodeStore.GetNodesByMachineKeyAllUsers(machineKey)) > 0 {
+		return types.NodeView{}, change.Change{}, ErrMachineKeyInUse
+	}
+
+	prevRoutes := s.nodeStore.PrimaryRoutes()
+
+	replacement := old.AsStruct()
+	replacement.ID = 0
+	replacement.MachineKey = machineKey
+	replacement.NodeKey = nodeKey
+	replacement.DiscoKey = key.DiscoPublic{}
+	replacement.Endpoints = nil
+	replacement.LastSeen = nil
+	replacement.CreatedAt = time.Time{}
+	replacement.UpdatedAt = time.Time{}
+	replacement.IsOnline = nil
+	replacement.Unhealthy = false
+	replacement.ActiveSessions = 0
+	replacement.SessionEpoch = 0
+
+	saved, err := hsdb.Write(s.db.DB, func(tx *gorm.DB) (*types.Node, error) {
+		// The history is kept under the replaced node's ID, which it outlives.
+		err := hsdb.RecordNodeKeyChange(tx, &types.Node{
+			ID:         oldID,
+			MachineKey: machineKey,
+			NodeKey:    nodeKey,
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		err = hsdb.PurgeNode(tx, old.AsStruct())
+		if err != nil {
+			return nil, fmt.Errorf("deleting replaced node: %w", err)
+		}
+
+		err = tx.Save(replacement).Error
+		if err != nil {
+			return nil, fmt.Errorf("saving replacement node: %w", err)
+		}
+
+		return replacement, nil
+	})
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	// The old node goes first so the replacement keeps its given name.
+	s.nodeStore.DeleteNode(oldID)
+	nv := s.nodeStore.PutNode(*saved)
+	s.publishPrimaryChanges()
+
+	log.Info().
+		EmbedObject(nv).
+		Uint64(zf.ExistingNodeID, oldID.Uint64()).
+		Msg("Node replaced under new keys")
+
+	c := change.NodeRemoved(oldID).Merge(change.NodeAdded(nv.ID()))
+
+	policyChange, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return nv, change.Change{}, fmt.Errorf("updating policy manager after node replacement: %w", err)
+	}
+
+	if !policyChange.IsEmpty() || !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes()) {
+		c = c.Merge(change.PolicyChange())
+	}
+
+	return nv, c, nil
+}
+
 // Connect marks a node connected and returns the resulting changes
 // plus a session epoch identifying this poll session. Every Connect
 // acquires one live session; the caller must release it with exactly
@@ -631,17 +966,33 @@ func (s *State) Connect(id types.NodeID) ([]change.Change, uint64) {
 	// connectivity by completing the Noise handshake.
 	var epoch uint64
 
+	handshake := time.Now()
+
 	node, ok := s.nodeStore.UpdateNode(id, func(n *types.Node) {
 		n.SessionEpoch++
 		epoch = n.SessionEpoch
 		n.ActiveSessions++
 		n.IsOnline = new(true)
 		n.Unhealthy = false
+		n.LastHandshake = &handshake
+
+		if n.FirstSeen == nil {
+			n.FirstSeen = new(handshake)
+		}
 	})
 	if !ok {
 		return nil, 0
 	}
 
+	// The handshake and onboarding times are for troubleshooting and
+	// metrics, not something worth failing a connection over.
+	err := s.db.RecordConnect(id, handshake)
+	if err != nil {
+		log.Warn().Err(err).EmbedObject(node).Msg("failed to record connect time")
+	}
+
+	s.publishPrimaryChanges()
+
 	// A node coming online sends a lightweight online peer patch. Subnet
 	// routers, relay targets, and via targets get their full peer recompute
 	// from the gated PolicyChange below, so no full update is needed here.
@@ -723,6 +1074,8 @@ func (s *State) Disconnect(id types.NodeID, epoch uint64) ([]change.Change, erro
 		c = change.Change{}
 	}
 
+	s.publishPrimaryChanges()
+
 	// Only a node whose online state changes what peers compute (a subnet
 	// router, relay target, or via target) needs a full peer recompute.
 	// An ordinary node going offline just sends the lightweight offline
@@ -763,61 +1116,121 @@ func (s *State) GetNodesByMachineKeyAllUsers(machineKey key.MachinePublic) map[t
 	return s.nodeStore.GetNodesByMachineKeyAllUsers(machineKey)
 }
 
-// ResolveNode looks up a node by numeric ID, IPv4/IPv6 address, given
-// name, or hostname. It tries ID first, then IP, then GivenName
-// (unique per tailnet), then Hostname (client-reported, may collide).
-// Within the name passes, the lowest NodeID wins so repeated calls
-// are deterministic across snapshot iterations.
-func (s *State) ResolveNode(query string) (types.NodeView, bool) {
+// NodeWithState is a node together with the state re-authentication
+// decides on, computed once when the node was looked up.
+type NodeWithState struct {
+	Node    types.NodeView
+	Expired bool
+	Online  bool
+}
+
+// GetNodeByMachineKeyWithState returns the node owned by userID (UserID(0)
+// for a tagged node) that shares machineKey, along with whether its key has
+// expired and whether it is connected. Expired and disabled nodes are
+// returned as well; the bool is false only when there is no such node.
+func (s *State) GetNodeByMachineKeyWithState(
+	machineKey key.MachinePublic,
+	userID types.UserID,
+) (NodeWithState, bool) {
+	node, ok := s.nodeStore.GetNodesByMachineKeyAllUsers(machineKey)[userID]
+	if !ok || !node.Valid() {
+		return NodeWithState{}, false
+	}
+
+	return NodeWithState{
+		Node:    node,
+		Expired: node.IsExpired(),
+		Online:  node.IsOnlineWithin(0),
+	}, true
+}
+
+// ResolveNode looks up a node by numeric ID, IPv4/IPv6 address,
+// "user:hostname", given name, or hostname. It tries ID first, then IP,
+// then "user:hostname", then GivenName (unique per tailnet), then Hostname
+// (client-reported, may collide). A numeric query that is not a node ID
+// falls through to the name passes, since a given name may be all digits.
+// The first form that matches decides: it returns [ErrNodeNotFound] if no
+// node matches and [ErrNodeAmbiguous] if more than one does, rather than
+// picking one of them.
+func (s *State) ResolveNode(query string) (types.NodeView, error) {
+	query = strings.TrimSpace(query)
+	if query == "" {
+		return types.NodeView{}, fmt.Errorf("%w: empty identifier", ErrNodeNotFound)
+	}
+
 	// Try numeric ID first.
 	id, idErr := types.ParseNodeID(query)
 	if idErr == nil {
-		return s.GetNodeByID(id)
+		if node, ok := s.GetNodeByID(id); ok {
+			return node, nil
+		}
 	}
 
-	// keepLowest returns whichever node has the lower ID, so repeated
-	// calls resolve deterministically across snapshot iterations.
-	keepLowest := func(cur, cand types.NodeView) types.NodeView {
-		if !cur.Valid() || cand.ID() < cur.ID() {
-			return cand
+	// only returns the single match, or reports none or several.
+	only := func(matches []types.NodeView) (types.NodeView, error) {
+		switch len(matches) {
+		case 0:
+			return types.NodeView{}, fmt.Errorf("%w: %q", ErrNodeNotFound, query)
+		case 1:
+			return matches[0], nil
+		}
+
+		ids := make([]types.NodeID, 0, len(matches))
+		for _, n := range matches {
+			ids = append(ids, n.ID())
 		}
 
-		return cur
+		slices.Sort(ids)
+
+		return types.NodeView{}, fmt.Errorf("%w: %q matches nodes %v", ErrNodeAmbiguous, query, ids)
 	}
 
 	// Try IP address.
 	addr, addrErr := netip.ParseAddr(query)
 	if addrErr == nil {
-		var match types.NodeView
+		var matches []types.NodeView
+
+		for _, n := range s.ListNodes().All() {
+			if slices.Contains(n.IPs(), addr) {
+				matches = append(matches, n)
+			}
+		}
+
+		return only(matches)
+	}
+
+	// Try "user:hostname"; tagged nodes belong to no user and never match.
+	if userName, hostname, ok := strings.Cut(query, ":"); ok {
+		var matches []types.NodeView
 
 		for _, n := range s.ListNodes().All() {
-			if !slices.Contains(n.IPs(), addr) {
+			if n.IsTagged() || !n.User().Valid() ||
+				n.User().Name() != userName || n.Hostname() != hostname {
 				continue
 			}
 
-			match = keepLowest(match, n)
+			matches = append(matches, n)
 		}
 
-		return match, match.Valid()
+		return only(matches)
 	}
 
-	// Try GivenName then Hostname, each with a stable tie-break on
-	// lowest NodeID.
-	var givenMatch, hostMatch types.NodeView
+	// Try GivenName then Hostname.
+	var givenMatches, hostMatches []types.NodeView
 
 	for _, n := range s.ListNodes().All() {
 		if n.GivenName() == query {
-			givenMatch = keepLowest(givenMatch, n)
+			givenMatches = append(givenMatches, n)
 		} else if n.Hostname() == query {
-			hostMatch = keepLowest(hostMatch, n)
+			hostMatches = append(hostMatches, n)
 		}
 	}
 
-	if givenMatch.Valid() {
-		return givenMatch, true
+	if len(givenMatches) > 0 {
+		return only(givenMatches)
 	}
 
-	return hostMatch, hostMatch.Valid()
+	return only(hostMatches)
 }
 
 // ListNodes retrieves specific nodes by ID, or all nodes if no IDs provided.
@@ -845,6 +1258,46 @@ func (s *State) ListNodes(nodeIDs ...types.NodeID) views.Slice[types.NodeView] {
 	return views.SliceOf(filteredNodes)
 }
 
+// approvedNodes drops the nodes pending approval, which take no part in
+// peer relationships until approved.
+func approvedNodes(nodes []types.NodeView) []types.NodeView {
+	return slices.DeleteFunc(slices.Clone(nodes), types.NodeView.PendingApproval)
+}
+
+// ApproveNode approves a node held back by node.require_approval. Peers
+// learn about the now visible node, and the node itself gets a full map
+// with its peers. Approving a node that is not pending is a no-op.
+func (s *State) ApproveNode(nodeID types.NodeID) (types.NodeView, []change.Change, error) {
+	node, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
+		return types.NodeView{}, nil, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
+	}
+
+	if !node.PendingApproval() {
+		return node, nil, nil
+	}
+
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.PendingApproval = false
+	})
+	if !ok {
+		return types.NodeView{}, nil, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, nil, err
+	}
+
+	log.Info().
+		Uint64(zf.NodeID, nodeID.Uint64()).
+		Str(zf.NodeName, nodeView.Hostname()).
+		Msg("Approved node")
+
+	// c tells peers about the node, see [State.persistNodeToDB].
+	return nodeView, []change.Change{c, change.FullSelf(nodeID)}, nil
+}
+
 // ListNodesByUser retrieves all nodes belonging to a specific user.
 func (s *State) ListNodesByUser(userID types.UserID) views.Slice[types.NodeView] {
 	return s.nodeStore.ListNodesByUser(userID)
@@ -859,9 +1312,15 @@ func (s *State) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) views.Sl
 	// For specific peerIDs, filter from all nodes.
 	// This path is used for incremental updates (NodeAdded, NodeChanged)
 	// where the caller already knows which peer IDs are involved.
-	// Peer visibility filtering happens in the mapper against the live
-	// policy (buildTailPeers and the shared visiblePeerIDs filter), because
-	// the snapshot peer map is not rebuilt on policy changes.
+	// Peer visibility filtering happens against the live policy in
+	// [State.ListVisiblePeers], because the snapshot peer map is not
+	// rebuilt on policy changes.
+	// A node pending approval neither sees nor is seen by any peer; the
+	// snapshot peer map leaves them out, so this path must as well.
+	if node, ok := s.nodeStore.GetNode(nodeID); ok && node.PendingApproval() {
+		return views.Slice[types.NodeView]{}
+	}
+
 	allNodes := s.nodeStore.ListNodes()
 
 	nodeIDSet := make(map[types.NodeID]struct{}, len(peerIDs))
@@ -872,7 +1331,7 @@ func (s *State) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) views.Sl
 	var filteredNodes []types.NodeView
 
 	for _, node := range allNodes.All() {
-		if _, exists := nodeIDSet[node.ID()]; exists {
+		if _, exists := nodeIDSet[node.ID()]; exists && !node.PendingApproval() {
 			filteredNodes = append(filteredNodes, node)
 		}
 	}
@@ -880,6 +1339,41 @@ func (s *State) ListPeers(nodeID types.NodeID, peerIDs ...types.NodeID) views.Sl
 	return views.SliceOf(filteredNodes)
 }
 
+// ListVisiblePeers returns the peers nodeID may see under the current policy,
+// limited to peerIDs if any are given. [State.ListPeers] gives the candidate
+// set and the node's live matchers filter it through [FilterVisiblePeers],
+// since the snapshot is not rebuilt on policy changes.
+func (s *State) ListVisiblePeers(nodeID types.NodeID, peerIDs ...types.NodeID) (views.Slice[types.NodeView], error) {
+	node, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
+		return views.Slice[types.NodeView]{}, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
+	}
+
+	matchers, err := s.polMan.MatchersForNode(node)
+	if err != nil {
+		return views.Slice[types.NodeView]{}, fmt.Errorf("resolving matchers for node %d: %w", nodeID, err)
+	}
+
+	return FilterVisiblePeers(node, s.ListPeers(nodeID, peerIDs...), matchers), nil
+}
+
+// FilterVisiblePeers returns the peers node may see under matchers, the
+// node's unreduced matchers from [State.MatchersForNode]. It is the one
+// visibility decision shared by the map responses and the API, for callers
+// that already hold the matchers. Without any matchers there are no
+// restrictions and every peer is visible.
+func FilterVisiblePeers(
+	node types.NodeView,
+	peers views.Slice[types.NodeView],
+	matchers []matcher.Match,
+) views.Slice[types.NodeView] {
+	if len(matchers) == 0 {
+		return peers
+	}
+
+	return policy.ReduceNodes(node, peers, matchers)
+}
+
 // ListEphemeralNodes retrieves all ephemeral (temporary) nodes in the system.
 func (s *State) ListEphemeralNodes() views.Slice[types.NodeView] {
 	allNodes := s.nodeStore.ListNodes()
@@ -896,78 +1390,291 @@ func (s *State) ListEphemeralNodes() views.Slice[types.NodeView] {
 	return views.SliceOf(ephemeralNodes)
 }
 
-// SetNodeExpiry updates the expiration time for a node.
-// If expiry is nil, the node's expiry is disabled (node will never expire).
-func (s *State) SetNodeExpiry(nodeID types.NodeID, expiry *time.Time) (types.NodeView, change.Change, error) {
-	// Update [NodeStore] before database to ensure consistency. The [NodeStore] update
-	// is blocking and will be the source of truth for the batcher. The database update
-	// must make the exact same change. If the database update fails, the [NodeStore]
-	// change will remain, but since we return an error, no change notification will be
-	// sent to the batcher, preventing inconsistent state propagation.
-	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
-		node.Expiry = expiry
-	})
+// ExpireEphemeralNodes deletes every ephemeral node, whichever user owns it,
+// that has been offline for longer than inactivityTimeout. A node that was
+// never seen gets the same grace period from its registration, so it is not
+// deleted before it had the chance to connect. Candidates are collected first
+// and removed in one [State.DeleteNodes] pass, so the returned change lists
+// every expired node at once.
+func (s *State) ExpireEphemeralNodes(inactivityTimeout time.Duration) (change.Change, error) {
+	var expired []types.NodeView
+
+	for _, node := range s.ListEphemeralNodes().All() {
+		if node.IsOnlineWithin(inactivityTimeout) {
+			continue
+		}
 
-	if !ok {
-		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+		if !node.LastSeen().Valid() && time.Since(node.CreatedAt()) < inactivityTimeout {
+			continue
+		}
+
+		expired = append(expired, node)
 	}
 
-	// Persist expiry change to database directly since persistNodeToDB omits expiry.
-	err := s.db.NodeSetExpiry(nodeID, expiry)
-	if err != nil {
-		return types.NodeView{}, change.Change{}, fmt.Errorf("setting node expiry in database: %w", err)
+	if len(expired) == 0 {
+		return change.Change{}, nil
 	}
 
-	// Update policy manager and generate change notification.
-	c, err := s.updatePolicyManagerNodes()
+	c, err := s.DeleteNodes(expired)
 	if err != nil {
-		return n, change.Change{}, fmt.Errorf("updating policy manager after setting expiry: %w", err)
+		return change.Change{}, fmt.Errorf("expiring ephemeral nodes: %w", err)
 	}
 
-	if c.IsEmpty() {
-		c = change.NodeAdded(n.ID())
-	}
+	log.Info().Int(zf.NodeCount, len(expired)).Msg("expired inactive ephemeral nodes")
 
-	return n, c, nil
+	return c, nil
 }
 
-// SetNodeTags assigns tags to a node, making it a "tagged node".
-// Once a node is tagged, it cannot be un-tagged (only tags can be changed).
-// Setting tags clears UserID since tagged nodes are owned by their tags.
-func (s *State) SetNodeTags(nodeID types.NodeID, tags []string) (types.NodeView, change.Change, error) {
-	if len(tags) == 0 {
-		return types.NodeView{}, change.Change{}, types.ErrCannotRemoveAllTags
+// PurgeLongExpiredNodes permanently deletes the nodes whose key expired more
+// than grace ago, unlike [State.ExpireExpiredNodes], which only tells peers a
+// key has expired. The grace period leaves time to re-authenticate a node
+// before it is gone. Nodes without an expiry and connected nodes are kept.
+// All purged nodes are removed in one [State.DeleteNodes] pass.
+func (s *State) PurgeLongExpiredNodes(grace time.Duration) (change.Change, error) {
+	cutoff := time.Now().Add(-grace)
+
+	var purge []types.NodeView
+
+	for _, node := range s.nodeStore.ListNodes().All() {
+		expiry, ok := node.Expiry().GetOk()
+		if !ok || expiry.IsZero() || !expiry.Before(cutoff) || node.IsOnlineWithin(0) {
+			continue
+		}
+
+		purge = append(purge, node)
 	}
 
-	// Get node for validation
-	existingNode, exists := s.nodeStore.GetNode(nodeID)
-	if !exists {
+	if len(purge) == 0 {
+		return change.Change{}, nil
+	}
+
+	c, err := s.DeleteNodes(purge)
+	if err != nil {
+		return change.Change{}, fmt.Errorf("purging long expired nodes: %w", err)
+	}
+
+	log.Info().Int(zf.NodeCount, len(purge)).Dur(zf.GraceDuration, grace).Msg("purged long expired nodes")
+
+	return c, nil
+}
+
+// ListStaleNodes returns the offline nodes last seen more than threshold ago,
+// including nodes that have never connected. Connected nodes are never stale,
+// whatever their LastSeen says.
+func (s *State) ListStaleNodes(threshold time.Duration) views.Slice[types.NodeView] {
+	var stale []types.NodeView
+
+	for _, node := range s.nodeStore.ListNodes().All() {
+		if !node.IsOnlineWithin(threshold) {
+			stale = append(stale, node)
+		}
+	}
+
+	return views.SliceOf(stale)
+}
+
+// keyLifetime returns how long the key of a node owned by user may live. The
+// user's MaxKeyLifetime takes precedence over the global node.expiry; capped
+// reports whether it did, in which case expiries requested by the client are
+// clamped to it as well. A zero lifetime means keys do not expire by default.
+func (s *State) keyLifetime(user *types.User) (time.Duration, bool) {
+	if user != nil && user.MaxKeyLifetime != nil {
+		return *user.MaxKeyLifetime, true
+	}
+
+	return s.cfg.Node.Expiry, false
+}
+
+// applyKeyLifetime sets the expiry of an untagged node registering for user:
+// a node without one gets the key lifetime from now, and a node whose
+// requested expiry exceeds the user's MaxKeyLifetime is clamped to it.
+func (s *State) applyKeyLifetime(node *types.Node, user *types.User) {
+	if node.IsTagged() {
+		return
+	}
+
+	lifetime, capped := s.keyLifetime(user)
+	if lifetime <= 0 {
+		return
+	}
+
+	limit := time.Now().Add(lifetime)
+
+	if node.Expiry == nil || node.Expiry.IsZero() || (capped && node.Expiry.After(limit)) {
+		node.Expiry = &limit
+	}
+}
+
+// SetUserMaxKeyLifetime sets the key lifetime override for the nodes of a
+// user, applied from their next registration. A nil lifetime removes the
+// override so the global node.expiry applies again.
+func (s *State) SetUserMaxKeyLifetime(userID types.UserID, lifetime *time.Duration) error {
+	return s.db.SetUserMaxKeyLifetime(userID, lifetime)
+}
+
+// SetUserMaxNodes sets how many nodes a user may own. Nodes the user
+// already has are kept; the limit only refuses new registrations. Zero
+// removes the limit.
+func (s *State) SetUserMaxNodes(userID types.UserID, maxNodes int) error {
+	return s.db.SetUserMaxNodes(userID, maxNodes)
+}
+
+// SetNodeExpiry updates the expiration time for a node.
+// If expiry is nil, the node's expiry is disabled (node will never expire).
+func (s *State) SetNodeExpiry(nodeID types.NodeID, expiry *time.Time) (types.NodeView, change.Change, error) {
+	n, c, err := s.setNodeExpiry(nodeID, expiry)
+	if err != nil {
+		return n, change.Change{}, err
+	}
+
+	if c.IsEmpty() {
+		c = change.NodeAdded(n.ID())
+	}
+
+	return n, c, nil
+}
+
+// SetNodeExpiryIn sets a node to expire d from now, for automation that
+// works with durations rather than timestamps. Connected peers are sent the
+// new expiry as a patch. A negative d is rejected rather than expiring the
+// node in the past; use a zero d to expire it immediately.
+func (s *State) SetNodeExpiryIn(nodeID types.NodeID, d time.Duration) (types.NodeView, change.Change, error) {
+	if d < 0 {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %s", ErrNegativeExpiryDuration, d)
+	}
+
+	expiry := time.Now().Add(d)
+
+	n, c, err := s.setNodeExpiry(nodeID, &expiry)
+	if err != nil {
+		return n, change.Change{}, err
+	}
+
+	return n, c.Merge(change.KeyExpiryFor(nodeID, expiry)), nil
+}
+
+// ExpireNodeAndRevokeAuthKey expires a node now and revokes the pre-auth key
+// it registered with, so it cannot simply log in again with a reusable key.
+// The key is revoked for every node, but nodes already registered with it
+// keep working. A node registered without a key is refused with
+// [ErrNodeHasNoAuthKey] and left untouched.
+func (s *State) ExpireNodeAndRevokeAuthKey(nodeID types.NodeID) (types.NodeView, change.Change, error) {
+	node, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
 		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
 	}
 
-	// Validate tags: must have correct format and exist in policy
-	validatedTags := make([]string, 0, len(tags))
-	invalidTags := make([]string, 0)
+	if !node.AuthKeyID().Valid() {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeHasNoAuthKey, nodeID)
+	}
 
-	for _, tag := range tags {
-		if !strings.HasPrefix(tag, "tag:") || !s.polMan.TagExists(tag) {
-			invalidTags = append(invalidTags, tag)
+	// Revoke before expiring so the node cannot re-register in between.
+	// An already revoked key is just as unusable, so that is not an error.
+	err := s.db.RevokePreAuthKey(node.AuthKeyID().Get())
+	if err != nil && !errors.Is(err, hsdb.ErrPreAuthKeyNotFound) {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("revoking auth key: %w", err)
+	}
 
-			continue
+	return s.SetNodeExpiryIn(nodeID, 0)
+}
+
+// ExpireNodesByRegisterMethod expires every node registered with method (one
+// of the util.RegisterMethod constants), e.g. to make all OIDC nodes log in
+// again after moving to a new identity provider. Connected peers are sent
+// the new expiry as patches.
+func (s *State) ExpireNodesByRegisterMethod(method string) (change.Change, error) {
+	now := time.Now()
+
+	nodeIDs, err := s.db.ExpireNodesByRegisterMethod(method, now)
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	if len(nodeIDs) == 0 {
+		return change.Change{}, nil
+	}
+
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(nodeIDs))
+	for _, id := range nodeIDs {
+		updates[id] = func(n *types.Node) {
+			n.Expiry = new(now)
 		}
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return change.Change{}, fmt.Errorf("updating policy manager after expiring nodes: %w", err)
+	}
+
+	for _, id := range nodeIDs {
+		c = c.Merge(change.KeyExpiryFor(id, now))
+	}
+
+	log.Info().
+		Str(zf.RegistrationMethod, method).
+		Int(zf.Records, len(nodeIDs)).
+		Msg("Expired nodes by register method")
+
+	return c, nil
+}
+
+// setNodeExpiry writes a node's expiry to the [NodeStore] and the database
+// and returns the resulting policy change, which is empty when the policy
+// is unaffected.
+func (s *State) setNodeExpiry(nodeID types.NodeID, expiry *time.Time) (types.NodeView, change.Change, error) {
+	// Update [NodeStore] before database to ensure consistency. The [NodeStore] update
+	// is blocking and will be the source of truth for the batcher. The database update
+	// must make the exact same change. If the database update fails, the [NodeStore]
+	// change will remain, but since we return an error, no change notification will be
+	// sent to the batcher, preventing inconsistent state propagation.
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.Expiry = expiry
+	})
 
-		validatedTags = append(validatedTags, tag)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
 	}
 
-	if len(invalidTags) > 0 {
-		return types.NodeView{}, change.Change{}, fmt.Errorf("%w %v are invalid or not permitted", ErrRequestedTagsInvalidOrNotPermitted, invalidTags)
+	// Persist expiry change to database directly since persistNodeToDB omits expiry.
+	err := s.db.NodeSetExpiry(nodeID, expiry)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("setting node expiry in database: %w", err)
+	}
+
+	// Update policy manager and generate change notification.
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return n, change.Change{}, fmt.Errorf("updating policy manager after setting expiry: %w", err)
 	}
 
-	slices.Sort(validatedTags)
-	validatedTags = slices.Compact(validatedTags)
+	return n, c, nil
+}
+
+// SetNodeTags assigns tags to a node, making it a "tagged node".
+// Setting tags clears UserID since tagged nodes are owned by their tags.
+// It cannot remove every tag, as that would leave the node without an owner;
+// use [State.ClearNodeTags] to hand a tagged node back to a user.
+func (s *State) SetNodeTags(nodeID types.NodeID, tags []string) (types.NodeView, change.Change, error) {
+	if len(tags) == 0 {
+		return types.NodeView{}, change.Change{}, types.ErrCannotRemoveAllTags
+	}
+
+	// Get node for validation
+	existingNode, exists := s.nodeStore.GetNode(nodeID)
+	if !exists {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
+	}
+
+	validatedTags, err := s.validateTags(tags)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
 
 	// Log the operation
 	logTagOperation(existingNode, validatedTags)
+	warnIfExternallyManaged(existingNode, "set_tags")
 
 	// Update [NodeStore] before database to ensure consistency. The [NodeStore] update
 	// is blocking and will be the source of truth for the batcher. The database update
@@ -977,6 +1684,8 @@ func (s *State) SetNodeTags(nodeID types.NodeID, tags []string) (types.NodeView,
 		// Tagged nodes are owned by their tags, not a user.
 		node.UserID = nil
 		node.User = nil
+		// Explicit tags are no longer the user's defaults to re-apply.
+		node.TaggedByUserID = nil
 	})
 
 	if !ok {
@@ -997,14 +1706,243 @@ func (s *State) SetNodeTags(nodeID types.NodeID, tags []string) (types.NodeView,
 	return nodeView, c, nil
 }
 
+// ClearNodeTags removes every tag from a node and hands it back to userID.
+// Tags and user ownership are mutually exclusive, so a node cannot simply be
+// left without tags: the caller must name the user that will own it. The
+// node gets a key expiry as any user-owned node registering for that user
+// would.
+func (s *State) ClearNodeTags(nodeID types.NodeID, userID types.UserID) (types.NodeView, change.Change, error) {
+	existingNode, exists := s.nodeStore.GetNode(nodeID)
+	if !exists {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
+	}
+
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("loading new owner: %w", err)
+	}
+
+	log.Info().
+		EmbedObject(existingNode).
+		Strs(zf.OldTags, existingNode.Tags().AsSlice()).
+		Uint(zf.NewUser, user.ID).
+		Msg("Clearing tags and returning node to user")
+	warnIfExternallyManaged(existingNode, "clear_tags")
+
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.Tags = nil
+		node.TaggedByUserID = nil
+		node.UserID = &user.ID
+		node.User = user
+
+		s.applyKeyLifetime(node, user)
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, err := s.persistNodeRowWithExpiryToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return nodeView, change.Change{}, fmt.Errorf("updating policy manager after clearing tags: %w", err)
+	}
+
+	if c.IsEmpty() {
+		c = change.NodeAdded(nodeID)
+	}
+
+	// As in [State.SetNodeTags], the node needs a self-update to learn it
+	// lost its tags.
+	c.OriginNode = nodeID
+
+	return nodeView, c, nil
+}
+
+// MoveNodeToUser hands a user-owned node over to userID. Moving a node to
+// the user that already owns it is a no-op returning an empty change.
+// Tagged nodes are owned by their tags and are refused with
+// [ErrTaggedNodeHasUser]; use [State.ClearNodeTags] to give one to a user.
+// Given names are unique across the tailnet, so the node keeps its name.
+func (s *State) MoveNodeToUser(nodeID types.NodeID, userID types.UserID) (types.NodeView, change.Change, error) {
+	existingNode, exists := s.nodeStore.GetNode(nodeID)
+	if !exists {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotFound, nodeID)
+	}
+
+	if existingNode.IsTagged() {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: node %d is owned by its tags", ErrTaggedNodeHasUser, nodeID)
+	}
+
+	if existingNode.UserID().Valid() && types.UserID(existingNode.UserID().Get()) == userID {
+		return existingNode, change.Change{}, nil
+	}
+
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("loading new owner: %w", err)
+	}
+
+	// A machine key maps to at most one node per user.
+	if _, taken := s.nodeStore.GetNodesByMachineKeyAllUsers(existingNode.MachineKey())[userID]; taken {
+		return types.NodeView{}, change.Change{}, ErrMachineKeyInUse
+	}
+
+	log.Info().
+		EmbedObject(existingNode).
+		Uint(zf.NewUser, user.ID).
+		Msg("Moving node to user")
+	warnIfExternallyManaged(existingNode, "move_user")
+
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.UserID = &user.ID
+		node.User = user
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return nodeView, c, err
+	}
+
+	// Peers list the node under its owner's profile and policy may grant
+	// the new owner different access, so every netmap needs rebuilding,
+	// the node's own included.
+	if !c.IsFull() {
+		c = change.PolicyChange()
+	}
+
+	c.OriginNode = nodeID
+
+	return nodeView, c, nil
+}
+
+// ReassignNodes hands every node of fromUserID over to toUserID, as when
+// teams are reorganised. Both users must exist. If any node's machine key is
+// already registered to toUserID the call fails with [ErrMachineKeyInUse]
+// before anything is written; otherwise all nodes move in a single database
+// statement and one change covering them is returned. Given names are unique
+// across the tailnet, so no node needs renaming.
+func (s *State) ReassignNodes(fromUserID, toUserID types.UserID) (change.Change, error) {
+	_, err := s.db.GetUserByID(fromUserID)
+	if err != nil {
+		return change.Change{}, fmt.Errorf("loading current owner: %w", err)
+	}
+
+	user, err := s.db.GetUserByID(toUserID)
+	if err != nil {
+		return change.Change{}, fmt.Errorf("loading new owner: %w", err)
+	}
+
+	if fromUserID == toUserID {
+		return change.Change{}, nil
+	}
+
+	nodes := s.nodeStore.ListNodesByUser(fromUserID)
+	if nodes.Len() == 0 {
+		return change.Change{}, nil
+	}
+
+	nodeIDs := make([]types.NodeID, 0, nodes.Len())
+
+	for _, node := range nodes.All() {
+		// A machine key maps to at most one node per user.
+		if _, taken := s.nodeStore.GetNodesByMachineKeyAllUsers(node.MachineKey())[toUserID]; taken {
+			return change.Change{}, fmt.Errorf("%w: node %d", ErrMachineKeyInUse, node.ID())
+		}
+
+		warnIfExternallyManaged(node, "move_user")
+
+		nodeIDs = append(nodeIDs, node.ID())
+	}
+
+	err = s.db.Write(func(tx *gorm.DB) error {
+		_, err := hsdb.ReassignNodes(tx, fromUserID, toUserID)
+
+		return err
+	})
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(nodeIDs))
+	for _, id := range nodeIDs {
+		updates[id] = func(n *types.Node) {
+			n.UserID = &user.ID
+			n.User = user
+		}
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	log.Info().
+		Uint64(zf.OldUser, uint64(fromUserID)).
+		Uint(zf.NewUser, user.ID).
+		Int(zf.NodeCount, len(nodeIDs)).
+		Msg("Reassigned nodes to user")
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return change.Change{}, fmt.Errorf("updating policy manager after reassigning nodes: %w", err)
+	}
+
+	return c.Merge(change.PolicyAndPeers(nodeIDs...)), nil
+}
+
 // SetApprovedRoutes sets the network routes that a node is approved to advertise.
 func (s *State) SetApprovedRoutes(nodeID types.NodeID, routes []netip.Prefix) (types.NodeView, change.Change, error) {
+	return s.setApprovedRoutes(nodeID, routes, nil)
+}
+
+// approvalCheck vets the routes an approval adds to node. It runs inside the
+// [NodeStore] update, so no other write lands between the check and the
+// approval; an error leaves the node unchanged.
+type approvalCheck func(node *types.Node, added []netip.Prefix) error
+
+func (s *State) setApprovedRoutes(
+	nodeID types.NodeID,
+	routes []netip.Prefix,
+	check approvalCheck,
+) (types.NodeView, change.Change, error) {
 	// TODO(kradalby): In principle we should call the AutoApprove logic here
 	// because even if the CLI removes an auto-approved route, it will be added
 	// back automatically.
 	prevRoutes := s.nodeStore.PrimaryRoutes()
 
+	if current, ok := s.nodeStore.GetNode(nodeID); ok {
+		if overlap, found := s.findRouteOverlap(nodeID, current.AnnouncedRoutes(), routes); found {
+			log.Warn().
+				Uint64(zf.NodeID, nodeID.Uint64()).
+				Str(zf.Prefix, overlap.route.String()).
+				Str(zf.OverlapsPrefix, overlap.other.String()).
+				Uint64(zf.OverlapsNodeID, overlap.owner.Uint64()).
+				Msg("enabling a route that overlaps a route of another node, routing to the overlap is ambiguous")
+		}
+	}
+
+	var (
+		prevApproved []netip.Prefix
+		checkErr     error
+	)
+
 	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		if check != nil {
+			added := slices.DeleteFunc(slices.Clone(routes), func(route netip.Prefix) bool {
+				return slices.Contains(node.ApprovedRoutes, route)
+			})
+
+			checkErr = check(node, added)
+			if checkErr != nil {
+				return
+			}
+		}
+
+		prevApproved = slices.Clone(node.ApprovedRoutes)
 		node.ApprovedRoutes = routes
 		// A node with no approved routes is no longer an HA
 		// candidate; drop any stale Unhealthy bit (mirrors the
@@ -1014,31 +1952,481 @@ func (s *State) SetApprovedRoutes(nodeID types.NodeID, routes []netip.Prefix) (t
 		}
 	})
 
-	if !ok {
-		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	if checkErr != nil {
+		return types.NodeView{}, change.Change{}, checkErr
+	}
+
+	// Persist the node changes to the database
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	s.emitRouteDiff(RouteEnabled, nodeView, prevApproved, routes)
+	s.emitRouteDiff(RouteDisabled, nodeView, routes, prevApproved)
+	s.publishPrimaryChanges()
+
+	// PolicyChange fans out a fresh netmap whenever the new approved
+	// set shifted a primary advertiser.
+	routeChange := !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes())
+	if routeChange || !c.IsFull() {
+		c = change.PolicyChange()
+	}
+
+	return nodeView, c, nil
+}
+
+// UpdateAdvertisedRoutes replaces the routes nodeID announces with
+// advertised. Approvals of routes that are still announced are kept, while
+// a route the node stops announcing also loses its approval, so it is not
+// served again by surprise if the node re-announces it later. Dropping an
+// approved route moves its primary to another advertiser, if any.
+//
+// The returned change only tells peers about the node, unless a primary
+// moved, in which case every node gets a fresh netmap. Nothing is written
+// and the change is empty when the announced set did not change.
+func (s *State) UpdateAdvertisedRoutes(
+	nodeID types.NodeID,
+	advertised []netip.Prefix,
+) (types.NodeView, change.Change, error) {
+	current, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	advertised = slices.Clone(advertised)
+	slices.SortFunc(advertised, netip.Prefix.Compare)
+	advertised = slices.Compact(advertised)
+
+	prevAnnounced := slices.SortedFunc(slices.Values(current.AnnouncedRoutes()), netip.Prefix.Compare)
+	if slices.Equal(prevAnnounced, advertised) {
+		return current, change.Change{}, nil
+	}
+
+	prevRoutes := s.nodeStore.PrimaryRoutes()
+
+	var withdrawn []netip.Prefix
+
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		hi := &tailcfg.Hostinfo{}
+		if node.Hostinfo != nil {
+			hi = node.Hostinfo.Clone()
+		}
+
+		hi.RoutableIPs = advertised
+		node.Hostinfo = hi
+
+		node.ApprovedRoutes = slices.DeleteFunc(slices.Clone(node.ApprovedRoutes), func(route netip.Prefix) bool {
+			if slices.Contains(prevAnnounced, route) && !slices.Contains(advertised, route) {
+				withdrawn = append(withdrawn, route)
+
+				return true
+			}
+
+			return false
+		})
+
+		if len(node.AllApprovedRoutes()) == 0 {
+			node.Unhealthy = false
+		}
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	s.emitRouteDiff(RouteAdvertised, nodeView, prevAnnounced, advertised)
+	s.emitRouteDiff(RouteDisabled, nodeView, nil, withdrawn)
+	s.publishPrimaryChanges()
+
+	if !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes()) {
+		return nodeView, change.PolicyChange(), nil
+	}
+
+	if !c.IsEmpty() {
+		return nodeView, c, nil
+	}
+
+	return nodeView, change.NodeAdded(nodeID), nil
+}
+
+// SetApprovedRoutesWithQuorum behaves like [State.SetApprovedRoutes] but
+// refuses with [ErrInsufficientRedundancy] unless every route it newly
+// approves is advertised by at least quorum nodes, counting nodeID itself.
+// Routes that are already approved are kept without a check. It lets
+// operators make sure a critical prefix is highly available from the moment
+// it is enabled.
+func (s *State) SetApprovedRoutesWithQuorum(
+	nodeID types.NodeID,
+	routes []netip.Prefix,
+	quorum int,
+) (types.NodeView, change.Change, error) {
+	return s.setApprovedRoutes(nodeID, routes, func(node *types.Node, added []netip.Prefix) error {
+		others := s.nodeStore.ListNodes()
+
+		for _, route := range added {
+			advertisers := 0
+			if slices.Contains(node.AnnouncedRoutes(), route) {
+				advertisers++
+			}
+
+			for _, other := range others.All() {
+				if other.ID() != node.ID && slices.Contains(other.AnnouncedRoutes(), route) {
+					advertisers++
+				}
+			}
+
+			if advertisers < quorum {
+				return fmt.Errorf(
+					"%w %s: %d of %d required",
+					ErrInsufficientRedundancy, route, advertisers, quorum,
+				)
+			}
+		}
+
+		return nil
+	})
+}
+
+// SetApprovedRoutesExclusive behaves like [State.SetApprovedRoutes] but
+// refuses with [ErrRouteOverlap] to enable a subnet route that overlaps a
+// different prefix another node serves, e.g. 10.0.0.0/24 while another node
+// serves 10.0.0.0/16. Equal prefixes are allowed: they are high availability
+// routes with a single elected primary. The check runs inside the [NodeStore]
+// update, so two concurrent approvals cannot both pass it.
+func (s *State) SetApprovedRoutesExclusive(
+	nodeID types.NodeID,
+	routes []netip.Prefix,
+) (types.NodeView, change.Change, error) {
+	return s.setApprovedRoutes(nodeID, routes, func(node *types.Node, _ []netip.Prefix) error {
+		if overlap, ok := s.findRouteOverlap(node.ID, node.AnnouncedRoutes(), routes); ok {
+			return fmt.Errorf(
+				"%w: %s overlaps %s on node %d",
+				ErrRouteOverlap, overlap.route, overlap.other, overlap.owner,
+			)
+		}
+
+		return nil
+	})
+}
+
+// routeOverlap describes a route of one node overlapping a route another
+// node serves.
+type routeOverlap struct {
+	route netip.Prefix
+	other netip.Prefix
+	owner types.NodeID
+}
+
+// findRouteOverlap reports the first of routes that is in announced, the
+// routes nodeID advertises, and that overlaps, without being equal to, a
+// subnet route served by another node. Exit routes are skipped, as they
+// overlap everything by design.
+func (s *State) findRouteOverlap(
+	nodeID types.NodeID,
+	announced []netip.Prefix,
+	routes []netip.Prefix,
+) (routeOverlap, bool) {
+	for _, other := range s.nodeStore.ListNodes().All() {
+		if other.ID() == nodeID {
+			continue
+		}
+
+		for _, route := range routes {
+			if tsaddr.IsExitRoute(route) || !slices.Contains(announced, route) {
+				continue
+			}
+
+			for _, served := range other.SubnetRoutes() {
+				if served != route && served.Overlaps(route) {
+					return routeOverlap{route: route, other: served, owner: other.ID()}, true
+				}
+			}
+		}
+	}
+
+	return routeOverlap{}, false
+}
+
+// DisableRoutes withdraws the approval of routes from a node, keeping its
+// other approved routes. Every route must be one the node advertises,
+// otherwise [hsdb.ErrNodeRouteIsNotAvailable] is returned and nothing
+// changes. Prefixes the node was primary for fail over to the remaining
+// advertisers.
+func (s *State) DisableRoutes(nodeID types.NodeID, routes ...netip.Prefix) (types.NodeView, change.Change, error) {
+	nv, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	announced := nv.AnnouncedRoutes()
+	for _, route := range routes {
+		if !slices.Contains(announced, route) {
+			return types.NodeView{}, change.Change{}, fmt.Errorf(
+				"%w: %s on node %d", hsdb.ErrNodeRouteIsNotAvailable, route, nodeID,
+			)
+		}
+	}
+
+	approved := slices.DeleteFunc(nv.ApprovedRoutes().AsSlice(), func(p netip.Prefix) bool {
+		return slices.Contains(routes, p)
+	})
+
+	return s.SetApprovedRoutes(nodeID, approved)
+}
+
+// SetNodeRoutes replaces the approved routes of a node with enabled in a single
+// write, so a node is never left with half of a new route set. Unlike
+// [State.SetApprovedRoutes], every route must be one the node advertises,
+// otherwise [hsdb.ErrNodeRouteIsNotAvailable] is returned and nothing changes.
+// Primaries of every added or removed prefix are re-elected by the NodeStore
+// and the returned change covers all of them.
+func (s *State) SetNodeRoutes(nodeID types.NodeID, enabled []netip.Prefix) (types.NodeView, change.Change, error) {
+	nv, ok := s.nodeStore.GetNode(nodeID)
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	announced := nv.AnnouncedRoutes()
+	for _, route := range enabled {
+		if !slices.Contains(announced, route) {
+			return types.NodeView{}, change.Change{}, fmt.Errorf(
+				"%w: %s on node %d", hsdb.ErrNodeRouteIsNotAvailable, route, nodeID,
+			)
+		}
+	}
+
+	routes := slices.Clone(enabled)
+	slices.SortFunc(routes, netip.Prefix.Compare)
+
+	return s.SetApprovedRoutes(nodeID, slices.Compact(routes))
+}
+
+// EnableRouteOnAllAdvertisers approves prefix on every node that advertises
+// it, as when a new pool of subnet routers is brought up. All approvals are
+// written in one database transaction and then applied in a single
+// [NodeStore] batch, so a failed write changes nothing, the NodeStore elects
+// one primary among them at once, and a single change is returned. It is a
+// no-op returning an empty change if no node advertises prefix or it is
+// already approved everywhere.
+func (s *State) EnableRouteOnAllAdvertisers(prefix netip.Prefix) (change.Change, error) {
+	prefix = prefix.Masked()
+
+	approvedByID := make(map[types.NodeID][]netip.Prefix)
+
+	for _, nv := range s.nodeStore.ListNodes().All() {
+		if !slices.Contains(nv.AnnouncedRoutes(), prefix) ||
+			slices.Contains(nv.ApprovedRoutes().AsSlice(), prefix) {
+			continue
+		}
+
+		approved := append(nv.ApprovedRoutes().AsSlice(), prefix)
+		slices.SortFunc(approved, netip.Prefix.Compare)
+
+		approvedByID[nv.ID()] = approved
+	}
+
+	if len(approvedByID) == 0 {
+		return change.Change{}, nil
+	}
+
+	// Persist every approval in one transaction before touching the
+	// NodeStore, so a failed write leaves both exactly as they were.
+	err := s.db.Write(func(tx *gorm.DB) error {
+		for id, approved := range approvedByID {
+			err := tx.Model(&types.Node{ID: id}).
+				Select("approved_routes").
+				Updates(&types.Node{ApprovedRoutes: approved}).Error
+			if err != nil {
+				return fmt.Errorf("saving approved routes of node %d: %w", id, err)
+			}
+		}
+
+		return nil
+	})
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(approvedByID))
+	for id, approved := range approvedByID {
+		updates[id] = func(n *types.Node) {
+			n.ApprovedRoutes = approved
+		}
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	for id := range approvedByID {
+		fresh, ok := s.nodeStore.GetNode(id)
+		if !ok {
+			continue
+		}
+
+		s.emitRouteDiff(RouteEnabled, fresh, nil, []netip.Prefix{prefix})
+	}
+
+	s.publishPrimaryChanges()
+
+	log.Info().
+		Str(zf.Prefix, prefix.String()).
+		Int(zf.NodeCount, len(approvedByID)).
+		Msg("Enabled route on all advertising nodes")
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return change.Change{}, fmt.Errorf("updating policy manager after enabling route: %w", err)
+	}
+
+	if c.IsEmpty() {
+		c = change.PolicyChange()
+	}
+
+	return c, nil
+}
+
+// DisableUserRoutes withdraws the route approvals of every node owned by
+// userID, so an offboarded user stops serving subnet and exit routes. Prefixes
+// the user was primary for fail over to the remaining advertisers. The
+// returned change covers all nodes; it is empty if none had approved routes.
+func (s *State) DisableUserRoutes(userID types.UserID) (change.Change, error) {
+	var c change.Change
+
+	for _, node := range s.nodeStore.ListNodesByUser(userID).All() {
+		if node.ApprovedRoutes().Len() == 0 {
+			continue
+		}
+
+		_, nodeChange, err := s.SetApprovedRoutes(node.ID(), nil)
+		if err != nil {
+			return change.Change{}, fmt.Errorf("disabling routes of node %d: %w", node.ID(), err)
+		}
+
+		c = c.Merge(nodeChange)
+	}
+
+	return c, nil
+}
+
+// SetExitNodeDisabled stops (or allows again) a node from acting as an exit
+// node, whatever exit routes it advertises or has approved.
+func (s *State) SetExitNodeDisabled(nodeID types.NodeID, disabled bool) (types.NodeView, change.Change, error) {
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.ExitNodeDisabled = disabled
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	// Every peer's netmap carries the node's exit routes, so all of them
+	// need a fresh one.
+	if !c.IsFull() {
+		c = change.PolicyChange()
+	}
+
+	return nodeView, c, nil
+}
+
+// SetRoutePriority sets the priority of a node in primary route election for
+// the subnet routes it advertises. A node with a higher priority takes over
+// as primary as soon as it is online and healthy; equal priorities keep the
+// current primary.
+func (s *State) SetRoutePriority(nodeID types.NodeID, priority int) (types.NodeView, change.Change, error) {
+	prevRoutes := s.nodeStore.PrimaryRoutes()
+
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.RoutePriority = priority
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	s.publishPrimaryChanges()
+
+	if !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes()) {
+		return nodeView, change.PolicyChange(), nil
+	}
+
+	return nodeView, c, nil
+}
+
+// SetAutoApproveExit sets whether the exit routes a node advertises are
+// approved without an autoApprovers entry. Enabling it approves the exit
+// routes the node already advertises right away.
+func (s *State) SetAutoApproveExit(nodeID types.NodeID, enabled bool) (types.NodeView, change.Change, error) {
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.AutoApproveExit = enabled
+	})
+	if !ok {
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	nodeView, c, err := s.persistNodeToDB(n)
+	if err != nil {
+		return types.NodeView{}, change.Change{}, err
+	}
+
+	if !enabled {
+		return nodeView, c, nil
 	}
 
-	// Persist the node changes to the database
-	nodeView, c, err := s.persistNodeToDB(n)
+	routeChange, err := s.AutoApproveRoutes(nodeView)
 	if err != nil {
 		return types.NodeView{}, change.Change{}, err
 	}
 
-	// PolicyChange fans out a fresh netmap whenever the new approved
-	// set shifted a primary advertiser.
-	routeChange := !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes())
-	if routeChange || !c.IsFull() {
-		c = change.PolicyChange()
+	if routeChange.IsEmpty() {
+		return nodeView, c, nil
 	}
 
-	return nodeView, c, nil
+	nodeView, _ = s.nodeStore.GetNode(nodeID)
+
+	return nodeView, c.Merge(routeChange), nil
+}
+
+// ListExitNodes returns the nodes that can currently be used as exit nodes:
+// those with approved exit routes that are not [types.Node.ExitNodeDisabled].
+func (s *State) ListExitNodes() []types.NodeView {
+	var exitNodes []types.NodeView
+
+	for _, nv := range s.nodeStore.ListNodes().All() {
+		if nv.IsExitNode() {
+			exitNodes = append(exitNodes, nv)
+		}
+	}
+
+	return exitNodes
 }
 
 // RenameNode changes the display name of a node. The admin supplies
 // the exact DNS label they want; malformed input is rejected (no
 // auto-sanitisation) and collisions error out rather than silently
 // bumping a user-facing label. See HOSTNAME.md for the CLI contract.
+// The label is stored in lower case, as registration stores it; the
+// returned view carries the name actually stored.
 func (s *State) RenameNode(nodeID types.NodeID, newName string) (types.NodeView, change.Change, error) {
+	// DNS labels are case-insensitive, so folding case loses nothing and
+	// keeps "Laptop" from coexisting with a registered "laptop".
+	newName = strings.ToLower(newName)
+
 	// Validate the label AND that the resulting FQDN fits MaxHostnameLength:
 	// a valid 63-char label can still overflow under a long base_domain, and
 	// an unmappable name would break this node and its peers (issue #3346).
@@ -1059,9 +2447,103 @@ func (s *State) RenameNode(nodeID types.NodeID, newName string) (types.NodeView,
 		}
 	}
 
+	warnIfExternallyManaged(view, "rename")
+
 	return s.persistNodeToDB(view)
 }
 
+// SetNodeDescription sets the operator description of a node, or clears it
+// if desc is empty. The description is metadata only: it is not part of the
+// policy or of any map response, so no change is returned.
+func (s *State) SetNodeDescription(nodeID types.NodeID, desc string) (types.NodeView, error) {
+	err := hsdb.ValidateNodeDescription(desc)
+	if err != nil {
+		return types.NodeView{}, err
+	}
+
+	view, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.Description = desc
+	})
+	if !ok {
+		return types.NodeView{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	err = s.db.SetNodeDescription(nodeID, desc)
+	if err != nil {
+		return types.NodeView{}, fmt.Errorf("saving node description: %w", err)
+	}
+
+	return view, nil
+}
+
+// RepairGivenNames gives every node without a given name one derived from its
+// hostname, falling back to "node" when the hostname sanitises to nothing.
+// The usual collision suffixes apply. It backs `headscale nodes check` and
+// returns the change peers need to learn the new names.
+func (s *State) RepairGivenNames() (change.Change, error) {
+	var c change.Change
+
+	for _, nv := range s.nodeStore.ListNodes().All() {
+		if nv.GivenName() != "" {
+			continue
+		}
+
+		n, ok := s.nodeStore.UpdateNode(nv.ID(), func(node *types.Node) {
+			node.GivenName = cmp.Or(dnsname.SanitizeHostname(node.Hostname), fallbackGivenName)
+		})
+		if !ok {
+			continue
+		}
+
+		repaired, nodeChange, err := s.persistNodeToDB(n)
+		if err != nil {
+			return change.Change{}, fmt.Errorf("repairing given name of node %d: %w", nv.ID(), err)
+		}
+
+		log.Info().
+			EmbedObject(repaired).
+			Msg("Repaired empty given name")
+
+		c = c.Merge(nodeChange)
+	}
+
+	return c, nil
+}
+
+// SetNodeManagedBy records the external system managing a node. An empty
+// system marks the node as manually managed again. The value is metadata only
+// and does not change what peers see, so no change is returned.
+func (s *State) SetNodeManagedBy(nodeID types.NodeID, system string) (types.NodeView, error) {
+	n, ok := s.nodeStore.UpdateNode(nodeID, func(node *types.Node) {
+		node.ManagedBy = system
+	})
+	if !ok {
+		return types.NodeView{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, nodeID)
+	}
+
+	return s.persistNodeRowToDB(n)
+}
+
+// warnIfExternallyManaged logs a warning when a manual operation touches a
+// node owned by an external system, as that system may revert the change.
+func warnIfExternallyManaged(node types.NodeView, op string) {
+	if !node.Valid() || node.ManagedBy() == "" {
+		return
+	}
+
+	log.Warn().
+		EmbedObject(node).
+		Str(zf.Op, op).
+		Msg("Modifying node managed by an external system, the change may be reverted")
+}
+
+// NodesWithMismatchedFamilies returns the nodes whose addresses do not match
+// the configured address families, e.g. dual-stack nodes after the IPv6
+// prefix was removed. [State.BackfillNodeIPs] reassigns them.
+func (s *State) NodesWithMismatchedFamilies() (types.Nodes, error) {
+	return s.db.FindNodesWithMismatchedFamilies(s.ipAlloc.Families())
+}
+
 // BackfillNodeIPs assigns IP addresses to nodes that don't have them.
 func (s *State) BackfillNodeIPs() ([]string, error) {
 	changes, err := s.db.BackfillNodeIPs(s.ipAlloc)
@@ -1099,6 +2581,118 @@ func (s *State) BackfillNodeIPs() ([]string, error) {
 	return changes, nil
 }
 
+// ReallocateOutOfRangeIPs moves nodes whose addresses fall outside the
+// configured prefixes, e.g. after the prefixes were changed, to new addresses
+// in range. The returned changes tell every peer about the new addresses and
+// each moved node about its own; there are none if all addresses were in
+// range.
+func (s *State) ReallocateOutOfRangeIPs() ([]change.Change, error) {
+	changed, err := s.db.ReallocateOutOfRangeIPs(s.ipAlloc)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(changed) == 0 {
+		return nil, nil
+	}
+
+	nodeIDs := make([]types.NodeID, 0, len(changed))
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(changed))
+
+	for _, node := range changed {
+		ipv4, ipv6 := node.IPv4, node.IPv6
+		updates[node.ID] = func(n *types.Node) {
+			n.IPv4 = ipv4
+			n.IPv6 = ipv6
+		}
+
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return nil, fmt.Errorf("updating policy manager after reallocating IPs: %w", err)
+	}
+
+	changes := []change.Change{c.Merge(change.PolicyAndPeers(nodeIDs...))}
+	for _, id := range nodeIDs {
+		changes = append(changes, change.SelfUpdate(id))
+	}
+
+	return changes, nil
+}
+
+// ImportNodes registers the nodes of an import manifest in one transaction,
+// so either all of them are created or none is; see [hsdb.ImportNodeManifest].
+// A manifest of an unknown version is rejected with
+// [hsdb.ErrNodeManifestVersion]. The imported nodes are offline until they
+// connect to this server.
+func (s *State) ImportNodes(manifest hsdb.NodeManifest) ([]types.NodeView, change.Change, error) {
+	var prefixes []netip.Prefix
+	for _, prefix := range []*netip.Prefix{s.cfg.PrefixV4, s.cfg.PrefixV6} {
+		if prefix != nil {
+			prefixes = append(prefixes, *prefix)
+		}
+	}
+
+	var reserved []netip.Addr
+
+	imported, err := hsdb.Write(s.db.DB, func(tx *gorm.DB) (types.Nodes, error) {
+		nodes, err := hsdb.ImportNodeManifest(tx, manifest, prefixes)
+		if err != nil {
+			return nil, err
+		}
+
+		// The import only sees the addresses stored in the database. Claim
+		// them in the allocator before committing, so an address handed to
+		// a registration that has not saved its node yet fails the import
+		// instead of being given out twice.
+		var ips []netip.Addr
+		for _, node := range nodes {
+			ips = append(ips, node.IPs()...)
+		}
+
+		err = s.ipAlloc.ReserveIPs(ips)
+		if err != nil {
+			return nil, fmt.Errorf("reserving imported addresses: %w", err)
+		}
+
+		reserved = ips
+
+		return nodes, nil
+	})
+	if err != nil {
+		// Only set when the commit itself failed.
+		s.ipAlloc.FreeIPs(reserved)
+
+		return nil, change.Change{}, err
+	}
+
+	views := make([]types.NodeView, 0, len(imported))
+	nodeIDs := make([]types.NodeID, 0, len(imported))
+
+	for _, node := range imported {
+		node.IsOnline = new(false)
+
+		nv, err := s.putNewNode(*node)
+		if err != nil {
+			return nil, change.Change{}, fmt.Errorf("adding imported node %d: %w", node.ID, err)
+		}
+
+		views = append(views, nv)
+		nodeIDs = append(nodeIDs, node.ID)
+	}
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return nil, change.Change{}, fmt.Errorf("updating policy manager after importing nodes: %w", err)
+	}
+
+	return views, c.Merge(change.PolicyAndPeers(nodeIDs...)), nil
+}
+
 // ExpireExpiredNodes finds and processes expired nodes since the last check.
 // Returns next check time, state update with expired nodes, and whether any were found.
 func (s *State) ExpireExpiredNodes(lastCheck time.Time) (time.Time, []change.Change, bool) {
@@ -1106,6 +2700,30 @@ func (s *State) ExpireExpiredNodes(lastCheck time.Time) (time.Time, []change.Cha
 	// while this function is running by using a consistent timestamp for the next check
 	started := time.Now()
 
+	updates := s.expiredNodeChanges(lastCheck, started)
+	if len(updates) > 0 {
+		return started, updates, true
+	}
+
+	return started, nil, false
+}
+
+// PreviewExpiredNodes reports the peer changes [State.ExpireExpiredNodes]
+// would produce for lastCheck right now, without advancing any check window.
+// Both share the same selection, so the preview matches the real sweep.
+func (s *State) PreviewExpiredNodes(lastCheck time.Time) []*tailcfg.PeerChange {
+	var patches []*tailcfg.PeerChange
+
+	for _, c := range s.expiredNodeChanges(lastCheck, time.Now()) {
+		patches = append(patches, c.PeerPatches...)
+	}
+
+	return patches
+}
+
+// expiredNodeChanges returns a key expiry change for every node whose expiry
+// falls in (lastCheck, until].
+func (s *State) expiredNodeChanges(lastCheck, until time.Time) []change.Change {
 	var updates []change.Change
 
 	for _, node := range s.nodeStore.ListNodes().All() { //nolint:unqueryvet // NodeStore.ListNodes not a SQL query
@@ -1113,18 +2731,21 @@ func (s *State) ExpireExpiredNodes(lastCheck time.Time) (time.Time, []change.Cha
 			continue
 		}
 
-		// Why check After(lastCheck): We only want to notify about nodes that
-		// expired since the last check to avoid duplicate notifications
-		if node.IsExpired() && node.Expiry().Valid() && node.Expiry().Get().After(lastCheck) {
-			updates = append(updates, change.KeyExpiryFor(node.ID(), node.Expiry().Get()))
+		if !node.Expiry().Valid() {
+			continue
 		}
-	}
 
-	if len(updates) > 0 {
-		return started, updates, true
+		// Only notify about nodes whose expiry falls in (lastCheck, until].
+		// Comparing against the start of the pass rather than the current
+		// time keeps the windows of consecutive passes from overlapping, so a
+		// node expiring while a pass runs is reported by exactly one of them.
+		expiry := node.Expiry().Get()
+		if expiry.After(lastCheck) && !expiry.After(until) {
+			updates = append(updates, change.KeyExpiryFor(node.ID(), expiry))
+		}
 	}
 
-	return started, nil, false
+	return updates
 }
 
 // SSHPolicy returns the SSH access policy for a node.
@@ -1356,6 +2977,7 @@ func (s *State) BatchSetNodeHealth(updates map[types.NodeID]bool) bool {
 	}
 
 	s.nodeStore.UpdateNodes(fns)
+	s.publishPrimaryChanges()
 
 	return !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes())
 }
@@ -1368,8 +2990,7 @@ func (s *State) BatchSetNodeHealth(updates map[types.NodeID]bool) bool {
 func healthSetter(healthy bool) UpdateNodeFunc {
 	return func(n *types.Node) {
 		if !healthy {
-			online := n.IsOnline != nil && *n.IsOnline
-			if !online || len(n.AllApprovedRoutes()) == 0 {
+			if !n.IsOnlineWithin(0) || len(n.AllApprovedRoutes()) == 0 {
 				return
 			}
 		}
@@ -1511,6 +3132,12 @@ func (s *State) SetPreAuthKeyDescription(id uint64, description string) error {
 	return s.db.SetPreAuthKeyDescription(id, description)
 }
 
+// SetPreAuthKeyUsageLimit caps how many nodes a reusable pre-auth key may
+// register. Zero removes the cap.
+func (s *State) SetPreAuthKeyUsageLimit(id uint64, limit int) error {
+	return s.db.SetPreAuthKeyUsageLimit(id, limit)
+}
+
 // ExpirePreAuthKey marks a pre-authentication key as expired.
 func (s *State) ExpirePreAuthKey(id uint64) error {
 	return s.db.ExpirePreAuthKey(id)
@@ -1521,6 +3148,39 @@ func (s *State) DeletePreAuthKey(id uint64) error {
 	return s.db.DeletePreAuthKey(id)
 }
 
+// RotateAuthKeyForNodes moves the nodes registered with one pre-auth key over
+// to another, as when a compromised key is replaced. The nodes keep their
+// tags, owner and addresses; only the key they are attributed to changes.
+func (s *State) RotateAuthKeyForNodes(oldKeyID, newKeyID uint64) (change.Change, error) {
+	nodeIDs, err := s.db.RotateAuthKeyForNodes(oldKeyID, newKeyID)
+	if err != nil {
+		return change.Change{}, err
+	}
+
+	if len(nodeIDs) == 0 {
+		return change.Change{}, nil
+	}
+
+	newKey, err := s.db.GetPreAuthKeyByID(newKeyID)
+	if err != nil {
+		return change.Change{}, fmt.Errorf("loading auth key %d: %w", newKeyID, err)
+	}
+
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(nodeIDs))
+	for _, id := range nodeIDs {
+		updates[id] = func(n *types.Node) {
+			n.AuthKeyID = new(newKey.ID)
+			n.AuthKey = newKey.Clone()
+		}
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	// The key a node registered with is not part of any netmap, so this is
+	// only a change if the policy refers to it indirectly.
+	return s.updatePolicyManagerNodes()
+}
+
 // CreateOAuthClient creates a new OAuth client-credentials client, returning the
 // plaintext secret (shown once) and the stored client.
 func (s *State) CreateOAuthClient(scopes, tags []string, description string, creatorUserID *uint) (string, *types.OAuthClient, error) {
@@ -1596,6 +3256,58 @@ func (s *State) DeleteAuthCacheEntryForTest(id types.AuthID) {
 	s.authCache.Remove(id)
 }
 
+// RegistrationInfo describes a node registration waiting in the auth cache.
+type RegistrationInfo struct {
+	AuthID     types.AuthID
+	MachineKey key.MachinePublic
+	Hostname   string
+	CreatedAt  time.Time
+}
+
+// ListStaleRegistrations returns the pending node registrations that were
+// started at least olderThan ago and have not completed yet, oldest first.
+// They usually belong to a device that gave up half-way, or one that is
+// still waiting on an auth flow the user never finished.
+func (s *State) ListStaleRegistrations(olderThan time.Duration) []RegistrationInfo {
+	cutoff := time.Now().Add(-olderThan)
+
+	var stale []RegistrationInfo
+
+	for _, id := range s.authCache.Keys() {
+		req, ok := s.authCache.Peek(id)
+		if !ok || !req.IsRegistration() || req.CreatedAt().After(cutoff) {
+			continue
+		}
+
+		regData := req.RegistrationData()
+		stale = append(stale, RegistrationInfo{
+			AuthID:     id,
+			MachineKey: regData.MachineKey,
+			Hostname:   regData.Hostname,
+			CreatedAt:  req.CreatedAt(),
+		})
+	}
+
+	slices.SortFunc(stale, func(a, b RegistrationInfo) int {
+		return a.CreatedAt.Compare(b.CreatedAt)
+	})
+
+	return stale
+}
+
+// EvictStaleRegistrations drops the registrations reported by
+// [State.ListStaleRegistrations] from the auth cache and returns how many were
+// removed. A client still waiting on one is told the registration expired.
+func (s *State) EvictStaleRegistrations(olderThan time.Duration) int {
+	stale := s.ListStaleRegistrations(olderThan)
+
+	for _, reg := range stale {
+		s.authCache.Remove(reg.AuthID)
+	}
+
+	return len(stale)
+}
+
 // SetLastSSHAuth records a successful SSH check authentication
 // for the given (src, dst) node pair.
 func (s *State) SetLastSSHAuth(src, dst types.NodeID) {
@@ -1648,6 +3360,14 @@ type newNodeParams struct {
 	Expiry         *time.Time
 	RegisterMethod string
 
+	// Optional: given name to use instead of one derived from Hostname
+	GivenName string
+
+	// Optional: address to assign instead of an allocated one; see
+	// [AuthPathOptions.RequestedIP]
+	RequestedIP        netip.Addr
+	RequireRequestedIP bool
+
 	// Optional: Pre-auth key specific fields
 	PreAuthKey *types.PreAuthKey
 
@@ -1740,6 +3460,7 @@ func (s *State) applyAuthNodeUpdate(params authNodeUpdateParams) (types.NodeView
 			params.ExistingNode.ID(),
 			params.ValidHostinfo,
 		)
+		node.UpdateClientInfo()
 
 		// Preserve the node's live endpoints when the register request carried
 		// none. Web/OIDC relogins report endpoints via MapRequest, not register,
@@ -1804,16 +3525,11 @@ func (s *State) applyAuthNodeUpdate(params authNodeUpdateParams) (types.NodeView
 		}
 		// Tagged → Tagged: keep existing expiry (nil) - no action needed
 
-		// Apply default node expiry for non-tagged nodes when the
-		// resolved expiry is still nil or zero (e.g., CLI registration
-		// where the client did not request a specific expiry).
-		needsDefaultExpiry := !node.IsTagged() &&
-			(node.Expiry == nil || node.Expiry.IsZero()) &&
-			s.cfg.Node.Expiry > 0
-		if needsDefaultExpiry {
-			exp := time.Now().Add(s.cfg.Node.Expiry)
-			node.Expiry = &exp
-		}
+		// Apply the key lifetime for non-tagged nodes: the default
+		// when the resolved expiry is still nil or zero (e.g., CLI
+		// registration where the client did not request a specific
+		// expiry), and the user's cap otherwise.
+		s.applyKeyLifetime(node, params.User)
 	})
 
 	if !ok {
@@ -1821,10 +3537,8 @@ func (s *State) applyAuthNodeUpdate(params authNodeUpdateParams) (types.NodeView
 	}
 
 	// Persist to database.
-	// Explicitly select all node columns so GORM includes nil/zero-value fields
-	// (see nodeUpdateColumns comment).
 	_, err := hsdb.Write(s.db.DB, func(tx *gorm.DB) (*types.Node, error) {
-		err := tx.Select(nodeUpdateColumns).Updates(updatedNodeView.AsStruct()).Error
+		err := updateNodeRow(tx, updatedNodeView.AsStruct())
 		if err != nil {
 			return nil, fmt.Errorf("saving node: %w", err)
 		}
@@ -1878,6 +3592,7 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 	// Prepare the node for registration
 	nodeToRegister := types.Node{
 		Hostname:       params.Hostname,
+		GivenName:      params.GivenName,
 		MachineKey:     params.MachineKey,
 		NodeKey:        params.NodeKey,
 		DiscoKey:       params.DiscoKey,
@@ -1887,6 +3602,9 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 		IsOnline:       new(false), // Explicitly offline until [State.Connect] is called
 		RegisterMethod: params.RegisterMethod,
 		Expiry:         params.Expiry,
+
+		// The node registers, but stays invisible until approved.
+		PendingApproval: s.cfg.Node.RequireApproval,
 	}
 
 	// Assign ownership based on PreAuthKey
@@ -1920,6 +3638,10 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 		return types.NodeView{}, fmt.Errorf("%w %v are invalid or not permitted", ErrRequestedTagsInvalidOrNotPermitted, params.Hostinfo.RequestTags)
 	}
 
+	// Remember the owner before RequestTags can hand the node over to its
+	// tags; the owner's default tags are merged in below.
+	owner := nodeToRegister.User
+
 	// Process RequestTags (from tailscale up --advertise-tags) ONLY for non-PreAuthKey registrations.
 	// Validate early before IP allocation to avoid resource leaks on failure.
 	if params.PreAuthKey == nil && params.Hostinfo != nil && len(params.Hostinfo.RequestTags) > 0 {
@@ -1951,25 +3673,38 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 		}
 	}
 
-	// Apply default node expiry for non-tagged nodes when the client
-	// did not request a specific expiry.
-	// Tagged nodes are exempt — they never expire.
-	needsDefaultExpiry := !nodeToRegister.IsTagged() &&
-		(nodeToRegister.Expiry == nil || nodeToRegister.Expiry.IsZero()) &&
-		s.cfg.Node.Expiry > 0
-	if needsDefaultExpiry {
-		exp := time.Now().Add(s.cfg.Node.Expiry)
-		nodeToRegister.Expiry = &exp
+	// Apply the owner's default tags. Like --advertise-tags, they make the
+	// node tagged, so it gives up its user and its key expiry. The owner is
+	// remembered so [State.ReapplyUserTags] still reaches the node.
+	if owner != nil && len(owner.DefaultTags) > 0 {
+		defaultTags, err := s.validateTags(owner.DefaultTags)
+		if err != nil {
+			return types.NodeView{}, fmt.Errorf("applying default tags of user %d: %w", owner.ID, err)
+		}
+
+		nodeToRegister.Tags = append(nodeToRegister.Tags, defaultTags...)
+		slices.Sort(nodeToRegister.Tags)
+		nodeToRegister.Tags = slices.Compact(nodeToRegister.Tags)
+
+		nodeToRegister.TaggedByUserID = new(owner.ID)
+		nodeToRegister.UserID = nil
+		nodeToRegister.User = nil
+		nodeToRegister.Expiry = nil
 	}
 
+	// Apply the key lifetime for non-tagged nodes: the default when the
+	// client did not request a specific expiry, and the user's cap otherwise.
+	// Tagged nodes are exempt — they never expire.
+	s.applyKeyLifetime(&nodeToRegister, nodeToRegister.User)
+
 	// Validate before saving
 	err := validateNodeOwnership(&nodeToRegister)
 	if err != nil {
 		return types.NodeView{}, err
 	}
 
-	// Allocate new IPs
-	ipv4, ipv6, err := s.ipAlloc.Next()
+	// Allocate new IPs, honouring a requested address
+	ipv4, ipv6, err := s.ipAlloc.NextWithRequested(params.RequestedIP, params.RequireRequestedIP)
 	if err != nil {
 		return types.NodeView{}, fmt.Errorf("allocating IPs: %w", err)
 	}
@@ -1977,21 +3712,30 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 	nodeToRegister.IPv4 = ipv4
 	nodeToRegister.IPv6 = ipv6
 
-	// Seed GivenName from the sanitised raw hostname. [NodeStore.PutNode]
-	// bumps on collision and falls back to "node" if the sanitised
-	// result is empty (pure non-ASCII / punctuation input).
+	// Seed GivenName from the sanitised raw hostname unless the caller
+	// picked one. [NodeStore.PutNode] bumps on collision and falls back to
+	// "node" if the sanitised result is empty (pure non-ASCII / punctuation
+	// input).
 	if nodeToRegister.GivenName == "" {
 		nodeToRegister.GivenName = dnsname.SanitizeHostname(nodeToRegister.Hostname)
 	}
 
+	nodeToRegister.GivenNameBase = nodeToRegister.GivenName
+	nodeToRegister.UpdateClientInfo()
+
 	// New node - database first to get ID, then [NodeStore]
 	savedNode, err := hsdb.Write(s.db.DB, func(tx *gorm.DB) (*types.Node, error) {
-		err := tx.Save(&nodeToRegister).Error
+		// The user's node limit is checked in the same transaction as the
+		// save, so two registrations racing for the last slot cannot both
+		// get it.
+		err := hsdb.RegisterNode(tx, &nodeToRegister)
 		if err != nil {
-			return nil, fmt.Errorf("saving node: %w", err)
+			return nil, err
 		}
 
-		if params.PreAuthKey != nil && !params.PreAuthKey.Reusable {
+		// Single-use keys are marked used, reusable ones count the
+		// registration against their usage limit.
+		if params.PreAuthKey != nil {
 			err := hsdb.UsePreAuthKey(tx, params.PreAuthKey)
 			if err != nil {
 				return nil, fmt.Errorf("using pre auth key: %w", err)
@@ -2001,11 +3745,28 @@ func (s *State) createAndSaveNewNode(params newNodeParams) (types.NodeView, erro
 		return &nodeToRegister, nil
 	})
 	if err != nil {
+		// Nothing was written, so the addresses go back to the pool.
+		s.ipAlloc.FreeIPs(nodeToRegister.IPs())
+
 		return types.NodeView{}, err
 	}
 
 	// Add to [NodeStore] after database creates the ID
-	return s.nodeStore.PutNode(*savedNode), nil
+	return s.putNewNode(*savedNode)
+}
+
+// putNewNode adds a node that was just written to the database to the
+// [NodeStore]. The NodeStore resolves given name collisions in its writer
+// goroutine, which serialises concurrent registrations, so a node asking
+// for a name another registration got first comes back with a suffixed
+// one; that name is written back so the database agrees.
+func (s *State) putNewNode(node types.Node) (types.NodeView, error) {
+	nv := s.nodeStore.PutNode(node)
+	if !nv.Valid() || nv.GivenName() == node.GivenName {
+		return nv, nil
+	}
+
+	return s.persistNodeRowToDB(nv)
 }
 
 // validateRequestTags validates that the requested tags are permitted for the node.
@@ -2126,12 +3887,77 @@ func (s *State) HandleNodeFromAuthPath(
 	expiry *time.Time,
 	registrationMethod string,
 ) (types.NodeView, change.Change, error) {
+	return s.HandleNodeFromAuthPathWithOptions(authID, userID, expiry, registrationMethod, AuthPathOptions{})
+}
+
+// HandleNodeFromAuthPathWithGivenName is [State.HandleNodeFromAuthPath] for
+// callers that pick the node's given name, e.g. an SSO flow deriving it from
+// the user's email. An empty givenName derives it from the hostname as usual.
+// The name must be a valid DNS label under the base domain and only applies
+// when a new node is created; one already used by another node gets a
+// numeric suffix like any other collision.
+func (s *State) HandleNodeFromAuthPathWithGivenName(
+	authID types.AuthID,
+	userID types.UserID,
+	expiry *time.Time,
+	registrationMethod string,
+	givenName string,
+) (types.NodeView, change.Change, error) {
+	return s.HandleNodeFromAuthPathWithOptions(
+		authID, userID, expiry, registrationMethod,
+		AuthPathOptions{GivenName: givenName},
+	)
+}
+
+// AuthPathOptions are the optional choices a caller of
+// [State.HandleNodeFromAuthPathWithOptions] can make for a new node. They
+// are ignored when the registration updates an existing node.
+type AuthPathOptions struct {
+	// GivenName is used instead of a name derived from the hostname; see
+	// [State.HandleNodeFromAuthPathWithGivenName].
+	GivenName string
+
+	// RequestedIP is assigned to the node when it lies inside the
+	// configured prefixes and is free. Otherwise an address is allocated as
+	// usual or, with RequireRequestedIP, the registration fails with
+	// [hsdb.ErrIPNotAvailable].
+	RequestedIP        netip.Addr
+	RequireRequestedIP bool
+}
+
+// HandleNodeFromAuthPathWithOptions is [State.HandleNodeFromAuthPath] with
+// the choices in opts applied to a newly created node.
+func (s *State) HandleNodeFromAuthPathWithOptions(
+	authID types.AuthID,
+	userID types.UserID,
+	expiry *time.Time,
+	registrationMethod string,
+	opts AuthPathOptions,
+) (types.NodeView, change.Change, error) {
+	if opts.GivenName != "" {
+		err := types.ValidateGivenName(opts.GivenName, s.cfg.BaseDomain)
+		if err != nil {
+			return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %w", ErrGivenNameInvalid, err)
+		}
+	}
+
 	// Get the registration entry from cache
 	regEntry, ok := s.GetAuthCacheEntry(authID)
 	if !ok {
 		return types.NodeView{}, change.Change{}, hsdb.ErrNodeNotFoundRegistrationCache
 	}
 
+	// The cache also holds SSH check requests, which carry no registration
+	// data; refuse them here rather than panic in RegistrationData.
+	if !regEntry.IsRegistration() {
+		log.Debug().
+			Str(zf.RegistrationID, authID.String()).
+			Bool(zf.SSHCheck, regEntry.IsSSHCheck()).
+			Msg("auth request used for registration is not a registration")
+
+		return types.NodeView{}, change.Change{}, fmt.Errorf("%w: %s", ErrAuthRequestNotRegistration, authID)
+	}
+
 	// Get the user
 	user, err := s.db.GetUserByID(userID)
 	if err != nil {
@@ -2147,7 +3973,7 @@ func (s *State) HandleNodeFromAuthPath(
 
 	hostinfo := &tailcfg.Hostinfo{}
 	if regData.Hostinfo != nil {
-		hostinfo = regData.Hostinfo.Clone()
+		hostinfo = s.capAdvertisedRoutes(regData.Hostinfo).Clone()
 	}
 
 	hostinfo.Hostname = hostname
@@ -2236,7 +4062,7 @@ func (s *State) HandleNodeFromAuthPath(
 			Msg("Creating new node for different user (same machine key exists for another user)")
 
 		finalNode, err = s.createNewNodeFromAuth(
-			logger, user, regData, hostname, hostinfo,
+			logger, user, regData, hostname, opts, hostinfo,
 			expiry, registrationMethod, existingNodeOtherUser,
 		)
 		if err != nil {
@@ -2244,7 +4070,7 @@ func (s *State) HandleNodeFromAuthPath(
 		}
 	} else {
 		finalNode, err = s.createNewNodeFromAuth(
-			logger, user, regData, hostname, hostinfo,
+			logger, user, regData, hostname, opts, hostinfo,
 			expiry, registrationMethod, types.NodeView{},
 		)
 		if err != nil {
@@ -2285,6 +4111,7 @@ func (s *State) createNewNodeFromAuth(
 	user *types.User,
 	regData *types.RegistrationData,
 	hostname string,
+	opts AuthPathOptions,
 	validHostinfo *tailcfg.Hostinfo,
 	expiry *time.Time,
 	registrationMethod string,
@@ -2300,6 +4127,9 @@ func (s *State) createNewNodeFromAuth(
 		NodeKey:                regData.NodeKey,
 		DiscoKey:               regData.DiscoKey,
 		Hostname:               hostname,
+		GivenName:              opts.GivenName,
+		RequestedIP:            opts.RequestedIP,
+		RequireRequestedIP:     opts.RequireRequestedIP,
 		Hostinfo:               validHostinfo,
 		Endpoints:              regData.Endpoints,
 		Expiry:                 cmp.Or(expiry, regData.Expiry),
@@ -2465,7 +4295,7 @@ func (s *State) HandleNodeFromPreAuthKey(
 	}
 
 	// Ensure we have valid hostinfo
-	validHostinfo := cmp.Or(regReq.Hostinfo, &tailcfg.Hostinfo{})
+	validHostinfo := cmp.Or(s.capAdvertisedRoutes(regReq.Hostinfo), &tailcfg.Hostinfo{})
 	validHostinfo.Hostname = hostname
 
 	log.Debug().
@@ -2518,6 +4348,7 @@ func (s *State) HandleNodeFromPreAuthKey(
 			// Preserve NetInfo from existing node when re-registering
 			node.Hostinfo = validHostinfo
 			node.Hostinfo.NetInfo = preserveNetInfo(existingNodeSameUser, existingNodeSameUser.ID(), validHostinfo)
+			node.UpdateClientInfo()
 
 			node.RegisterMethod = util.RegisterMethodAuthKey
 
@@ -2544,19 +4375,17 @@ func (s *State) HandleNodeFromPreAuthKey(
 
 			// Tagged nodes keep their existing expiry (disabled).
 			// User-owned nodes update expiry from the client request,
-			// falling back to the configured default if the client
+			// falling back to the configured key lifetime if the client
 			// did not request a specific expiry. If neither is set,
 			// clear the expiry so the database holds NULL instead of
 			// a pointer to zero time.
 			if !node.IsTagged() {
+				node.Expiry = nil
 				if !regReq.Expiry.IsZero() {
 					node.Expiry = &regReq.Expiry
-				} else if s.cfg.Node.Expiry > 0 {
-					exp := time.Now().Add(s.cfg.Node.Expiry)
-					node.Expiry = &exp
-				} else {
-					node.Expiry = nil
 				}
+
+				s.applyKeyLifetime(node, pak.User)
 			}
 		})
 
@@ -2565,9 +4394,7 @@ func (s *State) HandleNodeFromPreAuthKey(
 		}
 
 		_, err = hsdb.Write(s.db.DB, func(tx *gorm.DB) (*types.Node, error) {
-			// Explicitly select all node columns so GORM includes nil/zero-value fields
-			// (see nodeUpdateColumns comment).
-			err := tx.Select(nodeUpdateColumns).Updates(updatedNodeView.AsStruct()).Error
+			err := updateNodeRow(tx, updatedNodeView.AsStruct())
 			if err != nil {
 				return nil, fmt.Errorf("saving node: %w", err)
 			}
@@ -2802,6 +4629,7 @@ func (s *State) autoApproveNodes() ([]change.Change, error) {
 	// and O(n^2) peer-map rebuild for each changed node, i.e. O(m*n^2) per
 	// policy reload.
 	approvedByID := make(map[types.NodeID][]netip.Prefix)
+	prevByID := make(map[types.NodeID][]netip.Prefix)
 
 	for _, nv := range nodes.All() {
 		approved, changed := policy.ApproveRoutesWithPolicy(s.polMan, nv, nv.ApprovedRoutes().AsSlice(), nv.AnnouncedRoutes())
@@ -2809,6 +4637,8 @@ func (s *State) autoApproveNodes() ([]change.Change, error) {
 			continue
 		}
 
+		prevByID[nv.ID()] = nv.ApprovedRoutes().AsSlice()
+
 		log.Debug().
 			Uint64(zf.NodeID, nv.ID().Uint64()).
 			Str(zf.NodeName, nv.Hostname()).
@@ -2848,8 +4678,13 @@ func (s *State) autoApproveNodes() ([]change.Change, error) {
 		if err != nil {
 			return nil, err
 		}
+
+		s.emitRouteDiff(RouteEnabled, fresh, prevByID[id], approvedByID[id])
+		s.emitRouteDiff(RouteDisabled, fresh, approvedByID[id], prevByID[id])
 	}
 
+	s.publishPrimaryChanges()
+
 	c, err := s.updatePolicyManagerNodes()
 	if err != nil {
 		return nil, err
@@ -2883,6 +4718,33 @@ func isAutoDerivedGivenName(given, hostname string) bool {
 	return err == nil
 }
 
+// capAdvertisedRoutes returns hi with its advertised routes truncated to the
+// configured per-node maximum, logging [ErrTooManyRoutes] when it drops any.
+// hi itself is never modified: a truncated Hostinfo is a clone. A maximum
+// that is not positive falls back to defaultMaxRoutesPerNode.
+func (s *State) capAdvertisedRoutes(hi *tailcfg.Hostinfo) *tailcfg.Hostinfo {
+	maxRoutes := s.cfg.Tuning.MaxRoutesPerNode
+	if maxRoutes <= 0 {
+		maxRoutes = defaultMaxRoutesPerNode
+	}
+
+	if hi == nil || len(hi.RoutableIPs) <= maxRoutes {
+		return hi
+	}
+
+	log.Warn().
+		Err(ErrTooManyRoutes).
+		Str(zf.NodeHostname, hi.Hostname).
+		Int(zf.RoutesAdvertised, len(hi.RoutableIPs)).
+		Int(zf.RoutesMax, maxRoutes).
+		Msg("Dropping routes beyond the per-node maximum")
+
+	capped := hi.Clone()
+	capped.RoutableIPs = capped.RoutableIPs[:maxRoutes]
+
+	return capped
+}
+
 // UpdateNodeFromMapRequest is the sync point where Hostinfo changes,
 // endpoint updates, and route advertisements from a [tailcfg.MapRequest]
 // land in the [NodeStore]. It produces a [change.Change] summarising
@@ -2902,14 +4764,18 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 		Interface("request", req).
 		Msg("Processing MapRequest for node")
 
+	req.Hostinfo = s.capAdvertisedRoutes(req.Hostinfo)
+
 	var (
 		routeChange        bool
 		hostinfoChanged    bool
 		needsRouteApproval bool
 		autoApprovedRoutes []netip.Prefix
+		prevApproved       []netip.Prefix
 		endpointChanged    bool
 		derpChanged        bool
 		persistWorthy      bool
+		capVerChanged      bool
 	)
 	// Snapshot the primary assignment so we can tell whether the
 	// Hostinfo + auto-approval that follows shifted any prefix.
@@ -2917,9 +4783,20 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 
 	// We need to ensure we update the node as it is in the [NodeStore] at
 	// the time of the request.
+	var prevAnnounced []netip.Prefix
+
 	updatedNode, ok := s.nodeStore.UpdateNode(id, func(currentNode *types.Node) {
+		prevAnnounced = slices.Clone(currentNode.AnnouncedRoutes())
 		peerChange := currentNode.PeerChangeFromMapRequest(req)
 
+		// The capability version only matters to operators, so it is
+		// written on its own below rather than making the request
+		// persist-worthy.
+		if req.Version != 0 && req.Version != currentNode.CapVer {
+			currentNode.CapVer = req.Version
+			capVerChanged = true
+		}
+
 		// Track what specifically changed. An endpoint delta is only
 		// broadcast-worthy when it adds a useful (non-STUN) endpoint;
 		// STUN-only churn and pure shrinks are suppressed to reduce peer
@@ -3007,6 +4884,7 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 			// before we take the changes.
 			// NetInfo preservation has already been handled above before early return check
 			currentNode.Hostinfo = req.Hostinfo
+			currentNode.UpdateClientInfo()
 			if req.Hostinfo != nil && req.Hostinfo.Hostname != "" {
 				// Preserve an admin-renamed GivenName: only auto-derive when the
 				// current GivenName is still what SanitizeHostname of the old
@@ -3032,6 +4910,11 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 					Strs(zf.NewApprovedRoutes, util.PrefixesToString(autoApprovedRoutes)).
 					Bool(zf.RouteChanged, routeChange).
 					Msg("applying route approval results")
+
+				// Approve in the same update as the announcement, so one
+				// database write persists both.
+				prevApproved = slices.Clone(currentNode.ApprovedRoutes)
+				currentNode.ApprovedRoutes = autoApprovedRoutes
 			}
 		}
 
@@ -3048,22 +4931,45 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 		return change.Change{}, fmt.Errorf("%w: %d", ErrNodeNotInNodeStore, id)
 	}
 
+	// Route events are only emitted once the announcement is persisted.
+	emitAdvertised := func() {
+		s.emitRouteDiff(RouteAdvertised, updatedNode, prevAnnounced, updatedNode.AnnouncedRoutes())
+		prevAnnounced = updatedNode.AnnouncedRoutes()
+	}
+
+	if capVerChanged {
+		err := s.db.UpdateNodeCapVer(id, req.Version)
+		if err != nil {
+			return change.Change{}, fmt.Errorf("saving capability version: %w", err)
+		}
+	}
+
 	if routeChange {
 		log.Debug().
 			Uint64(zf.NodeID, id.Uint64()).
 			Strs(zf.AutoApprovedRoutes, util.PrefixesToString(autoApprovedRoutes)).
 			Msg("Persisting auto-approved routes from MapRequest")
 
-		// [State.SetApprovedRoutes] will update both database and PrimaryRoutes table
-		_, c, err := s.SetApprovedRoutes(id, autoApprovedRoutes)
+		// The NodeStore update above carried both the announcement and the
+		// approval, so a single write persists them together.
+		_, c, err := s.persistNodeToDB(updatedNode)
 		if err != nil {
 			return change.Change{}, fmt.Errorf("persisting auto-approved routes: %w", err)
 		}
 
-		// If [State.SetApprovedRoutes] resulted in a policy change, return it
-		if !c.IsEmpty() {
-			return c, nil
+		// The announcement is reported before the approval it led to.
+		emitAdvertised()
+		s.emitRouteDiff(RouteEnabled, updatedNode, prevApproved, autoApprovedRoutes)
+		s.emitRouteDiff(RouteDisabled, updatedNode, autoApprovedRoutes, prevApproved)
+		s.publishPrimaryChanges()
+
+		// As in [State.SetApprovedRoutes], fan out a fresh netmap to
+		// every node when the approval moved a primary.
+		if !maps.Equal(prevRoutes, s.nodeStore.PrimaryRoutes()) || !c.IsFull() {
+			c = change.PolicyChange()
 		}
+
+		return c, nil
 	} // Continue with the rest of the processing using the updated node
 
 	// SubnetRoutes = announced ∩ approved, so a Hostinfo update can
@@ -3097,6 +5003,9 @@ func (s *State) UpdateNodeFromMapRequest(id types.NodeID, req tailcfg.MapRequest
 		}
 	}
 
+	emitAdvertised()
+	s.publishPrimaryChanges()
+
 	if !policyChange.IsEmpty() {
 		return policyChange, nil
 	}
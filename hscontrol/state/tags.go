@@ -3,8 +3,12 @@ package state
 import (
 	"errors"
 	"fmt"
+	"maps"
+	"slices"
+	"strings"
 
 	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/types/change"
 	"github.com/rs/zerolog/log"
 )
 
@@ -69,3 +73,248 @@ func logTagOperation(existingNode types.NodeView, newTags []string) {
 			Msg("Converting user-owned node to tagged node")
 	}
 }
+
+// validateTags checks that every tag is well-formed and defined in the policy
+// and returns the sorted, de-duplicated set.
+func (s *State) validateTags(tags []string) ([]string, error) {
+	validatedTags := make([]string, 0, len(tags))
+	invalidTags := make([]string, 0)
+
+	for _, tag := range tags {
+		if !strings.HasPrefix(tag, "tag:") || !s.polMan.TagExists(tag) {
+			invalidTags = append(invalidTags, tag)
+
+			continue
+		}
+
+		validatedTags = append(validatedTags, tag)
+	}
+
+	if len(invalidTags) > 0 {
+		return nil, fmt.Errorf("%w %v are invalid or not permitted", ErrRequestedTagsInvalidOrNotPermitted, invalidTags)
+	}
+
+	slices.Sort(validatedTags)
+
+	return slices.Compact(validatedTags), nil
+}
+
+// setTagsForNodes assigns already validated tags to several nodes in a single
+// [NodeStore] batch, persists every row and refreshes the policy manager once.
+// It is the one batch tag setter; callers tagging many nodes get one change
+// for the peers, plus a self update per node so each learns its new tags and
+// ownership (see [State.SetNodeTags]). taggedBy names the user whose default
+// tags are being applied; it is nil for explicit tags, which also stops
+// [State.ReapplyUserTags] from overwriting them later.
+func (s *State) setTagsForNodes(
+	tagsByID map[types.NodeID][]string,
+	taggedBy *uint,
+) ([]change.Change, error) {
+	updates := make(map[types.NodeID]UpdateNodeFunc, len(tagsByID))
+	for id, tags := range tagsByID {
+		updates[id] = func(n *types.Node) {
+			n.Tags = tags
+			// Tagged nodes are owned by their tags, not a user.
+			n.UserID = nil
+			n.User = nil
+
+			n.TaggedByUserID = nil
+			if taggedBy != nil {
+				n.TaggedByUserID = new(*taggedBy)
+			}
+		}
+	}
+
+	s.nodeStore.UpdateNodes(updates)
+
+	ids := slices.Sorted(maps.Keys(tagsByID))
+
+	for _, id := range ids {
+		fresh, ok := s.nodeStore.GetNode(id)
+		if !ok {
+			continue
+		}
+
+		_, err := s.persistNodeRowToDB(fresh)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	c, err := s.updatePolicyManagerNodes()
+	if err != nil {
+		return nil, fmt.Errorf("updating policy manager after setting tags: %w", err)
+	}
+
+	cs := []change.Change{c.Merge(change.PolicyAndPeers(ids...))}
+	for _, id := range ids {
+		cs = append(cs, change.FullSelf(id))
+	}
+
+	return cs, nil
+}
+
+// SetTagsForNodes sets the same tags on many nodes at once. The tags are
+// validated and de-duplicated once and applied through the same batch as
+// [State.ImportTags], so the caller gets one change for the peers and a self
+// update per node. An empty list is rejected with
+// [types.ErrCannotRemoveAllTags], since a node without tags would be left
+// without an owner; [State.ClearNodeTags] removes them and names the user
+// that takes the node over.
+func (s *State) SetTagsForNodes(nodeIDs []types.NodeID, tags []string) ([]change.Change, error) {
+	return s.setSameTagsForNodes(nodeIDs, tags, nil)
+}
+
+// setSameTagsForNodes is [State.SetTagsForNodes] recording taggedBy as the
+// user whose default tags are applied (see [State.setTagsForNodes]).
+func (s *State) setSameTagsForNodes(
+	nodeIDs []types.NodeID,
+	tags []string,
+	taggedBy *uint,
+) ([]change.Change, error) {
+	if len(tags) == 0 {
+		return nil, types.ErrCannotRemoveAllTags
+	}
+
+	validatedTags, err := s.validateTags(tags)
+	if err != nil {
+		return nil, err
+	}
+
+	tagsByID := make(map[types.NodeID][]string, len(nodeIDs))
+
+	for _, id := range nodeIDs {
+		node, ok := s.nodeStore.GetNode(id)
+		if !ok {
+			return nil, fmt.Errorf("%w: %d", ErrNodeNotFound, id)
+		}
+
+		if _, seen := tagsByID[id]; seen {
+			continue
+		}
+
+		logTagOperation(node, validatedTags)
+		warnIfExternallyManaged(node, "set_tags")
+
+		tagsByID[id] = validatedTags
+	}
+
+	return s.setTagsForNodes(tagsByID, taggedBy)
+}
+
+// ImportTags replaces the tags of many nodes at once from an externally
+// maintained assignment of given name to tags. Every entry is resolved and
+// validated before anything is written, so an invalid tag anywhere leaves all
+// nodes untouched. Given names that match no node are skipped and returned so
+// the caller can report them.
+func (s *State) ImportTags(assignments map[string][]string) ([]change.Change, []string, error) {
+	byGivenName := make(map[string]types.NodeView)
+	for _, node := range s.nodeStore.ListNodes().All() {
+		byGivenName[node.GivenName()] = node
+	}
+
+	var unmatched []string
+
+	matched := make(map[types.NodeID]types.NodeView, len(assignments))
+	tagsByID := make(map[types.NodeID][]string, len(assignments))
+
+	for givenName, tags := range assignments {
+		node, ok := byGivenName[givenName]
+		if !ok {
+			unmatched = append(unmatched, givenName)
+
+			continue
+		}
+
+		if len(tags) == 0 {
+			return nil, nil, fmt.Errorf("node %q: %w", givenName, types.ErrCannotRemoveAllTags)
+		}
+
+		validatedTags, err := s.validateTags(tags)
+		if err != nil {
+			return nil, nil, fmt.Errorf("node %q: %w", givenName, err)
+		}
+
+		matched[node.ID()] = node
+		tagsByID[node.ID()] = validatedTags
+	}
+
+	slices.Sort(unmatched)
+
+	if len(tagsByID) == 0 {
+		return nil, unmatched, nil
+	}
+
+	for id, tags := range tagsByID {
+		logTagOperation(matched[id], tags)
+	}
+
+	cs, err := s.setTagsForNodes(tagsByID, nil)
+	if err != nil {
+		return nil, unmatched, err
+	}
+
+	return cs, unmatched, nil
+}
+
+// SetUserDefaultTags sets the tags applied to every node userID registers
+// from now on. The tags are validated against the policy; an empty list
+// clears them. Existing nodes are left alone until [State.ReapplyUserTags]
+// is called.
+func (s *State) SetUserDefaultTags(userID types.UserID, tags []string) error {
+	var validatedTags []string
+
+	if len(tags) > 0 {
+		var err error
+
+		validatedTags, err = s.validateTags(tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return s.db.SetUserDefaultTags(userID, validatedTags)
+}
+
+// ReapplyUserTags applies the default tags of userID to every node the user
+// still owns, turning them into tagged nodes as if they had registered with
+// the tags set. Tagging takes a node away from its user, so nodes tagged by
+// the user's earlier defaults are found through [types.Node.TaggedByUserID]
+// and have their tags replaced with the current defaults; nodes an admin
+// tagged explicitly since are left alone. It returns no changes if the user
+// has no default tags or every node already carries them. Clearing the
+// defaults does not give tagged nodes back; use [State.ClearNodeTags].
+func (s *State) ReapplyUserTags(userID types.UserID) ([]change.Change, error) {
+	user, err := s.db.GetUserByID(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(user.DefaultTags) == 0 {
+		return nil, nil
+	}
+
+	var nodeIDs []types.NodeID
+	for _, node := range s.nodeStore.ListNodesByUser(userID).All() {
+		nodeIDs = append(nodeIDs, node.ID())
+	}
+
+	for _, node := range s.nodeStore.ListNodes().All() {
+		taggedBy, ok := node.TaggedByUserID().GetOk()
+		if !ok || types.UserID(taggedBy) != userID {
+			continue
+		}
+
+		if slices.Equal(node.Tags().AsSlice(), []string(user.DefaultTags)) {
+			continue
+		}
+
+		nodeIDs = append(nodeIDs, node.ID())
+	}
+
+	if len(nodeIDs) == 0 {
+		return nil, nil
+	}
+
+	return s.setSameTagsForNodes(nodeIDs, user.DefaultTags, new(user.ID))
+}
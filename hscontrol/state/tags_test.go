@@ -0,0 +1,465 @@
+package state
+
+import (
+	"testing"
+
+	"github.com/juanfont/headscale/hscontrol/db"
+	"github.com/juanfont/headscale/hscontrol/types"
+	"github.com/juanfont/headscale/hscontrol/types/change"
+	"github.com/juanfont/headscale/hscontrol/util"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"tailscale.com/tailcfg"
+	"tailscale.com/types/key"
+)
+
+// tagsTestSetup creates a State with one user owning a registered node per
+// hostname and a policy defining tag:web and tag:db. The returned map is keyed
+// by hostname.
+func tagsTestSetup(
+	t *testing.T,
+	hostnames ...string,
+) (*State, map[string]*types.Node) {
+	t.Helper()
+
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	user := database.CreateUserForTest("tag-user")
+
+	nodes := make(map[string]*types.Node, len(hostnames))
+	for _, hostname := range hostnames {
+		nodes[hostname] = database.CreateRegisteredNodeForTest(user, hostname)
+	}
+
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	_, err = s.SetPolicy([]byte(`{"tagOwners": {
+		"tag:web": ["tag-user@"],
+		"tag:db": ["tag-user@"]
+	}}`))
+	require.NoError(t, err)
+
+	return s, nodes
+}
+
+func TestImportTags(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "web", "database", "other")
+
+	cs, unmatched, err := s.ImportTags(map[string][]string{
+		"web":      {"tag:web"},
+		"database": {"tag:db", "tag:web", "tag:db"},
+		"missing":  {"tag:web"},
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"missing"}, unmatched)
+	require.NotEmpty(t, cs)
+	assert.False(t, cs[0].IsEmpty(), "importing tags must produce a change")
+	assertTagSelfUpdates(t, cs, nodes["web"].ID, nodes["database"].ID)
+
+	want := map[string][]string{
+		"web":      {"tag:web"},
+		"database": {"tag:db", "tag:web"},
+	}
+
+	for hostname, tags := range want {
+		nv, ok := s.GetNodeByID(nodes[hostname].ID)
+		require.True(t, ok)
+		assert.Equal(t, tags, nv.Tags().AsSlice(), "NodeStore tags of %s", hostname)
+		assert.True(t, nv.IsTagged(), "node %s must be tagged", hostname)
+		assert.False(t, nv.UserID().Valid(), "node %s must not keep a user", hostname)
+
+		dbNode, err := s.DB().GetNodeByID(nodes[hostname].ID)
+		require.NoError(t, err)
+		assert.Equal(t, tags, dbNode.Tags.List(), "database tags of %s", hostname)
+	}
+
+	other, ok := s.GetNodeByID(nodes["other"].ID)
+	require.True(t, ok)
+	assert.False(t, other.IsTagged(), "unlisted node must be left alone")
+}
+
+// assertTagSelfUpdates checks that a batch tag change sends every tagged
+// node a self update, so it learns its new tags and ownership.
+func assertTagSelfUpdates(t *testing.T, cs []change.Change, ids ...types.NodeID) {
+	t.Helper()
+
+	var targets []types.NodeID
+
+	for _, c := range cs {
+		if c.TargetNode != 0 && c.IncludeSelf {
+			targets = append(targets, c.TargetNode)
+		}
+	}
+
+	assert.ElementsMatch(t, ids, targets, "every tagged node must get a self update")
+}
+
+func TestImportTagsInvalidTagWritesNothing(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "web", "other")
+
+	_, _, err := s.ImportTags(map[string][]string{
+		"other": {"tag:web"},
+		"web":   {"tag:undefined"},
+	})
+	require.ErrorIs(t, err, ErrRequestedTagsInvalidOrNotPermitted)
+
+	for _, node := range nodes {
+		nv, ok := s.GetNodeByID(node.ID)
+		require.True(t, ok)
+		assert.False(t, nv.IsTagged(), "an invalid entry must not tag any node")
+	}
+}
+
+// TestSetNodeTagsRejectsUndefinedTag covers a typo in a tag name: the call
+// must fail naming the tag rather than tag the node with one no ACL matches.
+func TestSetNodeTagsRejectsUndefinedTag(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "server")
+	nodeID := nodes["server"].ID
+
+	_, _, err := s.SetNodeTags(nodeID, []string{"tag:web", "tag:wbe"})
+	require.ErrorIs(t, err, ErrRequestedTagsInvalidOrNotPermitted)
+	assert.ErrorContains(t, err, "[tag:wbe]", "only the undefined tag is reported")
+
+	nv, ok := s.GetNodeByID(nodeID)
+	require.True(t, ok)
+	assert.False(t, nv.IsTagged())
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	assert.Empty(t, dbNode.Tags)
+}
+
+func TestSetTagsForNodes(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "web1", "web2", "other")
+
+	ids := []types.NodeID{nodes["web1"].ID, nodes["web2"].ID, nodes["web1"].ID}
+
+	cs, err := s.SetTagsForNodes(ids, []string{"tag:web", "tag:db", "tag:web"})
+	require.NoError(t, err)
+	require.NotEmpty(t, cs)
+	assert.ElementsMatch(t, []types.NodeID{nodes["web1"].ID, nodes["web2"].ID}, cs[0].PeersChanged,
+		"one change must list every tagged node")
+	assertTagSelfUpdates(t, cs, nodes["web1"].ID, nodes["web2"].ID)
+
+	for _, hostname := range []string{"web1", "web2"} {
+		nv, ok := s.GetNodeByID(nodes[hostname].ID)
+		require.True(t, ok)
+		assert.Equal(t, []string{"tag:db", "tag:web"}, nv.Tags().AsSlice())
+		assert.False(t, nv.UserID().Valid(), "node %s must not keep a user", hostname)
+
+		dbNode, err := s.DB().GetNodeByID(nodes[hostname].ID)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"tag:db", "tag:web"}, dbNode.Tags.List())
+		assert.Nil(t, dbNode.UserID, "database row of %s must drop its user", hostname)
+	}
+
+	other, err := s.DB().GetNodeByID(nodes["other"].ID)
+	require.NoError(t, err)
+	assert.Empty(t, other.Tags, "unlisted node must be left alone")
+	assert.NotNil(t, other.UserID)
+
+	_, err = s.SetTagsForNodes(ids, nil)
+	require.ErrorIs(t, err, types.ErrCannotRemoveAllTags)
+
+	_, err = s.SetTagsForNodes([]types.NodeID{nodes["other"].ID}, []string{"tag:undefined"})
+	require.ErrorIs(t, err, ErrRequestedTagsInvalidOrNotPermitted)
+
+	_, err = s.SetTagsForNodes([]types.NodeID{nodes["other"].ID, 9999}, []string{"tag:web"})
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	nv, ok := s.GetNodeByID(nodes["other"].ID)
+	require.True(t, ok)
+	assert.False(t, nv.IsTagged(), "a failed call must not tag any node")
+}
+
+func TestClearNodeTags(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "server")
+	nodeID := nodes["server"].ID
+	owner := types.UserID(*nodes["server"].UserID)
+
+	_, _, err := s.SetNodeTags(nodeID, []string{"tag:web", "tag:db"})
+	require.NoError(t, err)
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	require.Len(t, dbNode.Tags, 2, "precondition: node carries two tags")
+
+	nv, c, err := s.ClearNodeTags(nodeID, owner)
+	require.NoError(t, err)
+	assert.False(t, c.IsEmpty(), "peers must learn the node changed owner")
+	assert.Equal(t, nodeID, c.OriginNode)
+	assert.False(t, nv.IsTagged())
+	assert.Equal(t, uint(owner), nv.UserID().Get())
+
+	dbNode, err = s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	assert.Empty(t, dbNode.Tags, "the tags column must be empty")
+	require.NotNil(t, dbNode.UserID)
+	assert.Equal(t, uint(owner), *dbNode.UserID)
+
+	wantExpiry, ok := nv.Expiry().GetOk()
+	if ok {
+		require.NotNil(t, dbNode.Expiry, "the expiry is written with the row")
+		assert.True(t, wantExpiry.Equal(*dbNode.Expiry))
+	} else {
+		assert.Nil(t, dbNode.Expiry)
+	}
+
+	_, _, err = s.ClearNodeTags(nodeID, 9999)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+}
+
+func TestMoveNodeToUser(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "laptop", "server")
+	nodeID := nodes["laptop"].ID
+	owner := types.UserID(*nodes["laptop"].UserID)
+	newOwner := types.UserID(s.CreateUserForTest("new-owner").ID)
+
+	nv, c, err := s.MoveNodeToUser(nodeID, owner)
+	require.NoError(t, err)
+	assert.True(t, c.IsEmpty(), "moving to the current owner is a no-op")
+	assert.Equal(t, uint(owner), nv.UserID().Get())
+
+	nv, c, err = s.MoveNodeToUser(nodeID, newOwner)
+	require.NoError(t, err)
+	assert.True(t, c.IncludePolicy, "peers must learn the node changed owner")
+	assert.Equal(t, nodeID, c.OriginNode)
+	assert.Equal(t, uint(newOwner), nv.UserID().Get())
+	assert.Equal(t, nodes["laptop"].GivenName, nv.GivenName(), "the node keeps its name")
+
+	dbNode, err := s.DB().GetNodeByID(nodeID)
+	require.NoError(t, err)
+	require.NotNil(t, dbNode.UserID)
+	assert.Equal(t, uint(newOwner), *dbNode.UserID)
+
+	_, _, err = s.MoveNodeToUser(nodeID, 9999)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+
+	_, _, err = s.MoveNodeToUser(9999, newOwner)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+
+	serverID := nodes["server"].ID
+	_, _, err = s.SetNodeTags(serverID, []string{"tag:web"})
+	require.NoError(t, err)
+
+	_, _, err = s.MoveNodeToUser(serverID, newOwner)
+	require.ErrorIs(t, err, ErrTaggedNodeHasUser)
+
+	nv, ok := s.GetNodeByID(serverID)
+	require.True(t, ok)
+	assert.Equal(t, []string{"tag:web"}, nv.Tags().AsSlice(), "a refused move keeps the tags")
+}
+
+func TestListVisiblePeers(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "web", "database", "other")
+
+	_, _, err := s.SetNodeTags(nodes["web"].ID, []string{"tag:web"})
+	require.NoError(t, err)
+
+	_, _, err = s.SetNodeTags(nodes["database"].ID, []string{"tag:db"})
+	require.NoError(t, err)
+
+	_, err = s.SetPolicy([]byte(`{
+		"tagOwners": {
+			"tag:web": ["tag-user@"],
+			"tag:db": ["tag-user@"]
+		},
+		"acls": [{"action": "accept", "src": ["tag:web"], "dst": ["tag:db:*"]}]
+	}`))
+	require.NoError(t, err)
+
+	_, err = s.ReloadPolicy()
+	require.NoError(t, err)
+
+	visible := func(hostname string) []types.NodeID {
+		t.Helper()
+
+		peers, err := s.ListVisiblePeers(nodes[hostname].ID)
+		require.NoError(t, err)
+
+		ids := []types.NodeID{}
+		for _, peer := range peers.All() {
+			ids = append(ids, peer.ID())
+		}
+
+		return ids
+	}
+
+	// Visibility is symmetric: the destination sees its source too.
+	assert.Equal(t, []types.NodeID{nodes["database"].ID}, visible("web"))
+	assert.Equal(t, []types.NodeID{nodes["web"].ID}, visible("database"))
+	assert.Empty(t, visible("other"))
+
+	_, err = s.ListVisiblePeers(9999)
+	require.ErrorIs(t, err, ErrNodeNotFound)
+}
+
+func TestUserDefaultTags(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "existing")
+	userID := types.UserID(*nodes["existing"].UserID)
+
+	err := s.SetUserDefaultTags(userID, []string{"tag:undefined"})
+	require.ErrorIs(t, err, ErrRequestedTagsInvalidOrNotPermitted)
+
+	require.NoError(t, s.SetUserDefaultTags(userID, []string{"tag:web", "tag:web"}))
+
+	user, err := s.GetUserByID(userID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag:web"}, []string(user.DefaultTags))
+
+	authID := types.MustAuthID()
+	s.SetAuthCacheEntry(authID, types.NewRegisterAuthRequest(&types.RegistrationData{
+		MachineKey: key.NewMachine().Public(),
+		NodeKey:    key.NewNode().Public(),
+		DiscoKey:   key.NewDisco().Public(),
+		Hostname:   "laptop",
+		Hostinfo:   &tailcfg.Hostinfo{Hostname: "laptop"},
+	}))
+
+	nv, _, err := s.HandleNodeFromAuthPath(authID, userID, nil, util.RegisterMethodOIDC)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag:web"}, nv.Tags().AsSlice(), "a new node gets the default tags")
+	assert.False(t, nv.UserID().Valid(), "a tagged node has no user")
+	assert.Equal(t, uint(userID), nv.TaggedByUserID().Get(), "the node remembers whose defaults tagged it")
+
+	existing, ok := s.GetNodeByID(nodes["existing"].ID)
+	require.True(t, ok)
+	assert.False(t, existing.IsTagged(), "existing nodes wait for ReapplyUserTags")
+
+	cs, err := s.ReapplyUserTags(userID)
+	require.NoError(t, err)
+	require.NotEmpty(t, cs)
+	assert.Contains(t, cs[0].PeersChanged, nodes["existing"].ID)
+	assertTagSelfUpdates(t, cs, nodes["existing"].ID)
+
+	existing, ok = s.GetNodeByID(nodes["existing"].ID)
+	require.True(t, ok)
+	assert.Equal(t, []string{"tag:web"}, existing.Tags().AsSlice())
+
+	dbNode, err := s.DB().GetNodeByID(nodes["existing"].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag:web"}, dbNode.Tags.List())
+	assert.Nil(t, dbNode.UserID)
+	require.NotNil(t, dbNode.TaggedByUserID)
+	assert.Equal(t, uint(userID), *dbNode.TaggedByUserID)
+
+	cs, err = s.ReapplyUserTags(userID)
+	require.NoError(t, err)
+	assert.Empty(t, cs, "every node already carries the defaults")
+
+	_, err = s.ReapplyUserTags(9999)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+}
+
+// TestReapplyUserTagsAfterDefaultsChange asserts that nodes the user's
+// default tags turned into tagged nodes still follow later changes to the
+// defaults, even though tagging took them away from the user, while a node
+// an admin tagged explicitly keeps its tags.
+func TestReapplyUserTagsAfterDefaultsChange(t *testing.T) {
+	s, nodes := tagsTestSetup(t, "laptop", "desktop")
+	userID := types.UserID(*nodes["laptop"].UserID)
+
+	require.NoError(t, s.SetUserDefaultTags(userID, []string{"tag:web"}))
+
+	_, err := s.ReapplyUserTags(userID)
+	require.NoError(t, err)
+
+	_, _, err = s.SetNodeTags(nodes["desktop"].ID, []string{"tag:web", "tag:db"})
+	require.NoError(t, err)
+
+	require.NoError(t, s.SetUserDefaultTags(userID, []string{"tag:db"}))
+
+	cs, err := s.ReapplyUserTags(userID)
+	require.NoError(t, err)
+	require.NotEmpty(t, cs)
+	assertTagSelfUpdates(t, cs, nodes["laptop"].ID)
+
+	laptop, ok := s.GetNodeByID(nodes["laptop"].ID)
+	require.True(t, ok)
+	assert.Equal(t, []string{"tag:db"}, laptop.Tags().AsSlice(), "the changed defaults reach the tagged node")
+	assert.False(t, laptop.UserID().Valid())
+
+	dbNode, err := s.DB().GetNodeByID(nodes["laptop"].ID)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"tag:db"}, dbNode.Tags.List())
+
+	desktop, ok := s.GetNodeByID(nodes["desktop"].ID)
+	require.True(t, ok)
+	assert.Equal(t, []string{"tag:db", "tag:web"}, desktop.Tags().AsSlice(), "explicit tags are not overwritten")
+	assert.False(t, desktop.TaggedByUserID().Valid())
+}
+
+func TestReassignNodes(t *testing.T) {
+	cfg := persistTestConfig(t.TempDir() + "/headscale.db")
+
+	database, err := db.NewHeadscaleDatabase(cfg)
+	require.NoError(t, err)
+
+	from := database.CreateUserForTest("old-team")
+	to := database.CreateUserForTest("new-team")
+
+	moving := []*types.Node{
+		database.CreateRegisteredNodeForTest(from, "laptop"),
+		database.CreateRegisteredNodeForTest(from, "desktop"),
+		database.CreateRegisteredNodeForTest(from, "server"),
+	}
+
+	// The destination already has the laptop's machine registered.
+	clash := database.CreateRegisteredNodeForTest(to, "laptop-old")
+	require.NoError(t, database.DB.Model(&types.Node{}).
+		Where("id = ?", clash.ID).
+		Update("machine_key", moving[0].MachineKey.String()).Error)
+	require.NoError(t, database.Close())
+
+	s, err := NewState(cfg)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = s.Close() })
+
+	fromID, toID := types.UserID(from.ID), types.UserID(to.ID)
+
+	_, err = s.ReassignNodes(fromID, toID)
+	require.ErrorIs(t, err, ErrMachineKeyInUse)
+
+	for _, node := range moving {
+		dbNode, err := s.DB().GetNodeByID(node.ID)
+		require.NoError(t, err)
+		assert.Equal(t, from.ID, *dbNode.UserID, "a refused move changes no node")
+	}
+
+	clashView, ok := s.GetNodeByID(clash.ID)
+	require.True(t, ok)
+
+	_, err = s.PurgeNode(clashView)
+	require.NoError(t, err)
+
+	c, err := s.ReassignNodes(fromID, toID)
+	require.NoError(t, err)
+	assert.ElementsMatch(t,
+		[]types.NodeID{moving[0].ID, moving[1].ID, moving[2].ID},
+		c.PeersChanged,
+		"one change must list every moved node",
+	)
+
+	for _, node := range moving {
+		nv, ok := s.GetNodeByID(node.ID)
+		require.True(t, ok)
+		assert.Equal(t, to.ID, nv.UserID().Get())
+		assert.Equal(t, node.GivenName, nv.GivenName(), "given names are kept")
+
+		dbNode, err := s.DB().GetNodeByID(node.ID)
+		require.NoError(t, err)
+		assert.Equal(t, to.ID, *dbNode.UserID)
+	}
+
+	assert.Equal(t, 0, s.ListNodesByUser(fromID).Len())
+
+	_, err = s.ReassignNodes(fromID, 9999)
+	require.ErrorIs(t, err, db.ErrUserNotFound)
+}
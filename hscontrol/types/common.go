@@ -141,6 +141,10 @@ type AuthRequest struct {
 	// finalise the registration without re-running the OIDC flow.
 	pendingConfirmation *PendingRegistrationConfirmation
 
+	// createdAt records when the request was minted, so diagnostics can
+	// spot registrations that were started but never completed.
+	createdAt time.Time
+
 	finished chan AuthVerdict
 	closed   *atomic.Bool
 }
@@ -149,8 +153,9 @@ type AuthRequest struct {
 // for non-registration flows that only need a verdict channel.
 func NewAuthRequest() *AuthRequest {
 	return &AuthRequest{
-		finished: make(chan AuthVerdict, 1),
-		closed:   &atomic.Bool{},
+		createdAt: time.Now(),
+		finished:  make(chan AuthVerdict, 1),
+		closed:    &atomic.Bool{},
 	}
 }
 
@@ -159,9 +164,10 @@ func NewAuthRequest() *AuthRequest {
 // stored by pointer; callers must not mutate it after handing it off.
 func NewRegisterAuthRequest(data *RegistrationData) *AuthRequest {
 	return &AuthRequest{
-		regData:  data,
-		finished: make(chan AuthVerdict, 1),
-		closed:   &atomic.Bool{},
+		regData:   data,
+		createdAt: time.Now(),
+		finished:  make(chan AuthVerdict, 1),
+		closed:    &atomic.Bool{},
 	}
 }
 
@@ -175,8 +181,9 @@ func NewSSHCheckAuthRequest(src, dst NodeID) *AuthRequest {
 			SrcNodeID: src,
 			DstNodeID: dst,
 		},
-		finished: make(chan AuthVerdict, 1),
-		closed:   &atomic.Bool{},
+		createdAt: time.Now(),
+		finished:  make(chan AuthVerdict, 1),
+		closed:    &atomic.Bool{},
 	}
 }
 
@@ -202,6 +209,11 @@ func (rn *AuthRequest) SSHCheckBinding() *SSHCheckBinding {
 	return rn.sshBinding
 }
 
+// CreatedAt returns when the [AuthRequest] was created.
+func (rn *AuthRequest) CreatedAt() time.Time {
+	return rn.createdAt
+}
+
 // IsRegistration reports whether this auth request carries registration
 // data (i.e. it was created via [NewRegisterAuthRequest]).
 func (rn *AuthRequest) IsRegistration() bool {
@@ -97,6 +97,15 @@ type NodeConfig struct {
 	// A zero/negative duration means no default expiry (nodes never expire).
 	Expiry time.Duration
 
+	// ExpiredRetention is how long a node is kept after its key expired
+	// before the background collector deletes it. A zero or negative
+	// duration keeps expired nodes forever.
+	ExpiredRetention time.Duration
+
+	// RequireApproval keeps newly registered nodes pending, hidden from
+	// their peers and seeing none, until an admin approves them.
+	RequireApproval bool
+
 	// Ephemeral contains configuration for ephemeral node lifecycle.
 	Ephemeral EphemeralConfig
 
@@ -173,6 +182,10 @@ type SqliteConfig struct {
 	Path              string
 	WriteAheadLog     bool
 	WALAutoCheckPoint int
+
+	// WriteRetryAttempts is how many times starting a write transaction is tried
+	// while the database is busy or locked; 1 disables retries.
+	WriteRetryAttempts int
 }
 
 type PostgresConfig struct {
@@ -356,6 +369,13 @@ type Tuning struct {
 	// but trigger more frequent (expensive) peer map rebuilds. Higher values
 	// optimize for bulk throughput at the cost of individual operation latency.
 	NodeStoreBatchTimeout time.Duration
+
+	// MaxRoutesPerNode caps how many routes a single node may advertise.
+	// Routes beyond the cap are dropped when the node's Hostinfo is
+	// ingested so a misbehaving client cannot bloat every peer's netmap.
+	// A value of 0 falls back to defaultMaxRoutesPerNode (1024); negative
+	// values are rejected when the config is loaded.
+	MaxRoutesPerNode int
 }
 
 func validatePKCEMethod(method string) error {
@@ -467,6 +487,7 @@ func LoadConfig(path string, isFile bool) error {
 
 	viper.SetDefault("database.sqlite.write_ahead_log", true)
 	viper.SetDefault("database.sqlite.wal_autocheckpoint", 1000) // SQLite default
+	viper.SetDefault("database.sqlite.write_retry_attempts", 5)
 
 	viper.SetDefault("oidc.scope", []string{oidc.ScopeOpenID, "profile", "email"})
 	viper.SetDefault("oidc.only_start_if_oidc_is_available", true)
@@ -481,6 +502,8 @@ func LoadConfig(path string, isFile bool) error {
 
 	viper.SetDefault("node.expiry", "0")
 	viper.SetDefault("node.ephemeral.inactivity_timeout", "120s")
+	viper.SetDefault("node.expired_retention", "720h")
+	viper.SetDefault("node.require_approval", false)
 	viper.SetDefault("preauth_keys.revoked_retention", "168h")
 	viper.SetDefault("node.routes.ha.probe_interval", "10s")
 	viper.SetDefault("node.routes.ha.probe_timeout", "5s")
@@ -702,6 +725,13 @@ func validateServerConfig() error {
 		)
 	}
 
+	if maxRoutes := viper.GetInt("tuning.max_routes_per_node"); maxRoutes < 0 {
+		errorText += fmt.Sprintf(
+			"Fatal config error: tuning.max_routes_per_node must not be negative, got %d\n",
+			maxRoutes,
+		)
+	}
+
 	if errorText != "" {
 		// nolint
 		return errors.New(strings.TrimSuffix(errorText, "\n"))
@@ -880,8 +910,9 @@ func databaseConfig() DatabaseConfig {
 			Path: util.AbsolutePathFromConfigPath(
 				viper.GetString("database.sqlite.path"),
 			),
-			WriteAheadLog:     viper.GetBool("database.sqlite.write_ahead_log"),
-			WALAutoCheckPoint: viper.GetInt("database.sqlite.wal_autocheckpoint"),
+			WriteAheadLog:      viper.GetBool("database.sqlite.write_ahead_log"),
+			WALAutoCheckPoint:  viper.GetInt("database.sqlite.wal_autocheckpoint"),
+			WriteRetryAttempts: viper.GetInt("database.sqlite.write_retry_attempts"),
 		},
 		Postgres: PostgresConfig{
 			Host:               viper.GetString("database.postgres.host"),
@@ -1233,7 +1264,9 @@ func LoadServerConfig() (*Config, error) {
 		DERP: derpConfig,
 
 		Node: NodeConfig{
-			Expiry: resolveNodeExpiry(),
+			Expiry:           resolveNodeExpiry(),
+			ExpiredRetention: viper.GetDuration("node.expired_retention"),
+			RequireApproval:  viper.GetBool("node.require_approval"),
 			Ephemeral: EphemeralConfig{
 				InactivityTimeout: resolveEphemeralInactivityTimeout(),
 			},
@@ -1318,6 +1351,7 @@ func LoadServerConfig() (*Config, error) {
 			RegisterCacheMaxEntries: viper.GetInt("tuning.register_cache_max_entries"),
 			NodeStoreBatchSize:      viper.GetInt("tuning.node_store_batch_size"),
 			NodeStoreBatchTimeout:   viper.GetDuration("tuning.node_store_batch_timeout"),
+			MaxRoutesPerNode:        viper.GetInt("tuning.max_routes_per_node"),
 		},
 	}, nil
 }
@@ -144,6 +144,11 @@ type Node struct {
 	// parts of headscale.
 	GivenName string `gorm:"type:varchar(63);unique_index"`
 
+	// GivenNameBase is the label [Node.GivenName] was derived from,
+	// before any "-N" collision suffix was appended. Siblings sharing a
+	// base are counted to pick the next suffix.
+	GivenNameBase string `gorm:"column:given_name_base;type:varchar(63)"`
+
 	// UserID identifies the owning user for user-owned nodes.
 	// Nil for tagged nodes, which are owned by their tags.
 	UserID *uint
@@ -154,9 +159,20 @@ type Node struct {
 	// Tags is the definitive owner for tagged nodes.
 	// When non-empty, the node is "tagged" and tags define its identity.
 	// Empty for user-owned nodes.
-	// Tags cannot be removed once set (one-way transition).
+	// Tags are only removed all at once, together with naming the user
+	// that takes the node over (see state.ClearNodeTags).
 	Tags Strings `gorm:"column:tags;serializer:json"`
 
+	// TaggedByUserID is the user whose default tags made this node tagged,
+	// so state.ReapplyUserTags can still reach it after it stopped being
+	// the user's node. Nil for nodes not tagged by default tags.
+	TaggedByUserID *uint `gorm:"column:tagged_by_user_id"`
+
+	// ManagedBy names the external system (e.g. an IaC tool) that owns
+	// the lifecycle of this node. Empty for manually managed nodes.
+	// Headscale does not enforce it; manual changes only log a warning.
+	ManagedBy string `gorm:"column:managed_by"`
+
 	// When a node has been created with a [PreAuthKey], we need to
 	// prevent the preauthkey from being deleted before the node.
 	// The preauthkey can define "tags" of the node so we need it
@@ -170,12 +186,56 @@ type Node struct {
 	// headscale. It is best effort and not persisted.
 	LastSeen *time.Time `gorm:"column:last_seen"`
 
+	// FirstSeen is when the node first connected after registering. It is
+	// set once and never overwritten, so it measures onboarding latency.
+	FirstSeen *time.Time `gorm:"column:first_seen"`
+
+	// LastHandshake is when the node last completed the Noise handshake
+	// with headscale, i.e. last (re)connected. Unlike LastSeen it is not
+	// touched while a session stays up, so it helps debug connectivity.
+	// It is nil until the node connects.
+	LastHandshake *time.Time `gorm:"column:last_handshake"`
+
 	// ApprovedRoutes is a list of routes that the node is allowed to announce
 	// as a subnet router. They are not necessarily the routes that the node
 	// announces at the moment.
 	// See [Node.Hostinfo]
 	ApprovedRoutes Prefixes `gorm:"column:approved_routes;serializer:json"`
 
+	// ExitNodeDisabled stops the node from acting as an exit node even
+	// if it advertises and has approved exit routes, e.g. a laptop that
+	// enabled it by accident.
+	ExitNodeDisabled bool `gorm:"column:exit_node_disabled;default:false"`
+
+	// AutoApproveExit approves the exit routes the node advertises without
+	// an autoApprovers entry in the policy, for nodes trusted as exit nodes.
+	AutoApproveExit bool `gorm:"column:auto_approve_exit;default:false"`
+
+	// PendingApproval hides a node registered while node.require_approval
+	// is set from every peer, and its peers from it, until an admin
+	// approves it.
+	PendingApproval bool `gorm:"column:pending_approval;default:false"`
+
+	// RoutePriority ranks the node among the advertisers of a subnet route
+	// when electing its primary. The highest priority wins, then the lowest
+	// node ID; at the default of 0 for every node only the node ID counts.
+	RoutePriority int `gorm:"column:route_priority;default:0"`
+
+	// CapVer is the capability version the client last reported in a
+	// MapRequest, zero until it has connected once. It lets operators find
+	// clients too old for a feature before enabling it.
+	CapVer tailcfg.CapabilityVersion `gorm:"column:cap_ver"`
+
+	// OS and ClientVersion mirror Hostinfo.OS and Hostinfo.IPNVersion in
+	// their own columns so nodes can be queried by client. Both are empty
+	// until the node reports a Hostinfo; see [Node.UpdateClientInfo].
+	OS            string `gorm:"column:os"`
+	ClientVersion string `gorm:"column:client_version"`
+
+	// Description is a free-form note set by an operator, e.g. where the
+	// machine lives. It is metadata only and never sent to clients.
+	Description string `gorm:"column:description"`
+
 	CreatedAt time.Time
 	UpdatedAt time.Time
 	DeletedAt *time.Time
@@ -227,6 +287,27 @@ func (node *Node) IsExpired() bool {
 	return time.Since(*node.Expiry) > 0
 }
 
+// IsOnlineWithin reports whether the node is connected or was last seen
+// less than threshold ago. A zero threshold only considers the connection.
+// The connection is read from [Node.IsOnline], which the NodeStore keeps in
+// step with map sessions; a node loaded from the database is never
+// connected.
+func (node *Node) IsOnlineWithin(threshold time.Duration) bool {
+	return node.isOnlineAt(time.Now(), threshold)
+}
+
+func (node *Node) isOnlineAt(now time.Time, threshold time.Duration) bool {
+	if node.IsOnline != nil && *node.IsOnline {
+		return true
+	}
+
+	if threshold <= 0 || node.LastSeen == nil {
+		return false
+	}
+
+	return !node.LastSeen.Before(now.Add(-threshold))
+}
+
 // IsEphemeral returns if the node is registered as an Ephemeral node.
 // https://tailscale.com/docs/features/ephemeral-nodes
 func (node *Node) IsEphemeral() bool {
@@ -308,10 +389,14 @@ func (node *Node) Prefixes() []netip.Prefix {
 }
 
 // ExitRoutes returns the node's approved exit routes (0.0.0.0/0
-// and/or ::/0). Consumed unconditionally by RoutesForPeer when the
-// viewer uses an exit node; excluded from [Node.CanAccessRoute] which only
-// handles non-exit routing.
+// and/or ::/0), or none if [Node.ExitNodeDisabled] is set. Consumed
+// unconditionally by RoutesForPeer when the viewer uses an exit node;
+// excluded from [Node.CanAccessRoute] which only handles non-exit routing.
 func (node *Node) ExitRoutes() []netip.Prefix {
+	if node.ExitNodeDisabled {
+		return nil
+	}
+
 	var routes []netip.Prefix
 
 	for _, route := range node.AnnouncedRoutes() {
@@ -492,11 +577,15 @@ func (nodes Nodes) ContainsNodeKey(nodeKey key.NodePublic) bool {
 	return false
 }
 
+// GetFQDN returns the node's MagicDNS name: its given name under baseDomain,
+// fully qualified, or just the given name if baseDomain is empty. Leading and
+// trailing dots on baseDomain are ignored.
 func (node *Node) GetFQDN(baseDomain string) (string, error) {
 	if node.GivenName == "" {
 		return "", fmt.Errorf("creating valid FQDN: %w", ErrNodeHasNoGivenName)
 	}
 
+	baseDomain = strings.Trim(baseDomain, ".")
 	hostname := node.GivenName
 
 	if baseDomain != "" {
@@ -540,6 +629,17 @@ func ValidateGivenName(givenName, baseDomain string) error {
 	return nil
 }
 
+// UpdateClientInfo refreshes OS and ClientVersion from the node's Hostinfo.
+// It must be called whenever Hostinfo is replaced.
+func (node *Node) UpdateClientInfo() {
+	if node.Hostinfo == nil {
+		return
+	}
+
+	node.OS = node.Hostinfo.OS
+	node.ClientVersion = node.Hostinfo.IPNVersion
+}
+
 // AnnouncedRoutes returns the list of routes the node announces, as
 // reported by the client in [tailcfg.Hostinfo.RoutableIPs]. Announcement alone
 // does not grant visibility — see [Node.SubnetRoutes] for approval-gated
@@ -612,6 +712,10 @@ func (node *Node) MarshalZerologObject(e *zerolog.Event) {
 		e.Strs(zf.NodeTags, node.Tags)
 	}
 
+	if node.ManagedBy != "" {
+		e.Str(zf.NodeManagedBy, node.ManagedBy)
+	}
+
 	if node.User != nil {
 		e.Str(zf.UserName, node.User.Username())
 	} else if node.UserID != nil {
@@ -917,6 +1021,16 @@ func (nv NodeView) IsExpired() bool {
 	return nv.ж.IsExpired()
 }
 
+// IsOnlineWithin reports whether the node is connected or was last seen
+// less than threshold ago.
+func (nv NodeView) IsOnlineWithin(threshold time.Duration) bool {
+	if !nv.Valid() {
+		return false
+	}
+
+	return nv.ж.IsOnlineWithin(threshold)
+}
+
 // IsEphemeral returns if the node is registered as an Ephemeral node.
 // https://tailscale.com/docs/features/ephemeral-nodes
 func (nv NodeView) IsEphemeral() bool {
@@ -0,0 +1,36 @@
+package types
+
+import (
+	"time"
+
+	"tailscale.com/types/key"
+)
+
+// Reasons recorded in [NodeKeyHistory.Reason].
+const (
+	NodeKeyHistoryMachineKeyChanged = "machine_key_changed"
+	NodeKeyHistoryNodeKeyChanged    = "node_key_changed"
+)
+
+// NodeKeyHistory is one entry of the append-only audit trail of a node's
+// keys. Every time the machine or node key of a node is replaced, the keys
+// it held until then are recorded here, so a key seen in logs can be traced
+// back to a node after it has rotated.
+type NodeKeyHistory struct {
+	ID uint64 `gorm:"primary_key"`
+
+	// NodeID is a plain column with no foreign key, so the history of a
+	// node outlives the node itself.
+	NodeID NodeID
+
+	// MachineKey and NodeKey are the keys the node held before the change.
+	MachineKey key.MachinePublic `gorm:"serializer:text"`
+	NodeKey    key.NodePublic    `gorm:"serializer:text"`
+
+	Reason    string
+	ChangedAt time.Time
+}
+
+// TableName pins the table name. GORM's naming strategy would otherwise
+// pluralise it, diverging from the migration DDL and schema.sql.
+func (*NodeKeyHistory) TableName() string { return "node_key_history" }
@@ -5,6 +5,7 @@ import (
 	"net/netip"
 	"strings"
 	"testing"
+	"time"
 
 	"github.com/google/go-cmp/cmp"
 	"github.com/google/go-cmp/cmp/cmpopts"
@@ -396,6 +397,24 @@ func TestNodeFQDN(t *testing.T) {
 			domain: "example.com",
 			want:   "test.example.com.",
 		},
+		{
+			name:   "empty-domain",
+			node:   Node{GivenName: "test"},
+			domain: "",
+			want:   "test",
+		},
+		{
+			name:   "domain-with-dots",
+			node:   Node{GivenName: "test"},
+			domain: ".example.com.",
+			want:   "test.example.com.",
+		},
+		{
+			name:   "domain-only-dots",
+			node:   Node{GivenName: "test"},
+			domain: ".",
+			want:   "test",
+		},
 	}
 
 	for _, tc := range tests {
@@ -417,6 +436,86 @@ func TestNodeFQDN(t *testing.T) {
 	}
 }
 
+func TestNodeIsOnlineWithin(t *testing.T) {
+	now := time.Date(2026, 1, 1, 12, 0, 0, 0, time.UTC)
+	threshold := 5 * time.Minute
+
+	tests := []struct {
+		name      string
+		online    *bool
+		lastSeen  *time.Time
+		threshold time.Duration
+		want      bool
+	}{
+		{
+			name:      "connected-never-seen",
+			online:    new(true),
+			threshold: threshold,
+			want:      true,
+		},
+		{
+			name:      "connected-seen-long-ago",
+			online:    new(true),
+			lastSeen:  new(now.Add(-time.Hour)),
+			threshold: threshold,
+			want:      true,
+		},
+		{
+			name:      "offline-never-seen",
+			online:    new(false),
+			threshold: threshold,
+			want:      false,
+		},
+		{
+			name:      "unknown-seen-recently",
+			lastSeen:  new(now.Add(-time.Minute)),
+			threshold: threshold,
+			want:      true,
+		},
+		{
+			name:      "offline-seen-exactly-at-threshold",
+			online:    new(false),
+			lastSeen:  new(now.Add(-threshold)),
+			threshold: threshold,
+			want:      true,
+		},
+		{
+			name:      "offline-seen-just-past-threshold",
+			online:    new(false),
+			lastSeen:  new(now.Add(-threshold - time.Nanosecond)),
+			threshold: threshold,
+			want:      false,
+		},
+		{
+			name:      "zero-threshold-ignores-last-seen",
+			online:    new(false),
+			lastSeen:  new(now),
+			threshold: 0,
+			want:      false,
+		},
+		{
+			name:      "zero-threshold-connected",
+			online:    new(true),
+			threshold: 0,
+			want:      true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			node := &Node{IsOnline: tt.online, LastSeen: tt.lastSeen}
+
+			if got := node.isOnlineAt(now, tt.threshold); got != tt.want {
+				t.Errorf("isOnlineAt() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	if (NodeView{}).IsOnlineWithin(threshold) {
+		t.Error("invalid NodeView must not be online")
+	}
+}
+
 func TestValidateGivenName(t *testing.T) {
 	tests := []struct {
 		name       string
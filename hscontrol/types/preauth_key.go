@@ -14,6 +14,10 @@ type PAKError string
 
 func (e PAKError) Error() string { return string(e) }
 
+// ErrPreAuthKeyUsageLimitReached is returned for a reusable key that has
+// registered as many nodes as its UsageLimit allows.
+var ErrPreAuthKeyUsageLimitReached = PAKError("authkey usage limit reached")
+
 // StringID returns the key's id as a decimal string, the form the HTTP APIs
 // render it as.
 func (pak *PreAuthKey) StringID() string {
@@ -59,6 +63,11 @@ type PreAuthKey struct {
 	Ephemeral bool `gorm:"default:false"`
 	Used      bool `gorm:"default:false"`
 
+	// UsageLimit caps how many nodes a reusable key may register; zero
+	// leaves it unlimited. UsageCount is how many it has registered.
+	UsageLimit int `gorm:"default:0"`
+	UsageCount int `gorm:"default:0"`
+
 	// Tags to assign to nodes registered with this key.
 	// Tags are copied to the node during registration.
 	// If non-empty, this creates tagged nodes (not user-owned).
@@ -107,6 +116,10 @@ func (pak *PreAuthKey) Validate() error {
 
 	// we don't need to check if has been used before
 	if pak.Reusable {
+		if pak.UsageLimitReached() {
+			return ErrPreAuthKeyUsageLimitReached
+		}
+
 		return nil
 	}
 
@@ -117,6 +130,12 @@ func (pak *PreAuthKey) Validate() error {
 	return nil
 }
 
+// UsageLimitReached reports whether a reusable key has registered as many
+// nodes as its UsageLimit allows.
+func (pak *PreAuthKey) UsageLimitReached() bool {
+	return pak.UsageLimit > 0 && pak.UsageCount >= pak.UsageLimit
+}
+
 // IsTagged returns true if this [PreAuthKey] creates tagged nodes.
 // When a [PreAuthKey] has tags, nodes registered with it will be tagged nodes.
 func (pak *PreAuthKey) IsTagged() bool {
@@ -23,6 +23,10 @@ func (src *User) Clone() *User {
 	}
 	dst := new(User)
 	*dst = *src
+	if dst.MaxKeyLifetime != nil {
+		dst.MaxKeyLifetime = new(*src.MaxKeyLifetime)
+	}
+	dst.DefaultTags = append(src.DefaultTags[:0:0], src.DefaultTags...)
 	return dst
 }
 
@@ -35,6 +39,9 @@ var _UserCloneNeedsRegeneration = User(struct {
 	ProviderIdentifier sql.NullString
 	Provider           string
 	ProfilePicURL      string
+	MaxKeyLifetime     *time.Duration
+	MaxNodes           int
+	DefaultTags        Strings
 }{})
 
 // Clone makes a deep copy of Node.
@@ -60,6 +67,9 @@ func (src *Node) Clone() *Node {
 		dst.User = new(*src.User)
 	}
 	dst.Tags = append(src.Tags[:0:0], src.Tags...)
+	if dst.TaggedByUserID != nil {
+		dst.TaggedByUserID = new(*src.TaggedByUserID)
+	}
 	if dst.AuthKeyID != nil {
 		dst.AuthKeyID = new(*src.AuthKeyID)
 	}
@@ -70,6 +80,12 @@ func (src *Node) Clone() *Node {
 	if dst.LastSeen != nil {
 		dst.LastSeen = new(*src.LastSeen)
 	}
+	if dst.FirstSeen != nil {
+		dst.FirstSeen = new(*src.FirstSeen)
+	}
+	if dst.LastHandshake != nil {
+		dst.LastHandshake = new(*src.LastHandshake)
+	}
 	dst.ApprovedRoutes = append(src.ApprovedRoutes[:0:0], src.ApprovedRoutes...)
 	if dst.DeletedAt != nil {
 		dst.DeletedAt = new(*src.DeletedAt)
@@ -82,32 +98,45 @@ func (src *Node) Clone() *Node {
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _NodeCloneNeedsRegeneration = Node(struct {
-	ID             NodeID
-	MachineKey     key.MachinePublic
-	NodeKey        key.NodePublic
-	DiscoKey       key.DiscoPublic
-	Endpoints      AddrPorts
-	Hostinfo       *tailcfg.Hostinfo
-	IPv4           *netip.Addr
-	IPv6           *netip.Addr
-	Hostname       string
-	GivenName      string
-	UserID         *uint
-	User           *User
-	RegisterMethod string
-	Tags           Strings
-	AuthKeyID      *uint64
-	AuthKey        *PreAuthKey
-	Expiry         *time.Time
-	LastSeen       *time.Time
-	ApprovedRoutes Prefixes
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	DeletedAt      *time.Time
-	IsOnline       *bool
-	Unhealthy      bool
-	ActiveSessions int
-	SessionEpoch   uint64
+	ID               NodeID
+	MachineKey       key.MachinePublic
+	NodeKey          key.NodePublic
+	DiscoKey         key.DiscoPublic
+	Endpoints        AddrPorts
+	Hostinfo         *tailcfg.Hostinfo
+	IPv4             *netip.Addr
+	IPv6             *netip.Addr
+	Hostname         string
+	GivenName        string
+	GivenNameBase    string
+	UserID           *uint
+	User             *User
+	RegisterMethod   string
+	Tags             Strings
+	TaggedByUserID   *uint
+	ManagedBy        string
+	AuthKeyID        *uint64
+	AuthKey          *PreAuthKey
+	Expiry           *time.Time
+	LastSeen         *time.Time
+	FirstSeen        *time.Time
+	LastHandshake    *time.Time
+	ApprovedRoutes   Prefixes
+	ExitNodeDisabled bool
+	AutoApproveExit  bool
+	PendingApproval  bool
+	RoutePriority    int
+	CapVer           tailcfg.CapabilityVersion
+	OS               string
+	ClientVersion    string
+	Description      string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	DeletedAt        *time.Time
+	IsOnline         *bool
+	Unhealthy        bool
+	ActiveSessions   int
+	SessionEpoch     uint64
 }{})
 
 // Clone makes a deep copy of PreAuthKey.
@@ -150,6 +179,8 @@ var _PreAuthKeyCloneNeedsRegeneration = PreAuthKey(struct {
 	Reusable    bool
 	Ephemeral   bool
 	Used        bool
+	UsageLimit  int
+	UsageCount  int
 	Tags        []string
 	CreatedAt   *time.Time
 	Expiration  *time.Time
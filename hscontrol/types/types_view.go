@@ -117,6 +117,21 @@ func (v UserView) Provider() string { return v.ж.Provider }
 // TODO(kradalby): See if we can fill in Gravatar here.
 func (v UserView) ProfilePicURL() string { return v.ж.ProfilePicURL }
 
+// MaxKeyLifetime overrides node.expiry for the nodes of this user. It is
+// the default key lifetime and caps expiries requested by clients. Nil
+// falls back to the global default.
+func (v UserView) MaxKeyLifetime() views.ValuePointer[time.Duration] {
+	return views.ValuePointerOf(v.ж.MaxKeyLifetime)
+}
+
+// MaxNodes caps how many nodes the user may own. Zero means no limit.
+// Tagged nodes are owned by their tags and do not count.
+func (v UserView) MaxNodes() int { return v.ж.MaxNodes }
+
+// DefaultTags are applied to every node the user registers, turning
+// it into a tagged node. Empty leaves the user's nodes user-owned.
+func (v UserView) DefaultTags() views.Slice[string] { return views.SliceOf(v.ж.DefaultTags) }
+
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _UserViewNeedsRegeneration = User(struct {
 	gorm.Model
@@ -126,6 +141,9 @@ var _UserViewNeedsRegeneration = User(struct {
 	ProviderIdentifier sql.NullString
 	Provider           string
 	ProfilePicURL      string
+	MaxKeyLifetime     *time.Duration
+	MaxNodes           int
+	DefaultTags        Strings
 }{})
 
 // View returns a read-only view of Node.
@@ -217,6 +235,11 @@ func (v NodeView) Hostname() string { return v.ж.Hostname }
 // parts of headscale.
 func (v NodeView) GivenName() string { return v.ж.GivenName }
 
+// GivenNameBase is the label [Node.GivenName] was derived from,
+// before any "-N" collision suffix was appended. Siblings sharing a
+// base are counted to pick the next suffix.
+func (v NodeView) GivenNameBase() string { return v.ж.GivenNameBase }
+
 // UserID identifies the owning user for user-owned nodes.
 // Nil for tagged nodes, which are owned by their tags.
 func (v NodeView) UserID() views.ValuePointer[uint] { return views.ValuePointerOf(v.ж.UserID) }
@@ -227,9 +250,22 @@ func (v NodeView) RegisterMethod() string { return v.ж.RegisterMethod }
 // Tags is the definitive owner for tagged nodes.
 // When non-empty, the node is "tagged" and tags define its identity.
 // Empty for user-owned nodes.
-// Tags cannot be removed once set (one-way transition).
+// Tags are only removed all at once, together with naming the user
+// that takes the node over (see state.ClearNodeTags).
 func (v NodeView) Tags() views.Slice[string] { return views.SliceOf(v.ж.Tags) }
 
+// TaggedByUserID is the user whose default tags made this node tagged,
+// so state.ReapplyUserTags can still reach it after it stopped being
+// the user's node. Nil for nodes not tagged by default tags.
+func (v NodeView) TaggedByUserID() views.ValuePointer[uint] {
+	return views.ValuePointerOf(v.ж.TaggedByUserID)
+}
+
+// ManagedBy names the external system (e.g. an IaC tool) that owns
+// the lifecycle of this node. Empty for manually managed nodes.
+// Headscale does not enforce it; manual changes only log a warning.
+func (v NodeView) ManagedBy() string { return v.ж.ManagedBy }
+
 // When a node has been created with a [PreAuthKey], we need to
 // prevent the preauthkey from being deleted before the node.
 // The preauthkey can define "tags" of the node so we need it
@@ -245,6 +281,20 @@ func (v NodeView) LastSeen() views.ValuePointer[time.Time] {
 	return views.ValuePointerOf(v.ж.LastSeen)
 }
 
+// FirstSeen is when the node first connected after registering. It is
+// set once and never overwritten, so it measures onboarding latency.
+func (v NodeView) FirstSeen() views.ValuePointer[time.Time] {
+	return views.ValuePointerOf(v.ж.FirstSeen)
+}
+
+// LastHandshake is when the node last completed the Noise handshake
+// with headscale, i.e. last (re)connected. Unlike LastSeen it is not
+// touched while a session stays up, so it helps debug connectivity.
+// It is nil until the node connects.
+func (v NodeView) LastHandshake() views.ValuePointer[time.Time] {
+	return views.ValuePointerOf(v.ж.LastHandshake)
+}
+
 // ApprovedRoutes is a list of routes that the node is allowed to announce
 // as a subnet router. They are not necessarily the routes that the node
 // announces at the moment.
@@ -252,6 +302,40 @@ func (v NodeView) LastSeen() views.ValuePointer[time.Time] {
 func (v NodeView) ApprovedRoutes() views.Slice[netip.Prefix] {
 	return views.SliceOf(v.ж.ApprovedRoutes)
 }
+
+// ExitNodeDisabled stops the node from acting as an exit node even
+// if it advertises and has approved exit routes, e.g. a laptop that
+// enabled it by accident.
+func (v NodeView) ExitNodeDisabled() bool { return v.ж.ExitNodeDisabled }
+
+// AutoApproveExit approves the exit routes the node advertises without
+// an autoApprovers entry in the policy, for nodes trusted as exit nodes.
+func (v NodeView) AutoApproveExit() bool { return v.ж.AutoApproveExit }
+
+// PendingApproval hides a node registered while node.require_approval
+// is set from every peer, and its peers from it, until an admin
+// approves it.
+func (v NodeView) PendingApproval() bool { return v.ж.PendingApproval }
+
+// RoutePriority ranks the node among the advertisers of a subnet route
+// when electing its primary. The highest priority wins, then the lowest
+// node ID; at the default of 0 for every node only the node ID counts.
+func (v NodeView) RoutePriority() int { return v.ж.RoutePriority }
+
+// CapVer is the capability version the client last reported in a
+// MapRequest, zero until it has connected once. It lets operators find
+// clients too old for a feature before enabling it.
+func (v NodeView) CapVer() tailcfg.CapabilityVersion { return v.ж.CapVer }
+
+// OS and ClientVersion mirror Hostinfo.OS and Hostinfo.IPNVersion in
+// their own columns so nodes can be queried by client. Both are empty
+// until the node reports a Hostinfo; see [Node.UpdateClientInfo].
+func (v NodeView) OS() string            { return v.ж.OS }
+func (v NodeView) ClientVersion() string { return v.ж.ClientVersion }
+
+// Description is a free-form note set by an operator, e.g. where the
+// machine lives. It is metadata only and never sent to clients.
+func (v NodeView) Description() string  { return v.ж.Description }
 func (v NodeView) CreatedAt() time.Time { return v.ж.CreatedAt }
 func (v NodeView) UpdatedAt() time.Time { return v.ж.UpdatedAt }
 func (v NodeView) DeletedAt() views.ValuePointer[time.Time] {
@@ -284,32 +368,45 @@ func (v NodeView) String() string       { return v.ж.String() }
 
 // A compilation failure here means this code must be regenerated, with the command at the top of this file.
 var _NodeViewNeedsRegeneration = Node(struct {
-	ID             NodeID
-	MachineKey     key.MachinePublic
-	NodeKey        key.NodePublic
-	DiscoKey       key.DiscoPublic
-	Endpoints      AddrPorts
-	Hostinfo       *tailcfg.Hostinfo
-	IPv4           *netip.Addr
-	IPv6           *netip.Addr
-	Hostname       string
-	GivenName      string
-	UserID         *uint
-	User           *User
-	RegisterMethod string
-	Tags           Strings
-	AuthKeyID      *uint64
-	AuthKey        *PreAuthKey
-	Expiry         *time.Time
-	LastSeen       *time.Time
-	ApprovedRoutes Prefixes
-	CreatedAt      time.Time
-	UpdatedAt      time.Time
-	DeletedAt      *time.Time
-	IsOnline       *bool
-	Unhealthy      bool
-	ActiveSessions int
-	SessionEpoch   uint64
+	ID               NodeID
+	MachineKey       key.MachinePublic
+	NodeKey          key.NodePublic
+	DiscoKey         key.DiscoPublic
+	Endpoints        AddrPorts
+	Hostinfo         *tailcfg.Hostinfo
+	IPv4             *netip.Addr
+	IPv6             *netip.Addr
+	Hostname         string
+	GivenName        string
+	GivenNameBase    string
+	UserID           *uint
+	User             *User
+	RegisterMethod   string
+	Tags             Strings
+	TaggedByUserID   *uint
+	ManagedBy        string
+	AuthKeyID        *uint64
+	AuthKey          *PreAuthKey
+	Expiry           *time.Time
+	LastSeen         *time.Time
+	FirstSeen        *time.Time
+	LastHandshake    *time.Time
+	ApprovedRoutes   Prefixes
+	ExitNodeDisabled bool
+	AutoApproveExit  bool
+	PendingApproval  bool
+	RoutePriority    int
+	CapVer           tailcfg.CapabilityVersion
+	OS               string
+	ClientVersion    string
+	Description      string
+	CreatedAt        time.Time
+	UpdatedAt        time.Time
+	DeletedAt        *time.Time
+	IsOnline         *bool
+	Unhealthy        bool
+	ActiveSessions   int
+	SessionEpoch     uint64
 }{})
 
 // View returns a read-only view of PreAuthKey.
@@ -404,6 +501,11 @@ func (v PreAuthKeyView) Reusable() bool      { return v.ж.Reusable }
 func (v PreAuthKeyView) Ephemeral() bool     { return v.ж.Ephemeral }
 func (v PreAuthKeyView) Used() bool          { return v.ж.Used }
 
+// UsageLimit caps how many nodes a reusable key may register; zero
+// leaves it unlimited. UsageCount is how many it has registered.
+func (v PreAuthKeyView) UsageLimit() int { return v.ж.UsageLimit }
+func (v PreAuthKeyView) UsageCount() int { return v.ж.UsageCount }
+
 // Tags to assign to nodes registered with this key.
 // Tags are copied to the node during registration.
 // If non-empty, this creates tagged nodes (not user-owned).
@@ -435,6 +537,8 @@ var _PreAuthKeyViewNeedsRegeneration = PreAuthKey(struct {
 	Reusable    bool
 	Ephemeral   bool
 	Used        bool
+	UsageLimit  int
+	UsageCount  int
 	Tags        []string
 	CreatedAt   *time.Time
 	Expiration  *time.Time
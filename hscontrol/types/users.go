@@ -95,6 +95,19 @@ type User struct {
 
 	// TODO(kradalby): See if we can fill in Gravatar here.
 	ProfilePicURL string
+
+	// MaxKeyLifetime overrides node.expiry for the nodes of this user. It is
+	// the default key lifetime and caps expiries requested by clients. Nil
+	// falls back to the global default.
+	MaxKeyLifetime *time.Duration
+
+	// MaxNodes caps how many nodes the user may own. Zero means no limit.
+	// Tagged nodes are owned by their tags and do not count.
+	MaxNodes int
+
+	// DefaultTags are applied to every node the user registers, turning
+	// it into a tagged node. Empty leaves the user's nodes user-owned.
+	DefaultTags Strings `gorm:"column:default_tags;serializer:json"`
 }
 
 func (u *User) StringID() string {
@@ -22,6 +22,8 @@ const (
 	NodeOnline         = "node.online"
 	NodeExpired        = "node.expired"
 	NodeHostname       = "node.hostname"
+	NodeManagedBy      = "node.managed_by"
+	NodeCount          = "node.count"
 	ExistingNodeName   = "existing.node.name"
 	ExistingNodeID     = "existing.node.id"
 	CurrentHostname    = "current_hostname"
@@ -106,6 +108,11 @@ const (
 	Prefix             = "prefix"
 	FinalState         = "finalState"
 	NewState           = "newState"
+	OverlapsPrefix     = "overlaps.prefix"
+	OverlapsNodeID     = "overlaps.node.id"
+	RouteEvent         = "route.event"
+	RoutesAdvertised   = "routes.advertised"
+	RoutesMax          = "routes.max"
 )
 
 // Request/Response fields.
@@ -115,6 +122,7 @@ const (
 	Version        = "version"
 	StatusCode     = "status_code"
 	RegistrationID = "registration_id"
+	SSHCheck       = "ssh.check"
 )
 
 // Network fields.
@@ -180,6 +188,7 @@ const (
 const (
 	TotalDuration   = "total.duration"
 	TimeoutDuration = "timeout.duration"
+	GraceDuration   = "grace.duration"
 )
 
 // Database fields.
@@ -194,6 +203,9 @@ const (
 	Index       = "index"
 	Parent      = "parent"
 	Type        = "type"
+	Attempt     = "attempt"
+	Attempts    = "attempts"
+	Backoff     = "backoff"
 )
 
 // Component field for sub-loggers.